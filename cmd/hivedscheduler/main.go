@@ -23,6 +23,13 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/microsoft/hivedscheduler/pkg/algorithm"
+	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/scheduler"
 )
@@ -31,6 +38,88 @@ func init() {
 	common.InitAll()
 }
 
+// Usage:
+//
+//	hivedscheduler                                   Start the scheduler
+//	hivedscheduler validate [CONFIG_FILE]            Validate the config offline
+//	hivedscheduler explain-config [CONFIG_FILE]      Validate and explain the config offline
+//	hivedscheduler plan-defragmentation AFFINITY_GROUPS_FILE [CONFIG_FILE]
+//	                                                 Propose AffinityGroup relocations offline
+//
+// CONFIG_FILE is default to ${CONFIG}, see api.EnvValueConfigFilePath.
+// AFFINITY_GROUPS_FILE is the output of GET /v1/inspect/affinitygroups/.
 func main() {
-	scheduler.NewHivedScheduler().Run(common.NewStopChannel())
+	args := flag.Args()
+	if len(args) == 0 {
+		scheduler.NewHivedScheduler().Run(common.NewStopChannel())
+		return
+	}
+
+	if args[0] == "plan-defragmentation" {
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: hivedscheduler plan-defragmentation AFFINITY_GROUPS_FILE [CONFIG_FILE]\n")
+			os.Exit(2)
+		}
+		configPath := api.EnvValueConfigFilePath
+		if len(args) > 2 {
+			configPath = args[2]
+		}
+		os.Exit(planDefragmentation(args[1], configPath))
+	}
+
+	configPath := api.EnvValueConfigFilePath
+	if len(args) > 1 {
+		configPath = args[1]
+	}
+	switch args[0] {
+	case "validate":
+		os.Exit(checkConfig(configPath, false))
+	case "explain-config":
+		os.Exit(checkConfig(configPath, true))
+	default:
+		fmt.Fprintf(os.Stderr,
+			"Unknown subcommand: %v, supported: validate, explain-config, plan-defragmentation\n", args[0])
+		os.Exit(2)
+	}
+}
+
+// checkConfig loads the config in the same way as the scheduler, but without
+// touching K8S, and returns the exit code. Unlike the scheduler, it also rejects
+// the fields unknown to the config.
+func checkConfig(configPath string, explain bool) (exitCode int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config %v: %v\n", configPath, r)
+			exitCode = 1
+		}
+	}()
+
+	sConfig := api.NewConfig(api.InitRawConfigStrict(&configPath))
+	explanation := algorithm.ExplainConfig(sConfig)
+	if explain {
+		fmt.Print(explanation)
+	}
+	fmt.Printf("Config %v is valid\n", configPath)
+	return 0
+}
+
+// planDefragmentation proposes the AffinityGroup relocations to defragment the cluster
+// from a dump of the AffinityGroups, without touching K8S, and returns the exit code.
+func planDefragmentation(groupsPath string, configPath string) (exitCode int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Failed to plan defragmentation: %v\n", r)
+			exitCode = 1
+		}
+	}()
+
+	groupsBytes, err := ioutil.ReadFile(groupsPath)
+	if err != nil {
+		panic(fmt.Errorf("Failed to read AffinityGroups file %v: %v", groupsPath, err))
+	}
+	groups := api.AffinityGroupList{}
+	common.FromJsonBytes(groupsBytes, &groups)
+	sConfig := api.NewConfig(api.InitRawConfig(&configPath))
+	fmt.Print(algorithm.ExplainDefragmentationPlan(algorithm.PlanDefragmentation(sConfig, groups)))
+	return 0
 }
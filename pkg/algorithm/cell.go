@@ -129,13 +129,14 @@ func (c *GenericCell) IncreaseUsedLeafCellNumAtPriority(p CellPriority, delta in
 // PhysicalCell defines a cell in the physical cluster.
 type PhysicalCell struct {
 	GenericCell
-	nodes                    []string           // node names inside the cell
-	leafCellIndices          []int32            // [-1] for cells at levels higher than node
-	usingGroup               *AlgoAffinityGroup // affinity group using this cell
-	reservingOrReservedGroup *AlgoAffinityGroup // affinity group that is reserving, or has reserved the cell (e.g., waiting for preemption)
-	virtualCell              *VirtualCell       // points to the bound virtual cell
-	split                    bool               // true when the cell has been split
-	pinned                   bool               // true when this is a pinned cell
+	nodes                    []string             // node names inside the cell
+	leafCellIndices          []int32              // [-1] for cells at levels higher than node
+	usingGroups              []*AlgoAffinityGroup // affinity groups using this cell (more than one only if it is shared)
+	usedFraction             int32                // fraction of this leaf cell used by the using groups
+	reservingOrReservedGroup *AlgoAffinityGroup   // affinity group that is reserving, or has reserved the cell (e.g., waiting for preemption)
+	virtualCell              *VirtualCell         // points to the bound virtual cell
+	split                    bool                 // true when the cell has been split
+	pinned                   bool                 // true when this is a pinned cell
 	// This status only contains the statuses that need to be exposed to external,
 	// and should not be used for internal status management
 	apiStatus *api.PhysicalCellStatus
@@ -217,24 +218,55 @@ func (c *PhysicalCell) SetPhysicalResources(nodes []string, leafCellIndices []in
 }
 
 func (c *PhysicalCell) AddUsingGroup(g *AlgoAffinityGroup) {
-	if c.usingGroup != nil {
+	if len(c.usingGroups) != 0 && (c.usingGroups[0].leafCellFraction == leafCellFractionScale ||
+		c.usedFraction+g.leafCellFraction > leafCellFractionScale) {
 		klog.Errorf("Found another using affinity group %v when adding "+
-			"using affinity group %v to cell %v", c.usingGroup.name, g.name, c.address)
+			"using affinity group %v to cell %v", c.usingGroups[0].name, g.name, c.address)
 	}
-	c.usingGroup = g
+	c.usingGroups = append(c.usingGroups, g)
+	c.setUsedFraction(c.usedFraction + g.leafCellFraction)
 	klog.Infof("Cell %v is now used by affinity group %v", c.address, g.name)
 }
 
 func (c *PhysicalCell) DeleteUsingGroup(g *AlgoAffinityGroup) {
-	if c.usingGroup == nil || c.usingGroup.name != g.name {
-		klog.Errorf("Using affinity group %v not found when deleting it from cell %v", g.name, c.address)
+	for i, ug := range c.usingGroups {
+		if ug.name == g.name {
+			c.usingGroups = append(c.usingGroups[:i], c.usingGroups[i+1:]...)
+			c.setUsedFraction(c.usedFraction - g.leafCellFraction)
+			klog.Infof("Cell %v is no longer used by affinity group %v", c.address, g.name)
+			return
+		}
 	}
-	c.usingGroup = nil
-	klog.Infof("Cell %v is no longer used by affinity group %v", c.address, g.name)
+	klog.Errorf("Using affinity group %v not found when deleting it from cell %v", g.name, c.address)
 }
 
+// GetUsingGroup returns the first affinity group using this cell (or nil if it is not used).
+// The other groups, if any, are fractional pods of the same VC sharing the leaf cell with it.
 func (c *PhysicalCell) GetUsingGroup() *AlgoAffinityGroup {
-	return c.usingGroup
+	if len(c.usingGroups) == 0 {
+		return nil
+	}
+	return c.usingGroups[0]
+}
+
+func (c *PhysicalCell) GetUsingGroups() []*AlgoAffinityGroup {
+	return c.usingGroups
+}
+
+func (c *PhysicalCell) GetUsedFraction() int32 {
+	return c.usedFraction
+}
+
+func (c *PhysicalCell) setUsedFraction(f int32) {
+	c.usedFraction = f
+	if len(c.usingGroups) != 0 && c.usingGroups[0].leafCellFraction < leafCellFractionScale {
+		c.apiStatus.UsedLeafCellFraction = float64(f) / leafCellFractionScale
+	} else {
+		c.apiStatus.UsedLeafCellFraction = 0
+	}
+	if c.virtualCell != nil {
+		c.virtualCell.apiStatus.PhysicalCell.UsedLeafCellFraction = c.apiStatus.UsedLeafCellFraction
+	}
 }
 
 func (c *PhysicalCell) AddReservingOrReservedGroup(g *AlgoAffinityGroup) {
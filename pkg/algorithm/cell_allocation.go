@@ -163,37 +163,74 @@ func getLowestFreeCellLevel(freeList ChainCellList, l CellLevel) CellLevel {
 // mapVirtualPlacementToPhysical maps cells in a VC placement to the physical cluster.
 // For the preassigned cells, it will call buddy alloc to map them;
 // For the nonPreassigned cells, it will map them following the topology inside the corresponding preassigned cells.
+// The preassigned cells in the same group of colocatedCells are mapped to the same physical node,
+// by restricting the suggested nodes to the node of the first cell mapped in the group.
+// If the mapping fails, it also returns the preassigned cell that cannot be mapped.
 func mapVirtualPlacementToPhysical(
 	preassignedCells []*cellBindingPathVertex,
 	nonPreassignedCells [][]*cellBindingPathVertex,
+	colocatedCells map[api.CellAddress]CellList,
 	freeList ChainCellList,
 	freeCellNum map[CellLevel]int32,
 	suggestedNodes common.Set,
 	ignoreSuggestedNodes bool,
-	bindings map[api.CellAddress]*PhysicalCell) bool {
+	bindings map[api.CellAddress]*PhysicalCell) (bool, *VirtualCell) {
 
+	mappedNodes := map[api.CellAddress]string{}
 	for _, c := range preassignedCells {
+		cellSuggestedNodes, cellIgnoreSuggestedNodes := suggestedNodes, ignoreSuggestedNodes
+		if nodeName := getColocatedNode(colocatedCells[c.cell.GetAddress()], mappedNodes); nodeName != "" {
+			cellSuggestedNodes, cellIgnoreSuggestedNodes = common.NewSet(nodeName), false
+		}
 		if !buddyAlloc(c, freeList, getLowestFreeCellLevel(
-			freeList, c.cell.GetLevel()), suggestedNodes, ignoreSuggestedNodes, bindings) {
+			freeList, c.cell.GetLevel()), cellSuggestedNodes, cellIgnoreSuggestedNodes, bindings) {
 			klog.Info("Buddy allocation failed due to bad cells, try to split higher level cells")
 			if !safeRelaxedBuddyAlloc(c, freeList, freeCellNum, c.cell.GetLevel(),
-				suggestedNodes, ignoreSuggestedNodes, bindings) {
+				cellSuggestedNodes, cellIgnoreSuggestedNodes, bindings) {
 				klog.Info("Cannot split higher level cells")
-				return false
+				return false, c.cell
 			}
 		} else {
 			freeCellNum[c.cell.GetLevel()]--
 		}
+		if _, ok := colocatedCells[c.cell.GetAddress()]; ok {
+			mappedNodes[c.cell.GetAddress()] = getMappedNode(c, bindings)
+		}
 	}
 	for _, cells := range nonPreassignedCells {
 		ok, _ := mapVirtualCellsToPhysical(
 			cells, cells[0].cell.GetParent().(*VirtualCell).GetPhysicalCell().GetChildren(),
 			suggestedNodes, ignoreSuggestedNodes, bindings, false)
 		if !ok {
-			return false
+			return false, cells[0].cell.GetPreassignedCell()
 		}
 	}
-	return true
+	return true, nil
+}
+
+// getColocatedNode returns the physical node of the cells in a colocated group that are already bound
+// or mapped (empty if none).
+func getColocatedNode(colocatedCells CellList, mappedNodes map[api.CellAddress]string) string {
+	for _, c := range colocatedCells {
+		if pc := c.(*VirtualCell).GetPhysicalCell(); pc != nil {
+			nodeNames, _ := pc.GetPhysicalPlacement()
+			return nodeNames[0]
+		}
+		if nodeName, ok := mappedNodes[c.GetAddress()]; ok {
+			return nodeName
+		}
+	}
+	return ""
+}
+
+// getMappedNode returns the physical node of a preassigned cell lower than node level
+// after it is mapped (found by the binding of a leaf cell in it).
+func getMappedNode(c *cellBindingPathVertex, bindings map[api.CellAddress]*PhysicalCell) string {
+	for len(c.childrenToBind) > 0 {
+		c = c.childrenToBind[0]
+	}
+	nodeNames, _ := bindings[c.cell.GetAddress()].GetPhysicalPlacement()
+	return nodeNames[0]
 }
 
 // getUsablePhysicalCells returns the usable cells in a physical cell list for cell binding.
@@ -32,26 +32,32 @@ import (
 
 // internal wrapper for spec cellTypes
 type cellChainElement struct {
-	cellType       api.CellType // current cell type
-	level          CellLevel    // current cell level, leaf cell is 1
-	childCellType  api.CellType // child cell type
-	childNumber    int32        // child number
-	hasNode        bool         // current cell type is a node or above cell
-	isMultiNodes   bool         // current cell type is a multiple node cell
-	leafCellType   string       // current cell leaf cell type
-	leafCellNumber int32        // how many leaf cell in current cell
+	cellType       api.CellType     // current cell type
+	level          CellLevel        // current cell level, leaf cell is 1
+	childCellType  api.CellType     // child cell type
+	childNumber    int32            // child number
+	hasNode        bool             // current cell type is a node or above cell
+	isMultiNodes   bool             // current cell type is a multiple node cell
+	leafCellType   string           // current cell leaf cell type
+	leafCellNumber int32            // how many leaf cell in current cell
+	leafCellSku    *api.SkuTypeSpec // resource unit of the leaf cell type, nil if not specified
 }
 
 type cellTypeConstructor struct {
 	// input: raw spec from config
 	cellTypeSpecs map[api.CellType]api.CellTypeSpec
+	skuTypeSpecs  map[string]api.SkuTypeSpec
 	// output: converted wrapper
 	cellChainElements map[api.CellType]*cellChainElement
 }
 
-func newCellTypeConstructor(cellTypes map[api.CellType]api.CellTypeSpec) *cellTypeConstructor {
+func newCellTypeConstructor(
+	cellTypes map[api.CellType]api.CellTypeSpec,
+	skuTypes map[string]api.SkuTypeSpec) *cellTypeConstructor {
+
 	return &cellTypeConstructor{
 		cellTypeSpecs:     cellTypes,
+		skuTypeSpecs:      skuTypes,
 		cellChainElements: map[api.CellType]*cellChainElement{},
 	}
 }
@@ -66,6 +72,10 @@ func (c *cellTypeConstructor) addCellChain(ct api.CellType) {
 	ctSpec, ok := c.cellTypeSpecs[ct]
 	if !ok {
 		// not found in raw spec, it's leaf cell
+		var sku *api.SkuTypeSpec
+		if skuSpec, ok := c.skuTypeSpecs[string(ct)]; ok {
+			sku = &skuSpec
+		}
 		c.cellChainElements[ct] = &cellChainElement{
 			cellType:       ct,
 			level:          lowestLevel,
@@ -75,6 +85,7 @@ func (c *cellTypeConstructor) addCellChain(ct api.CellType) {
 			isMultiNodes:   false,
 			leafCellType:   string(ct),
 			leafCellNumber: 1,
+			leafCellSku:    sku,
 		}
 		return
 	}
@@ -96,6 +107,7 @@ func (c *cellTypeConstructor) addCellChain(ct api.CellType) {
 		isMultiNodes:   cct.hasNode,
 		leafCellType:   cct.leafCellType,
 		leafCellNumber: cct.leafCellNumber * ctSpec.ChildCellNumber,
+		leafCellSku:    cct.leafCellSku,
 	}
 	return
 }
@@ -214,6 +226,7 @@ func (c *physicalCellConstructor) buildFullTree() *PhysicalCell {
 	cellInstance := c.buildChildCell(c.buildingSpec, api.CellType(cc), "")
 	// set leaf cell type only for top-level cells (as a chain shares the same leaf cell type)
 	cellInstance.GetAPIStatus().LeafCellType = ce.leafCellType
+	cellInstance.GetAPIStatus().LeafCellSku = ce.leafCellSku
 	return cellInstance
 }
 
@@ -348,6 +361,7 @@ func (c *virtualCellConstructor) buildFullTree(address api.CellAddress) *Virtual
 	cellInstance := c.buildChildCell(c.buildingChild, address)
 	// set leaf cell type only for top-level cells (as a chain shares the same leaf cell type)
 	cellInstance.GetAPIStatus().LeafCellType = ce.leafCellType
+	cellInstance.GetAPIStatus().LeafCellSku = ce.leafCellSku
 	return cellInstance
 }
 
@@ -453,7 +467,7 @@ func ParseConfig(sConfig *api.Config) (
 ) {
 
 	cellTypes := sConfig.PhysicalCluster.CellTypes
-	cellChainElements := newCellTypeConstructor(cellTypes).buildCellChains()
+	cellChainElements := newCellTypeConstructor(cellTypes, sConfig.PhysicalCluster.SkuTypes).buildCellChains()
 
 	physicalSpecs := sConfig.PhysicalCluster.PhysicalCells
 	// physicalFullList is a full cell list containing ALL cells in the physical cluster,
@@ -38,6 +38,15 @@ const (
 	lowestLevel  CellLevel = 1
 	highestLevel CellLevel = math.MaxInt32
 
+	// the maximum number of nodes tried when searching the nodes for a set of pods by backtracking
+	maxBacktrackingSteps = 100000
+
+	// the maximum number of alternative placements evaluated when a new affinity group has to preempt others
+	maxPreemptionAlternatives = 3
+
+	// a whole leaf cell in the units of the fractions used by the pods sharing leaf cells
+	leafCellFractionScale = 1000
+
 	// internal cell states
 
 	// No affinity group is using, reserving, or has reserved the cell.
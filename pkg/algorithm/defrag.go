@@ -0,0 +1,405 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"k8s.io/klog"
+)
+
+// defragGroup is an affinity group considered by the defragmentation planner.
+type defragGroup struct {
+	name     string
+	vc       api.VirtualClusterName
+	priority int32
+	// leaf cells of each pod, which should be placed within a node when the group is relocated
+	pods        []CellList
+	relocatable bool
+}
+
+// defragPlanner proposes relocations of affinity groups that free the most high-level cells.
+// The relocations are only simulated on the occupancy of the leaf cells, so the cells are not changed.
+type defragPlanner struct {
+	fullCellList map[CellChain]ChainCellList
+	cellTypes    map[CellChain]map[CellLevel]api.CellType
+	// leaf cell -> the group occupying it (nil if the leaf cell cannot be freed)
+	occupants map[*PhysicalCell]*defragGroup
+	relocated map[*defragGroup]bool
+}
+
+// newDefragPlanner creates a planner for the groups. The blocked leaf cells (e.g., bad or reserved ones)
+// are regarded as occupied unless they are used by the groups.
+func newDefragPlanner(
+	fullCellList map[CellChain]ChainCellList,
+	cellTypes map[CellChain]map[CellLevel]api.CellType,
+	groups []*defragGroup,
+	blockedLeafCells []*PhysicalCell) *defragPlanner {
+
+	p := &defragPlanner{
+		fullCellList: fullCellList,
+		cellTypes:    cellTypes,
+		occupants:    map[*PhysicalCell]*defragGroup{},
+		relocated:    map[*defragGroup]bool{},
+	}
+	for _, g := range groups {
+		for _, pod := range g.pods {
+			for _, c := range pod {
+				leafCell := c.(*PhysicalCell)
+				if other := p.occupants[leafCell]; other != nil && other != g {
+					// groups sharing a leaf cell can only be relocated together, which we do not consider
+					g.relocatable = false
+					other.relocatable = false
+				}
+				p.occupants[leafCell] = g
+			}
+		}
+	}
+	for _, c := range blockedLeafCells {
+		if _, ok := p.occupants[c]; !ok {
+			p.occupants[c] = nil
+		}
+	}
+	return p
+}
+
+// plan frees the cells from the highest level to the lowest in each chain. In each level, it repeatedly
+// vacates the cell which needs the fewest groups (and then the fewest leaf cells) to be relocated.
+// A group is relocated only into the holes of the cells that are already used at the level of the vacated cell,
+// so each relocation frees one more cell at that level without reducing the free cells at the higher levels.
+func (p *defragPlanner) plan() api.DefragmentationPlan {
+	plan := api.DefragmentationPlan{Relocations: []api.AffinityGroupRelocation{}, Chains: []api.ChainFreeCells{}}
+	chains := sortedChains(p.fullCellList)
+	freeCellNumsBefore := map[CellChain]map[CellLevel]int32{}
+	for _, chain := range chains {
+		freeCellNumsBefore[chain] = p.countFreeCells(chain)
+	}
+	for _, chain := range chains {
+		for l := CellLevel(len(p.fullCellList[chain])); l > lowestLevel; l-- {
+			for {
+				relocations := p.vacateCheapestCell(chain, l)
+				if relocations == nil {
+					break
+				}
+				plan.Relocations = append(plan.Relocations, relocations...)
+			}
+		}
+	}
+	for _, chain := range chains {
+		freeCellNumsAfter := p.countFreeCells(chain)
+		chainFreeCells := api.ChainFreeCells{Chain: string(chain)}
+		for l := CellLevel(len(p.fullCellList[chain])); l >= lowestLevel; l-- {
+			chainFreeCells.Levels = append(chainFreeCells.Levels, api.LevelFreeCells{
+				Level:    int32(l),
+				CellType: p.cellTypes[chain][l],
+				Before:   freeCellNumsBefore[chain][l],
+				After:    freeCellNumsAfter[l],
+			})
+		}
+		plan.Chains = append(plan.Chains, chainFreeCells)
+	}
+	return plan
+}
+
+// vacateCheapestCell tries to vacate a used cell at the given level, from the cheapest one.
+// It returns the relocations of the groups in the vacated cell, or nil if no cell can be vacated.
+func (p *defragPlanner) vacateCheapestCell(chain CellChain, l CellLevel) []api.AffinityGroupRelocation {
+	var candidates []*PhysicalCell
+	candidateGroups := map[*PhysicalCell][]*defragGroup{}
+	usedLeafCellNums := map[*PhysicalCell]int{}
+	for _, c := range p.fullCellList[chain][l] {
+		pc := c.(*PhysicalCell)
+		if groups, usedLeafCellNum, ok := p.getRelocatableGroups(pc); ok && usedLeafCellNum > 0 {
+			candidates = append(candidates, pc)
+			candidateGroups[pc] = groups
+			usedLeafCellNums[pc] = usedLeafCellNum
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		gi, gj := len(candidateGroups[candidates[i]]), len(candidateGroups[candidates[j]])
+		if gi != gj {
+			return gi < gj
+		}
+		return usedLeafCellNums[candidates[i]] < usedLeafCellNums[candidates[j]]
+	})
+	for _, c := range candidates {
+		if relocations := p.vacate(c, candidateGroups[c]); relocations != nil {
+			return relocations
+		}
+	}
+	return nil
+}
+
+// getRelocatableGroups returns the groups using a cell (sorted by name) and the number of used leaf cells in it.
+// The bool return value is false if any of the used leaf cells cannot be freed.
+func (p *defragPlanner) getRelocatableGroups(c *PhysicalCell) ([]*defragGroup, int, bool) {
+	var groups []*defragGroup
+	usedLeafCellNum := 0
+	for _, leafCell := range getLeafCells(c) {
+		g, occupied := p.occupants[leafCell]
+		if !occupied {
+			continue
+		}
+		if g == nil || !g.relocatable || p.relocated[g] {
+			return nil, 0, false
+		}
+		usedLeafCellNum++
+		if !containsDefragGroup(groups, g) {
+			// a group in multiple chains is not relocated, as it cannot be placed only by this chain
+			for _, pod := range g.pods {
+				for _, podLeafCell := range pod {
+					if podLeafCell.GetChain() != c.GetChain() {
+						return nil, 0, false
+					}
+				}
+			}
+			groups = append(groups, g)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].name < groups[j].name
+	})
+	return groups, usedLeafCellNum, true
+}
+
+// vacate simulates relocating the groups in a cell to the holes of the other cells.
+// It returns the relocations, or nil (with the simulation reverted) if any pod cannot be placed.
+func (p *defragPlanner) vacate(c *PhysicalCell, groups []*defragGroup) []api.AffinityGroupRelocation {
+	p.setOccupants(groups, false)
+	var placedLeafCells []*PhysicalCell
+	var relocations []api.AffinityGroupRelocation
+	for _, g := range groups {
+		// place the larger pods first for a tighter packing
+		pods := make([]CellList, len(g.pods))
+		copy(pods, g.pods)
+		sort.SliceStable(pods, func(i, j int) bool {
+			return len(pods[i]) > len(pods[j])
+		})
+		toNodes := common.NewSet()
+		for _, pod := range pods {
+			target := p.findHole(c, len(pod))
+			if target == nil {
+				for _, leafCell := range placedLeafCells {
+					delete(p.occupants, leafCell)
+				}
+				p.setOccupants(groups, true)
+				return nil
+			}
+			for _, leafCell := range getLeafCells(target)[:len(pod)] {
+				// the group will not be relocated again, so its new leaf cells cannot be freed
+				p.occupants[leafCell] = nil
+				placedLeafCells = append(placedLeafCells, leafCell)
+			}
+			nodes, _ := target.GetPhysicalPlacement()
+			toNodes.Add(nodes[0])
+		}
+		relocations = append(relocations, api.AffinityGroupRelocation{
+			Name:      g.name,
+			VC:        g.vc,
+			Priority:  g.priority,
+			FreedCell: c.GetAddress(),
+			FromNodes: getDefragGroupNodes(g),
+			ToNodes:   sortedStrings(toNodes),
+		})
+	}
+	for _, g := range groups {
+		p.relocated[g] = true
+	}
+	klog.Infof("Defragmentation: cell %v can be freed by relocating %v affinity groups", c.GetAddress(), len(groups))
+	return relocations
+}
+
+// setOccupants occupies (or frees) the current leaf cells of the groups.
+func (p *defragPlanner) setOccupants(groups []*defragGroup, occupied bool) {
+	for _, g := range groups {
+		for _, pod := range g.pods {
+			for _, leafCell := range pod {
+				if occupied {
+					p.occupants[leafCell.(*PhysicalCell)] = g
+				} else {
+					delete(p.occupants, leafCell.(*PhysicalCell))
+				}
+			}
+		}
+	}
+}
+
+// findHole finds the smallest free cell within a node that has enough leaf cells for a pod,
+// which is below the level of the cell being vacated, and in a used cell at that level (other than the vacated one).
+func (p *defragPlanner) findHole(vacated *PhysicalCell, leafCellNum int) *PhysicalCell {
+	chain := vacated.GetChain()
+	for l := lowestLevel; l < vacated.GetLevel(); l++ {
+		for _, c := range p.fullCellList[chain][l] {
+			pc := c.(*PhysicalCell)
+			if int(pc.GetTotalLeafCellNum()) < leafCellNum || !p.isFree(pc) {
+				continue
+			}
+			if nodes, _ := pc.GetPhysicalPlacement(); len(nodes) != 1 {
+				continue
+			}
+			ancestor := pc
+			for ancestor.GetLevel() < vacated.GetLevel() {
+				ancestor = ancestor.GetParent().(*PhysicalCell)
+			}
+			if ancestor != vacated && !p.isFree(ancestor) {
+				return pc
+			}
+		}
+	}
+	return nil
+}
+
+// isFree checks if none of the leaf cells in a cell are occupied.
+func (p *defragPlanner) isFree(c *PhysicalCell) bool {
+	for _, leafCell := range getLeafCells(c) {
+		if _, occupied := p.occupants[leafCell]; occupied {
+			return false
+		}
+	}
+	return true
+}
+
+// countFreeCells counts the free cells of each level in a chain.
+func (p *defragPlanner) countFreeCells(chain CellChain) map[CellLevel]int32 {
+	freeCellNums := map[CellLevel]int32{}
+	for l, cells := range p.fullCellList[chain] {
+		for _, c := range cells {
+			if p.isFree(c.(*PhysicalCell)) {
+				freeCellNums[l]++
+			}
+		}
+	}
+	return freeCellNums
+}
+
+// getLeafCells returns the leaf cells in a physical cell.
+func getLeafCells(c *PhysicalCell) []*PhysicalCell {
+	if c.GetLevel() == lowestLevel {
+		return []*PhysicalCell{c}
+	}
+	var leafCells []*PhysicalCell
+	for _, child := range c.GetChildren() {
+		leafCells = append(leafCells, getLeafCells(child.(*PhysicalCell))...)
+	}
+	return leafCells
+}
+
+// getDefragGroupNodes returns the nodes a group uses, sorted.
+func getDefragGroupNodes(g *defragGroup) []string {
+	nodes := common.NewSet()
+	for _, pod := range g.pods {
+		for _, leafCell := range pod {
+			leafCellNodes, _ := leafCell.(*PhysicalCell).GetPhysicalPlacement()
+			nodes.Add(leafCellNodes[0])
+		}
+	}
+	return sortedStrings(nodes)
+}
+
+func containsDefragGroup(groups []*defragGroup, g *defragGroup) bool {
+	for _, group := range groups {
+		if group == g {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedStrings(s common.Set) []string {
+	strs := make([]string, 0, len(s.Items()))
+	for item := range s.Items() {
+		strs = append(strs, item.(string))
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// PlanDefragmentation proposes the relocations of the allocated AffinityGroups to defragment the cluster,
+// as GET /v1/inspect/defragmentationplan does, but offline, from the config and a dump of the AffinityGroups
+// returned by GET /v1/inspect/affinitygroups/. As the dump does not tell how the leaf cells of an AffinityGroup
+// are split among its pods, the leaf cells on each node are regarded as used by one pod.
+func PlanDefragmentation(sConfig *api.Config, groups api.AffinityGroupList) api.DefragmentationPlan {
+	physicalFullList, _, _, _, _, _, _, _, _, cellLevelToType := ParseConfig(sConfig)
+	chains := sortedChains(physicalFullList)
+	var defragGroups []*defragGroup
+	for _, ag := range groups.Items {
+		g := &defragGroup{
+			name:        ag.Name,
+			vc:          ag.Status.VC,
+			priority:    ag.Status.Priority,
+			relocatable: ag.Status.State == api.AffinityGroupState(groupAllocated),
+		}
+		nodes := make([]string, 0, len(ag.Status.PhysicalPlacement))
+		for node := range ag.Status.PhysicalPlacement {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			pod := CellList{}
+			for _, index := range ag.Status.PhysicalPlacement[node] {
+				var leafCell *PhysicalCell
+				for _, chain := range chains {
+					if leafCell = findPhysicalLeafCellInChain(physicalFullList, chain, node, index); leafCell != nil {
+						break
+					}
+				}
+				if leafCell == nil {
+					klog.Warningf("Leaf cell %v on node %v of affinity group %v not found in the config",
+						index, node, ag.Name)
+					continue
+				}
+				pod = append(pod, leafCell)
+			}
+			if len(pod) > 0 {
+				g.pods = append(g.pods, pod)
+			}
+		}
+		defragGroups = append(defragGroups, g)
+	}
+	return newDefragPlanner(physicalFullList, cellLevelToType, defragGroups, nil).plan()
+}
+
+// ExplainDefragmentationPlan returns a human readable description of a defragmentation plan.
+func ExplainDefragmentationPlan(plan api.DefragmentationPlan) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Relocations:\n")
+	if len(plan.Relocations) == 0 {
+		fmt.Fprintf(b, "  None\n")
+	}
+	for _, r := range plan.Relocations {
+		fmt.Fprintf(b, "  %v (VC %v, priority %v): from %v to %v, freeing cell %v\n",
+			r.Name, r.VC, r.Priority, strings.Join(r.FromNodes, ","), strings.Join(r.ToNodes, ","), r.FreedCell)
+	}
+	fmt.Fprintf(b, "Free Cells:\n")
+	for _, chain := range plan.Chains {
+		fmt.Fprintf(b, "  %v:\n", chain.Chain)
+		for _, l := range chain.Levels {
+			fmt.Fprintf(b, "    Level %v (cellType %v): %v -> %v\n", l.Level, l.CellType, l.Before, l.After)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/hivedscheduler/pkg/api"
+)
+
+// ExplainConfig returns a human readable description of how the config is resolved,
+// including the cell chains, the inferred physical cell addresses and the VC quotas.
+// It only parses the config, so it can be used offline, without a K8S cluster.
+func ExplainConfig(sConfig *api.Config) string {
+	physicalFullList, _, vcFreeCellNum, _, _, _, physicalPinnedCells, cellLevelToLeafCellNum, _, cellLevelToType :=
+		ParseConfig(sConfig)
+
+	b := &strings.Builder{}
+	chains := sortedChains(physicalFullList)
+
+	fmt.Fprintf(b, "Cell Chains:\n")
+	for _, chain := range chains {
+		topLevel := CellLevel(len(physicalFullList[chain]))
+		types := make([]string, 0, topLevel)
+		for l := topLevel; l >= lowestLevel; l-- {
+			types = append(types, string(cellLevelToType[chain][l]))
+		}
+		fmt.Fprintf(b, "  %v: %v\n", chain, strings.Join(types, " -> "))
+		for l := topLevel; l >= lowestLevel; l-- {
+			fmt.Fprintf(b, "    Level %v: cellType %v, %v leaf cells per cell, %v cells in total\n",
+				l, cellLevelToType[chain][l], cellLevelToLeafCellNum[chain][l], len(physicalFullList[chain][l]))
+		}
+	}
+
+	fmt.Fprintf(b, "Physical Cells:\n")
+	for _, spec := range sConfig.PhysicalCluster.PhysicalCells {
+		explainPhysicalCell(b, spec, "  ")
+	}
+
+	fmt.Fprintf(b, "Virtual Clusters:\n")
+	vcNames := make([]string, 0, len(vcFreeCellNum))
+	for vc := range vcFreeCellNum {
+		vcNames = append(vcNames, string(vc))
+	}
+	sort.Strings(vcNames)
+	for _, name := range vcNames {
+		vc := api.VirtualClusterName(name)
+		fmt.Fprintf(b, "  %v: intraVCScheduler %v\n", vc, (*sConfig.VirtualClusters)[vc].IntraVCScheduler)
+		for _, chain := range chains {
+			levelNums, ok := vcFreeCellNum[vc][chain]
+			if !ok {
+				continue
+			}
+			for l := CellLevel(len(physicalFullList[chain])); l >= lowestLevel; l-- {
+				if n := levelNums[l]; n > 0 {
+					fmt.Fprintf(b, "    %v Level %v: %v cells of cellType %v, %v leaf cells\n",
+						chain, l, n, cellLevelToType[chain][l], n*cellLevelToLeafCellNum[chain][l])
+				}
+			}
+		}
+		// the pinned cells are also counted in the above quotas
+		for _, pinned := range (*sConfig.VirtualClusters)[vc].PinnedCells {
+			if c, ok := physicalPinnedCells[vc][pinned.PinnedCellId]; ok {
+				fmt.Fprintf(b, "    Pinned Cell %v: %v Level %v, address %v\n",
+					pinned.PinnedCellId, c.GetChain(), c.GetLevel(), c.GetAddress())
+			}
+		}
+		if maxNums := (*sConfig.VirtualClusters)[vc].MaxOpportunisticLeafCells; len(maxNums) > 0 {
+			fmt.Fprintf(b, "    Max Opportunistic Leaf Cells: %v\n", maxNums)
+		}
+	}
+	return b.String()
+}
+
+func explainPhysicalCell(b *strings.Builder, spec api.PhysicalCellSpec, indent string) {
+	fmt.Fprintf(b, "%v%v: %v", indent, spec.CellType, spec.CellAddress)
+	if spec.PinnedCellId != "" {
+		fmt.Fprintf(b, " (pinnedCellId: %v)", spec.PinnedCellId)
+	}
+	fmt.Fprintf(b, "\n")
+	for _, child := range spec.CellChildren {
+		explainPhysicalCell(b, child, indent+"  ")
+	}
+}
+
+func sortedChains(m map[CellChain]ChainCellList) []CellChain {
+	names := make([]string, 0, len(m))
+	for chain := range m {
+		names = append(names, string(chain))
+	}
+	sort.Strings(names)
+	chains := make([]CellChain, len(names))
+	for i, n := range names {
+		chains[i] = CellChain(n)
+	}
+	return chains
+}
@@ -24,13 +24,16 @@ package algorithm
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/internal"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 )
 
@@ -89,8 +92,9 @@ type HivedAlgorithm struct {
 	// and may change across different pods. The consequence is that, even if ignoreK8sSuggestedNodes is false
 	// for an affinity group, the intra-VC scheduler may choose some placements that
 	// cannot be mapped to a physical placement fully within the suggested nodes.
-	// TODO: introduce randomization in intra-VC scheduling to avoid always choosing the same placement
-	// that cannot be mapped to suggested nodes
+	// To avoid always choosing the same placement that cannot be mapped to suggested nodes,
+	// we retry the intra-VC scheduling with the failed nodes excluded, for at most this number of attempts.
+	maxIntraVCSchedulingAttempts int32
 
 	// bad nodes in the physical cluster
 	badNodes common.Set
@@ -98,6 +102,31 @@ type HivedAlgorithm struct {
 	cellChains map[string][]CellChain
 	// map each level in a chain to the specific cell type name
 	cellTypes map[CellChain]map[CellLevel]api.CellType
+	// map each chain to its leaf cell type
+	chainLeafCellTypes map[CellChain]string
+	// maximum number of leaf cells of each leaf cell type that the opportunistic pods of each VC can use
+	vcMaxOpportunisticLeafCellNum map[api.VirtualClusterName]map[string]int32
+	// number of leaf cells of each leaf cell type used by the opportunistic pods of each VC
+	vcOpportunisticLeafCellNum map[api.VirtualClusterName]map[string]int32
+	// how the idle cells are shared among the opportunistic pods of the VCs
+	idleCellSharingPolicy api.IdleCellSharingPolicy
+	// weight of each VC when sharing the idle cells under api.IdleCellSharingWeightedFairShare
+	vcFairShareWeights map[api.VirtualClusterName]int32
+	// new affinity groups that have to wait for resources
+	waitingGroups map[string]*waitingAffinityGroup
+	// an affinity group waiting for longer than this in each VC has cells reserved (0 means no reservation)
+	vcAgingThresholds map[api.VirtualClusterName]time.Duration
+	// the pods of each VC preempted are notified and only deleted after this period (unless they acknowledge it)
+	vcPreemptionGracePeriods map[api.VirtualClusterName]time.Duration
+	// reservations of cells in the VCs for time windows
+	reservations map[string]*cellReservation
+	// an allocated affinity group missing some pods for longer than this is timed out (0 means never)
+	gangSchedulingTimeout time.Duration
+	// whether the existing pods of a timed-out affinity group are deleted to release its cells
+	gangSchedulingTimeoutDeletePods bool
+	// new affinity groups whose first pods have been placed by this algorithm, hence whose gang scheduling
+	// timeouts start once they are allocated (unlike the groups recovered from the bound pods)
+	placedAffinityGroups common.Set
 	// cluster status exposed to external
 	apiClusterStatus api.ClusterStatus
 	// lock
@@ -110,33 +139,54 @@ func NewHivedAlgorithm(sConfig *api.Config) *HivedAlgorithm {
 		leafCellNums, chains, cellTypes := ParseConfig(sConfig)
 
 	h := &HivedAlgorithm{
-		vcSchedulers:            map[api.VirtualClusterName]intraVCScheduler{},
-		opportunisticSchedulers: map[CellChain]*topologyAwareScheduler{},
-		fullCellList:            fullPcl,
-		freeCellList:            freePcl,
-		vcFreeCellNum:           vcFreeCellNum,
-		allVCFreeCellNum:        map[CellChain]map[CellLevel]int32{},
-		totalLeftCellNum:        map[CellChain]map[CellLevel]int32{},
-		badFreeCells:            map[CellChain]ChainCellList{},
-		vcDoomedBadCells:        map[api.VirtualClusterName]map[CellChain]ChainCellList{},
-		allVCDoomedBadCellNum:   map[CellChain]map[CellLevel]int32{},
-		badNodes:                common.NewSet(),
-		cellChains:              chains,
-		cellTypes:               cellTypes,
-		affinityGroups:          map[string]*AlgoAffinityGroup{},
+		vcSchedulers:                  map[api.VirtualClusterName]intraVCScheduler{},
+		opportunisticSchedulers:       map[CellChain]*topologyAwareScheduler{},
+		fullCellList:                  fullPcl,
+		freeCellList:                  freePcl,
+		vcFreeCellNum:                 vcFreeCellNum,
+		allVCFreeCellNum:              map[CellChain]map[CellLevel]int32{},
+		totalLeftCellNum:              map[CellChain]map[CellLevel]int32{},
+		badFreeCells:                  map[CellChain]ChainCellList{},
+		vcDoomedBadCells:              map[api.VirtualClusterName]map[CellChain]ChainCellList{},
+		allVCDoomedBadCellNum:         map[CellChain]map[CellLevel]int32{},
+		badNodes:                      common.NewSet(),
+		cellChains:                    chains,
+		cellTypes:                     cellTypes,
+		chainLeafCellTypes:            map[CellChain]string{},
+		vcMaxOpportunisticLeafCellNum: map[api.VirtualClusterName]map[string]int32{},
+		vcOpportunisticLeafCellNum:    map[api.VirtualClusterName]map[string]int32{},
+		idleCellSharingPolicy:         api.IdleCellSharingFirstComeFirstServed,
+		vcFairShareWeights:            map[api.VirtualClusterName]int32{},
+		waitingGroups:                 map[string]*waitingAffinityGroup{},
+		vcAgingThresholds:             map[api.VirtualClusterName]time.Duration{},
+		vcPreemptionGracePeriods:      map[api.VirtualClusterName]time.Duration{},
+		reservations:                  map[string]*cellReservation{},
+		affinityGroups:                map[string]*AlgoAffinityGroup{},
+		placedAffinityGroups:          common.NewSet(),
+		maxIntraVCSchedulingAttempts:  1,
 		apiClusterStatus: api.ClusterStatus{
 			PhysicalCluster: api.PhysicalClusterStatus{},
 			VirtualClusters: map[api.VirtualClusterName]api.VirtualClusterStatus{},
 		},
 	}
 	for vcName := range nonPinnedFullVcl {
-		// TODO: Support per-VC configurable intra VC scheduling algo.
-		h.vcSchedulers[vcName] = newDefaultIntraVCScheduler(
+		h.vcSchedulers[vcName] = newIntraVCScheduler((*sConfig.VirtualClusters)[vcName].IntraVCScheduler,
 			nonPinnedFullVcl[vcName], nonPinnedFreeVcl[vcName], pinnedVcl[vcName], leafCellNums)
+		h.vcOpportunisticLeafCellNum[vcName] = map[string]int32{}
+		for _, r := range (*sConfig.VirtualClusters)[vcName].Reservations {
+			h.reservations[r.Name] = newCellReservation(vcName, r)
+		}
+	}
+	for leafCellType, chains := range h.cellChains {
+		for _, chain := range chains {
+			h.chainLeafCellTypes[chain] = leafCellType
+		}
 	}
 	for chain, ccl := range h.fullCellList {
-		h.opportunisticSchedulers[chain] = NewTopologyAwareScheduler(ccl, leafCellNums[chain], false)
+		h.opportunisticSchedulers[chain] = NewTopologyAwareScheduler(
+			ccl, leafCellNums[chain], false, packNodesWithBacktracking)
 	}
+	h.initPolicies(sConfig)
 	h.initCellNums()
 	h.initAPIClusterStatus()
 	h.initPinnedCells(pinnedPcl)
@@ -144,6 +194,72 @@ func NewHivedAlgorithm(sConfig *api.Config) *HivedAlgorithm {
 	return h
 }
 
+// UpdatePolicies applies the changed scheduling policies in place, i.e. the
+// algorithm fields and the VC fields which do not change any cell, see
+// api.ConfigDiff.PoliciesChanged. The VCs in the config must be the same as
+// the current ones.
+func (h *HivedAlgorithm) UpdatePolicies(sConfig *api.Config) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+
+	h.initPolicies(sConfig)
+	klog.Infof("Scheduling policies updated")
+}
+
+// InheritState carries the states of the affinity groups which are only kept in memory over from
+// the algorithm replaced by this one after a config change, i.e., since when the waiting groups have
+// been waiting, since when the preempting groups have been preempting, the completed pods released
+// by the allocated groups, and the gang scheduling timeouts of the allocated groups. The groups which
+// are no longer the same after the replay, e.g., an allocated group is preempting now, are skipped.
+func (h *HivedAlgorithm) InheritState(old internal.SchedulerAlgorithm) {
+	o, ok := old.(*HivedAlgorithm)
+	if !ok {
+		return
+	}
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	o.algorithmLock.RLock()
+	defer o.algorithmLock.RUnlock()
+
+	for name, wg := range o.waitingGroups {
+		if h.affinityGroups[name] != nil {
+			continue
+		}
+		if cur := h.waitingGroups[name]; cur == nil || wg.waitingSince.Before(cur.waitingSince) {
+			h.waitingGroups[name] = wg
+		}
+	}
+	for name := range o.placedAffinityGroups.Items() {
+		if h.affinityGroups[name.(string)] == nil {
+			h.placedAffinityGroups.Add(name)
+		}
+	}
+	for name, og := range o.affinityGroups {
+		g := h.affinityGroups[name]
+		if g == nil || g.state != og.state {
+			continue
+		}
+		if g.state == groupPreempting {
+			g.preemptionStartTime = og.preemptionStartTime
+			continue
+		}
+		for member, podUIDs := range og.releasedPods {
+			for podIndex, podUID := range podUIDs {
+				if podUID != "" && podIndex < len(g.releasedPods[member]) &&
+					g.releasedPods[member][podIndex] == "" && g.allocatedPods[member][podIndex] == nil {
+					h.releaseAllocatedPod(g, member, int32(podIndex), podUID)
+				}
+			}
+		}
+		if created, total := countCreatedPods(g); created < total {
+			g.incompleteSince = og.incompleteSince
+			g.incompleteReason = og.incompleteReason
+			g.releaseReason = og.releaseReason
+		}
+	}
+	klog.Infof("Scheduling states inherited")
+}
+
 func (h *HivedAlgorithm) AddNode(node *core.Node) {
 	h.algorithmLock.Lock()
 	defer h.algorithmLock.Unlock()
@@ -187,20 +303,21 @@ func (h *HivedAlgorithm) Schedule(
 
 	klog.Infof("[%v]: Scheduling pod in %v phase...", internal.Key(pod), phase)
 	s := internal.ExtractPodSchedulingSpec(pod)
+	h.updateReservations(time.Now())
 	suggestedNodeSet := common.NewSet()
 	for _, n := range suggestedNodes {
 		suggestedNodeSet.Add(n)
 	}
 	var (
-		groupPhysicalPlacement groupPhysicalPlacement // leaf cell number -> a set of pods -> a set of leaf cells of each pod
-		groupVirtualPlacement  groupVirtualPlacement  // leaf cell number -> a set of pods -> a set of leaf cells of each pod
+		groupPhysicalPlacement groupPhysicalPlacement // member -> a set of pods -> a set of leaf cells of each pod
+		groupVirtualPlacement  groupVirtualPlacement  // member -> a set of pods -> a set of leaf cells of each pod
 		preemptionVictims      map[string]common.Set  // node -> pods
 		waitReason             string
-		podIndex               int32 // index of current pod among those of the same leaf cell number in the group, 0 by default
+		podIndex               int32 // index of current pod among those of the same member in the group, 0 by default
 	)
 
 	if g := h.affinityGroups[s.AffinityGroup.Name]; g != nil {
-		groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, podIndex =
+		groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, podIndex, waitReason =
 			h.schedulePodFromExistingGroup(g, s, suggestedNodeSet, phase, pod)
 	}
 	// we need to re-evaluate the existence of the group here (instead of an "else") because it is
@@ -209,13 +326,21 @@ func (h *HivedAlgorithm) Schedule(
 		groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, waitReason =
 			h.schedulePodFromNewGroup(s, suggestedNodeSet, phase, pod)
 	}
+	var gracefulVictims []internal.GracefulVictim
+	if g := h.affinityGroups[s.AffinityGroup.Name]; g != nil && g.state == groupPreempting && len(preemptionVictims) != 0 {
+		preemptionVictims, gracefulVictims = h.holdVictimsInGracePeriods(g, preemptionVictims)
+	}
+	if h.affinityGroups[s.AffinityGroup.Name] == nil && groupPhysicalPlacement != nil {
+		h.placedAffinityGroups.Add(s.AffinityGroup.Name)
+	}
 	return generatePodScheduleResult(
 		groupPhysicalPlacement,
 		groupVirtualPlacement,
 		preemptionVictims,
+		gracefulVictims,
 		waitReason,
 		h.cellTypes,
-		s.LeafCellNumber,
+		getPodMemberKey(s),
 		podIndex,
 		h.affinityGroups[s.AffinityGroup.Name],
 		s.AffinityGroup.Name,
@@ -231,6 +356,8 @@ func (h *HivedAlgorithm) DeleteUnallocatedPod(pod *core.Pod) {
 	defer h.algorithmLock.Unlock()
 
 	s := internal.ExtractPodSchedulingSpec(pod)
+	delete(h.waitingGroups, s.AffinityGroup.Name)
+	h.placedAffinityGroups.Delete(s.AffinityGroup.Name)
 	if g := h.affinityGroups[s.AffinityGroup.Name]; g != nil && g.state == groupPreempting {
 		if g.preemptingPods[pod.UID] != nil {
 			klog.Infof("[%v]: Deleting preempting pod from affinity group %v...", internal.Key(pod), g.name)
@@ -240,6 +367,7 @@ func (h *HivedAlgorithm) DeleteUnallocatedPod(pod *core.Pod) {
 			klog.Infof("[%v]: Canceling affinity group %v's preemption because its pods are all deleted",
 				internal.Key(pod), g.name)
 			h.deletePreemptingAffinityGroup(g, pod)
+			h.migrateLazyPreemptedGroups()
 		}
 	}
 }
@@ -251,22 +379,37 @@ func (h *HivedAlgorithm) AddAllocatedPod(pod *core.Pod) {
 	s := internal.ExtractPodSchedulingSpec(pod)
 	info := internal.ExtractPodBindInfo(pod)
 	klog.Infof("[%v]: Adding allocated pod to affinity group %v...", internal.Key(pod), s.AffinityGroup.Name)
+	delete(h.waitingGroups, s.AffinityGroup.Name)
 	klog.Infof("[%v]: Adding to node %v, leaf cells %v", internal.Key(pod), info.Node, common.ToJson(info.LeafCellIsolation))
 
-	podIndex := int32(0)
+	// the group may be created from the bind info of any of its pods, not necessarily the first one
+	member := getPodMemberKey(s)
+	podIndex := getAllocatedPodIndex(info, member)
+	if podIndex == -1 {
+		klog.Errorf("[%v]: Pod placement not found in group %v: node %v, leaf cells %v",
+			internal.Key(pod), s.AffinityGroup.Name, info.Node, info.LeafCellIsolation)
+		return
+	}
 	if g := h.affinityGroups[s.AffinityGroup.Name]; g != nil {
 		if g.state == groupPreempting {
 			h.allocatePreemptingAffinityGroup(g, pod)
 		}
-		if podIndex = getAllocatedPodIndex(info, s.LeafCellNumber); podIndex == -1 {
-			klog.Errorf("[%v]: Pod placement not found in group %v: node %v, leaf cells %v",
-				internal.Key(pod), s.AffinityGroup.Name, info.Node, info.LeafCellIsolation)
+		if g.gangReleaseEnable {
+			// release the pods recorded as released by this pod first, as it may be placed on their leaf cells
+			h.releaseRecordedPods(g, info)
+		}
+		if podIndex >= g.totalPodNums[member] && !h.extendAllocatedAffinityGroup(g, s, info, podIndex, pod) {
 			return
 		}
 	} else {
 		h.createAllocatedAffinityGroup(s, info, pod)
 	}
-	h.affinityGroups[s.AffinityGroup.Name].allocatedPods[s.LeafCellNumber][podIndex] = pod
+	g := h.affinityGroups[s.AffinityGroup.Name]
+	g.allocatedPods[member][podIndex] = pod
+	if created, total := countCreatedPods(g); !g.incompleteSince.IsZero() && created == total {
+		g.incompleteSince = time.Time{}
+		g.incompleteReason = ""
+	}
 }
 
 func (h *HivedAlgorithm) DeleteAllocatedPod(pod *core.Pod) {
@@ -282,15 +425,22 @@ func (h *HivedAlgorithm) DeleteAllocatedPod(pod *core.Pod) {
 		klog.Errorf("[%v]: Group %v not found when deleting pod", internal.Key(pod), s.AffinityGroup.Name)
 		return
 	} else {
-		if podIndex := getAllocatedPodIndex(info, s.LeafCellNumber); podIndex == -1 {
+		member := getPodMemberKey(s)
+		if podIndex := getAllocatedPodIndex(info, member); podIndex == -1 {
 			klog.Errorf("[%v]: Pod placement not found in group %v: node %v, leaf cells %v",
 				internal.Key(pod), s.AffinityGroup.Name, info.Node, info.LeafCellIsolation)
 			return
 		} else {
-			g.allocatedPods[s.LeafCellNumber][podIndex] = nil
-		}
-		if allPodsReleased(g.allocatedPods) {
-			h.deleteAllocatedAffinityGroup(g, pod)
+			g.allocatedPods[member][podIndex] = nil
+			if allPodsReleased(g.allocatedPods) {
+				h.deleteAllocatedAffinityGroup(g, pod)
+			} else if g.gangReleaseEnable {
+				h.releaseAllocatedPod(g, member, podIndex, pod.UID)
+			} else {
+				return
+			}
+			// the released cells may allow the lazy-preempted groups to return to their VCs
+			h.migrateLazyPreemptedGroups()
 		}
 	}
 }
@@ -362,6 +512,238 @@ func (h *HivedAlgorithm) GetVirtualClusterStatus(vcn api.VirtualClusterName) api
 	panic(internal.NewBadRequestError(fmt.Sprintf("VC %v not found", vcn)))
 }
 
+func (h *HivedAlgorithm) GetAllOpportunisticUsage() map[api.VirtualClusterName]api.OpportunisticUsage {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	allUsage := map[api.VirtualClusterName]api.OpportunisticUsage{}
+	for vcn := range h.vcOpportunisticLeafCellNum {
+		allUsage[vcn] = h.getOpportunisticUsage(vcn)
+	}
+	return allUsage
+}
+
+func (h *HivedAlgorithm) GetOpportunisticUsage(vcn api.VirtualClusterName) api.OpportunisticUsage {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	if _, ok := h.vcOpportunisticLeafCellNum[vcn]; ok {
+		return h.getOpportunisticUsage(vcn)
+	}
+	panic(internal.NewBadRequestError(fmt.Sprintf("VC %v not found", vcn)))
+}
+
+// GetDefragmentationPlan proposes the relocations of the allocated affinity groups
+// that free the most high-level cells, without changing the current allocation.
+func (h *HivedAlgorithm) GetDefragmentationPlan() api.DefragmentationPlan {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	var groupNames []string
+	for name := range h.affinityGroups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+	var groups []*defragGroup
+	for _, name := range groupNames {
+		g := h.affinityGroups[name]
+		dg := &defragGroup{
+			name:     g.name,
+			vc:       g.vc,
+			priority: g.priority,
+			// the preempting groups and the groups being preempted will release or change their placements soon,
+			// and the fractional groups are hard to relocate as they share leaf cells
+			relocatable: g.state == groupAllocated && g.leafCellFraction == leafCellFractionScale,
+		}
+		for _, member := range sortedMemberKeys(g.physicalLeafCellPlacement) {
+			for _, podPlacement := range g.physicalLeafCellPlacement[member] {
+				pod := CellList{}
+				for _, leafCell := range podPlacement {
+					if leafCell != nil {
+						pod = append(pod, leafCell)
+					}
+				}
+				if len(pod) > 0 {
+					dg.pods = append(dg.pods, pod)
+				}
+			}
+		}
+		groups = append(groups, dg)
+	}
+	var blockedLeafCells []*PhysicalCell
+	for _, ccl := range h.fullCellList {
+		for _, c := range ccl[lowestLevel] {
+			if pc := c.(*PhysicalCell); !pc.IsHealthy() || pc.GetState() != cellFree {
+				blockedLeafCells = append(blockedLeafCells, pc)
+			}
+		}
+	}
+	return newDefragPlanner(h.fullCellList, h.cellTypes, groups, blockedLeafCells).plan()
+}
+
+// ReleaseTimedOutAffinityGroups returns the allocated affinity groups which have been missing some pods
+// for longer than the gang scheduling timeout, with their existing pods. If the pods are to be deleted,
+// the groups are marked as released and returned until then: their cells are released once these pods
+// are deleted, and their missing pods wait until then. Otherwise, the groups are only marked as
+// incomplete and returned once, and their missing pods can still join them.
+func (h *HivedAlgorithm) ReleaseTimedOutAffinityGroups() []internal.TimedOutAffinityGroup {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+
+	if h.gangSchedulingTimeout == 0 {
+		return nil
+	}
+	var groupNames []string
+	for name := range h.affinityGroups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+	var timedOutGroups []internal.TimedOutAffinityGroup
+	now := time.Now()
+	for _, name := range groupNames {
+		g := h.affinityGroups[name]
+		if g.releaseReason == "" {
+			if g.state != groupAllocated || g.incompleteSince.IsZero() ||
+				now.Sub(g.incompleteSince) < h.gangSchedulingTimeout ||
+				(g.incompleteReason != "" && !h.gangSchedulingTimeoutDeletePods) {
+				continue
+			}
+			created, total := countCreatedPods(g)
+			reason := fmt.Sprintf("Only %v of %v pods were created within the gang scheduling timeout %v",
+				created, total, h.gangSchedulingTimeout)
+			if h.gangSchedulingTimeoutDeletePods {
+				g.releaseReason = reason
+				klog.Warningf("Releasing affinity group %v: %v", g.name, reason)
+			} else {
+				g.incompleteReason = reason
+				klog.Warningf("Affinity group %v is incomplete: %v", g.name, reason)
+			}
+		}
+		timedOutGroup := internal.TimedOutAffinityGroup{
+			Name: g.name, Reason: g.releaseReason, DeletePods: g.releaseReason != ""}
+		if !timedOutGroup.DeletePods {
+			timedOutGroup.Reason = g.incompleteReason
+		}
+		for _, pods := range g.allocatedPods {
+			for _, p := range pods {
+				if p != nil {
+					timedOutGroup.Pods = append(timedOutGroup.Pods, p)
+				}
+			}
+		}
+		timedOutGroups = append(timedOutGroups, timedOutGroup)
+	}
+	return timedOutGroups
+}
+
+// getOpportunisticUsage returns a copy of the opportunistic leaf cell usage of a VC and its limits.
+func (h *HivedAlgorithm) getOpportunisticUsage(vcn api.VirtualClusterName) api.OpportunisticUsage {
+	usage := api.OpportunisticUsage{UsedLeafCells: map[string]int32{}}
+	for leafCellType, num := range h.vcOpportunisticLeafCellNum[vcn] {
+		usage.UsedLeafCells[leafCellType] = num
+	}
+	if maxNums := h.vcMaxOpportunisticLeafCellNum[vcn]; len(maxNums) > 0 {
+		usage.MaxLeafCells = map[string]int32{}
+		for leafCellType, num := range maxNums {
+			usage.MaxLeafCells[leafCellType] = num
+		}
+	}
+	if h.idleCellSharingPolicy == api.IdleCellSharingWeightedFairShare {
+		usage.FairShareLeafCells = map[string]int32{}
+		for leafCellType := range h.cellChains {
+			usage.FairShareLeafCells[leafCellType] = h.getFairShareLeafCellNum(vcn, leafCellType)
+		}
+	}
+	return usage
+}
+
+// getFairShareLeafCellNum returns the fair share of a VC in the idle leaf cells of a leaf cell type,
+// i.e., the leaf cells not bound to any VC (either free or used by opportunistic pods), which are
+// lent to the VCs in proportion to their weights.
+func (h *HivedAlgorithm) getFairShareLeafCellNum(vcn api.VirtualClusterName, leafCellType string) int32 {
+	idleNum := int32(0)
+	for _, chain := range h.cellChains[leafCellType] {
+		if leftNum, ok := h.totalLeftCellNum[chain]; ok {
+			idleNum += leftNum[lowestLevel]
+		} else {
+			// no VC has cells in this chain
+			idleNum += int32(len(h.fullCellList[chain][lowestLevel]))
+		}
+	}
+	totalWeight := int32(0)
+	for _, w := range h.vcFairShareWeights {
+		totalWeight += w
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+	return int32(int64(idleNum) * int64(h.vcFairShareWeights[vcn]) / int64(totalWeight))
+}
+
+// findVCFurtherBelowFairShare finds the VC which has waiting opportunistic affinity groups of a leaf cell type
+// and is the furthest below its fair share, if it is further below than the given VC.
+// As the fair shares are proportional to the weights, the VCs are compared by their usages divided by the weights.
+func (h *HivedAlgorithm) findVCFurtherBelowFairShare(
+	vcn api.VirtualClusterName,
+	leafCellType string) api.VirtualClusterName {
+
+	furthestVC := vcn
+	for _, wg := range h.waitingGroups {
+		s := wg.spec
+		if CellPriority(s.Priority) != opportunisticPriority || s.VirtualCluster == vcn ||
+			(s.LeafCellType != "" && s.LeafCellType != leafCellType) {
+			continue
+		}
+		// break ties by the VC name for a stable result
+		if cmp := h.compareFairShareUsage(s.VirtualCluster, furthestVC, leafCellType); cmp < 0 ||
+			(cmp == 0 && furthestVC != vcn && s.VirtualCluster < furthestVC) {
+			furthestVC = s.VirtualCluster
+		}
+	}
+	if furthestVC == vcn {
+		return ""
+	}
+	return furthestVC
+}
+
+// compareFairShareUsage returns a negative number if VC a is further below its fair share
+// of a leaf cell type than VC b, a positive number if b is further below, and 0 otherwise.
+func (h *HivedAlgorithm) compareFairShareUsage(a, b api.VirtualClusterName, leafCellType string) int64 {
+	return int64(h.vcOpportunisticLeafCellNum[a][leafCellType])*int64(h.vcFairShareWeights[b]) -
+		int64(h.vcOpportunisticLeafCellNum[b][leafCellType])*int64(h.vcFairShareWeights[a])
+}
+
+// initPolicies initiates the scheduling policies of the VCs and the whole algorithm from the config,
+// i.e., the fields which can be changed without reconstructing any cell.
+func (h *HivedAlgorithm) initPolicies(sConfig *api.Config) {
+	for vcName := range h.vcSchedulers {
+		vcs := (*sConfig.VirtualClusters)[vcName]
+		h.vcMaxOpportunisticLeafCellNum[vcName] = vcs.MaxOpportunisticLeafCells
+		h.vcFairShareWeights[vcName] = 1
+		if vcs.FairShareWeight != nil {
+			h.vcFairShareWeights[vcName] = *vcs.FairShareWeight
+		}
+		h.vcAgingThresholds[vcName] = time.Duration(vcs.AgingThresholdSeconds) * time.Second
+		h.vcPreemptionGracePeriods[vcName] = time.Duration(vcs.PreemptionGracePeriodSeconds) * time.Second
+	}
+	h.maxIntraVCSchedulingAttempts = 1
+	if sConfig.MaxIntraVCSchedulingAttempts != nil && *sConfig.MaxIntraVCSchedulingAttempts > 1 {
+		h.maxIntraVCSchedulingAttempts = *sConfig.MaxIntraVCSchedulingAttempts
+	}
+	h.idleCellSharingPolicy = api.IdleCellSharingFirstComeFirstServed
+	if sConfig.IdleCellSharingPolicy != nil {
+		h.idleCellSharingPolicy = *sConfig.IdleCellSharingPolicy
+	}
+	h.gangSchedulingTimeout = 0
+	if sConfig.GangSchedulingTimeoutSec != nil {
+		h.gangSchedulingTimeout = time.Duration(*sConfig.GangSchedulingTimeoutSec) * time.Second
+	}
+	h.gangSchedulingTimeoutDeletePods = false
+	if sConfig.GangSchedulingTimeoutDeletePods != nil {
+		h.gangSchedulingTimeoutDeletePods = *sConfig.GangSchedulingTimeoutDeletePods
+	}
+}
+
 // initCellNums initiates the data structures for tracking cell usages and healthiness,
 // i.e., h.allVCFreeCellNum, h.totalLeftCellNum, h.badFreeCells, h.vcDoomedBadCells, and h.allVCDoomedBadCellNum.
 // This method also validates the initial cell assignment to the VCs to make sure that
@@ -653,7 +1035,8 @@ func (h *HivedAlgorithm) tryUnbindDoomedBadCell(c CellChain, l CellLevel) {
 }
 
 // schedulePodFromExistingGroup schedules a pod from an allocated or preempting affinity group.
-// If it is from an allocated group, we will schedule the pod to the corresponding placement.
+// If it is from an allocated group, we will schedule the pod to the corresponding placement
+// (or extend the group for the pod if the group is elastic and all its placements have been used).
 // If it is from a preempting group, we will continue its preemption, or schedule it when the preemption is done.
 func (h *HivedAlgorithm) schedulePodFromExistingGroup(
 	g *AlgoAffinityGroup,
@@ -664,7 +1047,8 @@ func (h *HivedAlgorithm) schedulePodFromExistingGroup(
 	groupPhysicalPlacement groupPhysicalPlacement,
 	groupVirtualPlacement groupVirtualPlacement,
 	preemptionVictims map[string]common.Set,
-	podIndex int32) {
+	podIndex int32,
+	waitReason string) {
 
 	badOrNonSuggestedNodes := collectBadOrNonSuggestedNodes(
 		g.physicalLeafCellPlacement, suggestedNodes, g.ignoreK8sSuggestedNodes)
@@ -672,6 +1056,12 @@ func (h *HivedAlgorithm) schedulePodFromExistingGroup(
 	if g.state == groupAllocated {
 		klog.Infof("[%v]: Pod is from an affinity group that is already allocated: %v",
 			internal.Key(pod), s.AffinityGroup.Name)
+		member := getPodMemberKey(s)
+		if g.releaseReason != "" {
+			// the pod waits until the existing pods are deleted, and then is scheduled in a new group
+			return nil, nil, nil, podIndex, fmt.Sprintf(
+				"Affinity group %v is being released: %v", g.name, g.releaseReason)
+		}
 		groupPhysicalPlacement = g.physicalLeafCellPlacement
 		groupVirtualPlacement = g.virtualLeafCellPlacement
 		if !badOrNonSuggestedNodes.IsEmpty() {
@@ -680,10 +1070,18 @@ func (h *HivedAlgorithm) schedulePodFromExistingGroup(
 			klog.Warningf("[%v]: Some nodes allocated to affinity group %v are no longer "+
 				"healthy and within K8s suggested nodes: %v", internal.Key(pod), g.name, badOrNonSuggestedNodes)
 		}
-		if podIndex = getNewPodIndex(g.allocatedPods[s.LeafCellNumber]); podIndex == -1 {
-			panic(internal.NewBadRequestError(fmt.Sprintf(
-				"Requesting more pods than the configured number for %v leaf cells (%v pods) in affinity group %v",
-				s.LeafCellNumber, g.totalPodNums[s.LeafCellNumber], s.AffinityGroup.Name)))
+		if podIndex = getNewPodIndex(
+			g.allocatedPods[member], g.releasedPods[member]); podIndex == -1 {
+			// a pod recreated after a completed pod has released its leaf cells is scheduled beyond the
+			// current size of the group, in the same way as extending an elastic group
+			if g.totalPodNums[member]-countReleasedPods(g.releasedPods[member]) >=
+				g.maxPodNums[member] {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Requesting more pods than the configured number for %v leaf cells (%v pods) in affinity group %v",
+					s.LeafCellNumber, g.maxPodNums[member], s.AffinityGroup.Name)))
+			}
+			podIndex = g.totalPodNums[member]
+			groupPhysicalPlacement, groupVirtualPlacement, waitReason = h.scheduleElasticPod(g, s, suggestedNodes, pod)
 		}
 	} else { // groupPreempting
 		klog.Infof("[%v]: Pod is from an affinity group that is preempting others: %v",
@@ -700,15 +1098,118 @@ func (h *HivedAlgorithm) schedulePodFromExistingGroup(
 		} else {
 			groupPhysicalPlacement = g.physicalLeafCellPlacement
 			groupVirtualPlacement = g.virtualLeafCellPlacement
-			preemptionVictims, _ = collectPreemptionVictims(groupPhysicalPlacement)
-			if len(preemptionVictims) == 0 {
+			var waitedGroups common.Set
+			if g.reservedForAging {
+				preemptionVictims, waitedGroups, _ = collectAgingReservationVictims(
+					groupPhysicalPlacement, CellPriority(g.priority))
+			} else {
+				preemptionVictims, _ = collectPreemptionVictims(groupPhysicalPlacement)
+			}
+			if len(preemptionVictims) == 0 && waitedGroups.IsEmpty() {
 				klog.Infof(
 					"Preemption victims have been cleaned up for the preemptor affinity group %v", g.name)
+			} else if len(preemptionVictims) == 0 {
+				groupPhysicalPlacement, groupVirtualPlacement = nil, nil
+				waitReason = fmt.Sprintf("Cells are reserved for affinity group %v after waiting for too long, "+
+					"waiting for affinity groups %v using them to complete", g.name, waitedGroups)
 			}
 			g.preemptingPods[pod.UID] = pod
 		}
 	}
-	return groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, podIndex
+	return groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, podIndex, waitReason
+}
+
+// scheduleElasticPod schedules a pod beyond the current size of an allocated elastic affinity group.
+// The pod is placed in the same chain (or pinned cell) as the existing pods, preferably on the nodes
+// they are using, and only on free resource (i.e., extending a group never preempts other groups).
+// It returns the placements of the group extended with the new pod.
+func (h *HivedAlgorithm) scheduleElasticPod(
+	g *AlgoAffinityGroup,
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set,
+	pod *core.Pod) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement,
+	failedReason string) {
+
+	member := getPodMemberKey(s)
+	klog.Infof("[%v]: Extending elastic affinity group %v: %v of at most %v pods with %v leaf cells allocated",
+		internal.Key(pod), g.name, g.totalPodNums[member], g.maxPodNums[member], s.LeafCellNumber)
+	sr := schedulingRequest{
+		vc:                   g.vc,
+		priority:             CellPriority(g.priority),
+		affinityGroupName:    g.name,
+		affinityGroupPodNums: map[int32]int32{s.LeafCellNumber: 1},
+		memberLeafCellType:   member.leafCellType,
+	}
+	if g.virtualLeafCellPlacement == nil {
+		// a lazy preempted group no longer has its VC resource, hence can only grow opportunistically
+		sr.priority = opportunisticPriority
+	} else {
+		sr.pinnedCellId = s.PinnedCellId
+	}
+	groupNodes := common.NewSet()
+	for m, podPlacements := range g.physicalLeafCellPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, leafCell := range podPlacement {
+				if leafCell == nil {
+					continue
+				}
+				// the pod is placed in the chain of the pods of the same member (i.e., the same leaf cell type)
+				if m == member && sr.chain == "" {
+					sr.chain = leafCell.GetChain()
+				}
+				nodes, _ := leafCell.(*PhysicalCell).GetPhysicalPlacement()
+				if g.ignoreK8sSuggestedNodes || suggestedNodes.Contains(nodes[0]) {
+					groupNodes.Add(nodes[0])
+				}
+			}
+		}
+	}
+	if sr.chain == "" {
+		return nil, nil, fmt.Sprintf(
+			"all pods with %v leaf cells in the elastic affinity group have released their leaf cells", s.LeafCellNumber)
+	}
+	// first try the nodes of the existing pods, then the other nodes in the same chain
+	for _, nodes := range []struct {
+		suggested common.Set
+		ignore    bool
+	}{{groupNodes, false}, {suggestedNodes, g.ignoreK8sSuggestedNodes}} {
+		sr.suggestedNodes = nodes.suggested
+		sr.ignoreSuggestedNodes = nodes.ignore
+		var (
+			podPhysicalPlacement groupPhysicalPlacement
+			podVirtualPlacement  groupVirtualPlacement
+			lazyPreemptedGroups  map[string]groupVirtualPlacement
+		)
+		podPhysicalPlacement, podVirtualPlacement, lazyPreemptedGroups, failedReason = h.handleSchedulingRequest(sr)
+		if podPhysicalPlacement == nil {
+			continue
+		}
+		if victims, overlappingPreemptors := collectPreemptionVictims(podPhysicalPlacement); len(victims) == 0 &&
+			overlappingPreemptors.IsEmpty() {
+			physicalPlacement = groupPhysicalPlacement{}
+			for m, podPlacements := range g.physicalLeafCellPlacement {
+				physicalPlacement[m] = append([]CellList{}, podPlacements...)
+			}
+			physicalPlacement[member] = append(
+				physicalPlacement[member], podPhysicalPlacement[member][0])
+			if g.virtualLeafCellPlacement != nil {
+				virtualPlacement = groupVirtualPlacement{}
+				for m, podPlacements := range g.virtualLeafCellPlacement {
+					virtualPlacement[m] = append([]CellList{}, podPlacements...)
+				}
+				virtualPlacement[member] = append(
+					virtualPlacement[member], podVirtualPlacement[member][0])
+			}
+			return physicalPlacement, virtualPlacement, ""
+		}
+		for groupName, placement := range lazyPreemptedGroups {
+			h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+		}
+		failedReason = "extending an elastic affinity group cannot preempt other affinity groups"
+	}
+	return nil, nil, failedReason
 }
 
 // schedulePodFromNewGroup schedules a pod from a new affinity group, find placement for the group,
@@ -723,15 +1224,38 @@ func (h *HivedAlgorithm) schedulePodFromNewGroup(
 	preemptionVictims map[string]common.Set,
 	waitReason string) {
 
-	groupPhysicalPlacement, groupVirtualPlacement, waitReason = h.scheduleNewAffinityGroup(
-		pod, s, suggestedNodes)
+	if s.Reservation != "" {
+		if groupPhysicalPlacement, groupVirtualPlacement = h.scheduleInReservation(s, suggestedNodes, pod); groupPhysicalPlacement != nil {
+			return groupPhysicalPlacement, groupVirtualPlacement, nil, ""
+		}
+	}
+	if s.LeafCellFraction != 0 {
+		// sharing a leaf cell already used by other fractional pods needs no preemption
+		if groupPhysicalPlacement, groupVirtualPlacement = h.findSharedLeafCell(s, suggestedNodes); groupPhysicalPlacement != nil {
+			return groupPhysicalPlacement, groupVirtualPlacement, nil, ""
+		}
+	}
+	groupPhysicalPlacement, groupVirtualPlacement, lazyPreemptedGroups, waitReason := h.scheduleNewAffinityGroup(
+		pod, s, suggestedNodes, common.NewSet(), false)
 	if groupPhysicalPlacement == nil {
+		if backfillPlacement := h.backfillAffinityGroup(s, suggestedNodes, pod); backfillPlacement != nil {
+			return backfillPlacement, nil, nil, ""
+		}
+		if waitingSince := h.trackWaitingAffinityGroup(s, pod); h.isOldestAgedAffinityGroup(s, waitingSince) {
+			return h.reserveForAgedAffinityGroup(s, suggestedNodes, phase, waitReason, pod)
+		}
 		return nil, nil, nil, waitReason
 	}
 	preemptionVictims, overlappingPreemptors := collectPreemptionVictims(groupPhysicalPlacement)
 	// we allow a new preemption only when in Preempting phase
 	// and the placement is fully within suggested nodes
 	if phase == internal.PreemptingPhase {
+		var preemptionDecision *api.PreemptionDecision
+		if len(preemptionVictims) != 0 {
+			groupPhysicalPlacement, groupVirtualPlacement, preemptionDecision = h.choosePreemptionPlacement(
+				s, suggestedNodes, groupPhysicalPlacement, groupVirtualPlacement, lazyPreemptedGroups, pod)
+			preemptionVictims, overlappingPreemptors = collectPreemptionVictims(groupPhysicalPlacement)
+		}
 		// first cancel preemption of other groups whose resources overlap with the current group
 		for preemptor := range overlappingPreemptors.Items() {
 			klog.Infof("[%v]: Canceling affinity group %v's preemption because it is "+
@@ -742,6 +1266,7 @@ func (h *HivedAlgorithm) schedulePodFromNewGroup(
 		if len(preemptionVictims) != 0 {
 			// create preemption state to avoid resource contention among multiple preemptors
 			h.createPreemptingAffinityGroup(s, groupPhysicalPlacement, groupVirtualPlacement, pod)
+			h.affinityGroups[s.AffinityGroup.Name].preemptionDecision = preemptionDecision
 		}
 	} else if len(preemptionVictims) != 0 {
 		// here we won't create preemption state since we call preempt only in Preempting phase
@@ -751,115 +1276,826 @@ func (h *HivedAlgorithm) schedulePodFromNewGroup(
 	return groupPhysicalPlacement, groupVirtualPlacement, preemptionVictims, waitReason
 }
 
-// scheduleNewAffinityGroup schedules each pod of a new affinity group to a set of leaf cells
-// (in both the physical cluster and the VC). This is the entrance of a new scheduling attempt.
-func (h *HivedAlgorithm) scheduleNewAffinityGroup(
-	pod *core.Pod,
+// choosePreemptionPlacement evaluates alternative placements for a new affinity group that has to preempt others,
+// and chooses the one with the least preemption cost. The first alternative is the given placement, and each
+// following one is scheduled with the nodes having victims in the previous ones excluded. Only the lazy preemptions
+// made for the chosen placement are kept.
+func (h *HivedAlgorithm) choosePreemptionPlacement(
 	s *api.PodSchedulingSpec,
-	suggestedNodes common.Set) (
+	suggestedNodes common.Set,
 	physicalPlacement groupPhysicalPlacement,
 	virtualPlacement groupVirtualPlacement,
-	failedReason string) {
-
-	klog.Infof("[%v]: Scheduling new affinity group %v", internal.Key(pod), s.AffinityGroup.Name)
-	priority := CellPriority(s.Priority)
-	sr := schedulingRequest{
-		vc:                   s.VirtualCluster,
-		pinnedCellId:         s.PinnedCellId,
-		priority:             priority,
-		affinityGroupName:    s.AffinityGroup.Name,
-		affinityGroupPodNums: map[int32]int32{},
-		suggestedNodes:       suggestedNodes,
-		ignoreSuggestedNodes: s.IgnoreK8sSuggestedNodes,
-	}
-	for _, m := range s.AffinityGroup.Members {
-		// we will merge group members with same leaf cell number
-		sr.affinityGroupPodNums[m.LeafCellNumber] += m.PodNumber
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
+	pod *core.Pod) (
+	chosenPhysicalPlacement groupPhysicalPlacement,
+	chosenVirtualPlacement groupVirtualPlacement,
+	decision *api.PreemptionDecision) {
+
+	decision = &api.PreemptionDecision{}
+	var physicalPlacements []groupPhysicalPlacement
+	var virtualPlacements []groupVirtualPlacement
+	excludedNodes := CellList{}
+	for {
+		cost := computePreemptionCost(physicalPlacement)
+		klog.Infof("[%v]: Preemption alternative %v for affinity group %v costs %v: %v",
+			internal.Key(pod), len(decision.AlternativeCosts), s.AffinityGroup.Name,
+			common.ToJson(cost), physicalPlacement)
+		decision.AlternativeCosts = append(decision.AlternativeCosts, cost)
+		physicalPlacements = append(physicalPlacements, physicalPlacement)
+		virtualPlacements = append(virtualPlacements, virtualPlacement)
+		for groupName, placement := range lazyPreemptedGroups {
+			h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+		}
+		if len(decision.AlternativeCosts) >= maxPreemptionAlternatives ||
+			cost.VictimGroups == 0 || virtualPlacement == nil {
+			break
+		}
+		excludedNodes = append(excludedNodes, preemptionVictimNodes(physicalPlacement, virtualPlacement)...)
+		excludedNodeSet := common.NewSet()
+		for _, n := range excludedNodes {
+			excludedNodeSet.Add(n)
+		}
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, _ = h.scheduleNewAffinityGroup(
+			pod, s, suggestedNodes, excludedNodeSet, false)
+		if physicalPlacement == nil {
+			break
+		}
 	}
-	h.validateSchedulingRequest(sr, pod)
-	if sr.pinnedCellId != "" {
-		klog.Infof("Using pinned cell %v", s.PinnedCellId)
-		physicalPlacement, virtualPlacement, failedReason = h.handleSchedulingRequest(sr)
-	} else if s.LeafCellType != "" {
-		if _, ok := h.cellChains[s.LeafCellType]; !ok {
-			panic(internal.NewBadRequestError(fmt.Sprintf(
-				"[%v]: Pod requesting leaf cell type %v which the whole cluster does not have",
-				internal.Key(pod), s.LeafCellType)))
+	for i := range decision.AlternativeCosts {
+		if lessPreemptionCost(decision.AlternativeCosts[i], decision.AlternativeCosts[decision.Chosen]) {
+			decision.Chosen = int32(i)
 		}
-		klog.Infof("Using specified leaf cell type %v", s.LeafCellType)
-		physicalPlacement, virtualPlacement, failedReason = h.scheduleAffinityGroupForLeafCellType(
-			sr, s.LeafCellType, pod, true)
-	} else {
-		physicalPlacement, virtualPlacement, failedReason = h.scheduleAffinityGroupForAnyLeafCellType(sr, pod)
 	}
-	return physicalPlacement, virtualPlacement, failedReason
+	chosenPhysicalPlacement = physicalPlacements[decision.Chosen]
+	chosenVirtualPlacement = virtualPlacements[decision.Chosen]
+	// redo the lazy preemptions for the chosen placement, which have been reverted above
+	h.tryLazyPreempt(
+		chosenVirtualPlacement, sortedMemberKeys(chosenVirtualPlacement), s.AffinityGroup.Name, CellPriority(s.Priority))
+	klog.Infof("[%v]: Chose preemption alternative %v for affinity group %v",
+		internal.Key(pod), decision.Chosen, s.AffinityGroup.Name)
+	return chosenPhysicalPlacement, chosenVirtualPlacement, decision
 }
 
-// scheduleAffinityGroupForLeafCellType schedules an affinity group in a certain cell chain
-// that matches the given leaf cell type.
-func (h *HivedAlgorithm) scheduleAffinityGroupForLeafCellType(
-	sr schedulingRequest,
-	leafCellType string,
-	pod *core.Pod,
-	typeSpecified bool) (
-	physicalPlacement groupPhysicalPlacement,
-	virtualPlacement groupVirtualPlacement,
-	failedReason string) {
-
-	vcHasType := false
-	for _, chain := range h.cellChains[leafCellType] {
-		if sr.priority < minGuaranteedPriority ||
-			h.vcSchedulers[sr.vc].getNonPinnedPreassignedCells()[chain] != nil {
-			vcHasType = true
-			klog.Infof("Searching chain %v", chain)
-			sr.chain = chain
-			physicalPlacement, virtualPlacement, failedReason =
-				h.handleSchedulingRequest(sr)
-			if physicalPlacement != nil {
-				return physicalPlacement, virtualPlacement, ""
-			}
-		}
+// trackWaitingAffinityGroup records a new affinity group that has to wait for resources,
+// and returns since when it has been waiting.
+func (h *HivedAlgorithm) trackWaitingAffinityGroup(s *api.PodSchedulingSpec, pod *core.Pod) time.Time {
+	waitingSince := pod.CreationTimestamp.Time
+	if waitingSince.IsZero() {
+		waitingSince = time.Now()
 	}
-	if typeSpecified && sr.priority >= minGuaranteedPriority && !vcHasType {
-		panic(internal.NewBadRequestError(fmt.Sprintf(
-			"[%v]: Pod requesting leaf cell type %v which VC %v does not have",
-			internal.Key(pod), leafCellType, sr.vc)))
+	if wg := h.waitingGroups[s.AffinityGroup.Name]; wg != nil && wg.waitingSince.Before(waitingSince) {
+		waitingSince = wg.waitingSince
 	}
-	return nil, nil, failedReason
+	h.waitingGroups[s.AffinityGroup.Name] = &waitingAffinityGroup{spec: s, waitingSince: waitingSince}
+	return waitingSince
 }
 
-// scheduleAffinityGroupForAnyLeafCellType schedules an affinity group in every possible leaf cell type
-// (when the user does not specify a leaf cell type).
-func (h *HivedAlgorithm) scheduleAffinityGroupForAnyLeafCellType(
-	sr schedulingRequest,
-	pod *core.Pod) (
-	groupPhysicalPlacement,
-	groupVirtualPlacement,
-	string) {
-
-	var failedReason string
-	for leafCellType := range h.cellChains {
-		klog.Infof("Searching leaf cell type %v", leafCellType)
-		typePhysicalPlacement, typeVirtualPlacement, typeFailedReason :=
-			h.scheduleAffinityGroupForLeafCellType(sr, leafCellType, pod, false)
-		if typePhysicalPlacement != nil {
-			return typePhysicalPlacement, typeVirtualPlacement, ""
+// isOldestAgedAffinityGroup checks if a waiting guaranteed affinity group has been waiting for longer than
+// the aging threshold of its VC, and is the oldest waiting one in the VC. Cells are reserved for at most
+// one aged group in a VC at a time.
+func (h *HivedAlgorithm) isOldestAgedAffinityGroup(s *api.PodSchedulingSpec, waitingSince time.Time) bool {
+	threshold := h.vcAgingThresholds[s.VirtualCluster]
+	if threshold == 0 || CellPriority(s.Priority) < minGuaranteedPriority || time.Since(waitingSince) < threshold {
+		return false
+	}
+	for name, wg := range h.waitingGroups {
+		if name == s.AffinityGroup.Name || wg.spec.VirtualCluster != s.VirtualCluster ||
+			CellPriority(wg.spec.Priority) < minGuaranteedPriority || h.affinityGroups[name] != nil {
+			continue
 		}
-		if typeFailedReason != "" {
-			failedReason = typeFailedReason
+		if wg.waitingSince.Before(waitingSince) || (wg.waitingSince.Equal(waitingSince) && name < s.AffinityGroup.Name) {
+			return false
 		}
 	}
-	return nil, nil, failedReason
+	for _, g := range h.affinityGroups {
+		if g.vc == s.VirtualCluster && g.reservedForAging {
+			return false
+		}
+	}
+	return true
 }
 
-// validateSchedulingRequest checks the existence of VC and pinned cell, and the legality of priority.
-func (h *HivedAlgorithm) validateSchedulingRequest(sr schedulingRequest, pod *core.Pod) {
-	var message string
-	if h.vcSchedulers[sr.vc] == nil {
-		message = fmt.Sprintf("VC %v does not exists!", sr.vc)
-	} else if sr.pinnedCellId != "" {
-		if h.vcSchedulers[sr.vc].getPinnedCells()[sr.pinnedCellId] == nil {
-			message = fmt.Sprintf("VC %v does not have pinned cell %v", sr.vc, sr.pinnedCellId)
+// reserveForAgedAffinityGroup schedules an aged affinity group one priority above its own, i.e., it can also
+// be placed on the cells used by the groups with the same priority. Instead of preempting those groups, it reserves
+// the cells of the placement (as a preempting group does) and waits for them to complete, so that the later groups
+// with non-higher priorities cannot take the cells. The groups with lower priorities are still preempted.
+func (h *HivedAlgorithm) reserveForAgedAffinityGroup(
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set,
+	phase internal.SchedulingPhase,
+	waitReason string,
+	pod *core.Pod) (
+	groupPhysicalPlacement groupPhysicalPlacement,
+	groupVirtualPlacement groupVirtualPlacement,
+	preemptionVictims map[string]common.Set,
+	reservedWaitReason string) {
+
+	klog.Infof("[%v]: Affinity group %v has been waiting for longer than %v, trying to reserve cells for it",
+		internal.Key(pod), s.AffinityGroup.Name, h.vcAgingThresholds[s.VirtualCluster])
+	physicalPlacement, virtualPlacement, _, failedReason := h.scheduleNewAffinityGroup(
+		pod, s, suggestedNodes, common.NewSet(), true)
+	if physicalPlacement == nil {
+		klog.Infof("[%v]: Cannot reserve cells for affinity group %v: %v",
+			internal.Key(pod), s.AffinityGroup.Name, failedReason)
+		return nil, nil, nil, waitReason
+	}
+	victims, waitedGroups, overlappingPreemptors := collectAgingReservationVictims(
+		physicalPlacement, CellPriority(s.Priority))
+	if !overlappingPreemptors.IsEmpty() {
+		klog.Infof("[%v]: Cannot reserve cells for affinity group %v because they are reserved by other groups",
+			internal.Key(pod), s.AffinityGroup.Name)
+		return nil, nil, nil, waitReason
+	}
+	var allocatedWaitedGroups []*AlgoAffinityGroup
+	for name := range waitedGroups.Items() {
+		if g := h.affinityGroups[name.(string)]; g.state == groupAllocated {
+			allocatedWaitedGroups = append(allocatedWaitedGroups, g)
+		}
+	}
+	h.createPreemptingAffinityGroup(s, physicalPlacement, virtualPlacement, pod)
+	h.affinityGroups[s.AffinityGroup.Name].reservedForAging = true
+	for _, g := range allocatedWaitedGroups {
+		// the groups waited for are not preempted
+		g.state = groupAllocated
+	}
+	if len(victims) > 0 && phase == internal.PreemptingPhase {
+		return physicalPlacement, virtualPlacement, victims, ""
+	}
+	return nil, nil, nil, fmt.Sprintf(
+		"Cells are reserved for affinity group %v after waiting for too long, waiting for affinity groups %v "+
+			"using them to complete", s.AffinityGroup.Name, waitedGroups)
+}
+
+// backfillAffinityGroup places a new affinity group with a declared runtime on the free cells reserved for
+// an aged affinity group, if it is expected to complete before the aged group can start. The backfilled group
+// uses the cells without a virtual placement, and is preempted by the aged group once it overruns.
+func (h *HivedAlgorithm) backfillAffinityGroup(
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set,
+	pod *core.Pod) groupPhysicalPlacement {
+
+	if s.ExpectedRuntimeSeconds == 0 || s.LeafCellFraction != 0 || s.PinnedCellId != "" {
+		return nil
+	}
+	expectedEndTime := time.Now().Add(time.Duration(s.ExpectedRuntimeSeconds) * time.Second)
+	var agedGroupNames []string
+	for name, g := range h.affinityGroups {
+		if g.reservedForAging && g.state == groupPreempting {
+			agedGroupNames = append(agedGroupNames, name)
+		}
+	}
+	sort.Strings(agedGroupNames)
+	for _, name := range agedGroupNames {
+		g := h.affinityGroups[name]
+		startTime, ok := h.estimateAgedGroupStartTime(g)
+		if !ok || expectedEndTime.After(startTime) {
+			continue
+		}
+		if placement := h.findBackfillPlacement(g, s, suggestedNodes); placement != nil {
+			klog.Infof("[%v]: Backfilling affinity group %v into the cells reserved for affinity group %v, "+
+				"which is expected to start at %v", internal.Key(pod), s.AffinityGroup.Name, g.name,
+				startTime.Format(time.RFC3339))
+			return placement
+		}
+	}
+	return nil
+}
+
+// estimateAgedGroupStartTime estimates when an aged affinity group reserving cells can start, i.e., when the groups
+// it waits for are expected to complete and its preemption victims are deleted. It returns false if the time cannot
+// be estimated because a group waited for has no declared runtime.
+func (h *HivedAlgorithm) estimateAgedGroupStartTime(g *AlgoAffinityGroup) (time.Time, bool) {
+	victims, waitedGroups, _ := collectAgingReservationVictims(g.physicalLeafCellPlacement, CellPriority(g.priority))
+	startTime := time.Now()
+	for name := range waitedGroups.Items() {
+		waitedGroup := h.affinityGroups[name.(string)]
+		if waitedGroup.expectedEndTime.IsZero() {
+			return startTime, false
+		}
+		if waitedGroup.expectedEndTime.After(startTime) {
+			startTime = waitedGroup.expectedEndTime
+		}
+	}
+	for _, pods := range victims {
+		for p := range pods.Items() {
+			vc := internal.ExtractPodSchedulingSpec(p.(*core.Pod)).VirtualCluster
+			if deadline := g.preemptionStartTime.Add(h.vcPreemptionGracePeriods[vc]); deadline.After(startTime) {
+				startTime = deadline
+			}
+		}
+	}
+	return startTime, true
+}
+
+// findBackfillPlacement finds a placement for a new affinity group among the free cells reserved for an aged
+// affinity group (nil if not found). The pods with more leaf cells are placed first, each on the node with
+// the fewest free reserved leaf cells that can hold it.
+func (h *HivedAlgorithm) findBackfillPlacement(
+	g *AlgoAffinityGroup,
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set) groupPhysicalPlacement {
+
+	podNums := map[int32]int32{}
+	for _, m := range s.AffinityGroup.Members {
+		if m.LeafCellType != "" && m.LeafCellType != s.LeafCellType {
+			// the members with different leaf cell types are not backfilled
+			return nil
+		}
+		podNums[m.LeafCellNumber] += m.PodNumber
+	}
+	memberLeafCellType := s.AffinityGroup.Members[0].LeafCellType
+	nodeLeafCells := map[string]CellList{}
+	for _, podPlacements := range g.physicalLeafCellPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, leafCell := range podPlacement {
+				pLeafCell := leafCell.(*PhysicalCell)
+				if pLeafCell.GetState() != cellReserved ||
+					(s.LeafCellType != "" && h.chainLeafCellTypes[pLeafCell.GetChain()] != s.LeafCellType) {
+					continue
+				}
+				nodes, _ := pLeafCell.GetPhysicalPlacement()
+				if s.IgnoreK8sSuggestedNodes || suggestedNodes.Contains(nodes[0]) {
+					nodeLeafCells[nodes[0]] = append(nodeLeafCells[nodes[0]], pLeafCell)
+				}
+			}
+		}
+	}
+	leafCellNums := common.Int32MapKeys(podNums)
+	common.SortInt32(leafCellNums)
+	placement := groupPhysicalPlacement{}
+	for i := len(leafCellNums) - 1; i >= 0; i-- {
+		leafCellNum := leafCellNums[i]
+		for podIndex := int32(0); podIndex < podNums[leafCellNum]; podIndex++ {
+			pickedNode := ""
+			for node, leafCells := range nodeLeafCells {
+				if n := len(leafCells); int32(n) >= leafCellNum && (pickedNode == "" ||
+					n < len(nodeLeafCells[pickedNode]) || (n == len(nodeLeafCells[pickedNode]) && node < pickedNode)) {
+					pickedNode = node
+				}
+			}
+			if pickedNode == "" {
+				return nil
+			}
+			leafCells := nodeLeafCells[pickedNode]
+			levelLeafCellNum := map[CellLevel]int32{}
+			for l, cells := range h.fullCellList[leafCells[0].GetChain()] {
+				if len(cells) > 0 {
+					levelLeafCellNum[l] = cells[0].GetTotalLeafCellNum()
+				}
+			}
+			var podLeafCells CellList
+			podLeafCells, nodeLeafCells[pickedNode] = findLeafCellsInNode(
+				ancestorNoHigherThanNode(leafCells[0]), leafCellNum, opportunisticPriority, leafCells, levelLeafCellNum)
+			member := memberKey{leafCellType: memberLeafCellType, leafCellNum: leafCellNum}
+			placement[member] = append(placement[member], podLeafCells)
+		}
+	}
+	return placement
+}
+
+// updateReservations chooses the cells of the reservations that begin to drain,
+// and releases the cells of those whose windows have ended.
+func (h *HivedAlgorithm) updateReservations(now time.Time) {
+	names := make([]string, 0, len(h.reservations))
+	for name := range h.reservations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := h.reservations[name]
+		if r.ended {
+			continue
+		}
+		if !now.Before(r.endTime) {
+			if r.holder != nil {
+				h.releaseReservedLeafCells(r.holder)
+				r.holder = nil
+			}
+			r.ended = true
+			klog.Infof("Reservation %v ended, its cells are released", name)
+		} else if r.holder == nil && !now.Before(r.drainTime) {
+			h.chooseReservedCells(r)
+		}
+	}
+}
+
+// chooseReservedCells chooses the cells of the reservation's cell type in its VC (preferring the least used ones),
+// and allocates them to a holder group with the highest guaranteed priority, so that no other group can be placed
+// on them. Instead of preempting the groups already using the cells, the holder waits for them to complete.
+// If the cells cannot be chosen now, we will retry when scheduling the next pod.
+func (h *HivedAlgorithm) chooseReservedCells(r *cellReservation) {
+	for _, chain := range sortedChains(h.vcSchedulers[r.vc].getNonPinnedFullCellList()) {
+		ccl := h.vcSchedulers[r.vc].getNonPinnedFullCellList()[chain]
+		for l := CellLevel(1); l <= CellLevel(len(ccl)); l++ {
+			if h.cellTypes[chain][l] != r.cellType {
+				continue
+			}
+			var candidates CellList
+			for _, c := range ccl[l] {
+				if isReservableVirtualCell(c) {
+					candidates = append(candidates, c)
+				}
+			}
+			if int32(len(candidates)) < r.cellNumber {
+				continue
+			}
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return getUsedLeafCellNum(candidates[i]) < getUsedLeafCellNum(candidates[j])
+			})
+			leafCellNum := candidates[0].GetTotalLeafCellNum()
+			member := memberKey{leafCellNum: leafCellNum}
+			virtualPlacement := groupVirtualPlacement{member: []CellList{}}
+			for _, c := range candidates[:r.cellNumber] {
+				virtualPlacement[member] = append(virtualPlacement[member], collectLeafCells(c))
+			}
+			bindings := map[api.CellAddress]*PhysicalCell{}
+			preassignedCells, nonPreassignedCells := virtualPlacement.toBindingPaths([]memberKey{member}, bindings)
+			freeCellNumCopy := map[CellLevel]int32{}
+			for k, v := range h.allVCFreeCellNum[chain] {
+				freeCellNumCopy[k] = v
+			}
+			if ok, _ := mapVirtualPlacementToPhysical(
+				preassignedCells,
+				nonPreassignedCells,
+				virtualPlacement.colocatedPreassignedCells(),
+				h.freeCellList[chain].shallowCopy(),
+				freeCellNumCopy,
+				common.NewSet(),
+				true,
+				bindings); !ok {
+				klog.Infof("Cannot map the cells chosen for reservation %v in chain %v to the physical cluster",
+					r.name, chain)
+				continue
+			}
+			r.holder = newAlgoAffinityGroup(
+				&api.AffinityGroupSpec{
+					Name:    fmt.Sprintf("reservation/%v", r.name),
+					Members: []api.AffinityGroupMemberSpec{{PodNumber: r.cellNumber, LeafCellNumber: leafCellNum}},
+				},
+				r.vc, false, false, int32(maxGuaranteedPriority), 0, groupPreempting)
+			r.holder.physicalLeafCellPlacement = virtualPlacement.toPhysicalPlacement(bindings, []memberKey{member})
+			r.holder.virtualLeafCellPlacement = virtualPlacement
+			r.holder.preemptionStartTime = time.Now()
+			// all the groups using the cells are waited for, even the opportunistic ones
+			_, waitedGroups, _ := collectAgingReservationVictims(r.holder.physicalLeafCellPlacement, opportunisticPriority)
+			var allocatedWaitedGroups []*AlgoAffinityGroup
+			for name := range waitedGroups.Items() {
+				if g := h.affinityGroups[name.(string)]; g.state == groupAllocated {
+					allocatedWaitedGroups = append(allocatedWaitedGroups, g)
+				}
+			}
+			h.reserveLeafCells(r.holder)
+			for _, g := range allocatedWaitedGroups {
+				// the groups using the cells are not preempted
+				g.state = groupAllocated
+			}
+			klog.Infof("Cells %v are reserved for reservation %v, waiting for affinity groups %v using them to complete",
+				r.holder.physicalLeafCellPlacement, r.name, waitedGroups)
+			return
+		}
+	}
+	klog.Infof("Cannot choose %v cells of cell type %v in VC %v for reservation %v, will retry later",
+		r.cellNumber, r.cellType, r.vc, r.name)
+}
+
+// scheduleInReservation schedules a new affinity group tagged with a reservation to the cells reserved
+// (and already free) during the window of the reservation. The cells are handed over from the holder of
+// the reservation to the group, which is created as a preempting group without victims.
+// If the group cannot be placed there, it is scheduled like an untagged group.
+func (h *HivedAlgorithm) scheduleInReservation(
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set,
+	pod *core.Pod) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement) {
+
+	r := h.reservations[s.Reservation]
+	if r == nil || r.vc != s.VirtualCluster {
+		panic(internal.NewBadRequestError(fmt.Sprintf("[%v]: VC %v does not have reservation %v",
+			internal.Key(pod), s.VirtualCluster, s.Reservation)))
+	}
+	if r.holder == nil || time.Now().Before(r.startTime) {
+		klog.Infof("[%v]: Reservation %v is not in its window, scheduling affinity group %v outside it",
+			internal.Key(pod), r.name, s.AffinityGroup.Name)
+		return nil, nil
+	}
+	// we only use the nodes whose reserved cells are free: the other nodes in the VC are excluded,
+	// and the physical nodes of the free reserved cells are the only suggested nodes
+	reservedNodes := common.NewSet()
+	reservedVirtualNodes := common.NewSet()
+	for member := range r.holder.physicalLeafCellPlacement {
+		for podIndex := range r.holder.physicalLeafCellPlacement[member] {
+			for leafCellIndex, leafCell := range r.holder.physicalLeafCellPlacement[member][podIndex] {
+				if leafCell == nil || leafCell.(*PhysicalCell).GetState() != cellReserved {
+					continue
+				}
+				nodes, _ := leafCell.(*PhysicalCell).GetPhysicalPlacement()
+				if s.IgnoreK8sSuggestedNodes || suggestedNodes.Contains(nodes[0]) {
+					reservedNodes.Add(nodes[0])
+					reservedVirtualNodes.Add(ancestorNoHigherThanNode(
+						r.holder.virtualLeafCellPlacement[member][podIndex][leafCellIndex]))
+				}
+			}
+		}
+	}
+	if reservedNodes.IsEmpty() {
+		klog.Infof("[%v]: No free cell is left in reservation %v, scheduling affinity group %v outside it",
+			internal.Key(pod), r.name, s.AffinityGroup.Name)
+		return nil, nil
+	}
+	// the group is scheduled one priority above the holder so that it can be placed on the reserved cells
+	reservedSpec := *s
+	reservedSpec.Priority = int32(maxGuaranteedPriority)
+	reservedSpec.IgnoreK8sSuggestedNodes = false
+	excludedNodes := common.NewSet()
+	for _, ccl := range h.vcSchedulers[r.vc].getNonPinnedFullCellList() {
+		for _, c := range ccl[lowestLevel] {
+			if n := ancestorNoHigherThanNode(c); !reservedVirtualNodes.Contains(n) {
+				excludedNodes.Add(n)
+			}
+		}
+	}
+	physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason := h.scheduleNewAffinityGroup(
+		pod, &reservedSpec, reservedNodes, excludedNodes, true)
+	if physicalPlacement == nil {
+		klog.Infof("[%v]: Cannot place affinity group %v in reservation %v: %v",
+			internal.Key(pod), s.AffinityGroup.Name, r.name, failedReason)
+		return nil, nil
+	}
+	for _, podPlacements := range physicalPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, leafCell := range podPlacement {
+				if pLeafCell := leafCell.(*PhysicalCell); pLeafCell.GetState() != cellReserved ||
+					pLeafCell.GetReservingOrReservedGroup() != r.holder {
+					klog.Infof("[%v]: Placement of affinity group %v is not fully within the free cells of "+
+						"reservation %v", internal.Key(pod), s.AffinityGroup.Name, r.name)
+					for groupName, placement := range lazyPreemptedGroups {
+						h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+					}
+					return nil, nil
+				}
+			}
+		}
+	}
+	for member := range r.holder.physicalLeafCellPlacement {
+		for podIndex := range r.holder.physicalLeafCellPlacement[member] {
+			for leafCellIndex, leafCell := range r.holder.physicalLeafCellPlacement[member][podIndex] {
+				if leafCell == nil || !isInPlacement(physicalPlacement, leafCell) {
+					continue
+				}
+				pLeafCell := leafCell.(*PhysicalCell)
+				pLeafCell.DeleteReservingOrReservedGroup(r.holder)
+				h.releaseLeafCell(pLeafCell, r.vc)
+				setCellState(pLeafCell, cellFree)
+				r.holder.physicalLeafCellPlacement[member][podIndex][leafCellIndex] = nil
+				r.holder.virtualLeafCellPlacement[member][podIndex][leafCellIndex] = nil
+			}
+		}
+	}
+	klog.Infof("[%v]: Cells of reservation %v are handed over to affinity group %v",
+		internal.Key(pod), r.name, s.AffinityGroup.Name)
+	h.createPreemptingAffinityGroup(s, physicalPlacement, virtualPlacement, pod)
+	return physicalPlacement, virtualPlacement
+}
+
+// findSharedLeafCell finds a leaf cell for a fractional pod among those used by the fractional pods of the same VC
+// (at any priority), which still has enough free fraction. We prefer the most used one to leave more whole leaf cells.
+// If no such leaf cell is found, the pod will be scheduled to a whole leaf cell, which will be shared later.
+// Hence the VC quota taken by the fractional pods is counted in fractions: a leaf cell is taken from the quota only
+// when the free fractions of the VC's shared leaf cells cannot fit a new pod.
+func (h *HivedAlgorithm) findSharedLeafCell(
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set) (groupPhysicalPlacement, groupVirtualPlacement) {
+
+	fraction := toLeafCellFraction(s.LeafCellFraction)
+	guaranteed := CellPriority(s.Priority) >= minGuaranteedPriority
+	var sharedCell *PhysicalCell
+	for _, g := range h.affinityGroups {
+		if g.state != groupAllocated || g.leafCellFraction == leafCellFractionScale || g.vc != s.VirtualCluster ||
+			(g.virtualLeafCellPlacement != nil) != guaranteed {
+			continue
+		}
+		var leafCell Cell
+		for _, podPlacements := range g.physicalLeafCellPlacement {
+			// a fractional group has a single pod with a single leaf cell
+			leafCell = podPlacements[0][0]
+		}
+		if leafCell == nil {
+			continue
+		}
+		pLeafCell := leafCell.(*PhysicalCell)
+		nodes, _ := pLeafCell.GetPhysicalPlacement()
+		typeMatched := s.LeafCellType == ""
+		for _, chain := range h.cellChains[s.LeafCellType] {
+			typeMatched = typeMatched || chain == pLeafCell.GetChain()
+		}
+		if !typeMatched || pLeafCell.GetState() != cellUsed || !pLeafCell.IsHealthy() ||
+			(!s.IgnoreK8sSuggestedNodes && !suggestedNodes.Contains(nodes[0])) ||
+			pLeafCell.GetUsedFraction()+fraction > leafCellFractionScale {
+			continue
+		}
+		if sharedCell == nil || pLeafCell.GetUsedFraction() > sharedCell.GetUsedFraction() ||
+			(pLeafCell.GetUsedFraction() == sharedCell.GetUsedFraction() &&
+				pLeafCell.GetAddress() < sharedCell.GetAddress()) {
+			sharedCell = pLeafCell
+		}
+	}
+	if sharedCell == nil {
+		return nil, nil
+	}
+	klog.Infof("Sharing leaf cell %v (%v used) with fraction %v",
+		sharedCell.GetAddress(), float64(sharedCell.GetUsedFraction())/leafCellFractionScale, s.LeafCellFraction)
+	member := getPodMemberKey(s)
+	physicalPlacement := groupPhysicalPlacement{member: {{sharedCell}}}
+	if !guaranteed {
+		return physicalPlacement, nil
+	}
+	return physicalPlacement, groupVirtualPlacement{member: {{sharedCell.GetVirtualCell()}}}
+}
+
+// scheduleNewAffinityGroup schedules each pod of a new affinity group to a set of leaf cells
+// (in both the physical cluster and the VC). This is the entrance of a new scheduling attempt.
+func (h *HivedAlgorithm) scheduleNewAffinityGroup(
+	pod *core.Pod,
+	s *api.PodSchedulingSpec,
+	suggestedNodes common.Set,
+	excludedNodes common.Set,
+	aged bool) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
+	failedReason string) {
+
+	klog.Infof("[%v]: Scheduling new affinity group %v", internal.Key(pod), s.AffinityGroup.Name)
+	priority := CellPriority(s.Priority)
+	if aged {
+		priority++
+	}
+	sr := schedulingRequest{
+		vc:                   s.VirtualCluster,
+		pinnedCellId:         s.PinnedCellId,
+		priority:             priority,
+		affinityGroupName:    s.AffinityGroup.Name,
+		affinityGroupPodNums: map[int32]int32{},
+		suggestedNodes:       suggestedNodes,
+		ignoreSuggestedNodes: s.IgnoreK8sSuggestedNodes,
+		crossChainEnable:     s.CrossChainEnable,
+		aged:                 aged,
+		excludedNodes:        excludedNodes,
+	}
+	memberLeafCellTypes := map[string]map[int32]int32{} // leaf cell type -> leaf cell number -> pod number
+	for _, m := range s.AffinityGroup.Members {
+		// we will merge group members with same leaf cell number (and same leaf cell type)
+		sr.affinityGroupPodNums[m.LeafCellNumber] += m.PodNumber
+		if m.LeafCellType != "" {
+			if memberLeafCellTypes[m.LeafCellType] == nil {
+				memberLeafCellTypes[m.LeafCellType] = map[int32]int32{}
+			}
+			memberLeafCellTypes[m.LeafCellType][m.LeafCellNumber] += m.PodNumber
+			sr.memberLeafCellType = m.LeafCellType
+		}
+	}
+	h.validateSchedulingRequest(sr, pod)
+	if sr.pinnedCellId != "" {
+		if len(memberLeafCellTypes) > 1 {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"[%v]: Pod requesting pinned cell %v for members of different leaf cell types",
+				internal.Key(pod), sr.pinnedCellId)))
+		}
+		klog.Infof("Using pinned cell %v", s.PinnedCellId)
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason = h.handleSchedulingRequest(sr)
+	} else if len(memberLeafCellTypes) > 1 {
+		klog.Infof("Using leaf cell types specified by the members: %v", common.ToJson(memberLeafCellTypes))
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason =
+			h.scheduleAffinityGroupForMemberLeafCellTypes(sr, memberLeafCellTypes, pod)
+	} else if s.LeafCellType != "" {
+		if _, ok := h.cellChains[s.LeafCellType]; !ok {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"[%v]: Pod requesting leaf cell type %v which the whole cluster does not have",
+				internal.Key(pod), s.LeafCellType)))
+		}
+		klog.Infof("Using specified leaf cell type %v", s.LeafCellType)
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason = h.scheduleAffinityGroupForLeafCellType(
+			sr, s.LeafCellType, pod, true)
+	} else {
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason =
+			h.scheduleAffinityGroupForAnyLeafCellType(sr, pod)
+	}
+	return physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason
+}
+
+// scheduleAffinityGroupForMemberLeafCellTypes schedules the members of an affinity group each in the
+// chains of its own leaf cell type. The members are placed atomically: if any of them cannot be placed,
+// the lazy preemptions made for the others are reverted and the whole group fails.
+func (h *HivedAlgorithm) scheduleAffinityGroupForMemberLeafCellTypes(
+	sr schedulingRequest,
+	memberLeafCellTypes map[string]map[int32]int32,
+	pod *core.Pod) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
+	failedReason string) {
+
+	var leafCellTypes []string
+	for leafCellType := range memberLeafCellTypes {
+		// check all the types before scheduling any member, so that a bad request does not leave lazy preemptions
+		if _, ok := h.cellChains[leafCellType]; !ok {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"[%v]: Pod requesting leaf cell type %v which the whole cluster does not have",
+				internal.Key(pod), leafCellType)))
+		}
+		vcHasType := sr.priority < minGuaranteedPriority
+		for _, chain := range h.cellChains[leafCellType] {
+			vcHasType = vcHasType || h.vcSchedulers[sr.vc].getNonPinnedPreassignedCells()[chain] != nil
+		}
+		if !vcHasType {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"[%v]: Pod requesting leaf cell type %v which VC %v does not have",
+				internal.Key(pod), leafCellType, sr.vc)))
+		}
+		leafCellTypes = append(leafCellTypes, leafCellType)
+	}
+	sort.Strings(leafCellTypes)
+	physicalPlacement = groupPhysicalPlacement{}
+	virtualPlacement = groupVirtualPlacement{}
+	lazyPreemptedGroups = map[string]groupVirtualPlacement{}
+	for _, leafCellType := range leafCellTypes {
+		klog.Infof("Searching leaf cell type %v for leaf cell numbers %v",
+			leafCellType, common.ToJson(memberLeafCellTypes[leafCellType]))
+		typeSr := sr
+		typeSr.affinityGroupPodNums = memberLeafCellTypes[leafCellType]
+		typeSr.memberLeafCellType = leafCellType
+		typePhysical, typeVirtual, typeLazyPreempted, typeFailedReason :=
+			h.scheduleAffinityGroupForLeafCellType(typeSr, leafCellType, pod, true)
+		if typePhysical == nil {
+			for groupName, placement := range lazyPreemptedGroups {
+				h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+			}
+			return nil, nil, nil, fmt.Sprintf(
+				"Cannot place the members of leaf cell type %v: %v", leafCellType, typeFailedReason)
+		}
+		for member, podPlacements := range typePhysical {
+			physicalPlacement[member] = podPlacements
+		}
+		for member, podPlacements := range typeVirtual {
+			virtualPlacement[member] = podPlacements
+		}
+		for groupName, placement := range typeLazyPreempted {
+			lazyPreemptedGroups[groupName] = placement
+		}
+	}
+	if sr.priority < minGuaranteedPriority {
+		virtualPlacement = nil
+	}
+	return physicalPlacement, virtualPlacement, lazyPreemptedGroups, ""
+}
+
+// scheduleAffinityGroupForLeafCellType schedules an affinity group in a certain cell chain
+// that matches the given leaf cell type. If the group cannot fit into any single chain and it is
+// allowed to cross chains, we will try to place it across the chains of this leaf cell type.
+// It also returns the groups lazy preempted for the placement, so that the caller can revert them.
+func (h *HivedAlgorithm) scheduleAffinityGroupForLeafCellType(
+	sr schedulingRequest,
+	leafCellType string,
+	pod *core.Pod,
+	typeSpecified bool) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
+	failedReason string) {
+
+	vcHasType := false
+	for _, chain := range h.cellChains[leafCellType] {
+		if sr.priority < minGuaranteedPriority ||
+			h.vcSchedulers[sr.vc].getNonPinnedPreassignedCells()[chain] != nil {
+			vcHasType = true
+			klog.Infof("Searching chain %v", chain)
+			sr.chain = chain
+			physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason =
+				h.handleSchedulingRequest(sr)
+			if physicalPlacement != nil {
+				return physicalPlacement, virtualPlacement, lazyPreemptedGroups, ""
+			}
+		}
+	}
+	if typeSpecified && sr.priority >= minGuaranteedPriority && !vcHasType {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"[%v]: Pod requesting leaf cell type %v which VC %v does not have",
+			internal.Key(pod), leafCellType, sr.vc)))
+	}
+	if sr.crossChainEnable && vcHasType && len(h.cellChains[leafCellType]) > 1 {
+		klog.Infof("Searching across chains %v", h.cellChains[leafCellType])
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason =
+			h.scheduleAffinityGroupAcrossChains(sr, h.cellChains[leafCellType])
+		if physicalPlacement != nil {
+			return physicalPlacement, virtualPlacement, lazyPreemptedGroups, ""
+		}
+	}
+	return nil, nil, nil, failedReason
+}
+
+// scheduleAffinityGroupAcrossChains splits an affinity group into several parts and schedules each part
+// in a different cell chain. Each pod is still placed within a single chain. We place the pods with
+// more leaf cells first, and let each chain take as many of the remaining pods as it can hold.
+func (h *HivedAlgorithm) scheduleAffinityGroupAcrossChains(
+	sr schedulingRequest,
+	chains []CellChain) (
+	physicalPlacement groupPhysicalPlacement,
+	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
+	failedReason string) {
+
+	var podLeafCellNums []int32 // leaf cell numbers of the pods to place, in descending order
+	for leafCellNum, podNum := range sr.affinityGroupPodNums {
+		for i := int32(0); i < podNum; i++ {
+			podLeafCellNums = append(podLeafCellNums, leafCellNum)
+		}
+	}
+	sort.SliceStable(podLeafCellNums, func(i, j int) bool {
+		return podLeafCellNums[i] > podLeafCellNums[j]
+	})
+	physicalPlacement = groupPhysicalPlacement{}
+	virtualPlacement = groupVirtualPlacement{}
+	lazyPreemptedGroups = map[string]groupVirtualPlacement{}
+	for _, chain := range chains {
+		if len(podLeafCellNums) == 0 {
+			break
+		}
+		if sr.priority >= minGuaranteedPriority &&
+			h.vcSchedulers[sr.vc].getNonPinnedPreassignedCells()[chain] == nil {
+			continue
+		}
+		for n := len(podLeafCellNums); n > 0; n-- {
+			partSr := sr
+			partSr.chain = chain
+			partSr.affinityGroupPodNums = map[int32]int32{}
+			for _, leafCellNum := range podLeafCellNums[:n] {
+				partSr.affinityGroupPodNums[leafCellNum]++
+			}
+			partPhysical, partVirtual, partLazyPreempted, _ := h.handleSchedulingRequest(partSr)
+			if partPhysical == nil {
+				continue
+			}
+			for member, podPlacements := range partPhysical {
+				physicalPlacement[member] = append(physicalPlacement[member], podPlacements...)
+			}
+			for member, podPlacements := range partVirtual {
+				virtualPlacement[member] = append(virtualPlacement[member], podPlacements...)
+			}
+			for groupName, placement := range partLazyPreempted {
+				lazyPreemptedGroups[groupName] = placement
+			}
+			podLeafCellNums = podLeafCellNums[n:]
+			break
+		}
+	}
+	if len(podLeafCellNums) != 0 {
+		for groupName, placement := range lazyPreemptedGroups {
+			h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+		}
+		return nil, nil, nil, fmt.Sprintf(
+			"Cannot place %v of the pods (leaf cell numbers %v) across chains %v",
+			len(podLeafCellNums), common.ToJson(podLeafCellNums), chains)
+	}
+	if sr.priority < minGuaranteedPriority {
+		virtualPlacement = nil
+	}
+	return physicalPlacement, virtualPlacement, lazyPreemptedGroups, ""
+}
+
+// scheduleAffinityGroupForAnyLeafCellType schedules an affinity group in every possible leaf cell type
+// (when the user does not specify a leaf cell type).
+func (h *HivedAlgorithm) scheduleAffinityGroupForAnyLeafCellType(
+	sr schedulingRequest,
+	pod *core.Pod) (
+	groupPhysicalPlacement,
+	groupVirtualPlacement,
+	map[string]groupVirtualPlacement,
+	string) {
+
+	var failedReason string
+	for leafCellType := range h.cellChains {
+		klog.Infof("Searching leaf cell type %v", leafCellType)
+		typePhysicalPlacement, typeVirtualPlacement, typeLazyPreempted, typeFailedReason :=
+			h.scheduleAffinityGroupForLeafCellType(sr, leafCellType, pod, false)
+		if typePhysicalPlacement != nil {
+			return typePhysicalPlacement, typeVirtualPlacement, typeLazyPreempted, ""
+		}
+		if typeFailedReason != "" {
+			failedReason = typeFailedReason
+		}
+	}
+	return nil, nil, nil, failedReason
+}
+
+// validateSchedulingRequest checks the existence of VC and pinned cell, and the legality of priority.
+func (h *HivedAlgorithm) validateSchedulingRequest(sr schedulingRequest, pod *core.Pod) {
+	var message string
+	if h.vcSchedulers[sr.vc] == nil {
+		message = fmt.Sprintf("VC %v does not exists!", sr.vc)
+	} else if sr.pinnedCellId != "" {
+		if h.vcSchedulers[sr.vc].getPinnedCells()[sr.pinnedCellId] == nil {
+			message = fmt.Sprintf("VC %v does not have pinned cell %v", sr.vc, sr.pinnedCellId)
 		} else if sr.priority == opportunisticPriority {
 			message = fmt.Sprintf("opportunistic pod not supported to use pinned cell %v", sr.pinnedCellId)
 		}
@@ -874,6 +2110,7 @@ func (h *HivedAlgorithm) handleSchedulingRequest(
 	sr schedulingRequest) (
 	physicalPlacement groupPhysicalPlacement,
 	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
 	failedReason string) {
 
 	str := fmt.Sprintf("chain %v", sr.chain)
@@ -883,77 +2120,107 @@ func (h *HivedAlgorithm) handleSchedulingRequest(
 	klog.Infof("Processing scheduling request: %v, leaf cell numbers %v, priority %v",
 		str, common.ToJson(sr.affinityGroupPodNums), sr.priority)
 	if sr.priority >= minGuaranteedPriority {
-		physicalPlacement, virtualPlacement, failedReason = h.scheduleGuaranteedAffinityGroup(sr)
+		physicalPlacement, virtualPlacement, lazyPreemptedGroups, failedReason = h.scheduleGuaranteedAffinityGroup(sr)
 	} else {
 		physicalPlacement, failedReason = h.scheduleOpportunisticAffinityGroup(sr)
 	}
 	if physicalPlacement == nil {
 		klog.Infof("Cannot find placement in %v: %v", str, failedReason)
-		return nil, nil, failedReason
+		return nil, nil, nil, failedReason
 	}
 	klog.Infof("Found placement in %v: %v", str, physicalPlacement)
-	return physicalPlacement, virtualPlacement, ""
+	return physicalPlacement, virtualPlacement, lazyPreemptedGroups, ""
 }
 
 // scheduleGuaranteedAffinityGroup schedules an affinity group in its VC,
 // and then maps the placement in VC to the physical cluster.
+// It also returns the groups lazy preempted for this placement, so that the caller can revert them.
 func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 	sr schedulingRequest) (
 	physicalPlacement groupPhysicalPlacement,
 	virtualPlacement groupVirtualPlacement,
+	lazyPreemptedGroups map[string]groupVirtualPlacement,
 	failedReason string) {
 
-	// schedule in VC
-	virtualPlacement, failedReason = h.vcSchedulers[sr.vc].schedule(sr)
-	if virtualPlacement == nil {
-		return nil, nil, failedReason
+	for attempt := int32(1); ; attempt++ {
+		// schedule in VC
+		virtualPlacement, failedReason = h.vcSchedulers[sr.vc].schedule(sr)
+		if virtualPlacement == nil {
+			return nil, nil, nil, failedReason
+		}
+		members := sortedMemberKeys(virtualPlacement)
+		// map the vc placement to the physical cluster
+		bindings := map[api.CellAddress]*PhysicalCell{}
+		lazyPreemptionPriority := sr.priority
+		if sr.aged {
+			// an aged group does not lazy preempt the groups with its own priority
+			lazyPreemptionPriority--
+		}
+		lazyPreemptedGroups = h.tryLazyPreempt(
+			virtualPlacement, members, sr.affinityGroupName, lazyPreemptionPriority)
+		preassignedCells, nonPreassignedCells := virtualPlacement.toBindingPaths(members, bindings)
+		// make a copy of freeCellNum, may change its values during allocation
+		freeCellNumCopy := map[CellLevel]int32{}
+		for k, v := range h.allVCFreeCellNum[sr.chain] {
+			freeCellNumCopy[k] = v
+		}
+		ok, failedPreassignedCell := mapVirtualPlacementToPhysical(
+			preassignedCells,
+			nonPreassignedCells,
+			virtualPlacement.colocatedPreassignedCells(),
+			h.freeCellList[sr.chain].shallowCopy(),
+			freeCellNumCopy,
+			sr.suggestedNodes,
+			sr.ignoreSuggestedNodes,
+			bindings)
+		if ok {
+			return virtualPlacement.toPhysicalPlacement(bindings, members), virtualPlacement, lazyPreemptedGroups, ""
+		}
+		for groupName, placement := range lazyPreemptedGroups {
+			h.revertLazyPreempt(h.affinityGroups[groupName], placement)
+		}
+		failedNodeType := "bad or non-suggested"
+		if sr.ignoreSuggestedNodes {
+			failedNodeType = "bad"
+		}
+		failedReason = fmt.Sprintf(
+			"Mapping the virtual placement would need to use at least one %v node "+
+				"(virtual placement : %v)", failedNodeType, virtualPlacement)
+		if attempt >= h.maxIntraVCSchedulingAttempts {
+			return nil, nil, nil, failedReason
+		}
+		// retry with the nodes in the preassigned cell that failed to be mapped excluded
+		// (on a copy of the excluded nodes, so that the set passed in by the caller is not changed)
+		excludedNodes := common.NewSet()
+		for n := range sr.excludedNodes.Items() {
+			excludedNodes.Add(n)
+		}
+		failedNodes := virtualPlacement.nodesInPreassignedCell(failedPreassignedCell)
+		for _, n := range failedNodes {
+			excludedNodes.Add(n)
+		}
+		sr.excludedNodes = excludedNodes
+		sr.retry = attempt
+		klog.Infof("%v. Retrying intra-VC scheduling (attempt %v of %v) with nodes %v excluded",
+			failedReason, attempt+1, h.maxIntraVCSchedulingAttempts, failedNodes)
 	}
-	// map the vc placement to the physical cluster
-	bindings := map[api.CellAddress]*PhysicalCell{}
-	leafCellNums := common.Int32MapKeys(sr.affinityGroupPodNums)
-	common.SortInt32(leafCellNums)
-	lazyPreemptedGroups := h.tryLazyPreempt(virtualPlacement, leafCellNums, sr.affinityGroupName)
-	preassignedCells, nonPreassignedCells := virtualPlacement.toBindingPaths(leafCellNums, bindings)
-	// make a copy of freeCellNum, may change its values during allocation
-	freeCellNumCopy := map[CellLevel]int32{}
-	for k, v := range h.allVCFreeCellNum[sr.chain] {
-		freeCellNumCopy[k] = v
-	}
-	if ok := mapVirtualPlacementToPhysical(
-		preassignedCells,
-		nonPreassignedCells,
-		h.freeCellList[sr.chain].shallowCopy(),
-		freeCellNumCopy,
-		sr.suggestedNodes,
-		sr.ignoreSuggestedNodes,
-		bindings); ok {
-		return virtualPlacement.toPhysicalPlacement(bindings, leafCellNums), virtualPlacement, ""
-	}
-	for groupName, placement := range lazyPreemptedGroups {
-		h.revertLazyPreempt(h.affinityGroups[groupName], placement)
-	}
-	failedNodeType := "bad or non-suggested"
-	if sr.ignoreSuggestedNodes {
-		failedNodeType = "bad"
-	}
-	return nil, nil, fmt.Sprintf(
-		"Mapping the virtual placement would need to use at least one %v node "+
-			"(virtual placement : %v)", failedNodeType, virtualPlacement)
-}
-
-// tryLazyPreempt tries to lazy preempt the affinity groups found on a placement.
+}
+
+// tryLazyPreempt tries to lazy preempt the affinity groups with priorities lower than the given priority found on a placement.
 func (h *HivedAlgorithm) tryLazyPreempt(
 	p groupVirtualPlacement,
-	leafCellNums []int32,
-	groupName string) map[string]groupVirtualPlacement {
+	members []memberKey,
+	groupName string,
+	priority CellPriority) map[string]groupVirtualPlacement {
 
 	preemptedGroups := map[string]groupVirtualPlacement{}
-	for _, podLeafCellNum := range leafCellNums {
-		podPlacements := p[podLeafCellNum]
+	for _, member := range members {
+		podPlacements := p[member]
 		for _, pod := range podPlacements {
 			for _, leafCell := range pod {
 				if pLeafCell := leafCell.(*VirtualCell).GetPhysicalCell(); pLeafCell != nil {
-					if pLeafCell.GetState() == cellUsed && pLeafCell.GetUsingGroup().lazyPreemptionEnable {
+					if g := pLeafCell.GetUsingGroup(); pLeafCell.GetState() == cellUsed && g.lazyPreemptionEnable &&
+						CellPriority(g.priority) < priority {
 						preemptedGroups[pLeafCell.GetUsingGroup().name] = h.lazyPreemptAffinityGroup(
 							pLeafCell.GetUsingGroup(), groupName)
 					}
@@ -970,67 +2237,64 @@ func (h *HivedAlgorithm) scheduleOpportunisticAffinityGroup(
 	placement groupPhysicalPlacement,
 	failedReason string) {
 
-	placement, failedReason = h.opportunisticSchedulers[sr.chain].Schedule(
-		sr.affinityGroupPodNums, opportunisticPriority, sr.suggestedNodes, sr.ignoreSuggestedNodes)
-	if placement == nil {
+	leafCellType := h.chainLeafCellTypes[sr.chain]
+	usedNum, requestedNum := h.vcOpportunisticLeafCellNum[sr.vc][leafCellType], int32(0)
+	for leafCellNum, podNum := range sr.affinityGroupPodNums {
+		requestedNum += leafCellNum * podNum
+	}
+	if maxNum, ok := h.vcMaxOpportunisticLeafCellNum[sr.vc][leafCellType]; ok && usedNum+requestedNum > maxNum {
+		return nil, fmt.Sprintf(
+			"VC %v has used %v opportunistic leaf cells of type %v, requesting %v more exceeds "+
+				"its maxOpportunisticLeafCells %v", sr.vc, usedNum, leafCellType, requestedNum, maxNum)
+	}
+	if h.idleCellSharingPolicy == api.IdleCellSharingWeightedFairShare {
+		if fairShare := h.getFairShareLeafCellNum(sr.vc, leafCellType); usedNum+requestedNum > fairShare {
+			if vcn := h.findVCFurtherBelowFairShare(sr.vc, leafCellType); vcn != "" {
+				return nil, fmt.Sprintf(
+					"VC %v has used %v opportunistic leaf cells of type %v, requesting %v more exceeds its fair share %v, "+
+						"while VC %v has waiting opportunistic affinity groups and is further below its fair share",
+					sr.vc, usedNum, leafCellType, requestedNum, fairShare, vcn)
+			}
+		}
+	}
+	podPlacements, podAffinities, failedReason := h.opportunisticSchedulers[sr.chain].Schedule(
+		sr.affinityGroupPodNums, opportunisticPriority, sr.suggestedNodes, sr.ignoreSuggestedNodes, common.NewSet(), 0)
+	if podPlacements == nil {
 		return nil, fmt.Sprintf("%v when scheduling in physical cluster", failedReason)
 	}
-	return placement, ""
+	klog.Infof("Found placement in physical cluster: affinity levels %v", common.ToJson(podAffinities))
+	return newMemberPlacement(sr.memberLeafCellType, podPlacements), ""
 }
 
 // createAllocatedAffinityGroup creates a new affinity group and allocate the resources.
 func (h *HivedAlgorithm) createAllocatedAffinityGroup(s *api.PodSchedulingSpec, info *api.PodBindInfo, pod *core.Pod) {
 	klog.Infof("[%v]: Creating new allocated affinity group: %v", internal.Key(pod), s.AffinityGroup.Name)
 	newGroup := newAlgoAffinityGroup(
-		s.AffinityGroup, s.VirtualCluster, s.LazyPreemptionEnable, s.Priority, groupAllocated)
+		s.AffinityGroup, s.VirtualCluster, s.LazyPreemptionEnable, s.GangReleaseEnable, s.Priority,
+		s.LeafCellFraction, groupAllocated)
+	if h.placedAffinityGroups.Contains(s.AffinityGroup.Name) && !s.GangReleaseEnable {
+		// a recovered group may have lost the records of its completed pods, hence is not timed out,
+		// and neither is a group releasing its completed pods
+		newGroup.incompleteSince = time.Now()
+	}
+	h.placedAffinityGroups.Delete(s.AffinityGroup.Name)
+	if s.ExpectedRuntimeSeconds > 0 {
+		startTime := time.Now()
+		if pod.Status.StartTime != nil {
+			startTime = pod.Status.StartTime.Time
+		}
+		newGroup.expectedEndTime = startTime.Add(time.Duration(s.ExpectedRuntimeSeconds) * time.Second)
+	}
 	shouldLazyPreempt := false
 	for _, gms := range info.AffinityGroupBindInfo {
-		leafCellNumber := int32(len(gms.PodPlacements[0].PhysicalLeafCellIndices))
+		member := getBindInfoMemberKey(gms)
+		// an elastic group may have been extended beyond its minimum size
+		if podNum := int32(len(gms.PodPlacements)); podNum > newGroup.totalPodNums[member] {
+			newGroup.extend(member, podNum-newGroup.totalPodNums[member])
+		}
 		for podIndex := int32(0); podIndex < int32(len(gms.PodPlacements)); podIndex++ {
-			node := gms.PodPlacements[podIndex].PhysicalNode
-			for leafCellIndex := int32(0); leafCellIndex < int32(
-				len(gms.PodPlacements[podIndex].PhysicalLeafCellIndices)); leafCellIndex++ {
-				pLeafCell, vLeafCell, lazyPreempt := h.findAllocatedLeafCell(
-					leafCellIndex,
-					gms.PodPlacements[podIndex].PhysicalLeafCellIndices,
-					gms.PodPlacements[podIndex].PreassignedCellTypes,
-					CellChain(info.CellChain), node, shouldLazyPreempt, s, newGroup, pod)
-				if pLeafCell == nil {
-					// pLeafCell not being found means that this leaf cell address does not exist in the spec.
-					// we simply ignore this leaf cell, and let the job run normally
-					// (but we cannot ignore the other leaf cells of this pod that are still in the spec,
-					// otherwise it may cause resource conflicts)
-					continue
-				} else {
-					newGroup.physicalLeafCellPlacement[leafCellNumber][podIndex][leafCellIndex] = pLeafCell
-					if lazyPreempt == nil {
-						newGroup.virtualLeafCellPlacement = nil
-					} else if vLeafCell != nil {
-						newGroup.virtualLeafCellPlacement[leafCellNumber][podIndex][leafCellIndex] = vLeafCell
-						if inFreeCellList(pLeafCell) && vLeafCell.GetPreassignedCell().GetPriority() > freePriority {
-							// This means we decide to bind this cell to a virtual cell whose preassigned cell
-							// has been bound (in cases like reconfiguration and the VC's cells are fewer than before).
-							// We need to destroy the previous binding, by lazy preempting all the groups
-							// in the preassigned cell
-							h.lazyPreemptCell(vLeafCell.GetPreassignedCell(), newGroup.name)
-						}
-					} else {
-						shouldLazyPreempt = shouldLazyPreempt || *lazyPreempt
-					}
-					// Even if we have successfully found the vLeafCell and pLeafCell, there is still one possibility
-					// that we should not bind them: allocating the physical cell may lead to broken safety.
-					// Such case won't happen by design as buddy alloc guarantees safety; but this could
-					// happen due to inconsistency of VC assignments for reasons like reconfiguration.
-					// In this case, we will lazy preempt this affinity group.
-					safetyOk, reason := h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(s.Priority), newGroup.vc)
-					pLeafCell.AddUsingGroup(newGroup)
-					setCellState(pLeafCell, cellUsed)
-					if !safetyOk {
-						shouldLazyPreempt = true
-						klog.Warningf("[%v]: %v", internal.Key(pod), reason)
-					}
-				}
-			}
+			shouldLazyPreempt = h.allocatePodPlacement(newGroup, s, info, gms.PodPlacements[podIndex],
+				member, podIndex, shouldLazyPreempt, pod)
 		}
 	}
 	if shouldLazyPreempt {
@@ -1040,6 +2304,132 @@ func (h *HivedAlgorithm) createAllocatedAffinityGroup(s *api.PodSchedulingSpec,
 	klog.Infof("[%v]: New allocated affinity group created: %v", internal.Key(pod), s.AffinityGroup.Name)
 }
 
+// extendAllocatedAffinityGroup extends an allocated elastic affinity group to include a pod placed
+// beyond its current size, and allocates the resources of the pod (and of the pods placed before it
+// that have not been added yet) according to the pod's bind info.
+func (h *HivedAlgorithm) extendAllocatedAffinityGroup(
+	g *AlgoAffinityGroup,
+	s *api.PodSchedulingSpec,
+	info *api.PodBindInfo,
+	podIndex int32,
+	pod *core.Pod) bool {
+
+	member := getPodMemberKey(s)
+	var podPlacements []api.PodPlacementInfo
+	for _, gms := range info.AffinityGroupBindInfo {
+		if getBindInfoMemberKey(gms) == member {
+			podPlacements = gms.PodPlacements
+		}
+	}
+	// the pods whose leaf cells have been released are not counted
+	releasedPodNum := int32(0)
+	for _, placement := range podPlacements[:podIndex] {
+		if placement.ReleasedPod != "" {
+			releasedPodNum++
+		}
+	}
+	if podIndex-releasedPodNum >= g.maxPodNums[member] {
+		klog.Errorf("[%v]: Pod placement exceeds the maximum pod number %v in group %v",
+			internal.Key(pod), g.maxPodNums[member], g.name)
+		return false
+	}
+	klog.Infof("[%v]: Extending elastic affinity group %v to %v pods with %v leaf cells",
+		internal.Key(pod), g.name, podIndex+1, s.LeafCellNumber)
+	shouldLazyPreempt := false
+	for i := g.totalPodNums[member]; i <= podIndex; i++ {
+		g.extend(member, 1)
+		shouldLazyPreempt = h.allocatePodPlacement(
+			g, s, info, podPlacements[i], member, i, shouldLazyPreempt, pod)
+	}
+	if shouldLazyPreempt && g.virtualLeafCellPlacement != nil {
+		h.lazyPreemptAffinityGroup(g, g.name)
+	}
+	return true
+}
+
+// allocatePodPlacement allocates the leaf cells of a pod placement recorded in a bind info to an affinity group.
+// It returns whether the group should be lazy preempted.
+func (h *HivedAlgorithm) allocatePodPlacement(
+	g *AlgoAffinityGroup,
+	s *api.PodSchedulingSpec,
+	info *api.PodBindInfo,
+	placement api.PodPlacementInfo,
+	member memberKey,
+	podIndex int32,
+	shouldLazyPreempt bool,
+	pod *core.Pod) bool {
+
+	if placement.ReleasedPod != "" {
+		// the leaf cells of the completed pod have been released
+		g.releasedPods[member][podIndex] = placement.ReleasedPod
+		return shouldLazyPreempt
+	}
+	node := placement.PhysicalNode
+	// the pods of an affinity group placed across chains record their own chains
+	chain := CellChain(info.CellChain)
+	if placement.CellChain != "" {
+		chain = CellChain(placement.CellChain)
+	}
+	for leafCellIndex := int32(0); leafCellIndex < int32(len(placement.PhysicalLeafCellIndices)); leafCellIndex++ {
+		pLeafCell, vLeafCell, lazyPreempt := h.findAllocatedLeafCell(
+			leafCellIndex,
+			placement.PhysicalLeafCellIndices,
+			placement.PreassignedCellTypes,
+			chain, node, shouldLazyPreempt, s, g, pod)
+		if pLeafCell == nil {
+			// pLeafCell not being found means that this leaf cell address does not exist in the spec.
+			// we simply ignore this leaf cell, and let the job run normally
+			// (but we cannot ignore the other leaf cells of this pod that are still in the spec,
+			// otherwise it may cause resource conflicts)
+			continue
+		} else {
+			g.physicalLeafCellPlacement[member][podIndex][leafCellIndex] = pLeafCell
+			if lazyPreempt == nil {
+				g.virtualLeafCellPlacement = nil
+			} else if vLeafCell != nil {
+				g.virtualLeafCellPlacement[member][podIndex][leafCellIndex] = vLeafCell
+				if inFreeCellList(pLeafCell) && vLeafCell.GetPreassignedCell().GetPriority() > freePriority {
+					// This means we decide to bind this cell to a virtual cell whose preassigned cell
+					// has been bound (in cases like reconfiguration and the VC's cells are fewer than before).
+					// We need to destroy the previous binding, by lazy preempting all the groups
+					// in the preassigned cell
+					h.lazyPreemptCell(vLeafCell.GetPreassignedCell(), g.name)
+				}
+			} else {
+				shouldLazyPreempt = shouldLazyPreempt || *lazyPreempt
+			}
+			if pLeafCell.GetState() == cellReserved {
+				// the group is backfilled into a leaf cell reserved for an aged group (see h.backfillAffinityGroup),
+				// which stays allocated to the aged group
+				pLeafCell.AddUsingGroup(g)
+				setCellState(pLeafCell, cellReserving)
+				g.backfilled = true
+				continue
+			}
+			if usingGroup := pLeafCell.GetUsingGroup(); pLeafCell.GetState() == cellUsed && usingGroup != nil &&
+				usingGroup.leafCellFraction < leafCellFractionScale && g.leafCellFraction < leafCellFractionScale {
+				// the leaf cell has been allocated to the other fractional pods sharing it
+				pLeafCell.AddUsingGroup(g)
+				h.updateSharedLeafCellPriority(pLeafCell)
+				continue
+			}
+			// Even if we have successfully found the vLeafCell and pLeafCell, there is still one possibility
+			// that we should not bind them: allocating the physical cell may lead to broken safety.
+			// Such case won't happen by design as buddy alloc guarantees safety; but this could
+			// happen due to inconsistency of VC assignments for reasons like reconfiguration.
+			// In this case, we will lazy preempt this affinity group.
+			safetyOk, reason := h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(s.Priority), g.vc)
+			pLeafCell.AddUsingGroup(g)
+			setCellState(pLeafCell, cellUsed)
+			if !safetyOk {
+				shouldLazyPreempt = true
+				klog.Warningf("[%v]: %v", internal.Key(pod), reason)
+			}
+		}
+	}
+	return shouldLazyPreempt
+}
+
 // deleteAllocatedAffinityGroup deletes a new affinity group and release the resources (that are not
 // allocated to a preempting group).
 func (h *HivedAlgorithm) deleteAllocatedAffinityGroup(g *AlgoAffinityGroup, pod *core.Pod) {
@@ -1051,17 +2441,7 @@ func (h *HivedAlgorithm) deleteAllocatedAffinityGroup(g *AlgoAffinityGroup, pod
 				if leafCell == nil {
 					continue
 				}
-				pLeafCell := leafCell.(*PhysicalCell)
-				pLeafCell.DeleteUsingGroup(g)
-				// state of pLeafCell can be either Used or Reserving
-				if pLeafCell.GetState() == cellUsed {
-					h.releaseLeafCell(pLeafCell, g.vc)
-					setCellState(pLeafCell, cellFree)
-				} else { // cellReserving
-					// When pLeafCell is in Reserving state, we shouldn't call h.releaseLeafCell
-					// because it must have been allocated to the reserving group before
-					setCellState(pLeafCell, cellReserved)
-				}
+				h.releaseAllocatedLeafCell(leafCell.(*PhysicalCell), g)
 			}
 		}
 	}
@@ -1069,6 +2449,86 @@ func (h *HivedAlgorithm) deleteAllocatedAffinityGroup(g *AlgoAffinityGroup, pod
 	klog.Infof("[%v]: Allocated affinity group deleted: %v", internal.Key(pod), g.name)
 }
 
+// releaseAllocatedPod releases the leaf cells of a completed pod in an allocated affinity group
+// whose gang release is enabled, without waiting for the other pods in the group to complete.
+// The released pod is recorded in the bind info of the pods allocated afterwards (see generateAffinityGroupBindInfo),
+// so that its leaf cells are not allocated again when the group is recovered from these pods. Note that completed
+// pods are not informed to the scheduler, so if the group is recovered only from the pods allocated before the release
+// (e.g., after the scheduler restarts), the leaf cells of the released pod will be held until the group is deleted.
+func (h *HivedAlgorithm) releaseAllocatedPod(g *AlgoAffinityGroup, member memberKey, podIndex int32, podUID types.UID) {
+	klog.Infof("Releasing the leaf cells of completed pod %v from affinity group %v", podUID, g.name)
+	for leafCellIndex, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
+		if leafCell == nil {
+			continue
+		}
+		h.releaseAllocatedLeafCell(leafCell.(*PhysicalCell), g)
+		g.physicalLeafCellPlacement[member][podIndex][leafCellIndex] = nil
+		if g.virtualLeafCellPlacement != nil {
+			g.virtualLeafCellPlacement[member][podIndex][leafCellIndex] = nil
+		}
+	}
+	g.releasedPods[member][podIndex] = podUID
+}
+
+// releaseRecordedPods releases the pods of an allocated affinity group that are recorded as released
+// in the bind info of a pod, which may be allocated after the pods from which the group was recovered.
+func (h *HivedAlgorithm) releaseRecordedPods(g *AlgoAffinityGroup, info *api.PodBindInfo) {
+	for _, gms := range info.AffinityGroupBindInfo {
+		member := getBindInfoMemberKey(gms)
+		for podIndex, placement := range gms.PodPlacements {
+			if placement.ReleasedPod != "" && podIndex < len(g.releasedPods[member]) &&
+				g.releasedPods[member][podIndex] == "" && g.allocatedPods[member][podIndex] == nil {
+				h.releaseAllocatedPod(g, member, int32(podIndex), placement.ReleasedPod)
+			}
+		}
+	}
+}
+
+// releaseAllocatedLeafCell releases a leaf cell used by an allocated affinity group
+// (unless it has been allocated to a preempting group).
+func (h *HivedAlgorithm) releaseAllocatedLeafCell(pLeafCell *PhysicalCell, g *AlgoAffinityGroup) {
+	pLeafCell.DeleteUsingGroup(g)
+	if len(pLeafCell.GetUsingGroups()) != 0 {
+		// the leaf cell is still shared by other fractional pods
+		if pLeafCell.GetState() == cellUsed {
+			h.updateSharedLeafCellPriority(pLeafCell)
+		}
+		return
+	}
+	// state of pLeafCell can be either Used or Reserving
+	if pLeafCell.GetState() == cellUsed {
+		h.releaseLeafCell(pLeafCell, g.vc)
+		setCellState(pLeafCell, cellFree)
+	} else { // cellReserving
+		// When pLeafCell is in Reserving state, we shouldn't call h.releaseLeafCell
+		// because it must have been allocated to the reserving group before
+		setCellState(pLeafCell, cellReserved)
+	}
+}
+
+// updateSharedLeafCellPriority sets the priority of a leaf cell shared by fractional pods (and of its virtual cell)
+// to the highest among them, so that it can only be preempted by the groups that can preempt all of them.
+func (h *HivedAlgorithm) updateSharedLeafCellPriority(pLeafCell *PhysicalCell) {
+	p := freePriority
+	for _, g := range pLeafCell.GetUsingGroups() {
+		if CellPriority(g.priority) > p {
+			p = CellPriority(g.priority)
+		}
+	}
+	if p == freePriority || p == pLeafCell.GetPriority() {
+		return
+	}
+	cells := []Cell{pLeafCell}
+	if vLeafCell := pLeafCell.GetVirtualCell(); vLeafCell != nil {
+		cells = append(cells, vLeafCell)
+	}
+	for _, c := range cells {
+		updateUsedLeafCellNumAtPriority(c, c.GetPriority(), false)
+		setCellPriority(c, p)
+		updateUsedLeafCellNumAtPriority(c, p, true)
+	}
+}
+
 // createPreemptingAffinityGroup creates a new affinity group that is preempting some other groups.
 // Its resources are immediately allocated to the group (even if the preemption victims have not yet been deleted),
 // so that other groups will not be scheduled to the same placement (unless they have higher priorities).
@@ -1081,21 +2541,33 @@ func (h *HivedAlgorithm) createPreemptingAffinityGroup(
 
 	klog.Infof("[%v]: Creating new preempting affinity group: %v", internal.Key(pod), s.AffinityGroup.Name)
 	newGroup := newAlgoAffinityGroup(
-		s.AffinityGroup, s.VirtualCluster, s.LazyPreemptionEnable, s.Priority, groupPreempting)
+		s.AffinityGroup, s.VirtualCluster, s.LazyPreemptionEnable, s.GangReleaseEnable, s.Priority,
+		s.LeafCellFraction, groupPreempting)
 	newGroup.physicalLeafCellPlacement = physicalPlacement
 	newGroup.virtualLeafCellPlacement = virtualPlacement
-	for leafCellNum := range physicalPlacement {
-		for podIndex := range physicalPlacement[leafCellNum] {
-			for leafCellIndex, leafCell := range physicalPlacement[leafCellNum][podIndex] {
+	newGroup.preemptionStartTime = time.Now()
+	h.reserveLeafCells(newGroup)
+	newGroup.preemptingPods[pod.UID] = pod
+	h.affinityGroups[s.AffinityGroup.Name] = newGroup
+	klog.Infof("[%v]: New preempting affinity group created: %v", internal.Key(pod), newGroup.name)
+}
+
+// reserveLeafCells allocates the leaf cells in the placement of a preempting affinity group to the group,
+// and marks the groups using them as being preempted.
+func (h *HivedAlgorithm) reserveLeafCells(g *AlgoAffinityGroup) {
+	for member := range g.physicalLeafCellPlacement {
+		for podIndex := range g.physicalLeafCellPlacement[member] {
+			for leafCellIndex, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
 				pLeafCell := leafCell.(*PhysicalCell)
-				vLeafCell := virtualPlacement[leafCellNum][podIndex][leafCellIndex].(*VirtualCell)
+				vLeafCell := g.virtualLeafCellPlacement[member][podIndex][leafCellIndex].(*VirtualCell)
 				if pLeafCell.GetState() == cellUsed {
-					usingGroup := pLeafCell.GetUsingGroup()
-					h.releaseLeafCell(pLeafCell, usingGroup.vc)
-					usingGroup.state = groupBeingPreempted
+					h.releaseLeafCell(pLeafCell, pLeafCell.GetUsingGroup().vc)
+					for _, usingGroup := range pLeafCell.GetUsingGroups() {
+						usingGroup.state = groupBeingPreempted
+					}
 				}
-				h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(s.Priority), newGroup.vc)
-				pLeafCell.AddReservingOrReservedGroup(newGroup)
+				h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(g.priority), g.vc)
+				pLeafCell.AddReservingOrReservedGroup(g)
 				// state of pLeafCell can be either Used or Free (if it was Reserving or Reserved,
 				// we must have canceled the ongoing preemption before, in h.Schedule)
 				if pLeafCell.GetState() == cellUsed {
@@ -1106,17 +2578,62 @@ func (h *HivedAlgorithm) createPreemptingAffinityGroup(
 			}
 		}
 	}
-	newGroup.preemptingPods[pod.UID] = pod
-	h.affinityGroups[s.AffinityGroup.Name] = newGroup
-	klog.Infof("[%v]: New preempting affinity group created: %v", internal.Key(pod), newGroup.name)
+}
+
+// holdVictimsInGracePeriods splits the preemption victims of a preempting affinity group into those to be deleted
+// now, and those still in the preemption grace periods of their VCs (counted from when the group started preempting),
+// which are only notified of the preemption.
+func (h *HivedAlgorithm) holdVictimsInGracePeriods(
+	g *AlgoAffinityGroup,
+	victims map[string]common.Set) (
+	deletedVictims map[string]common.Set,
+	gracefulVictims []internal.GracefulVictim) {
+
+	deletedVictims = map[string]common.Set{}
+	now := time.Now()
+	for node, pods := range victims {
+		for p := range pods.Items() {
+			pod := p.(*core.Pod)
+			vc := internal.ExtractPodSchedulingSpec(pod).VirtualCluster
+			if deadline := g.preemptionStartTime.Add(h.vcPreemptionGracePeriods[vc]); now.Before(deadline) {
+				gracefulVictims = append(gracefulVictims, internal.GracefulVictim{
+					Pod: pod,
+					Notice: api.PreemptionNotice{
+						Preemptor: g.name,
+						Deadline:  deadline.Format(time.RFC3339),
+					},
+				})
+				continue
+			}
+			if _, ok := deletedVictims[node]; !ok {
+				deletedVictims[node] = common.NewSet()
+			}
+			deletedVictims[node].Add(pod)
+		}
+	}
+	sort.SliceStable(gracefulVictims, func(i, j int) bool {
+		return internal.Key(gracefulVictims[i].Pod) < internal.Key(gracefulVictims[j].Pod)
+	})
+	return deletedVictims, gracefulVictims
 }
 
 // deletePreemptingAffinityGroup revokes a preemption and deletes the affinity group that is
 // still waiting for the completion of the preemption.
 func (h *HivedAlgorithm) deletePreemptingAffinityGroup(g *AlgoAffinityGroup, pod *core.Pod) {
-	for leafCellNum := range g.physicalLeafCellPlacement {
-		for podIndex := range g.physicalLeafCellPlacement[leafCellNum] {
-			for _, leafCell := range g.physicalLeafCellPlacement[leafCellNum][podIndex] {
+	h.releaseReservedLeafCells(g)
+	delete(h.affinityGroups, g.name)
+	klog.Infof("[%v]: Preempting affinity group %v deleted", internal.Key(pod), g.name)
+}
+
+// releaseReservedLeafCells releases the leaf cells reserved by a preempting affinity group,
+// and returns those still used by the groups being preempted to them.
+func (h *HivedAlgorithm) releaseReservedLeafCells(g *AlgoAffinityGroup) {
+	for member := range g.physicalLeafCellPlacement {
+		for podIndex := range g.physicalLeafCellPlacement[member] {
+			for _, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
+				if leafCell == nil {
+					continue
+				}
 				pLeafCell := leafCell.(*PhysicalCell)
 				h.releaseLeafCell(pLeafCell, g.vc)
 				pLeafCell.DeleteReservingOrReservedGroup(pLeafCell.GetReservingOrReservedGroup())
@@ -1133,22 +2650,21 @@ func (h *HivedAlgorithm) deletePreemptingAffinityGroup(g *AlgoAffinityGroup, pod
 					}
 					h.allocateLeafCell(
 						pLeafCell, beingPreemptedVLeafCell, CellPriority(beingPreemptedGroup.priority), beingPreemptedGroup.vc)
+					h.updateSharedLeafCellPriority(pLeafCell)
 				} else { // cellReserved
 					setCellState(pLeafCell, cellFree)
 				}
 			}
 		}
 	}
-	delete(h.affinityGroups, g.name)
-	klog.Infof("[%v]: Preempting affinity group %v deleted", internal.Key(pod), g.name)
 }
 
 // allocatePreemptingAffinityGroup lets a preemptor affinity group whose preemption has completed
 // transition to allocated state.
 func (h *HivedAlgorithm) allocatePreemptingAffinityGroup(g *AlgoAffinityGroup, pod *core.Pod) {
-	for leafCellNum := range g.physicalLeafCellPlacement {
-		for podIndex := range g.physicalLeafCellPlacement[leafCellNum] {
-			for _, leafCell := range g.physicalLeafCellPlacement[leafCellNum][podIndex] {
+	for member := range g.physicalLeafCellPlacement {
+		for podIndex := range g.physicalLeafCellPlacement[member] {
+			for _, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
 				pLeafCell := leafCell.(*PhysicalCell)
 				pLeafCell.DeleteReservingOrReservedGroup(g)
 				pLeafCell.AddUsingGroup(g)
@@ -1158,6 +2674,9 @@ func (h *HivedAlgorithm) allocatePreemptingAffinityGroup(g *AlgoAffinityGroup, p
 	}
 	g.state = groupAllocated
 	g.preemptingPods = nil
+	if !g.gangReleaseEnable {
+		g.incompleteSince = time.Now()
+	}
 	klog.Infof("[%v]: Preempting affinity group %v transitioned to allocated", internal.Key(pod), g.name)
 }
 
@@ -1166,12 +2685,22 @@ func (h *HivedAlgorithm) allocatePreemptingAffinityGroup(g *AlgoAffinityGroup, p
 func (h *HivedAlgorithm) lazyPreemptAffinityGroup(
 	victim *AlgoAffinityGroup,
 	preemptor string) (originalVirtualPlacement groupVirtualPlacement) {
+	var sharingGroups []*AlgoAffinityGroup
 	for _, podVirtualPlacements := range victim.virtualLeafCellPlacement {
 		for _, podVirtualPlacement := range podVirtualPlacements {
 			for _, leafCell := range podVirtualPlacement {
 				if leafCell != nil {
 					vLeafCell := leafCell.(*VirtualCell)
 					pLeafCell := vLeafCell.GetPhysicalCell()
+					if pLeafCell == nil {
+						// the leaf cell has been removed from the VC by lazy preempting another group sharing it
+						continue
+					}
+					for _, g := range pLeafCell.GetUsingGroups() {
+						if g != victim {
+							sharingGroups = append(sharingGroups, g)
+						}
+					}
 					h.releaseLeafCell(pLeafCell, victim.vc)
 					h.allocateLeafCell(pLeafCell, nil, opportunisticPriority, victim.vc)
 				}
@@ -1185,6 +2714,12 @@ func (h *HivedAlgorithm) lazyPreemptAffinityGroup(
 		PreemptionTime: meta.Now(),
 	}
 	klog.Infof("Affinity group %v is lazy preempted from VC by %v", victim.name, preemptor)
+	// the groups sharing a leaf cell can only stay in the VC together
+	for _, g := range sharingGroups {
+		if g.virtualLeafCellPlacement != nil {
+			h.lazyPreemptAffinityGroup(g, preemptor)
+		}
+	}
 	return originalVirtualPlacement
 }
 
@@ -1200,14 +2735,14 @@ func (h *HivedAlgorithm) lazyPreemptCell(c *VirtualCell, preemptor string) {
 
 // revertLazyPreempt reverts the lazy preemption of an affinity group.
 func (h *HivedAlgorithm) revertLazyPreempt(g *AlgoAffinityGroup, virtualPlacement groupVirtualPlacement) {
-	for leafCellNum := range g.physicalLeafCellPlacement {
-		for podIndex := range g.physicalLeafCellPlacement[leafCellNum] {
-			for leafCellIndex, leafCell := range g.physicalLeafCellPlacement[leafCellNum][podIndex] {
+	for member := range g.physicalLeafCellPlacement {
+		for podIndex := range g.physicalLeafCellPlacement[member] {
+			for leafCellIndex, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
 				if leafCell == nil {
 					continue
 				}
 				pLeafCell := leafCell.(*PhysicalCell)
-				vLeafCell := virtualPlacement[leafCellNum][podIndex][leafCellIndex].(*VirtualCell)
+				vLeafCell := virtualPlacement[member][podIndex][leafCellIndex].(*VirtualCell)
 				h.releaseLeafCell(pLeafCell, g.vc)
 				h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(g.priority), g.vc)
 			}
@@ -1218,6 +2753,172 @@ func (h *HivedAlgorithm) revertLazyPreempt(g *AlgoAffinityGroup, virtualPlacemen
 	klog.Infof("Lazy preemption of affinity group %v is reverted", g.name)
 }
 
+// migrateLazyPreemptedGroups tries to migrate the lazy-preempted affinity groups back into their VCs.
+// It is called whenever cells are released in the VCs.
+func (h *HivedAlgorithm) migrateLazyPreemptedGroups() {
+	var groupNames []string
+	for name, g := range h.affinityGroups {
+		// groups sharing leaf cells are not migrated because they can only stay in the VC together,
+		// and groups of a VC no longer in the config have no VC to be migrated back into
+		if g.state == groupAllocated && g.virtualLeafCellPlacement == nil && g.lazyPreemptionStatus != nil &&
+			g.leafCellFraction == leafCellFractionScale && h.vcSchedulers[g.vc] != nil {
+			groupNames = append(groupNames, name)
+		}
+	}
+	sort.Strings(groupNames)
+	for _, name := range groupNames {
+		h.migrateLazyPreemptedGroup(h.affinityGroups[name])
+	}
+}
+
+// migrateLazyPreemptedGroup re-binds the physical leaf cells of a lazy-preempted affinity group
+// to free virtual cells of its VC, and restores its guaranteed priority. The group is migrated
+// only if all of its leaf cells can be re-bound; otherwise it stays lazy-preempted.
+func (h *HivedAlgorithm) migrateLazyPreemptedGroup(g *AlgoAffinityGroup) {
+	preassignedCellTypes, pinnedCellId := h.getAllocatedPreassignedCellTypes(g)
+	if preassignedCellTypes == nil {
+		return
+	}
+	virtualPlacement := groupVirtualPlacement{}
+	var migratedLeafCells []*PhysicalCell
+	failedReason := ""
+	for member := range g.physicalLeafCellPlacement {
+		virtualPlacement[member] = make([]CellList, len(g.physicalLeafCellPlacement[member]))
+		for podIndex := range g.physicalLeafCellPlacement[member] {
+			virtualPlacement[member][podIndex] = make(
+				CellList, len(g.physicalLeafCellPlacement[member][podIndex]))
+			for leafCellIndex, leafCell := range g.physicalLeafCellPlacement[member][podIndex] {
+				if leafCell == nil || failedReason != "" {
+					continue
+				}
+				pLeafCell := leafCell.(*PhysicalCell)
+				var preassignedType api.CellType
+				if podTypes := preassignedCellTypes[member]; podIndex < len(podTypes) &&
+					leafCellIndex < len(podTypes[podIndex]) {
+					preassignedType = podTypes[podIndex][leafCellIndex]
+				}
+				vLeafCell, reason := h.findMigrationVirtualCell(g, pLeafCell, preassignedType, pinnedCellId)
+				if vLeafCell == nil {
+					failedReason = reason
+					continue
+				}
+				h.releaseLeafCell(pLeafCell, g.vc)
+				safetyOk, reason := h.allocateLeafCell(pLeafCell, vLeafCell, CellPriority(g.priority), g.vc)
+				migratedLeafCells = append(migratedLeafCells, pLeafCell)
+				virtualPlacement[member][podIndex][leafCellIndex] = vLeafCell
+				if !safetyOk {
+					failedReason = reason
+				}
+			}
+		}
+	}
+	if failedReason != "" {
+		for _, pLeafCell := range migratedLeafCells {
+			h.releaseLeafCell(pLeafCell, g.vc)
+			h.allocateLeafCell(pLeafCell, nil, opportunisticPriority, g.vc)
+		}
+		klog.Infof("Affinity group %v stays lazy preempted: %v", g.name, failedReason)
+		return
+	}
+	g.virtualLeafCellPlacement = virtualPlacement
+	g.lazyPreemptionStatus = nil
+	klog.Infof("Lazy preempted affinity group %v is migrated back into VC %v", g.name, g.vc)
+}
+
+// getAllocatedPreassignedCellTypes collects the preassigned cell types of the leaf cells of an allocated
+// affinity group from the bind info of its pods (member -> pod index -> leaf cell index -> type),
+// as well as the pinned cell the group requests.
+func (h *HivedAlgorithm) getAllocatedPreassignedCellTypes(
+	g *AlgoAffinityGroup) (map[memberKey][][]api.CellType, api.PinnedCellId) {
+
+	var preassignedCellTypes map[memberKey][][]api.CellType
+	var pinnedCellId api.PinnedCellId
+	for _, pods := range g.allocatedPods {
+		for _, pod := range pods {
+			if pod == nil {
+				continue
+			}
+			if preassignedCellTypes == nil {
+				preassignedCellTypes = map[memberKey][][]api.CellType{}
+				pinnedCellId = internal.ExtractPodSchedulingSpec(pod).PinnedCellId
+			}
+			// the bind info of a pod covers the pods of the group placed before it,
+			// so a later pod of an elastic group may cover more pods than an earlier one
+			for _, member := range internal.ExtractPodBindInfo(pod).AffinityGroupBindInfo {
+				if len(member.PodPlacements) == 0 {
+					continue
+				}
+				key := getBindInfoMemberKey(member)
+				for podIndex := len(preassignedCellTypes[key]); podIndex < len(member.PodPlacements); podIndex++ {
+					preassignedCellTypes[key] = append(preassignedCellTypes[key],
+						member.PodPlacements[podIndex].PreassignedCellTypes)
+				}
+			}
+		}
+	}
+	return preassignedCellTypes, pinnedCellId
+}
+
+// findMigrationVirtualCell finds a free virtual leaf cell in the VC of a lazy-preempted affinity group
+// that a physical leaf cell used by the group can be re-bound to.
+func (h *HivedAlgorithm) findMigrationVirtualCell(
+	g *AlgoAffinityGroup,
+	pLeafCell *PhysicalCell,
+	preassignedType api.CellType,
+	pinnedCellId api.PinnedCellId) (*VirtualCell, string) {
+
+	if !pLeafCell.IsHealthy() || pLeafCell.GetState() != cellUsed {
+		return nil, fmt.Sprintf("leaf cell %v is bad or being reserved", pLeafCell.GetAddress())
+	}
+	chain := pLeafCell.GetChain()
+	var preassignedLevel CellLevel
+	for l, t := range h.cellTypes[chain] {
+		if t == preassignedType {
+			preassignedLevel = l
+		}
+	}
+	if preassignedLevel == 0 {
+		return nil, fmt.Sprintf("preassigned cell type %v not found in chain %v", preassignedType, chain)
+	}
+	vccl := h.vcSchedulers[g.vc].getNonPinnedPreassignedCells()[chain]
+	if pinnedCellId != "" {
+		vccl = h.vcSchedulers[g.vc].getPinnedCells()[pinnedCellId]
+	}
+	if vccl == nil {
+		return nil, fmt.Sprintf("VC %v has no cell for chain %v", g.vc, chain)
+	}
+	// the physical cell at the preassigned level should be either already bound to the VC or free,
+	// otherwise it has been taken by other VCs
+	pac := pLeafCell
+	for pac.GetLevel() < preassignedLevel {
+		pac = pac.GetParent().(*PhysicalCell)
+	}
+	if vpac := pac.GetVirtualCell(); vpac != nil {
+		if vpac.GetVirtualCluster() != g.vc {
+			return nil, fmt.Sprintf("cell %v is bound to VC %v", pac.GetAddress(), vpac.GetVirtualCluster())
+		}
+	} else if !inFreeCellList(pac) {
+		return nil, fmt.Sprintf("cell %v is no longer free", pac.GetAddress())
+	}
+	vLeafCell, message := mapPhysicalCellToVirtual(pLeafCell, vccl, preassignedLevel, CellPriority(g.priority))
+	if vLeafCell == nil {
+		return nil, message
+	}
+	if vLeafCell.GetPriority() != freePriority || vLeafCell.GetPhysicalCell() != nil {
+		return nil, fmt.Sprintf("virtual cell %v is not free", vLeafCell.GetAddress())
+	}
+	// the virtual cells already bound on the way to the preassigned cell should be bound to
+	// the same physical cells as the ones the leaf cell is in
+	var v, p Cell = vLeafCell, pLeafCell
+	for ; v != nil && p != nil; v, p = v.GetParent(), p.GetParent() {
+		if boundCell := v.(*VirtualCell).GetPhysicalCell(); boundCell != nil && boundCell != p {
+			return nil, fmt.Sprintf("virtual cell %v is bound to another cell %v",
+				v.GetAddress(), boundCell.GetAddress())
+		}
+	}
+	return vLeafCell, ""
+}
+
 // findAllocatedLeafCell finds the physical and virtual leaf cells in the full cell lists for an allocate pod.
 // The boolean return value indicates whether the affinity group should be lazy-preempted.
 // The bool being nil means the group is OT and has no virtual placement.
@@ -1315,6 +3016,10 @@ func (h *HivedAlgorithm) allocateLeafCell(
 	} else {
 		setCellPriority(pLeafCell, opportunisticPriority)
 		updateUsedLeafCellNumAtPriority(pLeafCell, opportunisticPriority, true)
+		// the opportunistic pods of a VC no longer in the config are not counted
+		if num, ok := h.vcOpportunisticLeafCellNum[vcn]; ok {
+			num[h.chainLeafCellTypes[pLeafCell.GetChain()]]++
+		}
 		pLeafCell.GetAPIStatus().VC = vcn
 		h.apiClusterStatus.VirtualClusters[vcn] = append(
 			h.apiClusterStatus.VirtualClusters[vcn], generateOTVirtualCell(pLeafCell.GetAPIStatus()))
@@ -1343,6 +3048,9 @@ func (h *HivedAlgorithm) releaseLeafCell(pLeafCell *PhysicalCell, vcn api.Virtua
 			h.releasePreassignedCell(preassignedPhysical, vcn, false)
 		}
 	} else {
+		if num, ok := h.vcOpportunisticLeafCellNum[vcn]; ok {
+			num[h.chainLeafCellTypes[pLeafCell.GetChain()]]--
+		}
 		pLeafCell.GetAPIStatus().VC = ""
 		h.apiClusterStatus.VirtualClusters[vcn] = deleteOTVirtualCell(
 			h.apiClusterStatus.VirtualClusters[vcn], pLeafCell.GetAddress())
@@ -26,12 +26,15 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/internal"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
@@ -84,8 +87,11 @@ var group1, group2, group3, group4, group5, group6, group7, group8, group9, grou
 	Name:    "group6",
 	Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, LeafCellNumber: 1}},
 }, &api.AffinityGroupSpec{
-	Name:    "group7",
-	Members: []api.AffinityGroupMemberSpec{{PodNumber: 3, LeafCellNumber: 8}},
+	Name: "group7",
+	// VC2 has 24 DGX1-P100 leaf cells: 2 DGX1-P100-NODE and 2 DGX1-P100-CPU-SOCKET.
+	// The 2 sockets can be grouped into an 8-leaf-cell pod once they are on the same
+	// physical node, so 3 such pods fit, and 4 pods are needed to exceed the quota.
+	Members: []api.AffinityGroupMemberSpec{{PodNumber: 4, LeafCellNumber: 8}},
 }, &api.AffinityGroupSpec{
 	Name:    "group8",
 	Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, LeafCellNumber: 8}},
@@ -218,7 +224,7 @@ var pss = map[types.UID]api.PodSchedulingSpec{
 		LeafCellType:         "DGX2-V100",
 		LeafCellNumber:       16,
 		AffinityGroup:        group5,
-	}, "pod7": { // insufficient VC cells; should return PodWaitInfo
+	}, "pod7": { // insufficient VC cells (4*8 > 24 leaf cells of VC2); should return PodWaitInfo
 		VirtualCluster:       "VC2",
 		Priority:             1,
 		LazyPreemptionEnable: true,
@@ -628,7 +634,32 @@ func TestHivedAlgorithm(t *testing.T) {
 	testBadNodes(t, configFilePath)
 	testSafeRelaxedBuddyAlloc(t, configFilePath)
 	testReconfiguration(t, configFilePath)
+	testRemovedVirtualCluster(t, configFilePath)
 	testInvalidInitialAssignment(t, sConfig)
+	testSkuTypes(t, "../../example/feature/file/hived-config-1.yaml")
+	testGangRelease(t, configFilePath)
+	testCrossChain(t, configFilePath)
+	testIntraVCSchedulers(t, configFilePath)
+	testIntraVCSchedulingRetry(t, configFilePath)
+	testSubNodeCells(t, configFilePath)
+	testAffinityAwareNodeSelection(t, configFilePath)
+	testOpportunisticBacktracking(t, configFilePath)
+	testElasticGroup(t, configFilePath)
+	testMixedLeafCellTypes(t, configFilePath)
+	testFractionalLeafCells(t, configFilePath)
+	testOpportunisticUsageCap(t, configFilePath)
+	testWeightedFairShare(t, configFilePath)
+	testAgingReservation(t, configFilePath)
+	testPreemptionCost(t, configFilePath)
+	testPreemptionGracePeriod(t, configFilePath)
+	testLazyPreemptionMigration(t, configFilePath)
+	testDefragmentationPlan(t, configFilePath)
+	testReservation(t, configFilePath)
+	testBackfill(t, configFilePath)
+	testGangSchedulingTimeout(t, configFilePath)
+	testExplainConfig(t, configFilePath)
+	testUpdatePolicies(t, configFilePath)
+	testInheritState(t, configFilePath)
 }
 
 func sortChains(chains []CellChain) {
@@ -653,6 +684,18 @@ func setHealthyNodes(h *HivedAlgorithm) {
 	}
 }
 
+// newTestPod creates a pod with the given scheduling spec.
+func newTestPod(name string, s api.PodSchedulingSpec) *core.Pod {
+	return &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        name,
+			Namespace:   "test",
+			UID:         types.UID(name),
+			Annotations: map[string]string{api.AnnotationKeyPodSchedulingSpec: common.ToYaml(s)},
+		},
+	}
+}
+
 func printConfig(t *testing.T, h *HivedAlgorithm) {
 	for chain, ccl := range h.fullCellList {
 		t.Logf("%v", chain)
@@ -1073,6 +1116,11 @@ func testReconfiguration(t *testing.T, configFilePath string) {
 	originalCell.CellChildren[1].CellChildren[1].CellAddress = "0.0.4.103"
 	(*newConfig.PhysicalCluster).PhysicalCells = append((*newConfig.PhysicalCluster).PhysicalCells, originalCell)
 
+	diff := api.DiffConfig(oldConfig, newConfig)
+	if !diff.ClusterChanged() || diff.RestartRequired() || len(diff.ResizedVirtualClusters) != 1 {
+		t.Errorf("Expected the cluster change to be applied in place, but got: %v", diff)
+	}
+
 	h = NewHivedAlgorithm(newConfig)
 	for _, chains := range h.cellChains {
 		sortChains(chains)
@@ -1091,6 +1139,37 @@ func testReconfiguration(t *testing.T, configFilePath string) {
 	testDeletePods(t, h)
 }
 
+func testRemovedVirtualCluster(t *testing.T, configFilePath string) {
+	h := NewHivedAlgorithm(api.NewConfig(api.InitRawConfig(&configFilePath)))
+	for _, chains := range h.cellChains {
+		sortChains(chains)
+	}
+	setHealthyNodes(h)
+	testCasesThatShouldSucceed(t, h)
+
+	// case: VC2 is renamed, so the pods of VC2 belong to a VC no longer in the config
+	newConfig := api.InitRawConfig(&configFilePath)
+	(*newConfig.VirtualClusters)["VC2-RENAMED"] = (*newConfig.VirtualClusters)["VC2"]
+	delete(*newConfig.VirtualClusters, "VC2")
+	h = NewHivedAlgorithm(api.NewConfig(newConfig))
+	for _, chains := range h.cellChains {
+		sortChains(chains)
+	}
+	setHealthyNodes(h)
+	for _, pod := range allocatedPods {
+		h.AddAllocatedPod(pod)
+	}
+	for _, pod := range allocatedPods {
+		s := pss[pod.UID]
+		if g := h.affinityGroups[s.AffinityGroup.Name]; s.VirtualCluster == "VC2" &&
+			s.Priority >= 0 && g.virtualLeafCellPlacement != nil {
+			t.Errorf("Group %v of the removed VC2 is expected to be lazy preempted, but not", g.name)
+		}
+	}
+	// deleting pods tries to migrate the lazy preempted groups, which skips those of the removed VC2
+	testDeletePods(t, h)
+}
+
 func testInvalidInitialAssignment(t *testing.T, sConfig *api.Config) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -1102,9 +1181,1532 @@ func testInvalidInitialAssignment(t *testing.T, sConfig *api.Config) {
 	(*sConfig.VirtualClusters)["VC1"].VirtualCells[0].CellType = "CT1-NODE"
 	(*sConfig.VirtualClusters)["VC1"].VirtualCells[1].CellType = "CT1-NODE.CT1"
 	(*sConfig.VirtualClusters)["VC1"].VirtualCells[1].CellNumber = 2
+	if errs := api.ValidateConfig(sConfig); len(errs) == 0 {
+		t.Errorf("Expected errors in config validation, but got none")
+	} else {
+		t.Logf("Config validation failed as expected: %v", errs)
+	}
 	NewHivedAlgorithm(sConfig)
 }
 
+func testSkuTypes(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	expectedSku := api.SkuTypeSpec{Gpu: 1, Cpu: "4", Memory: "8192Mi"}
+	checked := 0
+	for _, pcs := range h.GetPhysicalClusterStatus() {
+		if pcs.LeafCellType != "K80" {
+			continue
+		}
+		checked++
+		if pcs.LeafCellSku == nil || *pcs.LeafCellSku != expectedSku {
+			t.Errorf("Expected leaf cell sku %v of cell %v, but got %v",
+				expectedSku, pcs.CellAddress, pcs.LeafCellSku)
+		}
+	}
+	if checked == 0 {
+		t.Errorf("Expected physical cells of leaf cell type K80, but got none")
+	}
+
+	// a pod without leafCellType is only rejected if it exceeds the skuTypes of all leaf cell types
+	pc := sConfig.PhysicalCluster
+	pc.CellTypes["V100-NODE"] = api.CellTypeSpec{ChildCellType: "V100", ChildCellNumber: 4, IsNodeLevel: true}
+	pc.SkuTypes["V100"] = api.SkuTypeSpec{Gpu: 1, Cpu: "8", Memory: "8192Mi"}
+	checkSku := func(leafCellType string, cpu string, leafCellFraction float64) (err interface{}) {
+		defer func() {
+			err = recover()
+		}()
+		pod := &core.Pod{Spec: core.PodSpec{Containers: []core.Container{{Resources: core.ResourceRequirements{
+			Requests: core.ResourceList{core.ResourceCPU: resource.MustParse(cpu)}}}}}}
+		internal.CheckPodSkuResources(pod, &api.PodSchedulingSpec{
+			LeafCellType: leafCellType, LeafCellNumber: 1, LeafCellFraction: leafCellFraction}, pc)
+		return nil
+	}
+	if err := checkSku("", "6", 0); err != nil {
+		t.Errorf("Expected the pod to fit the skuType of V100, but got %v", err)
+	}
+	if err := checkSku("K80", "6", 0); err == nil {
+		t.Errorf("Expected the pod to exceed the skuType of K80, but got none")
+	}
+	if err := checkSku("", "10", 0); err == nil || !strings.Contains(fmt.Sprint(err), "K80") ||
+		!strings.Contains(fmt.Sprint(err), "V100") {
+		t.Errorf("Expected the pod to exceed the skuTypes of K80 and V100, but got %v", err)
+	}
+	// the skuType is scaled by the leaf cell fraction
+	if err := checkSku("K80", "1", 0.25); err != nil {
+		t.Errorf("Expected the fractional pod to fit a quarter of the skuType of K80, but got %v", err)
+	}
+	if err := checkSku("K80", "2", 0.25); err == nil {
+		t.Errorf("Expected the fractional pod to exceed a quarter of the skuType of K80, but got none")
+	}
+}
+
+func testGangRelease(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	for _, chains := range h.cellChains {
+		sortChains(chains)
+	}
+	setHealthyNodes(h)
+	group := &api.AffinityGroupSpec{
+		Name:    "gangReleaseGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 8}},
+	}
+	spec := api.PodSchedulingSpec{
+		VirtualCluster:    "VC1",
+		Priority:          1,
+		LeafCellType:      "DGX2-V100",
+		LeafCellNumber:    8,
+		GangReleaseEnable: true,
+		AffinityGroup:     group,
+	}
+	var groupPods []*core.Pod
+	for i := 0; i < 2; i++ {
+		podName := fmt.Sprintf("gangReleasePod%v", i)
+		pod := newTestPod(podName, spec)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled, but got %v", podName, psr)
+		}
+		allocatedPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(allocatedPod)
+		groupPods = append(groupPods, allocatedPod)
+	}
+	g := h.affinityGroups[group.Name]
+	released := append(CellList{}, g.physicalLeafCellPlacement[memberKey{leafCellNum: 8}][0]...)
+	h.DeleteAllocatedPod(groupPods[0])
+	if _, ok := h.affinityGroups[group.Name]; !ok {
+		t.Fatalf("Group %v is expected to be kept after one of its pods completes, but not", group.Name)
+	}
+	for _, leafCell := range released {
+		if pLeafCell := leafCell.(*PhysicalCell); pLeafCell.GetState() != cellFree {
+			t.Errorf("Cell %v is expected to be released, but is %v", pLeafCell.GetAddress(), pLeafCell.GetState())
+		}
+	}
+	for _, leafCell := range g.physicalLeafCellPlacement[memberKey{leafCellNum: 8}][1] {
+		if pLeafCell := leafCell.(*PhysicalCell); pLeafCell.GetState() != cellUsed {
+			t.Errorf("Cell %v is expected to be used, but is %v", pLeafCell.GetAddress(), pLeafCell.GetState())
+		}
+	}
+	if status := g.ToAffinityGroup(); len(status.Status.ReleasedPods) != 1 {
+		t.Errorf("Expected 1 released pod in group %v, but got %v", group.Name, status.Status.ReleasedPods)
+	}
+
+	// a recreated pod is scheduled beyond the released pod, whose placement is not kept in the bind info
+	recreatedPod := newTestPod("gangReleasePod2", spec)
+	psr := h.Schedule(recreatedPod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Pod %v is expected to be scheduled, but got %v", recreatedPod.Name, psr)
+	}
+	if placement := psr.PodBindInfo.AffinityGroupBindInfo[0].PodPlacements[0]; placement.ReleasedPod != groupPods[0].UID ||
+		placement.PhysicalNode != "" {
+		t.Errorf("Expected the placement of the released pod %v to be left empty, but got %v", groupPods[0].Name, placement)
+	}
+	recreatedPod = internal.NewBindingPod(recreatedPod, psr.PodBindInfo)
+	h.AddAllocatedPod(recreatedPod)
+	// the released pod is not allocated again when the group is recovered, whichever pod is added first
+	for _, pods := range [][]*core.Pod{{groupPods[1], recreatedPod}, {recreatedPod, groupPods[1]}} {
+		newH := NewHivedAlgorithm(sConfig)
+		setHealthyNodes(newH)
+		for _, pod := range pods {
+			newH.AddAllocatedPod(pod)
+		}
+		newReleasedPods := newH.affinityGroups[group.Name].releasedPods[memberKey{leafCellNum: 8}]
+		if newReleasedPods[0] != groupPods[0].UID {
+			t.Errorf("Expected pod %v to be released in the recovered group %v, but got %v",
+				groupPods[0].Name, group.Name, newReleasedPods)
+		}
+		usedLeafCellNum := 0
+		for _, c := range newH.fullCellList[CellChain(psr.PodBindInfo.CellChain)][lowestLevel] {
+			if c.(*PhysicalCell).GetState() == cellUsed {
+				usedLeafCellNum++
+			}
+		}
+		if usedLeafCellNum != 16 {
+			t.Errorf("Expected 16 used leaf cells after recovering group %v from pods %v and %v, but got %v",
+				group.Name, pods[0].Name, pods[1].Name, usedLeafCellNum)
+		}
+	}
+	h.DeleteAllocatedPod(groupPods[1])
+	h.DeleteAllocatedPod(recreatedPod)
+	if _, ok := h.affinityGroups[group.Name]; ok {
+		t.Errorf("Group %v is expected to be deleted, but not", group.Name)
+	}
+}
+
+func testCrossChain(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	for _, chains := range h.cellChains {
+		sortChains(chains)
+	}
+	setHealthyNodes(h)
+	// VC1 has 128 DGX2-V100 leaf cells in 3 chains, while none of the chains has more than 64
+	group := &api.AffinityGroupSpec{
+		Name:    "crossChainGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 8, LeafCellNumber: 16}},
+	}
+	newPod := func(i int, crossChainEnable bool) *core.Pod {
+		return newTestPod(fmt.Sprintf("crossChainPod%v", i), api.PodSchedulingSpec{
+			VirtualCluster:   "VC1",
+			Priority:         1,
+			LeafCellType:     "DGX2-V100",
+			LeafCellNumber:   16,
+			CrossChainEnable: crossChainEnable,
+			AffinityGroup:    group,
+		})
+	}
+	if psr := h.Schedule(newPod(0, false), allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		t.Errorf("Group %v is expected to wait without crossChainEnable, but got %v", group.Name, psr.PodBindInfo)
+	}
+	var groupPods []*core.Pod
+	chains := common.NewSet()
+	for i := 0; i < 8; i++ {
+		psr := h.Schedule(newPod(i, true), allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled across chains, but got %v", i, psr)
+		}
+		chains.Add(psr.PodBindInfo.CellChain)
+		allocatedPod := internal.NewBindingPod(newPod(i, true), psr.PodBindInfo)
+		h.AddAllocatedPod(allocatedPod)
+		groupPods = append(groupPods, allocatedPod)
+	}
+	if len(chains.Items()) < 2 {
+		t.Errorf("Group %v is expected to be placed across chains, but got %v", group.Name, chains)
+	}
+
+	// recover the group from the bind info
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	for _, pod := range groupPods {
+		h.AddAllocatedPod(pod)
+	}
+	g := h.affinityGroups[group.Name]
+	if g == nil || g.virtualLeafCellPlacement == nil {
+		t.Fatalf("Group %v is expected to be recovered in VC1, but got %v", group.Name, g)
+	}
+	for _, podPlacement := range g.physicalLeafCellPlacement[memberKey{leafCellNum: 16}] {
+		for _, leafCell := range podPlacement {
+			if leafCell == nil || leafCell.(*PhysicalCell).GetState() != cellUsed {
+				t.Errorf("Leaf cell %v of group %v is expected to be recovered and used", leafCell, group.Name)
+			}
+		}
+	}
+}
+
+func testIntraVCSchedulers(t *testing.T, configFilePath string) {
+	for _, policy := range api.IntraVCSchedulerPolicies {
+		if _, ok := intraVCSchedulerRegistry[policy]; !ok {
+			t.Errorf("Intra-VC scheduler %v is not registered", policy)
+		}
+	}
+	rawConfig := api.InitRawConfig(&configFilePath)
+	vc1 := (*rawConfig.VirtualClusters)["VC1"]
+	vc1.IntraVCScheduler = "best-fit"
+	(*rawConfig.VirtualClusters)["VC1"] = vc1
+	if errs := api.ValidateConfig(rawConfig); len(errs) == 0 {
+		t.Errorf("Expected unknown intraVCScheduler to be rejected, but not")
+	}
+
+	// pods of the same group are packed to the same node by default, and spread to different nodes if required
+	expectedNodeNums := map[api.IntraVCSchedulerPolicy]int{
+		api.IntraVCSchedulerTopologyPacking: 1,
+		api.IntraVCSchedulerSpread:          2,
+	}
+	for policy, expectedNodeNum := range expectedNodeNums {
+		rawConfig = api.InitRawConfig(&configFilePath)
+		vc1 = (*rawConfig.VirtualClusters)["VC1"]
+		vc1.IntraVCScheduler = policy
+		(*rawConfig.VirtualClusters)["VC1"] = vc1
+		h := NewHivedAlgorithm(api.NewConfig(rawConfig))
+		setHealthyNodes(h)
+		sr := schedulingRequest{
+			vc:                   "VC1",
+			priority:             1,
+			affinityGroupName:    "intraVCSchedulerGroup",
+			affinityGroupPodNums: map[int32]int32{4: 2},
+			ignoreSuggestedNodes: true,
+		}
+		for _, chain := range h.cellChains["DGX2-V100"] {
+			if h.vcSchedulers["VC1"].getNonPinnedPreassignedCells()[chain] == nil {
+				continue
+			}
+			sr.chain = chain
+			physicalPlacement, _, _, _ := h.handleSchedulingRequest(sr)
+			if physicalPlacement == nil {
+				t.Errorf("Expected placement in chain %v with intra-VC scheduler %v, but not found", chain, policy)
+				continue
+			}
+			if nodeNum := len(physicalPlacement.nodeToLeafCellIndices()); nodeNum != expectedNodeNum {
+				t.Errorf("Expected %v node(s) in chain %v with intra-VC scheduler %v, but got %v",
+					expectedNodeNum, chain, policy, physicalPlacement)
+			}
+		}
+	}
+}
+
+func testIntraVCSchedulingRetry(t *testing.T, configFilePath string) {
+	for _, attempts := range []int32{1, 3} {
+		rawConfig := api.InitRawConfig(&configFilePath)
+		rawConfig.MaxIntraVCSchedulingAttempts = common.PtrInt32(attempts)
+		// let the intra-VC scheduler prefer the 2-node preassigned cell
+		vc1 := (*rawConfig.VirtualClusters)["VC1"]
+		n := len(vc1.VirtualCells)
+		vc1.VirtualCells = append([]api.VirtualCellSpec{vc1.VirtualCells[n-1]}, vc1.VirtualCells[:n-1]...)
+		(*rawConfig.VirtualClusters)["VC1"] = vc1
+		h := NewHivedAlgorithm(api.NewConfig(rawConfig))
+		setHealthyNodes(h)
+		// the suggested nodes are in different 2-node cells, so the 2-node preassigned cell cannot be mapped
+		sr := schedulingRequest{
+			vc:                   "VC1",
+			chain:                "4-DGX2-V100-NODE",
+			priority:             1,
+			affinityGroupName:    "retryGroup",
+			affinityGroupPodNums: map[int32]int32{16: 2},
+			suggestedNodes:       common.NewSet("0.0.3.3", "0.0.4.0"),
+		}
+		physicalPlacement, _, _, _ := h.handleSchedulingRequest(sr)
+		if attempts == 1 && physicalPlacement != nil {
+			t.Errorf("Expected no placement without retry, but got %v", physicalPlacement)
+		}
+		if attempts > 1 && len(physicalPlacement.nodeToLeafCellIndices()) != 2 {
+			t.Errorf("Expected a placement on the suggested nodes after retry, but got %v", physicalPlacement)
+		}
+	}
+}
+
+func testSubNodeCells(t *testing.T, configFilePath string) {
+	rawConfig := api.InitRawConfig(&configFilePath)
+	// VC2 only has 2 DGX1-P100-CPU-SOCKET cells (each with 4 leaf cells) in chain 3-DGX1-P100-NODE
+	vc2 := (*rawConfig.VirtualClusters)["VC2"]
+	vc2.VirtualCells = []api.VirtualCellSpec{
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE.DGX1-P100-CPU-SOCKET", CellNumber: 2},
+	}
+	(*rawConfig.VirtualClusters)["VC2"] = vc2
+	h := NewHivedAlgorithm(api.NewConfig(rawConfig))
+	setHealthyNodes(h)
+	var nodes []string
+	for i, leafCellNum := range []int32{2, 6} {
+		podName := fmt.Sprintf("subNodeCellPod%v", i)
+		pod := newTestPod(podName, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: leafCellNum,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    fmt.Sprintf("subNodeCellGroup%v", i),
+				Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, LeafCellNumber: leafCellNum}},
+			},
+		})
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled on the sub-node cells, but got %v", podName, psr)
+		}
+		h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+		nodes = append(nodes, psr.PodBindInfo.Node)
+	}
+	if nodes[0] != nodes[1] {
+		t.Errorf("Expected the pods to be placed on the same node, but got %v", nodes)
+	}
+}
+
+func testAffinityAwareNodeSelection(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	// each DGX1-P100-NODE has 2 CPU sockets, each with 2 PCI switches, each with 2 leaf cells.
+	// 1.0.0.0 is full, 1.0.0.1 has 4 free leaf cells but each under a different PCI switch,
+	// and 1.0.0.2 has 6 free leaf cells including 2 under the same PCI switch.
+	usedLeafCells := map[string]common.Set{
+		"1.0.0.0": common.NewSet(int32(0), int32(1), int32(2), int32(3), int32(4), int32(5), int32(6), int32(7)),
+		"1.0.0.1": common.NewSet(int32(0), int32(2), int32(4), int32(6)),
+		"1.0.0.2": common.NewSet(int32(0), int32(2)),
+	}
+	for _, c := range h.fullCellList["3-DGX1-P100-NODE"][lowestLevel] {
+		nodes, leafCellIndices := c.(*PhysicalCell).GetPhysicalPlacement()
+		if usedLeafCells[nodes[0]].Contains(leafCellIndices[0]) {
+			setCellPriority(c, opportunisticPriority)
+			updateUsedLeafCellNumAtPriority(c, opportunisticPriority, true)
+		}
+	}
+	placement, podAffinities, _ := h.opportunisticSchedulers["3-DGX1-P100-NODE"].Schedule(
+		map[int32]int32{2: 1}, opportunisticPriority, common.NewSet(), true, common.NewSet(), 0)
+	if placement == nil {
+		t.Fatalf("Expected a placement for the pod, but got none")
+	}
+	physicalPlacement := groupPhysicalPlacement(newMemberPlacement("", placement))
+	if nodes := physicalPlacement.nodeToLeafCellIndices(); nodes["1.0.0.2"] == nil {
+		t.Errorf("Expected the pod to be placed on node 1.0.0.2, but got %v", nodes)
+	}
+	if podAffinities[2][0] != CellLevel(2) {
+		t.Errorf("Expected the pod to achieve affinity level 2, but got %v", podAffinities[2][0])
+	}
+
+	// the achieved affinity levels are reported in the affinity group status
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	pod := newTestPod("affinityLevelPod", api.PodSchedulingSpec{
+		VirtualCluster: "VC2",
+		Priority:       1,
+		LeafCellType:   "DGX1-P100",
+		LeafCellNumber: 2,
+		AffinityGroup: &api.AffinityGroupSpec{
+			Name:    "affinityLevelGroup",
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 2}},
+		},
+	})
+	psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected pod %v to be scheduled, but got %v", pod.Name, psr)
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+	status := h.GetAffinityGroup("affinityLevelGroup").Status
+	if levels := status.PodAffinityLevels[2]; len(levels) != 2 || levels[0] != 2 || levels[1] != 2 {
+		t.Errorf("Expected both pods to achieve affinity level 2, but got %v", common.ToJson(status.PodAffinityLevels))
+	}
+}
+
+func testOpportunisticBacktracking(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	// 1.0.0.0 is full, 1.0.0.1 has 2 free leaf cells (and is preferred for packing opportunistic pods),
+	// and 1.0.0.2 has 1 free leaf cell
+	usedLeafCellNums := map[string]int32{"1.0.0.0": 8, "1.0.0.1": 6, "1.0.0.2": 7}
+	usedLeafCellPriorities := map[string]CellPriority{"1.0.0.0": 1, "1.0.0.1": opportunisticPriority, "1.0.0.2": 1}
+	for _, c := range h.fullCellList["3-DGX1-P100-NODE"][lowestLevel] {
+		nodes, _ := c.(*PhysicalCell).GetPhysicalPlacement()
+		if usedLeafCellNums[nodes[0]] > 0 {
+			usedLeafCellNums[nodes[0]]--
+			setCellPriority(c, usedLeafCellPriorities[nodes[0]])
+			updateUsedLeafCellNumAtPriority(c, usedLeafCellPriorities[nodes[0]], true)
+		}
+	}
+	scheduler := h.opportunisticSchedulers["3-DGX1-P100-NODE"]
+	// picking the nodes in order would place the 1-leaf-cell pod on 1.0.0.1, leaving no node for the 2-leaf-cell pod
+	placement, _, failedReason := scheduler.Schedule(
+		map[int32]int32{1: 1, 2: 1}, opportunisticPriority, common.NewSet(), true, common.NewSet(), 0)
+	if placement == nil {
+		t.Fatalf("Expected a placement for the opportunistic pods, but failed: %v", failedReason)
+	}
+	physicalPlacement := groupPhysicalPlacement(newMemberPlacement("", placement))
+	if nodes := physicalPlacement.nodeToLeafCellIndices(); len(nodes["1.0.0.1"]) != 2 {
+		t.Errorf("Expected the 2-leaf-cell pod to be placed on node 1.0.0.1, but got %v", nodes)
+	}
+	if _, failedReason = findNodesForPodsWithBacktracking(scheduler.cv, []int32{1, 2}, 0); !strings.Contains(
+		failedReason, "search steps") {
+		t.Errorf("Expected the search to fail for exceeding the step budget, but got %v", failedReason)
+	}
+}
+
+func testElasticGroup(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newElasticPod := func(i int) *core.Pod {
+		return newTestPod(fmt.Sprintf("elasticPod%v", i), api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: 2,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    "elasticGroup",
+				Members: []api.AffinityGroupMemberSpec{{MinPodNumber: 1, MaxPodNumber: 3, LeafCellNumber: 2}},
+			},
+		})
+	}
+	var boundPods []*core.Pod
+	for i := 0; i < 3; i++ {
+		pod := newElasticPod(i)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled by extending the elastic group, but got %v", pod.Name, psr)
+		}
+		if n := len(psr.PodBindInfo.AffinityGroupBindInfo[0].PodPlacements); n != i+1 {
+			t.Errorf("Expected %v pod placements in the bind info of pod %v, but got %v", i+1, pod.Name, n)
+		}
+		if i > 0 && psr.PodBindInfo.Node != internal.ExtractPodBindInfo(boundPods[0]).Node {
+			t.Errorf("Expected pod %v to be placed near the existing pods on node %v, but got %v",
+				pod.Name, internal.ExtractPodBindInfo(boundPods[0]).Node, psr.PodBindInfo.Node)
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		boundPods = append(boundPods, boundPod)
+		status := h.GetAffinityGroup("elasticGroup").Status
+		if status.CurrentPodNumbers[2] != int32(i+1) || status.DesiredPodNumbers[2] != 3 {
+			t.Errorf("Expected elastic group size %v of 3, but got %v of %v",
+				i+1, status.CurrentPodNumbers[2], status.DesiredPodNumbers[2])
+		}
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected a user error when exceeding the maximum pod number, but got none")
+			}
+		}()
+		h.Schedule(newElasticPod(3), allNodes, internal.PreemptingPhase)
+	}()
+
+	// the group can be recovered from its pods added in any order
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	for _, i := range []int{0, 2, 1} {
+		h.AddAllocatedPod(boundPods[i])
+	}
+	g := h.affinityGroups["elasticGroup"]
+	member := memberKey{leafCellNum: 2}
+	if g.totalPodNums[member] != 3 {
+		t.Fatalf("Expected the recovered elastic group to have 3 pods, but got %v", g.totalPodNums[member])
+	}
+	for i, p := range g.allocatedPods[member] {
+		if p == nil || p.UID != boundPods[i].UID {
+			t.Errorf("Expected pod %v at index %v of the recovered elastic group, but got %v", boundPods[i].Name, i, p)
+		}
+		for _, c := range g.physicalLeafCellPlacement[member][i] {
+			if c == nil || c.GetPriority() != CellPriority(1) {
+				t.Errorf("Expected the leaf cells of pod %v to be allocated, but got %v", boundPods[i].Name, c)
+			}
+		}
+	}
+}
+
+func testMixedLeafCellTypes(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newMixedPod := func(name string, leafCellNumber int32, ct1PodNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			LeafCellNumber: leafCellNumber,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name: fmt.Sprintf("mixedGroup%v", ct1PodNumber),
+				Members: []api.AffinityGroupMemberSpec{
+					{PodNumber: ct1PodNumber, LeafCellNumber: 2, LeafCellType: "CT1"},
+					{PodNumber: 1, LeafCellNumber: 4, LeafCellType: "DGX1-P100"},
+				},
+			},
+		})
+	}
+	// VC2 only has 2 CT1 leaf cells, so the whole group cannot be placed even if the DGX1-P100 member fits
+	psr := h.Schedule(newMixedPod("mixedPod0", 4, 2), allNodes, internal.PreemptingPhase)
+	if psr.PodWaitInfo == nil {
+		t.Errorf("Expected the mixed group to wait for the CT1 leaf cells, but got %v", psr)
+	}
+
+	expectedChains := map[int32]string{2: "CT1-NODE", 4: "3-DGX1-P100-NODE"}
+	psr = h.Schedule(newMixedPod("mixedPod1", 4, 1), allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected the mixed group to be scheduled, but got %v", psr)
+	}
+	if psr.PodBindInfo.CellChain != expectedChains[4] {
+		t.Errorf("Expected the pod to be placed in chain %v, but got %v", expectedChains[4], psr.PodBindInfo.CellChain)
+	}
+	for _, mbi := range psr.PodBindInfo.AffinityGroupBindInfo {
+		leafCellNum := int32(len(mbi.PodPlacements[0].PhysicalLeafCellIndices))
+		if chain := mbi.PodPlacements[0].CellChain; chain != expectedChains[leafCellNum] {
+			t.Errorf("Expected the member with %v leaf cells in chain %v, but got %v",
+				leafCellNum, expectedChains[leafCellNum], chain)
+		}
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(newMixedPod("mixedPod1", 4, 1), psr.PodBindInfo))
+	psr = h.Schedule(newMixedPod("mixedPod2", 2, 1), allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil || psr.PodBindInfo.CellChain != expectedChains[2] {
+		t.Errorf("Expected the pod to be placed in chain %v, but got %v", expectedChains[2], psr)
+	}
+
+	// the members of different leaf cell types may have the same leaf cell number,
+	// and the pods choose their members by the leaf cell types
+	newPSWorkerPod := func(name string, leafCellType string) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			LeafCellType:   leafCellType,
+			LeafCellNumber: 1,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name: "psWorkerGroup",
+				Members: []api.AffinityGroupMemberSpec{
+					{PodNumber: 1, LeafCellNumber: 1, LeafCellType: "CT1"},
+					{PodNumber: 2, LeafCellNumber: 1, LeafCellType: "DGX1-P100"},
+				},
+			},
+		})
+	}
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	expectedTypeChains := map[string]string{"CT1": "CT1-NODE", "DGX1-P100": "3-DGX1-P100-NODE"}
+	var boundPods []*core.Pod
+	for i, leafCellType := range []string{"DGX1-P100", "CT1", "DGX1-P100"} {
+		pod := newPSWorkerPod(fmt.Sprintf("psWorkerPod%v", i), leafCellType)
+		psr = h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil || psr.PodBindInfo.CellChain != expectedTypeChains[leafCellType] {
+			t.Fatalf("Expected pod %v to be placed in chain %v, but got %v",
+				pod.Name, expectedTypeChains[leafCellType], psr)
+		}
+		for _, mbi := range psr.PodBindInfo.AffinityGroupBindInfo {
+			if chain := mbi.PodPlacements[0].CellChain; chain != expectedTypeChains[mbi.LeafCellType] {
+				t.Errorf("Expected the member of leaf cell type %v in chain %v, but got %v",
+					mbi.LeafCellType, expectedTypeChains[mbi.LeafCellType], chain)
+			}
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		boundPods = append(boundPods, boundPod)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected a user error when exceeding the pod number of leaf cell type CT1, but got none")
+			}
+		}()
+		h.Schedule(newPSWorkerPod("psWorkerPod3", "CT1"), allNodes, internal.PreemptingPhase)
+	}()
+
+	// the group is recovered with the pods of each member on its own leaf cells
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	for _, i := range []int{2, 1, 0} {
+		h.AddAllocatedPod(boundPods[i])
+	}
+	g := h.affinityGroups["psWorkerGroup"]
+	for leafCellType, podNum := range map[string]int{"CT1": 1, "DGX1-P100": 2} {
+		member := memberKey{leafCellType: leafCellType, leafCellNum: 1}
+		for podIndex := 0; podIndex < podNum; podIndex++ {
+			if g.allocatedPods[member][podIndex] == nil ||
+				string(g.physicalLeafCellPlacement[member][podIndex][0].GetChain()) != expectedTypeChains[leafCellType] {
+				t.Errorf("Expected pod %v of leaf cell type %v to be recovered in chain %v",
+					podIndex, leafCellType, expectedTypeChains[leafCellType])
+			}
+		}
+	}
+	if g.ToAffinityGroup().Status.CurrentPodNumbers[1] != 3 {
+		t.Errorf("Expected 3 pods with 1 leaf cell in the group status, but got %v",
+			g.ToAffinityGroup().Status.CurrentPodNumbers)
+	}
+}
+
+func testFractionalLeafCells(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newFractionalPod := func(name string, priority int32, fraction float64) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster:   "VC2",
+			Priority:         priority,
+			LeafCellType:     "DGX1-P100",
+			LeafCellNumber:   1,
+			LeafCellFraction: fraction,
+		})
+	}
+	// pods 0 and 1 fill one leaf cell, and pods 2 and 3 share another one
+	fractions := []float64{0.5, 0.5, 0.25, 0.5}
+	var boundPods []*core.Pod
+	for i, fraction := range fractions {
+		pod := newFractionalPod(fmt.Sprintf("fractionalPod%v", i), 1, fraction)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Expected fractional pod %v to be scheduled, but got %v", pod.Name, psr)
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		boundPods = append(boundPods, boundPod)
+	}
+	leafCellOf := func(h *HivedAlgorithm, pod *core.Pod) *PhysicalCell {
+		info := internal.ExtractPodBindInfo(pod)
+		return findPhysicalLeafCell(h.fullCellList, CellChain(info.CellChain), info.Node, info.LeafCellIsolation[0])
+	}
+	c0, c2 := leafCellOf(h, boundPods[0]), leafCellOf(h, boundPods[2])
+	if c0 != leafCellOf(h, boundPods[1]) || c2 != leafCellOf(h, boundPods[3]) || c0 == c2 {
+		t.Fatalf("Expected fractional pods 0, 1 and pods 2, 3 to share two leaf cells")
+	}
+	if c0.GetAPIStatus().UsedLeafCellFraction != 1 || c2.GetAPIStatus().UsedLeafCellFraction != 0.75 {
+		t.Errorf("Expected used fractions 1 and 0.75, but got %v and %v",
+			c0.GetAPIStatus().UsedLeafCellFraction, c2.GetAPIStatus().UsedLeafCellFraction)
+	}
+	// the VC quota counts each shared leaf cell once
+	var root Cell = c0
+	for root.GetParent() != nil {
+		root = root.GetParent()
+	}
+	if n := root.GetUsedLeafCellNumAtPriorities()[CellPriority(1)]; n != 2 {
+		t.Errorf("Expected 2 leaf cells used by the fractional pods, but got %v", n)
+	}
+	h.DeleteAllocatedPod(boundPods[0])
+	if c0.GetState() != cellUsed || len(c0.GetUsingGroups()) != 1 {
+		t.Errorf("Expected the leaf cell to be still used by fractional pod 1, but got state %v", c0.GetState())
+	}
+	h.DeleteAllocatedPod(boundPods[1])
+	if c0.GetState() != cellFree || c0.GetPriority() != freePriority {
+		t.Errorf("Expected the leaf cell to be free, but got state %v, priority %v", c0.GetState(), c0.GetPriority())
+	}
+	// a fractional pod of the same VC at a higher priority shares the leaf cell too,
+	// which then takes the highest priority among the pods sharing it
+	pod := newFractionalPod("fractionalPod4", 2, 0.25)
+	psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected fractional pod %v to be scheduled, but got %v", pod.Name, psr)
+	}
+	boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+	h.AddAllocatedPod(boundPod)
+	if leafCellOf(h, boundPod) != c2 || c2.GetPriority() != CellPriority(2) ||
+		c2.GetVirtualCell().GetPriority() != CellPriority(2) {
+		t.Errorf("Expected fractional pod 4 to share the leaf cell of pods 2 and 3 at priority 2, but got priority %v",
+			c2.GetPriority())
+	}
+	usedLeafCellNums := root.GetUsedLeafCellNumAtPriorities()
+	if usedLeafCellNums[CellPriority(1)] != 0 || usedLeafCellNums[CellPriority(2)] != 1 {
+		t.Errorf("Expected 1 leaf cell used at priority 2, but got %v", usedLeafCellNums)
+	}
+	if f := c2.GetVirtualCell().GetAPIStatus().PhysicalCell.UsedLeafCellFraction; f != 1 {
+		t.Errorf("Expected used fraction 1 in the virtual cluster status, but got %v", f)
+	}
+	h.DeleteAllocatedPod(boundPod)
+	if c2.GetPriority() != CellPriority(1) || root.GetUsedLeafCellNumAtPriorities()[CellPriority(1)] != 1 {
+		t.Errorf("Expected the leaf cell to be back to priority 1, but got %v", c2.GetPriority())
+	}
+
+	// the shared leaf cells can be recovered from the pods
+	h = NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	for _, i := range []int{3, 2} {
+		h.AddAllocatedPod(boundPods[i])
+	}
+	if c := leafCellOf(h, boundPods[2]); len(c.GetUsingGroups()) != 2 || c.GetUsedFraction() != 750 ||
+		c.GetPriority() != CellPriority(1) || c.GetVirtualCell() == nil {
+		t.Errorf("Expected the recovered leaf cell to be shared by fractional pods 2 and 3 in VC2, but got %v groups",
+			len(c.GetUsingGroups()))
+	}
+}
+
+func testOpportunisticUsageCap(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.MaxOpportunisticLeafCells = map[string]int32{"DGX1-P100": 4}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newOpportunisticPod := func(name string, leafCellNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       int32(opportunisticPriority),
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: leafCellNumber,
+		})
+	}
+	pod := newOpportunisticPod("opportunisticPod0", 4)
+	psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected opportunistic pod %v to be scheduled, but got %v", pod.Name, psr)
+	}
+	boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+	h.AddAllocatedPod(boundPod)
+	if usage := h.GetOpportunisticUsage("VC2"); usage.UsedLeafCells["DGX1-P100"] != 4 ||
+		usage.MaxLeafCells["DGX1-P100"] != 4 {
+		t.Errorf("Expected 4 of at most 4 opportunistic leaf cells used by VC2, but got %v", common.ToJson(usage))
+	}
+	pod = newOpportunisticPod("opportunisticPod1", 1)
+	psr = h.Schedule(pod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo != nil || psr.PodWaitInfo == nil ||
+		!strings.Contains(psr.PodWaitInfo.Reason, "maxOpportunisticLeafCells") {
+		t.Errorf("Expected opportunistic pod %v to wait for the usage cap of VC2, but got %v", pod.Name, psr)
+	}
+	h.DeleteAllocatedPod(boundPod)
+	if usage := h.GetOpportunisticUsage("VC2"); usage.UsedLeafCells["DGX1-P100"] != 0 {
+		t.Errorf("Expected no opportunistic leaf cells used by VC2, but got %v", common.ToJson(usage))
+	}
+	if psr = h.Schedule(pod, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected opportunistic pod %v to be scheduled, but got %v", pod.Name, psr)
+	}
+}
+
+func testWeightedFairShare(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	policy := api.IdleCellSharingWeightedFairShare
+	sConfig.IdleCellSharingPolicy = &policy
+	vcSpec := (*sConfig.VirtualClusters)["VC1"]
+	vcSpec.FairShareWeight = common.PtrInt32(2)
+	(*sConfig.VirtualClusters)["VC1"] = vcSpec
+	// VC2 cannot use any idle leaf cell, so its opportunistic pods keep waiting
+	vcSpec = (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.MaxOpportunisticLeafCells = map[string]int32{"DGX1-P100": 0}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newOpportunisticPod := func(name string, vc api.VirtualClusterName) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: vc,
+			Priority:       int32(opportunisticPriority),
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: 1,
+		})
+	}
+	fairShare1, fairShare2 := h.getFairShareLeafCellNum("VC1", "DGX1-P100"), h.getFairShareLeafCellNum("VC2", "DGX1-P100")
+	if fairShare1 == 0 || fairShare1 < 2*fairShare2 || fairShare1 > 2*fairShare2+2 {
+		t.Errorf("Expected the fair share of VC1 to be twice that of VC2, but got %v and %v", fairShare1, fairShare2)
+	}
+	if usage := h.GetOpportunisticUsage("VC1"); usage.FairShareLeafCells["DGX1-P100"] != fairShare1 {
+		t.Errorf("Expected the fair share %v of VC1 to be exposed, but got %v", fairShare1, common.ToJson(usage))
+	}
+	// pretend that VC1 has used up its fair share
+	h.vcOpportunisticLeafCellNum["VC1"]["DGX1-P100"] = fairShare1
+	pod2 := newOpportunisticPod("fairSharePod2", "VC2")
+	if psr := h.Schedule(pod2, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		t.Fatalf("Expected opportunistic pod %v to wait, but got %v", pod2.Name, psr)
+	}
+	pod1 := newOpportunisticPod("fairSharePod1", "VC1")
+	psr := h.Schedule(pod1, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo != nil || psr.PodWaitInfo == nil || !strings.Contains(psr.PodWaitInfo.Reason, "fair share") {
+		t.Errorf("Expected opportunistic pod %v to wait for VC2 below its fair share, but got %v", pod1.Name, psr)
+	}
+	h.DeleteUnallocatedPod(pod2)
+	if psr = h.Schedule(pod1, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected opportunistic pod %v to be scheduled without other waiting VCs, but got %v", pod1.Name, psr)
+	}
+}
+
+func testAgingReservation(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.AgingThresholdSeconds = 60
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, leafCellNumber int32, created time.Time) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: leafCellNumber,
+		})
+		pod.CreationTimestamp = meta.NewTime(created)
+		return pod
+	}
+	// fill the VC with small groups, and then free one leaf cell
+	var smallPods []*core.Pod
+	for i := 0; ; i++ {
+		pod := newPod(fmt.Sprintf("smallPod%v", i), 1, time.Now())
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			break
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		smallPods = append(smallPods, boundPod)
+	}
+	if len(smallPods) < 2 {
+		t.Fatalf("Expected VC2 to hold at least 2 small pods, but got %v", len(smallPods))
+	}
+	h.DeleteAllocatedPod(smallPods[0])
+
+	// a large group which has been waiting for long reserves leaf cells
+	largePod := newPod("largePod", 2, time.Now().Add(-time.Hour))
+	psr := h.Schedule(largePod, allNodes, internal.PreemptingPhase)
+	g := h.affinityGroups["test/largePod"]
+	if psr.PodBindInfo != nil || g == nil || !g.reservedForAging || g.state != groupPreempting {
+		t.Fatalf("Expected leaf cells to be reserved for the aged group, but got %v", psr)
+	}
+	waitedGroups := map[string]bool{}
+	for _, leafCell := range g.physicalLeafCellPlacement[memberKey{leafCellNum: 2}][0] {
+		pLeafCell := leafCell.(*PhysicalCell)
+		if pLeafCell.GetPriority() != 1 || (pLeafCell.GetState() != cellReserved && pLeafCell.GetState() != cellReserving) {
+			t.Errorf("Expected the leaf cell to be reserved at priority 1, but got state %v, priority %v",
+				pLeafCell.GetState(), pLeafCell.GetPriority())
+		}
+		for _, usingGroup := range pLeafCell.GetUsingGroups() {
+			if usingGroup.state != groupAllocated {
+				t.Errorf("Expected the group %v waited for not to be preempted, but got state %v",
+					usingGroup.name, usingGroup.state)
+			}
+			waitedGroups[usingGroup.name] = true
+		}
+	}
+	// a later group with the same priority cannot take the reserved leaf cells
+	newSmallPod := newPod("newSmallPod", 1, time.Now())
+	if psr = h.Schedule(newSmallPod, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		if c := findPhysicalLeafCell(h.fullCellList, CellChain(psr.PodBindInfo.CellChain), psr.PodBindInfo.Node,
+			psr.PodBindInfo.LeafCellIsolation[0]); c.GetState() != cellFree {
+			t.Errorf("Expected the new small pod to take a free leaf cell, but got one in state %v", c.GetState())
+		}
+	}
+	// the aged group is scheduled once the groups using its reserved leaf cells complete
+	for _, pod := range smallPods[1:] {
+		if waitedGroups[internal.ExtractPodSchedulingSpec(pod).AffinityGroup.Name] {
+			h.DeleteAllocatedPod(pod)
+		}
+	}
+	if psr = h.Schedule(largePod, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected the aged group to be scheduled, but got %v", psr)
+	}
+}
+
+func testPreemptionCost(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, priority int32, leafCellNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: leafCellNumber,
+		})
+	}
+	// fill the VC with single-leaf-cell groups
+	nodePods := map[string][]*core.Pod{}
+	for i := 0; ; i++ {
+		pod := newPod(fmt.Sprintf("smallPod%v", i), 0, 1)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			break
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		nodePods[psr.PodBindInfo.Node] = append(nodePods[psr.PodBindInfo.Node], boundPod)
+	}
+	// replace the groups in one node with a single group, which is cheaper to preempt
+	// than any two of the single-leaf-cell groups
+	for _, pod := range nodePods["1.0.0.0"] {
+		h.DeleteAllocatedPod(pod)
+	}
+	bigPod := newPod("bigPod", 0, 8)
+	psr := h.Schedule(bigPod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil || psr.PodBindInfo.Node != "1.0.0.0" {
+		t.Fatalf("Expected the big pod to be scheduled to node 1.0.0.0, but got %v", psr)
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(bigPod, psr.PodBindInfo))
+
+	preemptor := newPod("preemptor", 1, 2)
+	psr = h.Schedule(preemptor, allNodes, internal.PreemptingPhase)
+	if psr.PodPreemptInfo == nil || len(psr.PodPreemptInfo.VictimPods) != 1 ||
+		psr.PodPreemptInfo.VictimPods[0].Name != "bigPod" {
+		t.Fatalf("Expected the big pod to be preempted, but got %v", psr)
+	}
+	decision := h.affinityGroups["test/preemptor"].ToAffinityGroup().Status.PreemptionDecision
+	if decision == nil || len(decision.AlternativeCosts) < 2 {
+		t.Fatalf("Expected multiple preemption alternatives, but got %v", common.ToJson(decision))
+	}
+	chosenCost := decision.AlternativeCosts[decision.Chosen]
+	if chosenCost.VictimGroups != 1 || chosenCost.VictimLeafCells != 8 {
+		t.Errorf("Expected the chosen alternative to preempt 1 group using 8 leaf cells, but got %v",
+			common.ToJson(chosenCost))
+	}
+	for i, cost := range decision.AlternativeCosts {
+		if lessPreemptionCost(cost, chosenCost) {
+			t.Errorf("Expected the chosen alternative to have the least cost, but alternative %v costs less: %v",
+				i, common.ToJson(cost))
+		}
+	}
+}
+
+func testPreemptionGracePeriod(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.PreemptionGracePeriodSeconds = 60
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, priority int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: 1,
+		})
+	}
+	for i := 0; ; i++ {
+		pod := newPod(fmt.Sprintf("victimPod%v", i), 0)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			break
+		}
+		h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+	}
+
+	// the victim is only notified within its grace period
+	preemptor := newPod("preemptor", 1)
+	psr := h.Schedule(preemptor, allNodes, internal.PreemptingPhase)
+	if psr.PodPreemptInfo == nil || len(psr.PodPreemptInfo.VictimPods) != 0 ||
+		len(psr.PodPreemptInfo.GracefulVictims) != 1 {
+		t.Fatalf("Expected a victim in its grace period, but got %v", psr)
+	}
+	notice := psr.PodPreemptInfo.GracefulVictims[0].Notice
+	deadline, err := time.Parse(time.RFC3339, notice.Deadline)
+	if err != nil || notice.Preemptor != "test/preemptor" || time.Until(deadline) > time.Minute ||
+		time.Until(deadline) < 50*time.Second {
+		t.Errorf("Expected the victim to be notified of a deadline in 60 seconds, but got %v", common.ToJson(notice))
+	}
+	g := h.affinityGroups["test/preemptor"]
+	if g == nil || g.state != groupPreempting {
+		t.Fatalf("Expected the preemptor to stay preempting")
+	}
+
+	// the victim is deleted after its grace period
+	victim := psr.PodPreemptInfo.GracefulVictims[0].Pod
+	g.preemptionStartTime = g.preemptionStartTime.Add(-2 * time.Minute)
+	psr = h.Schedule(preemptor, allNodes, internal.PreemptingPhase)
+	if psr.PodPreemptInfo == nil || len(psr.PodPreemptInfo.GracefulVictims) != 0 ||
+		len(psr.PodPreemptInfo.VictimPods) != 1 || psr.PodPreemptInfo.VictimPods[0] != victim {
+		t.Errorf("Expected the victim %v to be preempted after its grace period, but got %v",
+			internal.Key(victim), psr)
+	}
+}
+
+func testLazyPreemptionMigration(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	// leave a single DGX1-P100 node in the VC, so that the other nodes are free out of the VC
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.VirtualCells = vcSpec.VirtualCells[:1]
+	vcSpec.VirtualCells[0].CellNumber = 1
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, group string, priority int32, leafCellNumber int32, podNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster:       "VC2",
+			Priority:             priority,
+			LazyPreemptionEnable: true,
+			LeafCellType:         "DGX1-P100",
+			LeafCellNumber:       leafCellNumber,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    group,
+				Members: []api.AffinityGroupMemberSpec{{PodNumber: podNumber, LeafCellNumber: leafCellNumber}},
+			},
+		})
+	}
+	schedule := func(pod *core.Pod) *core.Pod {
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Expected %v to be scheduled without preemption, but got %v", internal.Key(pod), psr)
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		return boundPod
+	}
+	schedule(newPod("victim", "victim", 0, 8, 1))
+
+	// the preemptor takes the only node of the VC, and the victim keeps running out of the VC
+	preemptor := schedule(newPod("preemptor", "preemptor", 1, 8, 1))
+	g := h.affinityGroups["victim"]
+	if g.virtualLeafCellPlacement != nil || g.lazyPreemptionStatus == nil {
+		t.Fatalf("Expected the victim to be lazy preempted, but not")
+	}
+
+	// the victim migrates back into the VC once the preemptor completes
+	h.DeleteAllocatedPod(preemptor)
+	if g.virtualLeafCellPlacement == nil || g.lazyPreemptionStatus != nil {
+		t.Fatalf("Expected the victim to be migrated back into the VC, but not")
+	}
+	for _, podPlacements := range g.physicalLeafCellPlacement {
+		for podIndex, podPlacement := range podPlacements {
+			for leafCellIndex, leafCell := range podPlacement {
+				pLeafCell := leafCell.(*PhysicalCell)
+				vLeafCell := g.virtualLeafCellPlacement[memberKey{leafCellNum: 8}][podIndex][leafCellIndex].(*VirtualCell)
+				if pLeafCell.GetVirtualCell() != vLeafCell || pLeafCell.GetPriority() != 0 ||
+					vLeafCell.GetVirtualCluster() != "VC2" {
+					t.Errorf("Expected leaf cell %v to be bound to VC2 with priority 0, but got %v with priority %v",
+						pLeafCell.GetAddress(), pLeafCell.GetVirtualCell(), pLeafCell.GetPriority())
+				}
+			}
+		}
+	}
+}
+
+func testDefragmentationPlan(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	// fill the DGX1-P100 nodes with single-leaf-cell groups
+	nodePods := map[string][]*core.Pod{}
+	for i := 0; ; i++ {
+		pod := newTestPod(fmt.Sprintf("pod%v", i), api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       0,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: 1,
+		})
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			break
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		nodePods[psr.PodBindInfo.Node] = append(nodePods[psr.PodBindInfo.Node], boundPod)
+	}
+	// leave a single group in each of two nodes, so that one of them can be freed by relocating its group
+	for i, node := range []string{"1.0.0.0", "1.0.0.1", "1.0.0.2"} {
+		for j, pod := range nodePods[node] {
+			if i == 2 || j > 0 {
+				h.DeleteAllocatedPod(pod)
+			}
+		}
+	}
+
+	chain := "3-DGX1-P100-NODE"
+	nodeLevel := int32(4)
+	checkPlan := func(plan api.DefragmentationPlan) {
+		if len(plan.Relocations) != 1 {
+			t.Fatalf("Expected 1 relocation, but got %v", common.ToJson(plan.Relocations))
+		}
+		r := plan.Relocations[0]
+		if len(r.FromNodes) != 1 || len(r.ToNodes) != 1 || r.FromNodes[0] == r.ToNodes[0] ||
+			!strings.HasSuffix(string(r.FreedCell), "/"+r.FromNodes[0]) {
+			t.Errorf("Expected the group to be relocated to the other used node, but got %v", common.ToJson(r))
+		}
+		for _, c := range plan.Chains {
+			if c.Chain != chain {
+				continue
+			}
+			for _, l := range c.Levels {
+				if l.Level == nodeLevel && (l.Before != 1 || l.After != 2) {
+					t.Errorf("Expected the free nodes to increase from 1 to 2, but got %v", common.ToJson(l))
+				}
+			}
+		}
+	}
+	checkPlan(h.GetDefragmentationPlan())
+	checkPlan(PlanDefragmentation(sConfig, h.GetAllAffinityGroups()))
+}
+
+func testReservation(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	// leave a single DGX1-P100 node in the VC and reserve it for a window starting later,
+	// which begins to drain half an hour before
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.VirtualCells = vcSpec.VirtualCells[:1]
+	vcSpec.VirtualCells[0].CellNumber = 1
+	now := time.Now()
+	vcSpec.Reservations = []api.ReservationSpec{{
+		Name:         "benchmark",
+		CellType:     "DGX1-P100-NODE",
+		CellNumber:   1,
+		StartTime:    now.Add(time.Hour).Format(time.RFC3339),
+		EndTime:      now.Add(2 * time.Hour).Format(time.RFC3339),
+		DrainSeconds: 1800,
+	}}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, priority int32, reservation string) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: 8,
+			Reservation:    reservation,
+		})
+	}
+	psr := h.Schedule(newPod("running", 0, ""), allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected the running pod to be scheduled, but got %v", psr)
+	}
+	running := internal.NewBindingPod(newPod("running", 0, ""), psr.PodBindInfo)
+	h.AddAllocatedPod(running)
+
+	// the reservation drains the node: the running group is waited for instead of preempted,
+	// and neither an untagged group nor a tagged one before the window can use the node
+	r := h.reservations["benchmark"]
+	r.drainTime = now.Add(-time.Minute)
+	untagged := newPod("untagged", 1000, "")
+	tagged := newPod("tagged", 1, "benchmark")
+	for _, pod := range []*core.Pod{untagged, tagged} {
+		if psr := h.Schedule(pod, allNodes, internal.PreemptingPhase); psr.PodWaitInfo == nil {
+			t.Errorf("Expected %v to wait, but got %v", internal.Key(pod), psr)
+		}
+	}
+	if r.holder == nil || h.affinityGroups["test/running"].state != groupAllocated {
+		t.Fatalf("Expected the reservation to hold the node and the running group to be allocated, but not")
+	}
+	for _, leafCell := range r.holder.physicalLeafCellPlacement[memberKey{leafCellNum: 8}][0] {
+		if s := leafCell.(*PhysicalCell).GetState(); s != cellReserving {
+			t.Errorf("Expected leaf cell %v to be Reserving, but got %v", leafCell.GetAddress(), s)
+		}
+	}
+	h.DeleteAllocatedPod(running)
+
+	// during the window, only the tagged group can use the drained node
+	r.startTime = now.Add(-time.Minute)
+	if psr := h.Schedule(untagged, allNodes, internal.PreemptingPhase); psr.PodWaitInfo == nil {
+		t.Errorf("Expected %v to wait, but got %v", internal.Key(untagged), psr)
+	}
+	psr = h.Schedule(tagged, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil || psr.PodBindInfo.Node != running.Spec.NodeName {
+		t.Fatalf("Expected %v to be scheduled to the reserved node %v, but got %v",
+			internal.Key(tagged), running.Spec.NodeName, psr)
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(tagged, psr.PodBindInfo))
+	if g := h.affinityGroups["test/tagged"]; g.state != groupAllocated || CellPriority(g.priority) != 1 {
+		t.Errorf("Expected the tagged group to be allocated with priority 1, but not")
+	}
+
+	// the cells left in the reservation are released after the window
+	h.DeleteAllocatedPod(internal.NewBindingPod(tagged, psr.PodBindInfo))
+	r.endTime = now.Add(-time.Second)
+	if psr := h.Schedule(untagged, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected %v to be scheduled after the reservation ends, but got %v", internal.Key(untagged), psr)
+	}
+	if r.holder != nil || !r.ended {
+		t.Errorf("Expected the reservation to be ended, but not")
+	}
+}
+
+func testBackfill(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.AgingThresholdSeconds = 60
+	vcSpec.VirtualCells = vcSpec.VirtualCells[:1]
+	vcSpec.VirtualCells[0].CellNumber = 1
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, leafCellNumber int32, created time.Time, runtimeSeconds int64) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster:         "VC2",
+			Priority:               1,
+			LeafCellType:           "DGX1-P100",
+			LeafCellNumber:         leafCellNumber,
+			ExpectedRuntimeSeconds: runtimeSeconds,
+		})
+		pod.CreationTimestamp = meta.NewTime(created)
+		return pod
+	}
+	// fill the VC with small groups declaring their runtimes, and then free one leaf cell
+	var smallPods []*core.Pod
+	for i := 0; ; i++ {
+		pod := newPod(fmt.Sprintf("smallPod%v", i), 1, time.Now(), 3600)
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			break
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		smallPods = append(smallPods, boundPod)
+	}
+	h.DeleteAllocatedPod(smallPods[0])
+	largePod := newPod("largePod", 2, time.Now().Add(-time.Hour), 0)
+	if psr := h.Schedule(largePod, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil ||
+		!h.affinityGroups["test/largePod"].reservedForAging {
+		t.Fatalf("Expected leaf cells to be reserved for the aged group, but got %v", psr)
+	}
+
+	// a group which may outlast the groups waited for is not backfilled
+	longPod := newPod("longPod", 1, time.Now(), 7200)
+	if psr := h.Schedule(longPod, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		t.Errorf("Expected the long group not to be backfilled, but got %v", psr.PodBindInfo)
+	}
+	// a group which completes before the aged group can start is backfilled into the reserved leaf cell
+	shortPod := newPod("shortPod", 1, time.Now(), 1800)
+	psr := h.Schedule(shortPod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected the short group to be backfilled, but got %v", psr)
+	}
+	shortPod = internal.NewBindingPod(shortPod, psr.PodBindInfo)
+	h.AddAllocatedPod(shortPod)
+	backfilledGroup := h.affinityGroups["test/shortPod"]
+	c := findPhysicalLeafCell(h.fullCellList, CellChain(psr.PodBindInfo.CellChain), psr.PodBindInfo.Node,
+		psr.PodBindInfo.LeafCellIsolation[0])
+	if !backfilledGroup.backfilled || c.GetState() != cellReserving {
+		t.Errorf("Expected the short group to be backfilled into a reserving leaf cell, but got state %v",
+			c.GetState())
+	}
+
+	// the backfilled group is preempted once it overruns
+	for _, pod := range smallPods[1:] {
+		h.DeleteAllocatedPod(pod)
+	}
+	if psr = h.Schedule(largePod, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		t.Errorf("Expected the aged group to wait for the backfilled group, but got %v", psr.PodBindInfo)
+	}
+	backfilledGroup.expectedEndTime = time.Now().Add(-time.Minute)
+	psr = h.Schedule(largePod, allNodes, internal.PreemptingPhase)
+	if psr.PodPreemptInfo == nil || len(psr.PodPreemptInfo.VictimPods) != 1 ||
+		psr.PodPreemptInfo.VictimPods[0] != shortPod {
+		t.Errorf("Expected the overrunning backfilled group to be preempted, but got %v", psr)
+	}
+	h.DeleteAllocatedPod(shortPod)
+	if c.GetState() != cellReserved {
+		t.Errorf("Expected the leaf cell to be reserved again, but got state %v", c.GetState())
+	}
+	if psr = h.Schedule(largePod, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected the aged group to be scheduled, but got %v", psr)
+	}
+}
+
+func testGangSchedulingTimeout(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	sConfig.GangSchedulingTimeoutSec = common.PtrInt64(600)
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, group *api.AffinityGroupSpec) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC1",
+			Priority:       1,
+			LeafCellType:   "DGX2-V100",
+			LeafCellNumber: 8,
+			AffinityGroup:  group,
+		})
+	}
+	schedule := func(pod *core.Pod) *core.Pod {
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled, but got %v", pod.Name, psr)
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		return boundPod
+	}
+	// only one of the two pods of a group is created, while another group is complete
+	incompleteGroup := &api.AffinityGroupSpec{
+		Name:    "gangTimeoutGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 8}},
+	}
+	completeGroup := &api.AffinityGroupSpec{
+		Name:    "gangCompleteGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, LeafCellNumber: 8}},
+	}
+	createdPod := schedule(newPod("gangTimeoutPod0", incompleteGroup))
+	schedule(newPod("gangCompletePod", completeGroup))
+	if timedOutGroups := h.ReleaseTimedOutAffinityGroups(); len(timedOutGroups) != 0 {
+		t.Errorf("Expected no group to be released before the timeout, but got %v", timedOutGroups)
+	}
+
+	// the incomplete group is only reported once after the timeout, and its pods are not deleted
+	g := h.affinityGroups[incompleteGroup.Name]
+	g.incompleteSince = time.Now().Add(-time.Hour)
+	if !h.affinityGroups[completeGroup.Name].incompleteSince.IsZero() {
+		t.Errorf("Expected group %v to be complete", completeGroup.Name)
+	}
+	timedOutGroups := h.ReleaseTimedOutAffinityGroups()
+	if len(timedOutGroups) != 1 || timedOutGroups[0].Name != incompleteGroup.Name || timedOutGroups[0].DeletePods ||
+		len(timedOutGroups[0].Pods) != 1 || timedOutGroups[0].Pods[0] != createdPod {
+		t.Fatalf("Expected group %v to be reported with its created pod, but got %v",
+			incompleteGroup.Name, timedOutGroups)
+	}
+	if status := h.GetAffinityGroup(incompleteGroup.Name).Status; status.IncompleteReason != timedOutGroups[0].Reason ||
+		status.ReleaseReason != "" {
+		t.Errorf("Expected the incomplete reason %v in the group status, but got %v",
+			timedOutGroups[0].Reason, common.ToJson(status))
+	}
+	if timedOutGroups = h.ReleaseTimedOutAffinityGroups(); len(timedOutGroups) != 0 {
+		t.Errorf("Expected the incomplete group to be reported only once, but got %v", timedOutGroups)
+	}
+
+	// neither a group recovered from its bound pods nor a gang release group is timed out
+	recoveredH := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(recoveredH)
+	recoveredH.AddAllocatedPod(createdPod)
+	if !recoveredH.affinityGroups[incompleteGroup.Name].incompleteSince.IsZero() {
+		t.Errorf("Expected the recovered group %v not to be timed out", incompleteGroup.Name)
+	}
+	gangReleaseGroup := &api.AffinityGroupSpec{
+		Name:    "gangTimeoutReleaseGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 1}},
+	}
+	gangReleasePod := schedule(newTestPod("gangTimeoutReleasePod0", api.PodSchedulingSpec{
+		VirtualCluster:    "VC1",
+		Priority:          1,
+		LeafCellType:      "DGX2-V100",
+		LeafCellNumber:    1,
+		GangReleaseEnable: true,
+		AffinityGroup:     gangReleaseGroup,
+	}))
+	if !h.affinityGroups[gangReleaseGroup.Name].incompleteSince.IsZero() {
+		t.Errorf("Expected the gang release group %v not to be timed out", gangReleaseGroup.Name)
+	}
+	h.DeleteAllocatedPod(gangReleasePod)
+
+	// the incomplete group is released once its pods are to be deleted
+	sConfig.GangSchedulingTimeoutDeletePods = common.PtrBool(true)
+	h.UpdatePolicies(sConfig)
+	timedOutGroups = h.ReleaseTimedOutAffinityGroups()
+	if len(timedOutGroups) != 1 || timedOutGroups[0].Name != incompleteGroup.Name || !timedOutGroups[0].DeletePods ||
+		len(timedOutGroups[0].Pods) != 1 || timedOutGroups[0].Pods[0] != createdPod {
+		t.Fatalf("Expected group %v to be released with its created pod, but got %v",
+			incompleteGroup.Name, timedOutGroups)
+	}
+	if status := h.GetAffinityGroup(incompleteGroup.Name).Status; status.ReleaseReason != timedOutGroups[0].Reason {
+		t.Errorf("Expected the release reason %v in the group status, but got %v",
+			timedOutGroups[0].Reason, status.ReleaseReason)
+	}
+	// the missing pod waits until the created one is deleted
+	missingPod := newPod("gangTimeoutPod1", incompleteGroup)
+	if psr := h.Schedule(missingPod, allNodes, internal.PreemptingPhase); psr.PodWaitInfo == nil {
+		t.Errorf("Expected the missing pod to wait, but got %v", psr)
+	}
+	if timedOutGroups = h.ReleaseTimedOutAffinityGroups(); len(timedOutGroups) != 1 {
+		t.Errorf("Expected the released group to be returned until its pods are deleted, but got %v",
+			timedOutGroups)
+	}
+	h.DeleteAllocatedPod(createdPod)
+	if _, ok := h.affinityGroups[incompleteGroup.Name]; ok {
+		t.Fatalf("Group %v is expected to be deleted, but not", incompleteGroup.Name)
+	}
+	for _, leafCell := range g.physicalLeafCellPlacement[memberKey{leafCellNum: 8}][0] {
+		if pLeafCell := leafCell.(*PhysicalCell); pLeafCell.GetState() != cellFree {
+			t.Errorf("Cell %v is expected to be released, but is %v", pLeafCell.GetAddress(), pLeafCell.GetState())
+		}
+	}
+	schedule(missingPod)
+	if h.affinityGroups[incompleteGroup.Name].releaseReason != "" {
+		t.Errorf("Expected the missing pod to be scheduled in a new group")
+	}
+}
+
+func testExplainConfig(t *testing.T, configFilePath string) {
+	explanation := ExplainConfig(api.NewConfig(api.InitRawConfigStrict(&configFilePath)))
+	vcExplanations := strings.SplitN(explanation, "\nVirtual Clusters:\n", 2)
+	if len(vcExplanations) != 2 {
+		t.Fatalf("Expected the explanation to contain the virtual clusters, but got:\n%v", explanation)
+	}
+	// the cell chains and the VC quotas
+	for _, expected := range []string{
+		"  3-DGX1-P100-NODE: 3-DGX1-P100-NODE -> DGX1-P100-NODE -> DGX1-P100-CPU-SOCKET -> " +
+			"DGX1-P100-PCI-SWITCH -> DGX1-P100\n",
+		"    Level 4: cellType DGX1-P100-NODE, 8 leaf cells per cell, 3 cells in total\n",
+		"  CT1-NODE: CT1-NODE -> CT1\n",
+		"    Level 1: cellType CT1, 1 leaf cells per cell, 6 cells in total\n",
+	} {
+		if !strings.Contains(vcExplanations[0], expected) {
+			t.Errorf("Expected the explanation to contain %q, but got:\n%v", expected, vcExplanations[0])
+		}
+	}
+	vc2Explanation := vcExplanations[1][strings.Index(vcExplanations[1], "  VC2: "):]
+	for _, expected := range []string{
+		"    3-DGX1-P100-NODE Level 4: 2 cells of cellType DGX1-P100-NODE, 16 leaf cells\n",
+		"    3-DGX1-P100-NODE Level 3: 2 cells of cellType DGX1-P100-CPU-SOCKET, 8 leaf cells\n",
+		"    CT1-NODE Level 2: 1 cells of cellType CT1-NODE, 2 leaf cells\n",
+	} {
+		if !strings.Contains(vc2Explanation, expected) {
+			t.Errorf("Expected the explanation of VC2 to contain %q, but got:\n%v", expected, vc2Explanation)
+		}
+	}
+	if expected := "    Pinned Cell VC1-YQW-CT1: CT1-NODE Level 1, address 1.0.0.2/8\n"; !strings.Contains(
+		vcExplanations[1], expected) {
+		t.Errorf("Expected the explanation to contain %q, but got:\n%v", expected, vcExplanations[1])
+	}
+}
+
+func testUpdatePolicies(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.MaxOpportunisticLeafCells = map[string]int32{"DGX1-P100": 4}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newOpportunisticPod := func(name string, leafCellNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       int32(opportunisticPriority),
+			LeafCellType:   "DGX1-P100",
+			LeafCellNumber: leafCellNumber,
+		})
+	}
+	pod := newOpportunisticPod("updatePoliciesPod0", 4)
+	psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("Expected opportunistic pod %v to be scheduled, but got %v", pod.Name, psr)
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+	pod = newOpportunisticPod("updatePoliciesPod1", 1)
+	if psr = h.Schedule(pod, allNodes, internal.PreemptingPhase); psr.PodBindInfo != nil {
+		t.Fatalf("Expected opportunistic pod %v to wait for the usage cap of VC2, but got %v", pod.Name, psr)
+	}
+
+	newConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	vcSpec = (*newConfig.VirtualClusters)["VC2"]
+	vcSpec.MaxOpportunisticLeafCells = map[string]int32{"DGX1-P100": 8}
+	vcSpec.FairShareWeight = common.PtrInt32(3)
+	(*newConfig.VirtualClusters)["VC2"] = vcSpec
+	newConfig.GangSchedulingTimeoutSec = common.PtrInt64(60)
+	diff := api.DiffConfig(sConfig, newConfig)
+	if diff.ClusterChanged() || !diff.PoliciesChanged() {
+		t.Fatalf("Expected only the scheduling policies to be changed, but got: %v", diff)
+	}
+	h.UpdatePolicies(newConfig)
+	if usage := h.GetOpportunisticUsage("VC2"); usage.UsedLeafCells["DGX1-P100"] != 4 ||
+		usage.MaxLeafCells["DGX1-P100"] != 8 {
+		t.Errorf("Expected 4 of at most 8 opportunistic leaf cells used by VC2, but got %v", common.ToJson(usage))
+	}
+	if h.vcFairShareWeights["VC2"] != 3 || h.gangSchedulingTimeout != 60*time.Second {
+		t.Errorf("Expected the policies to be updated, but got fair share weight %v and gang scheduling timeout %v",
+			h.vcFairShareWeights["VC2"], h.gangSchedulingTimeout)
+	}
+	if psr = h.Schedule(pod, allNodes, internal.PreemptingPhase); psr.PodBindInfo == nil {
+		t.Errorf("Expected opportunistic pod %v to be scheduled with the new usage cap, but got %v", pod.Name, psr)
+	}
+}
+
+func testInheritState(t *testing.T, configFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
+	sConfig.GangSchedulingTimeoutSec = common.PtrInt64(600)
+	h := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(h)
+	newPod := func(name string, group *api.AffinityGroupSpec, gangReleaseEnable bool) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster:    "VC1",
+			Priority:          1,
+			LeafCellType:      "DGX2-V100",
+			LeafCellNumber:    8,
+			GangReleaseEnable: gangReleaseEnable,
+			AffinityGroup:     group,
+		})
+	}
+	schedule := func(pod *core.Pod) *core.Pod {
+		psr := h.Schedule(pod, allNodes, internal.PreemptingPhase)
+		if psr.PodBindInfo == nil {
+			t.Fatalf("Pod %v is expected to be scheduled, but got %v", pod.Name, psr)
+		}
+		boundPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(boundPod)
+		return boundPod
+	}
+	// a gang release group with a completed pod, an incomplete group, and a waiting group
+	releaseGroup := &api.AffinityGroupSpec{
+		Name:    "inheritReleaseGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 8}},
+	}
+	completedPod := schedule(newPod("inheritReleasePod0", releaseGroup, true))
+	releasePod := schedule(newPod("inheritReleasePod1", releaseGroup, true))
+	incompleteGroup := &api.AffinityGroupSpec{
+		Name:    "inheritIncompleteGroup",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, LeafCellNumber: 8}},
+	}
+	incompletePod := schedule(newPod("inheritIncompletePod0", incompleteGroup, false))
+	h.DeleteAllocatedPod(completedPod)
+	incompleteSince := time.Now().Add(-time.Hour)
+	h.affinityGroups[incompleteGroup.Name].incompleteSince = incompleteSince
+	waitingSince := time.Now().Add(-time.Hour)
+	h.waitingGroups["inheritWaitingGroup"] = &waitingAffinityGroup{waitingSince: waitingSince}
+
+	// the states are lost by replaying the pods, and then inherited
+	newH := NewHivedAlgorithm(sConfig)
+	setHealthyNodes(newH)
+	newH.AddAllocatedPod(releasePod)
+	newH.AddAllocatedPod(incompletePod)
+	newH.InheritState(h)
+	g := newH.affinityGroups[releaseGroup.Name]
+	if g.releasedPods[memberKey{leafCellNum: 8}][0] != completedPod.UID {
+		t.Errorf("Expected pod %v to be released, but got %v", completedPod.Name, g.releasedPods)
+	}
+	usedLeafCellNum := 0
+	for _, ccl := range newH.fullCellList {
+		for _, c := range ccl[lowestLevel] {
+			if c.(*PhysicalCell).GetState() == cellUsed {
+				usedLeafCellNum++
+			}
+		}
+	}
+	// 8 leaf cells of the remaining pod in the gang release group, and 16 of the incomplete group
+	if usedLeafCellNum != 24 {
+		t.Errorf("Expected 24 used leaf cells after the completed pod is released, but got %v", usedLeafCellNum)
+	}
+	if since := newH.affinityGroups[incompleteGroup.Name].incompleteSince; !since.Equal(incompleteSince) {
+		t.Errorf("Expected group %v to be incomplete since %v, but got %v", incompleteGroup.Name, incompleteSince, since)
+	}
+	if wg := newH.waitingGroups["inheritWaitingGroup"]; wg == nil || !wg.waitingSince.Equal(waitingSince) {
+		t.Errorf("Expected the waiting group to be waiting since %v, but got %v", waitingSince, wg)
+	}
+}
+
 func compareLeafCellIsolation(a []int32, b []int32) bool {
 	if len(a) == len(b) {
 		for i := 0; i < len(a); i++ {
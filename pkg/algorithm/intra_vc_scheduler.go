@@ -42,31 +42,79 @@ type intraVCScheduler interface {
 	schedule(schedulingRequest) (groupVirtualPlacement, string)
 }
 
+// intraVCSchedulerConstructor creates an intraVCScheduler from the cells of a VC.
+type intraVCSchedulerConstructor func(
+	nonPinnedFullList map[CellChain]ChainCellList,
+	nonPinnedFreeList map[CellChain]ChainCellList,
+	pinnedList map[api.PinnedCellId]ChainCellList,
+	leafCellNums map[CellChain]map[CellLevel]int32) intraVCScheduler
+
+// intraVCSchedulerRegistry maps each of api.IntraVCSchedulerPolicies to the constructor of its implementation.
+// The policies only decide the placement inside a VC. The placement is always mapped to the physical cluster
+// by the buddy cell allocation, hence the VC safety does not depend on the policy.
+var intraVCSchedulerRegistry = map[api.IntraVCSchedulerPolicy]intraVCSchedulerConstructor{
+	api.IntraVCSchedulerTopologyPacking: newDefaultIntraVCSchedulerConstructor(packNodes),
+	api.IntraVCSchedulerSpread:          newDefaultIntraVCSchedulerConstructor(spreadNodes),
+	api.IntraVCSchedulerFirstFit:        newDefaultIntraVCSchedulerConstructor(firstFitNodes),
+}
+
+// newIntraVCScheduler creates the intraVCScheduler of a VC according to its policy.
+func newIntraVCScheduler(
+	policy api.IntraVCSchedulerPolicy,
+	nonPinnedFullList map[CellChain]ChainCellList,
+	nonPinnedFreeList map[CellChain]ChainCellList,
+	pinnedList map[api.PinnedCellId]ChainCellList,
+	leafCellNums map[CellChain]map[CellLevel]int32) intraVCScheduler {
+
+	if policy == "" {
+		policy = api.IntraVCSchedulerTopologyPacking
+	}
+	constructor, ok := intraVCSchedulerRegistry[policy]
+	if !ok {
+		panic(fmt.Sprintf("Unknown intra-VC scheduler %v", policy))
+	}
+	return constructor(nonPinnedFullList, nonPinnedFreeList, pinnedList, leafCellNums)
+}
+
 type defaultIntraVCScheduler struct {
 	nonPinnedFullCellList     map[CellChain]ChainCellList
 	nonPinnedPreassignedCells map[CellChain]ChainCellList
 	pinnedCells               map[api.PinnedCellId]ChainCellList
 	// Currently we create a topologyAwareScheduler for each cluster view (each chain, each pinned cell).
-	// We plan to support multiple cluster views in one scheduler, and to support schedule pods
-	// across different cluster views.
-	// TODO: Support an affinity group can relax to be allocated across multiple chains.
+	// We plan to support multiple cluster views in one scheduler.
+	// An affinity group allowed to cross chains is split by HivedAlgorithm into one request per chain.
 	nonPinnedCellSchedulers map[CellChain]*topologyAwareScheduler
 	pinnedCellSchedulers    map[api.PinnedCellId]*topologyAwareScheduler
 }
 
+// newDefaultIntraVCSchedulerConstructor returns a constructor of defaultIntraVCScheduler
+// which selects nodes using the given policy.
+func newDefaultIntraVCSchedulerConstructor(nodeSelection nodeSelectionPolicy) intraVCSchedulerConstructor {
+	return func(
+		nonPinnedFullList map[CellChain]ChainCellList,
+		nonPinnedFreeList map[CellChain]ChainCellList,
+		pinnedList map[api.PinnedCellId]ChainCellList,
+		leafCellNums map[CellChain]map[CellLevel]int32) intraVCScheduler {
+
+		return newDefaultIntraVCScheduler(nonPinnedFullList, nonPinnedFreeList, pinnedList, leafCellNums, nodeSelection)
+	}
+}
+
 func newDefaultIntraVCScheduler(
 	nonPinnedFullList map[CellChain]ChainCellList,
 	nonPinnedFreeList map[CellChain]ChainCellList,
 	pinnedList map[api.PinnedCellId]ChainCellList,
-	leafCellNums map[CellChain]map[CellLevel]int32) *defaultIntraVCScheduler {
+	leafCellNums map[CellChain]map[CellLevel]int32,
+	nodeSelection nodeSelectionPolicy) *defaultIntraVCScheduler {
 
 	snr := map[CellChain]*topologyAwareScheduler{}
 	sr := map[api.PinnedCellId]*topologyAwareScheduler{}
 	for chain, ccl := range nonPinnedFullList {
-		snr[chain] = NewTopologyAwareScheduler(ccl, leafCellNums[chain], true)
+		snr[chain] = NewTopologyAwareScheduler(ccl, leafCellNums[chain], true, nodeSelection)
 	}
 	for pid, ccl := range pinnedList {
-		sr[pid] = NewTopologyAwareScheduler(ccl, leafCellNums[ccl[CellLevel(1)][0].GetChain()], true)
+		sr[pid] = NewTopologyAwareScheduler(
+			ccl, leafCellNums[ccl[CellLevel(1)][0].GetChain()], true, nodeSelection)
 	}
 	return &defaultIntraVCScheduler{
 		nonPinnedFullCellList:     nonPinnedFullList,
@@ -102,16 +150,23 @@ func (s *defaultIntraVCScheduler) schedule(
 	}
 	klog.Infof("Processing scheduling request in VC %v: %v, leaf cell numbers %v, priority %v",
 		sr.vc, str, common.ToJson(sr.affinityGroupPodNums), sr.priority)
+	var (
+		podPlacements map[int32][]CellList
+		podAffinities map[int32][]CellLevel
+	)
 	if scheduler != nil {
-		placement, failedReason = scheduler.Schedule(
+		podPlacements, podAffinities, failedReason = scheduler.Schedule(
 			sr.affinityGroupPodNums,
 			sr.priority,
 			sr.suggestedNodes,
-			sr.ignoreSuggestedNodes)
+			sr.ignoreSuggestedNodes,
+			sr.excludedNodes,
+			sr.retry)
 	}
+	placement = newMemberPlacement(sr.memberLeafCellType, podPlacements)
 	if placement == nil {
 		return nil, fmt.Sprintf("%v when scheduling in VC %v", failedReason, sr.vc)
 	}
-	klog.Infof("Found placement in VC %v: %v", sr.vc, placement)
+	klog.Infof("Found placement in VC %v: %v, affinity levels %v", sr.vc, placement, common.ToJson(podAffinities))
 	return placement, ""
 }
@@ -24,18 +24,40 @@ package algorithm
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 )
 
+// nodeSelectionPolicy decides how the nodes in a cluster view are selected for a set of pods.
+type nodeSelectionPolicy int
+
+const (
+	// prefer the nodes with fewer free leaf cells
+	packNodes nodeSelectionPolicy = iota
+	// prefer the nodes with more free leaf cells, and try to place the pods on different nodes
+	spreadNodes
+	// prefer the nodes in the order of the cluster view
+	firstFitNodes
+	// prefer the nodes as packNodes, but search by backtracking if that fails,
+	// so that a feasible placement is found whenever one exists
+	packNodesWithBacktracking
+)
+
 // topologyAwareScheduler can schedule a set of pods on a cluster view.
-// It first tries to place pods to nodes with fewer free leaf cells (i.e., packing), while trying to avoid preemptions.
+// By default, it first tries to place pods to nodes where the pods can get better affinity,
+// and then to nodes with fewer free leaf cells (i.e., packing), while trying to avoid preemptions.
 // Then inside each node, it tries to allocate leaf cells with better affinity.
 type topologyAwareScheduler struct {
 	// a list of nodes (node-level cells or top-level cells that are lower than node level)
 	cv clusterView
+	// the nodes extracted from the free cell list. if some of them are top-level virtual cells lower than
+	// node level, cv is regrouped from them before each scheduling (see groupSubNodeCells).
+	nodes clusterView
+	// if there are top-level virtual cells lower than node level
+	hasSubNodeCells bool
 	// leaf cell number at each level in the cell hierarchy. we use this to
 	// calculate the optimal affinity for a given leaf cell number.
 	levelLeafCellNum map[CellLevel]int32
@@ -46,6 +68,8 @@ type topologyAwareScheduler struct {
 	// because guaranteed pods can avoid preempting opportunistic pods only among buddy cells (this is decided
 	// by the buddy cell allocation algorithm).
 	crossPriorityPack bool
+	// how to select the nodes for the pods
+	nodeSelection nodeSelectionPolicy
 }
 
 // NewTopologyAwareScheduler initializes the scheduler by extracting node-level cells
@@ -53,21 +77,40 @@ type topologyAwareScheduler struct {
 func NewTopologyAwareScheduler(
 	ccl ChainCellList,
 	levelLeafCellNum map[CellLevel]int32,
-	crossPriorityPack bool) *topologyAwareScheduler {
+	crossPriorityPack bool,
+	nodeSelection nodeSelectionPolicy) *topologyAwareScheduler {
 
+	cv := newClusterView(ccl)
+	hasSubNodeCells := false
+	for _, n := range cv {
+		if _, ok := n.c.(*VirtualCell); ok && !n.c.AtOrHigherThanNode() {
+			hasSubNodeCells = true
+			break
+		}
+	}
 	return &topologyAwareScheduler{
-		cv:                newClusterView(ccl),
+		cv:                cv,
+		nodes:             cv,
+		hasSubNodeCells:   hasSubNodeCells,
 		levelLeafCellNum:  levelLeafCellNum,
 		crossPriorityPack: crossPriorityPack,
+		nodeSelection:     nodeSelection,
 	}
 }
 
+// Schedule finds a placement for the pods, and the affinity level achieved by each pod in the placement
+// (i.e., the level of the lowest common ancestor of its leaf cells). The excluded nodes (if any) are
+// treated as non-suggested. When retrying a placement that failed (retry > 0), the ties among the nodes
+// are broken by a shuffle seeded with the retry number, so as to find an alternative placement.
 func (t *topologyAwareScheduler) Schedule(
 	podLeafCellNumbers map[int32]int32,
 	p CellPriority,
 	suggestedNodes common.Set,
-	ignoreSuggestedNodes bool) (
+	ignoreSuggestedNodes bool,
+	excludedNodes common.Set,
+	retry int32) (
 	podPlacements map[int32][]CellList,
+	podAffinities map[int32][]CellLevel,
 	failedReason string) {
 
 	// leaf cell numbers of the pods to schedule
@@ -79,45 +122,68 @@ func (t *topologyAwareScheduler) Schedule(
 	}
 	common.SortInt32(sortedPodLeafCellNumbers)
 
+	if t.hasSubNodeCells {
+		t.cv = t.groupSubNodeCells(excludedNodes)
+	}
+	if retry > 0 {
+		// shuffle a copy of the cluster view, so that the node order kept for the later requests is not affected
+		cv := t.cv
+		defer func() { t.cv = cv }()
+		t.cv = append(clusterView{}, cv...)
+		rand.New(rand.NewSource(int64(retry))).Shuffle(len(t.cv), func(i, j int) {
+			t.cv[i], t.cv[j] = t.cv[j], t.cv[i]
+		})
+	}
+	// the largest pod, for which we evaluate the affinity that can be achieved in each node
+	maxPodLeafCellNum := sortedPodLeafCellNumbers[len(sortedPodLeafCellNumbers)-1]
 	// disable preemption first (reduce preemption)
 	priority := opportunisticPriority
-	t.updateClusterView(priority, suggestedNodes, ignoreSuggestedNodes)
+	t.updateClusterView(priority, suggestedNodes, ignoreSuggestedNodes, excludedNodes, maxPodLeafCellNum)
 	// try to fit the pods to a set of nodes
-	selectedNodeIndices, failedReason := findNodesForPods(t.cv, sortedPodLeafCellNumbers)
+	selectedNodeIndices, failedReason := t.findNodesForPods(sortedPodLeafCellNumbers)
 	// enable preemption if scheduling failed
 	if selectedNodeIndices == nil && p > opportunisticPriority {
 		priority = p
-		t.updateClusterView(priority, suggestedNodes, ignoreSuggestedNodes)
-		selectedNodeIndices, failedReason = findNodesForPods(t.cv, sortedPodLeafCellNumbers)
+		t.updateClusterView(priority, suggestedNodes, ignoreSuggestedNodes, excludedNodes, maxPodLeafCellNum)
+		selectedNodeIndices, failedReason = t.findNodesForPods(sortedPodLeafCellNumbers)
 	}
 	if selectedNodeIndices == nil {
-		return nil, failedReason
+		return nil, nil, failedReason
 	}
 	// find leaf cells inside the selected node for each pod
-	selectedNodes := make(CellList, len(sortedPodLeafCellNumbers))
+	selectedNodes := make([]*node, len(sortedPodLeafCellNumbers))
 	for i := 0; i < len(selectedNodeIndices); i++ {
-		selectedNodes[i] = t.cv[selectedNodeIndices[i]].c
+		selectedNodes[i] = t.cv[selectedNodeIndices[i]]
 	}
 	selectedLeafCells := CellList{}
 	nodeAvailableLeafCells := map[Cell]CellList{}
 	podPlacements = map[int32][]CellList{}
+	podAffinities = map[int32][]CellLevel{}
 	for podIndex := 0; podIndex < len(sortedPodLeafCellNumbers); podIndex++ {
 		leafCellNumber := sortedPodLeafCellNumbers[podIndex]
 		n := selectedNodes[podIndex]
-		// TODO: Optimize findNodesForPods and findLeafCellsInNode together to get a better placement,
-		//  such as also aware intra node topology when findNodesForPods.
-		selectedLeafCells, nodeAvailableLeafCells[n] = findLeafCellsInNode(n, leafCellNumber, priority, nodeAvailableLeafCells[n], t.levelLeafCellNum)
+		if n.cells == nil {
+			selectedLeafCells, nodeAvailableLeafCells[n.c] = findLeafCellsInNode(
+				n.c, leafCellNumber, priority, nodeAvailableLeafCells[n.c], t.levelLeafCellNum)
+		} else {
+			selectedLeafCells = findLeafCellsInGroupedNode(
+				n.cells, leafCellNumber, priority, nodeAvailableLeafCells, t.levelLeafCellNum)
+		}
 		if podPlacements[leafCellNumber] == nil {
 			podPlacements[leafCellNumber] = []CellList{}
 		}
 		podPlacements[leafCellNumber] = append(podPlacements[leafCellNumber], selectedLeafCells)
+		podAffinities[leafCellNumber] = append(podAffinities[leafCellNumber], getAffinityLevel(selectedLeafCells))
 	}
-	return podPlacements, ""
+	return podPlacements, podAffinities, ""
 }
 
 type node struct {
 	c                             Cell            // a node-level cell or a top-level cell that is lower than node level
+	cells                         CellList        // top-level cells lower than node level grouped in the node (nil if not grouped)
+	index                         int             // index of the node when the cluster view is created
 	freeLeafCellNumAtPriority     int32           // free leaf cell number at the priority of the pod to be scheduled (lower priority considered as free)
+	affinity                      CellLevel       // the best affinity level that the largest pod to be scheduled can achieve in the node
 	usedLeafCellNumSamePriority   int32           // leaf cell number used by the same priority as that of the pod to be scheduled
 	usedLeafCellNumHigherPriority int32           // leaf cell number used by higher priorities than that of the pod to be scheduled
 	healthy                       bool            // if the node is healthy
@@ -136,32 +202,43 @@ type node struct {
 // so that nodes with more used leaf cells will be preferred (i.e., pack pods globally across priorities).
 // In this case a feasible pod placement is guaranteed to be found (as long as all nodes are in suggested nodes).
 func (n *node) updateUsedLeafCellNumForPriority(p CellPriority, crossPriorityPack bool) {
-	n.usedLeafCellNumSamePriority = n.c.GetUsedLeafCellNumAtPriorities()[p]
+	n.usedLeafCellNumSamePriority = 0
 	n.usedLeafCellNumHigherPriority = 0
-	n.freeLeafCellNumAtPriority = n.c.GetTotalLeafCellNum()
-	for priority, num := range n.c.GetUsedLeafCellNumAtPriorities() {
-		if crossPriorityPack {
-			if priority != p {
-				n.usedLeafCellNumSamePriority += num
+	n.freeLeafCellNumAtPriority = 0
+	for _, c := range n.members() {
+		n.usedLeafCellNumSamePriority += c.GetUsedLeafCellNumAtPriorities()[p]
+		n.freeLeafCellNumAtPriority += c.GetTotalLeafCellNum()
+		for priority, num := range c.GetUsedLeafCellNumAtPriorities() {
+			if crossPriorityPack {
+				if priority != p {
+					n.usedLeafCellNumSamePriority += num
+				}
+			} else if priority > p {
+				n.usedLeafCellNumHigherPriority += num
+			}
+			if priority >= p {
+				n.freeLeafCellNumAtPriority -= num
 			}
-		} else if priority > p {
-			n.usedLeafCellNumHigherPriority += num
-		}
-		if priority >= p {
-			n.freeLeafCellNumAtPriority -= num
 		}
 	}
 }
 
+// members returns the cells in the node.
+func (n *node) members() CellList {
+	if n.cells == nil {
+		return CellList{n.c}
+	}
+	return n.cells
+}
+
 type clusterView []*node
 
 func newClusterView(ccl ChainCellList) clusterView {
 	var l CellLevel
-	// TODO: currently if a top-level cell is lower than node level, it will be considered as a single node.
+	// If a top-level cell is lower than node level, it will be considered as a single node here.
 	// For example, 2 single leaf-level cells are considered as 2 nodes each with 1 leaf cell.
-	// We cannot merge them because the 2 cells might be mapped to different physical nodes.
-	// We plan to support using multiple cells in a best-effort manner (for example, schedule a 2-leaf-cell pod
-	// on 2 1-leaf-cell cells, if we can find 2 1-leaf-cell cells that can be mapped to the same physical node).
+	// For virtual cells, such cells are further grouped by their (bindable) physical nodes
+	// before each scheduling (see groupSubNodeCells).
 	for l = CellLevel(1); l <= CellLevel(len(ccl)); l++ {
 		if ccl[l][0].AtOrHigherThanNode() {
 			break
@@ -171,13 +248,110 @@ func newClusterView(ccl ChainCellList) clusterView {
 	for ; l >= lowestLevel; l-- {
 		for _, c := range ccl[l] {
 			if !cv.containsCell(ancestorNoHigherThanNode(c)) {
-				cv = append(cv, &node{c: c})
+				cv = append(cv, &node{c: c, index: len(cv)})
+			}
+		}
+	}
+	return cv
+}
+
+// groupSubNodeCells creates the cluster view for a scheduling, where the top-level virtual cells lower
+// than node level are grouped in a best-effort manner, so that a pod can use multiple such cells:
+// (1) the cells bound to the same physical node are grouped into a node;
+// (2) an unbound cell is added to a node of (1) if the physical node still has a bindable cell at its level;
+// (3) the other unbound cells are grouped into a node, which may be bound to any physical node.
+// The cells used by the same pod will be mapped to the same physical node (see mapVirtualPlacementToPhysical).
+// The mapping may still fail (e.g., the bindable cells are reserved for other VCs), but it will never
+// break the VC safety, because the cells are still mapped by buddy alloc. The excluded cells are not grouped.
+func (t *topologyAwareScheduler) groupSubNodeCells(excludedNodes common.Set) clusterView {
+	cv := clusterView{}
+	var boundNodeNames []string
+	boundGroups := map[string]*node{}
+	var unboundCells CellList
+	for _, n := range t.nodes {
+		vc, ok := n.c.(*VirtualCell)
+		if !ok || n.c.AtOrHigherThanNode() || excludedNodes.Contains(n.c) {
+			cv = append(cv, n)
+			continue
+		}
+		pc := vc.GetPhysicalCell()
+		if pc == nil {
+			unboundCells = append(unboundCells, n.c)
+			continue
+		}
+		nodeNames, _ := pc.GetPhysicalPlacement()
+		if g := boundGroups[nodeNames[0]]; g != nil {
+			g.cells = append(g.cells, n.c)
+		} else {
+			boundGroups[nodeNames[0]] = &node{c: n.c, cells: CellList{n.c}, index: n.index}
+			boundNodeNames = append(boundNodeNames, nodeNames[0])
+		}
+	}
+	var unboundGroup *node
+	bindableCellNums := map[string]map[CellLevel]int32{}
+	for _, c := range unboundCells {
+		var group *node
+		for _, nodeName := range boundNodeNames {
+			g := boundGroups[nodeName]
+			if bindableCellNums[nodeName] == nil {
+				bindableCellNums[nodeName] = map[CellLevel]int32{}
+			}
+			if _, ok := bindableCellNums[nodeName][c.GetLevel()]; !ok {
+				physicalNode := ancestorNoHigherThanNode(g.c.(*VirtualCell).GetPhysicalCell()).(*PhysicalCell)
+				bindableCellNums[nodeName][c.GetLevel()] = countBindableCells(physicalNode, c.GetLevel())
+			}
+			if bindableCellNums[nodeName][c.GetLevel()] > 0 {
+				bindableCellNums[nodeName][c.GetLevel()]--
+				group = g
+				break
 			}
 		}
+		if group == nil {
+			if unboundGroup == nil {
+				unboundGroup = &node{c: c, index: t.nodes.indexOf(c)}
+			}
+			group = unboundGroup
+		}
+		group.cells = append(group.cells, c)
+	}
+	for _, nodeName := range boundNodeNames {
+		cv = append(cv, boundGroups[nodeName])
+	}
+	if unboundGroup != nil {
+		cv = append(cv, unboundGroup)
 	}
 	return cv
 }
 
+// countBindableCells counts the cells at a level inside a physical cell that can be bound to a virtual cell,
+// i.e., neither the cell nor its ancestors (inside the physical cell) or descendants are bound.
+func countBindableCells(c *PhysicalCell, l CellLevel) int32 {
+	if c.GetVirtualCell() != nil {
+		return 0
+	}
+	if c.GetLevel() == l {
+		if hasBoundDescendant(c) {
+			return 0
+		}
+		return 1
+	}
+	num := int32(0)
+	for _, child := range c.GetChildren() {
+		num += countBindableCells(child.(*PhysicalCell), l)
+	}
+	return num
+}
+
+// hasBoundDescendant checks if any descendant of a physical cell is bound to a virtual cell.
+func hasBoundDescendant(c *PhysicalCell) bool {
+	for _, child := range c.GetChildren() {
+		if child.(*PhysicalCell).GetVirtualCell() != nil || hasBoundDescendant(child.(*PhysicalCell)) {
+			return true
+		}
+	}
+	return false
+}
+
 // ancestorNoHigherThanNode finds an ancestor at a level no higher than node level for a cell.
 // If the input cell is at node (or higher) level, will return the cell itself.
 func ancestorNoHigherThanNode(c Cell) Cell {
@@ -189,12 +363,17 @@ func ancestorNoHigherThanNode(c Cell) Cell {
 }
 
 func (cv clusterView) containsCell(c Cell) bool {
-	for _, n := range cv {
+	return cv.indexOf(c) >= 0
+}
+
+// indexOf returns the index of the node of a cell in the cluster view (-1 if not found).
+func (cv clusterView) indexOf(c Cell) int {
+	for i, n := range cv {
 		if CellEqual(c, n.c) {
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
 // Methods for sorting nodes in a clusterView.
@@ -227,18 +406,45 @@ func (cv clusterView) Swap(i int, j int) {
 	cv[i], cv[j] = cv[j], cv[i]
 }
 
-// updateClusterView updates the leaf cell numbers of the nodes for the sorting.
+// updateClusterView updates the leaf cell numbers of the nodes for the sorting,
+// and (for packing) the affinity that a pod with the given leaf cell number can achieve in each node.
 func (t *topologyAwareScheduler) updateClusterView(
 	p CellPriority,
 	suggestedNodes common.Set,
-	ignoreSuggestedNodes bool) {
+	ignoreSuggestedNodes bool,
+	excludedNodes common.Set,
+	podLeafCellNum int32) {
 
 	for _, n := range t.cv {
 		n.updateUsedLeafCellNumForPriority(p, t.crossPriorityPack)
 		n.healthy, n.suggested, n.nodeAddress = nodeHealthyAndInSuggested(n, suggestedNodes, ignoreSuggestedNodes)
+		if excludedNodes.Contains(n.c) {
+			n.suggested = false
+			n.nodeAddress = n.c.GetAddress()
+		}
+		n.affinity = lowestLevel
+		if (t.nodeSelection == packNodes || t.nodeSelection == packNodesWithBacktracking) && podLeafCellNum > 1 {
+			n.updateAffinity(p, podLeafCellNum, t.levelLeafCellNum)
+		}
 	}
 }
 
+// updateAffinity evaluates the best affinity level that a pod can achieve in the node
+// (highestLevel if the pod cannot fit in the node).
+func (n *node) updateAffinity(p CellPriority, podLeafCellNum int32, levelLeafCellNum map[CellLevel]int32) {
+	if n.freeLeafCellNumAtPriority < podLeafCellNum {
+		n.affinity = highestLevel
+		return
+	}
+	var leafCells CellList
+	if n.cells == nil {
+		leafCells, _ = findLeafCellsInNode(n.c, podLeafCellNum, p, nil, levelLeafCellNum)
+	} else {
+		leafCells = findLeafCellsInGroupedNode(n.cells, podLeafCellNum, p, map[Cell]CellList{}, levelLeafCellNum)
+	}
+	n.affinity = getAffinityLevel(leafCells)
+}
+
 func nodeHealthyAndInSuggested(
 	n *node,
 	suggestedNodes common.Set,
@@ -264,17 +470,121 @@ func nodeHealthyAndInSuggested(
 	return true, true, ""
 }
 
+// findNodesForPods finds a set of nodes for the pods according to the node selection policy.
+func (t *topologyAwareScheduler) findNodesForPods(leafCellNums []int32) (pickedNodeIndices []int32, failedReason string) {
+	switch t.nodeSelection {
+	case spreadNodes:
+		return spreadNodesForPods(t.cv, leafCellNums)
+	case firstFitNodes:
+		// only avoid bad and non-suggested nodes, and otherwise keep the original order of the nodes
+		sort.SliceStable(t.cv, func(i, j int) bool {
+			if t.cv[i].healthy != t.cv[j].healthy {
+				return t.cv[i].healthy
+			} else if t.cv[i].suggested != t.cv[j].suggested {
+				return t.cv[i].suggested
+			}
+			return t.cv[i].index < t.cv[j].index
+		})
+		return pickNodesInOrder(t.cv, leafCellNums)
+	case packNodesWithBacktracking:
+		return findNodesForPodsWithBacktracking(t.cv, leafCellNums, maxBacktrackingSteps)
+	default:
+		return findNodesForPods(t.cv, leafCellNums)
+	}
+}
+
 // findNodesForPods finds a set of nodes that can accommodate the leaf cell requirements of the pods.
 func findNodesForPods(cv clusterView, leafCellNums []int32) (pickedNodeIndices []int32, failedReason string) {
 	// sort the nodes according to leaf cell numbers in each node.
 	// this is achieved through the Less method defined in type clusterView.
-	// TODO: Ensure Opportunistic Pods also can always can find the solution, regardless of
-	//  the iteration order.
-	//  For example:
+	// Note that without cross-priority packing (i.e., for opportunistic pods), this may fail because of
+	// the iteration order, for example:
 	//   1. clusterView = 2-leaf-cell Node, 1-leaf-cell Node
 	//   2. leafCellNums = 1-leaf-cell Pod, 2-leaf-cell Pod
 	//   First 1-leaf-cell Pod may allocate to 2-leaf-cell Node, but the latter pod cannot be fitted anymore.
+	// findNodesForPodsWithBacktracking is used in this case to find a feasible placement.
 	sort.Stable(cv)
+	// then prefer the nodes where the largest pod can achieve better affinity (keeping the above order
+	// among the nodes with the same affinity). the nodes with better affinity may be the emptier ones,
+	// which cannot accommodate all the pods, so we fall back to the above order in this case.
+	affinityOrderedCv := append(clusterView{}, cv...)
+	sort.SliceStable(affinityOrderedCv, func(i, j int) bool {
+		if affinityOrderedCv[i].healthy != affinityOrderedCv[j].healthy {
+			return affinityOrderedCv[i].healthy
+		} else if affinityOrderedCv[i].suggested != affinityOrderedCv[j].suggested {
+			return affinityOrderedCv[i].suggested
+		}
+		return affinityOrderedCv[i].affinity < affinityOrderedCv[j].affinity
+	})
+	if pickedNodeIndices, _ = pickNodesInOrder(affinityOrderedCv, leafCellNums); pickedNodeIndices != nil {
+		for i, index := range pickedNodeIndices {
+			pickedNodeIndices[i] = int32(cv.indexOf(affinityOrderedCv[index].c))
+		}
+		return pickedNodeIndices, ""
+	}
+	return pickNodesInOrder(cv, leafCellNums)
+}
+
+// findNodesForPodsWithBacktracking first tries findNodesForPods, which may fail only because of the order
+// it picks the nodes (e.g., a 1-leaf-cell pod takes a 2-leaf-cell node needed by a 2-leaf-cell pod).
+// In this case it searches the healthy and suggested nodes by backtracking (the pods with more leaf cells first),
+// which finds a feasible placement whenever one exists, unless the search tries more than maxSteps nodes.
+func findNodesForPodsWithBacktracking(
+	cv clusterView,
+	leafCellNums []int32,
+	maxSteps int) (pickedNodeIndices []int32, failedReason string) {
+
+	if pickedNodeIndices, failedReason = findNodesForPods(cv, leafCellNums); pickedNodeIndices != nil {
+		return pickedNodeIndices, ""
+	}
+	var usableNodeIndices []int32
+	freeLeafCellNums := make([]int32, len(cv)) // free leaf cells left in each node
+	for i, n := range cv {
+		freeLeafCellNums[i] = n.freeLeafCellNumAtPriority
+		if n.healthy && n.suggested {
+			usableNodeIndices = append(usableNodeIndices, int32(i))
+		}
+	}
+	pickedNodeIndices = make([]int32, len(leafCellNums))
+	steps := 0
+	var search func(podIndex int) bool
+	search = func(podIndex int) bool {
+		if podIndex < 0 {
+			return true
+		}
+		// nodes with the same free leaf cell number are equivalent for the remaining pods,
+		// so we only try one of them
+		triedFreeLeafCellNums := common.NewSet()
+		for _, nodeIndex := range usableNodeIndices {
+			if freeLeafCellNums[nodeIndex] < leafCellNums[podIndex] ||
+				triedFreeLeafCellNums.Contains(freeLeafCellNums[nodeIndex]) {
+				continue
+			}
+			if steps++; steps > maxSteps {
+				return false
+			}
+			triedFreeLeafCellNums.Add(freeLeafCellNums[nodeIndex])
+			pickedNodeIndices[podIndex] = nodeIndex
+			freeLeafCellNums[nodeIndex] -= leafCellNums[podIndex]
+			found := search(podIndex - 1)
+			freeLeafCellNums[nodeIndex] += leafCellNums[podIndex]
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+	if search(len(leafCellNums) - 1) {
+		return pickedNodeIndices, ""
+	}
+	if steps > maxSteps {
+		return nil, fmt.Sprintf("cannot find a placement within %v search steps", maxSteps)
+	}
+	return nil, failedReason
+}
+
+// pickNodesInOrder picks nodes for the pods by trying the nodes one by one in the order of the cluster view.
+func pickNodesInOrder(cv clusterView, leafCellNums []int32) (pickedNodeIndices []int32, failedReason string) {
 	pickedNodeIndices = make([]int32, len(leafCellNums)) // indices of the currently picked nodes
 	podIndex := 0
 	pickedLeafCellNum := int32(0)
@@ -305,6 +615,44 @@ func findNodesForPods(cv clusterView, leafCellNums []int32) (pickedNodeIndices [
 	return nil, "insufficient capacity"
 }
 
+// spreadNodesForPods picks nodes for the pods (starting from the pod with the most leaf cells),
+// each time choosing the node with the most free leaf cells left, so that the pods are spread over the nodes.
+func spreadNodesForPods(cv clusterView, leafCellNums []int32) (pickedNodeIndices []int32, failedReason string) {
+	pickedNodeIndices = make([]int32, len(leafCellNums))
+	pickedLeafCellNums := make([]int32, len(cv)) // leaf cells picked in each node
+	for podIndex := len(leafCellNums) - 1; podIndex >= 0; podIndex-- {
+		bestNodeIndex := -1
+		var unusableNode *node
+		for nodeIndex, n := range cv {
+			freeLeafCellNum := n.freeLeafCellNumAtPriority - pickedLeafCellNums[nodeIndex]
+			if freeLeafCellNum < leafCellNums[podIndex] {
+				continue
+			}
+			if !n.healthy || !n.suggested {
+				if unusableNode == nil {
+					unusableNode = n
+				}
+				continue
+			}
+			if bestNodeIndex == -1 || freeLeafCellNum >
+				cv[bestNodeIndex].freeLeafCellNumAtPriority-pickedLeafCellNums[bestNodeIndex] {
+				bestNodeIndex = nodeIndex
+			}
+		}
+		if bestNodeIndex == -1 {
+			if unusableNode == nil {
+				return nil, "insufficient capacity"
+			} else if !unusableNode.healthy {
+				return nil, fmt.Sprintf("have to use at least one bad node %v", unusableNode.nodeAddress)
+			}
+			return nil, fmt.Sprintf("have to use at least one non-suggested node %v", unusableNode.nodeAddress)
+		}
+		pickedNodeIndices[podIndex] = int32(bestNodeIndex)
+		pickedLeafCellNums[bestNodeIndex] += leafCellNums[podIndex]
+	}
+	return pickedNodeIndices, ""
+}
+
 // findLeafCellsInNode finds a set of leaf cells with the best affinity in a node for a pod.
 func findLeafCellsInNode(
 	n Cell,
@@ -386,6 +734,69 @@ func findLeafCellsInNode(
 	}
 }
 
+// findLeafCellsInGroupedNode finds a set of leaf cells in a node grouped from multiple cells for a pod.
+// It prefers a single cell that can hold the pod (the one with the fewest available leaf cells, for packing),
+// and otherwise takes the leaf cells from the cells with the most available leaf cells first.
+// The available leaf cells of each cell are updated in place.
+func findLeafCellsInGroupedNode(
+	cells CellList,
+	leafCellNum int32,
+	p CellPriority,
+	availableLeafCells map[Cell]CellList,
+	levelLeafCellNum map[CellLevel]int32) CellList {
+
+	for _, c := range cells {
+		if availableLeafCells[c] == nil {
+			freeLeafCells, preemptibleLeafCells := getLeafCellsFromNode(c, p, CellList{}, CellList{})
+			availableLeafCells[c] = append(freeLeafCells, preemptibleLeafCells...)
+		}
+	}
+	sortedCells := make(CellList, len(cells))
+	copy(sortedCells, cells)
+	sort.SliceStable(sortedCells, func(i, j int) bool {
+		return len(availableLeafCells[sortedCells[i]]) < len(availableLeafCells[sortedCells[j]])
+	})
+	var pickedLeafCells CellList
+	for _, c := range sortedCells {
+		if int32(len(availableLeafCells[c])) >= leafCellNum {
+			pickedLeafCells, availableLeafCells[c] = findLeafCellsInNode(
+				c, leafCellNum, p, availableLeafCells[c], levelLeafCellNum)
+			return pickedLeafCells
+		}
+	}
+	for i := len(sortedCells) - 1; i >= 0 && int32(len(pickedLeafCells)) < leafCellNum; i-- {
+		c := sortedCells[i]
+		num := leafCellNum - int32(len(pickedLeafCells))
+		if available := int32(len(availableLeafCells[c])); available < num {
+			num = available
+		}
+		if num == 0 {
+			break
+		}
+		var leafCells CellList
+		leafCells, availableLeafCells[c] = findLeafCellsInNode(c, num, p, availableLeafCells[c], levelLeafCellNum)
+		pickedLeafCells = append(pickedLeafCells, leafCells...)
+	}
+	if int32(len(pickedLeafCells)) < leafCellNum {
+		// Unreachable
+		panic(fmt.Sprintf("Assert Failure: failed to allocate %v leaf cells in picked node %v",
+			leafCellNum, cells[0].GetAddress()))
+	}
+	return pickedLeafCells
+}
+
+// getAffinityLevel returns the level of the lowest common ancestor of a set of leaf cells
+// (highestLevel if they have no common ancestor).
+func getAffinityLevel(leafCells CellList) CellLevel {
+	lca := leafCells[0]
+	for _, c := range leafCells[1:] {
+		if lca = findLCA(c, lca); lca == nil {
+			return highestLevel
+		}
+	}
+	return lca.GetLevel()
+}
+
 // getOptimalAffinity calculates the optimal affinity for a given leaf cell number.
 func getOptimalAffinity(leafCellNum int32, levelLeafCellNum map[CellLevel]int32) CellLevel {
 	for l := CellLevel(1); l <= CellLevel(len(levelLeafCellNum)); l++ {
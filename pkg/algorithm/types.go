@@ -24,7 +24,9 @@ package algorithm
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
@@ -46,9 +48,18 @@ type schedulingRequest struct {
 	chain                CellChain
 	affinityGroupName    string
 	affinityGroupPodNums map[int32]int32 // leaf cell number -> pod number
+	// leaf cell type of the members to schedule if they specify their own types, which keys the placement
+	memberLeafCellType   string
 	priority             CellPriority
 	suggestedNodes       common.Set
 	ignoreSuggestedNodes bool
+	crossChainEnable     bool
+	// whether the request schedules an aged affinity group one priority above its own to reserve cells
+	aged bool
+	// node-level virtual cells excluded when retrying the intra-VC scheduling
+	excludedNodes common.Set
+	// number of the failed intra-VC scheduling attempts before this one
+	retry int32
 }
 
 // CellList is a list of cells at a certain level of a chain.
@@ -134,37 +145,109 @@ type AlgoAffinityGroup struct {
 	name                 string
 	vc                   api.VirtualClusterName
 	lazyPreemptionEnable bool
+	// Whether the leaf cells of a pod are released once it completes, without waiting for the whole group.
+	gangReleaseEnable bool
 	// Whether we should ignore K8s suggested nodes. If false, we will avoid binding cells to non-suggested nodes.
 	// Note that we always avoid using bad nodes; avoiding non-suggested nodes is optional and best-effort.
 	ignoreK8sSuggestedNodes   bool
 	priority                  int32
-	totalPodNums              map[int32]int32       // LeafCellNum -> PodNum
-	allocatedPods             map[int32][]*core.Pod // LeafCellNum -> a list of allocated pods
+	totalPodNums              map[memberKey]int32       // member -> PodNum
+	maxPodNums                map[memberKey]int32       // member -> PodNum the group can be extended to (if elastic)
+	leafCellFraction          int32                     // fraction of each leaf cell used (less than a whole if shared)
+	allocatedPods             map[memberKey][]*core.Pod // member -> a list of allocated pods
+	releasedPods              map[memberKey][]types.UID // member -> a list of pods whose leaf cells have been released
 	preemptingPods            map[types.UID]*core.Pod
 	physicalLeafCellPlacement groupPhysicalPlacement
 	virtualLeafCellPlacement  groupVirtualPlacement
 	state                     AffinityGroupState
 	lazyPreemptionStatus      *api.LazyPreemptionStatus
+	// whether the group is preempting only to reserve cells after waiting for too long,
+	// i.e., it waits for the groups with non-lower priorities in its placement to complete
+	reservedForAging bool
+	// the alternative placements considered and the chosen one, if the group preempted others
+	preemptionDecision *api.PreemptionDecision
+	// when the group started preempting, from which the preemption grace periods of the victims are counted
+	preemptionStartTime time.Time
+	// when the group is expected to complete according to its declared runtime (zero if not declared)
+	expectedEndTime time.Time
+	// whether the group is backfilled into the cells reserved for an aged group,
+	// hence preempted once it runs beyond its expected end time
+	backfilled bool
+	// since when the allocated group has been missing some of its pods (zero once they are all allocated)
+	incompleteSince time.Time
+	// why the group is released before its pods complete (empty if not released)
+	releaseReason string
+	// why the group is still incomplete after the gang scheduling timeout, if it is not released
+	incompleteReason string
+}
+
+// waitingAffinityGroup is an affinity group whose pods have to wait for resources.
+type waitingAffinityGroup struct {
+	spec *api.PodSchedulingSpec
+	// creation time of the earliest pod of the group that has waited
+	waitingSince time.Time
+}
+
+// cellReservation is a reservation of cells in a VC for a time window (see api.ReservationSpec).
+type cellReservation struct {
+	name       string
+	vc         api.VirtualClusterName
+	cellType   api.CellType
+	cellNumber int32
+	// when the reservation begins to drain (zero if from when it is configured), starts and ends
+	drainTime time.Time
+	startTime time.Time
+	endTime   time.Time
+	// a pseudo preempting affinity group (not in HivedAlgorithm.affinityGroups) holding the reserved cells
+	// that have not been handed over to the tagged groups, nil before the cells are chosen or after the window
+	holder *AlgoAffinityGroup
+	ended  bool
+}
+
+func newCellReservation(vc api.VirtualClusterName, spec api.ReservationSpec) *cellReservation {
+	// the times have been validated with the config
+	startTime, _ := time.Parse(time.RFC3339, spec.StartTime)
+	endTime, _ := time.Parse(time.RFC3339, spec.EndTime)
+	r := &cellReservation{
+		name:       spec.Name,
+		vc:         vc,
+		cellType:   spec.CellType,
+		cellNumber: spec.CellNumber,
+		startTime:  startTime,
+		endTime:    endTime,
+	}
+	if spec.DrainSeconds > 0 {
+		r.drainTime = startTime.Add(-time.Duration(spec.DrainSeconds) * time.Second)
+	}
+	return r
 }
 
 func newAlgoAffinityGroup(
 	g *api.AffinityGroupSpec,
 	vc api.VirtualClusterName,
 	lazyPreemptionEnable bool,
+	gangReleaseEnable bool,
 	priority int32,
+	leafCellFraction float64,
 	state AffinityGroupState) *AlgoAffinityGroup {
 
-	podNums := make(map[int32]int32)
+	podNums := make(map[memberKey]int32)
+	maxPodNums := make(map[memberKey]int32)
 	for _, m := range g.Members {
-		podNums[m.LeafCellNumber] += m.PodNumber
+		podNums[memberKey{leafCellType: m.LeafCellType, leafCellNum: m.LeafCellNumber}] += m.PodNumber
+		maxPodNums[memberKey{leafCellType: m.LeafCellType, leafCellNum: m.LeafCellNumber}] += m.MaxPodNumber
 	}
 	group := &AlgoAffinityGroup{
 		name:                      g.Name,
 		vc:                        vc,
 		lazyPreemptionEnable:      lazyPreemptionEnable,
+		gangReleaseEnable:         gangReleaseEnable,
 		priority:                  priority,
 		totalPodNums:              podNums,
-		allocatedPods:             map[int32][]*core.Pod{},
+		maxPodNums:                maxPodNums,
+		leafCellFraction:          toLeafCellFraction(leafCellFraction),
+		allocatedPods:             map[memberKey][]*core.Pod{},
+		releasedPods:              map[memberKey][]types.UID{},
 		physicalLeafCellPlacement: groupPhysicalPlacement{},
 		virtualLeafCellPlacement:  groupVirtualPlacement{},
 		state:                     state,
@@ -172,18 +255,34 @@ func newAlgoAffinityGroup(
 	if state == groupPreempting {
 		group.preemptingPods = map[types.UID]*core.Pod{}
 	}
-	for leafCellNum, podNum := range podNums {
-		group.physicalLeafCellPlacement[leafCellNum] = make([]CellList, podNum)
-		group.virtualLeafCellPlacement[leafCellNum] = make([]CellList, podNum)
-		group.allocatedPods[leafCellNum] = make([]*core.Pod, podNum)
+	for member, podNum := range podNums {
+		group.physicalLeafCellPlacement[member] = make([]CellList, podNum)
+		group.virtualLeafCellPlacement[member] = make([]CellList, podNum)
+		group.allocatedPods[member] = make([]*core.Pod, podNum)
+		group.releasedPods[member] = make([]types.UID, podNum)
 		for i := int32(0); i < podNum; i++ {
-			group.physicalLeafCellPlacement[leafCellNum][i] = make(CellList, leafCellNum)
-			group.virtualLeafCellPlacement[leafCellNum][i] = make(CellList, leafCellNum)
+			group.physicalLeafCellPlacement[member][i] = make(CellList, member.leafCellNum)
+			group.virtualLeafCellPlacement[member][i] = make(CellList, member.leafCellNum)
 		}
 	}
 	return group
 }
 
+// extend adds the slots of more pods of a certain member to an elastic group.
+func (aag *AlgoAffinityGroup) extend(member memberKey, podNum int32) {
+	for i := int32(0); i < podNum; i++ {
+		aag.physicalLeafCellPlacement[member] = append(
+			aag.physicalLeafCellPlacement[member], make(CellList, member.leafCellNum))
+		if aag.virtualLeafCellPlacement != nil {
+			aag.virtualLeafCellPlacement[member] = append(
+				aag.virtualLeafCellPlacement[member], make(CellList, member.leafCellNum))
+		}
+		aag.allocatedPods[member] = append(aag.allocatedPods[member], nil)
+		aag.releasedPods[member] = append(aag.releasedPods[member], "")
+	}
+	aag.totalPodNums[member] += podNum
+}
+
 func (aag *AlgoAffinityGroup) ToAffinityGroup() api.AffinityGroup {
 	ag := api.AffinityGroup{
 		ObjectMeta: api.ObjectMeta{Name: aag.name},
@@ -192,10 +291,20 @@ func (aag *AlgoAffinityGroup) ToAffinityGroup() api.AffinityGroup {
 			Priority:             aag.priority,
 			State:                api.AffinityGroupState(aag.state),
 			LazyPreemptionStatus: aag.lazyPreemptionStatus,
+			PreemptionDecision:   aag.preemptionDecision,
+			ReleaseReason:        aag.releaseReason,
+			IncompleteReason:     aag.incompleteReason,
+			CurrentPodNumbers:    map[int32]int32{},
+			DesiredPodNumbers:    map[int32]int32{},
 		},
 	}
+	for member, podNum := range aag.totalPodNums {
+		ag.Status.CurrentPodNumbers[member.leafCellNum] += podNum
+		ag.Status.DesiredPodNumbers[member.leafCellNum] += aag.maxPodNums[member]
+	}
 	if aag.physicalLeafCellPlacement != nil {
 		ag.Status.PhysicalPlacement = aag.physicalLeafCellPlacement.nodeToLeafCellIndices()
+		ag.Status.PodAffinityLevels = aag.physicalLeafCellPlacement.podAffinityLevels()
 	}
 	if aag.virtualLeafCellPlacement != nil {
 		ag.Status.VirtualPlacement = aag.virtualLeafCellPlacement.preassignedCellToLeafCells()
@@ -207,14 +316,64 @@ func (aag *AlgoAffinityGroup) ToAffinityGroup() api.AffinityGroup {
 			}
 		}
 	}
+	for _, pods := range aag.releasedPods {
+		for _, p := range pods {
+			if p != "" {
+				ag.Status.ReleasedPods = append(ag.Status.ReleasedPods, p)
+			}
+		}
+	}
 	for p := range aag.preemptingPods {
 		ag.Status.PreemptingPods = append(ag.Status.PreemptingPods, p)
 	}
 	return ag
 }
 
-type groupPhysicalPlacement map[int32][]CellList // LeafCellNum -> a list of pods -> a list of physical leaf cells of each pod
-type groupVirtualPlacement map[int32][]CellList  // LeafCellNum -> a list of pods -> a list of virtual leaf cells of each pod
+// memberKey identifies the pods of an affinity group with the same leaf cell number, and the same
+// leaf cell type if the members specify their own types (otherwise the type is empty).
+type memberKey struct {
+	leafCellType string
+	leafCellNum  int32
+}
+
+// MarshalText lets memberKey be a JSON map key in the logs.
+func (k memberKey) MarshalText() ([]byte, error) {
+	if k.leafCellType == "" {
+		return []byte(fmt.Sprint(k.leafCellNum)), nil
+	}
+	return []byte(fmt.Sprintf("%v/%v", k.leafCellType, k.leafCellNum)), nil
+}
+
+// newMemberPlacement keys the placements of the pods of each leaf cell number by the members
+// of a leaf cell type (empty if the members do not specify their own types).
+func newMemberPlacement(leafCellType string, podPlacements map[int32][]CellList) map[memberKey][]CellList {
+	if podPlacements == nil {
+		return nil
+	}
+	placement := map[memberKey][]CellList{}
+	for leafCellNum, placements := range podPlacements {
+		placement[memberKey{leafCellType: leafCellType, leafCellNum: leafCellNum}] = placements
+	}
+	return placement
+}
+
+// sortedMemberKeys returns the members of a placement in ascending order of their leaf cell numbers.
+func sortedMemberKeys(p map[memberKey][]CellList) []memberKey {
+	members := make([]memberKey, 0, len(p))
+	for member := range p {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].leafCellNum != members[j].leafCellNum {
+			return members[i].leafCellNum < members[j].leafCellNum
+		}
+		return members[i].leafCellType < members[j].leafCellType
+	})
+	return members
+}
+
+type groupPhysicalPlacement map[memberKey][]CellList // member -> a list of pods -> physical leaf cells of each pod
+type groupVirtualPlacement map[memberKey][]CellList  // member -> a list of pods -> virtual leaf cells of each pod
 
 func (p groupPhysicalPlacement) String() string {
 	return common.ToJson(p.nodeToLeafCellIndices())
@@ -225,6 +384,9 @@ func (p groupPhysicalPlacement) nodeToLeafCellIndices() map[string][]int32 {
 	for _, podPlacements := range p {
 		for _, podPlacement := range podPlacements {
 			for _, leafCell := range podPlacement {
+				if leafCell == nil {
+					continue
+				}
 				pLeafCell := leafCell.(*PhysicalCell)
 				nodes, leafCellIndices := pLeafCell.GetPhysicalPlacement()
 				if _, ok := nodeToLeafCellIndices[nodes[0]]; !ok {
@@ -237,6 +399,28 @@ func (p groupPhysicalPlacement) nodeToLeafCellIndices() map[string][]int32 {
 	return nodeToLeafCellIndices
 }
 
+// podAffinityLevels returns the affinity level achieved by each pod, see getAffinityLevel.
+// The pods of the members with the same leaf cell number are listed in the order of their leaf cell types.
+func (p groupPhysicalPlacement) podAffinityLevels() map[int32][]int32 {
+	podAffinityLevels := map[int32][]int32{}
+	for _, member := range sortedMemberKeys(p) {
+		for _, podPlacement := range p[member] {
+			leafCells := CellList{}
+			for _, leafCell := range podPlacement {
+				if leafCell != nil {
+					leafCells = append(leafCells, leafCell)
+				}
+			}
+			level := int32(0)
+			if len(leafCells) > 0 {
+				level = int32(getAffinityLevel(leafCells))
+			}
+			podAffinityLevels[member.leafCellNum] = append(podAffinityLevels[member.leafCellNum], level)
+		}
+	}
+	return podAffinityLevels
+}
+
 func (p groupVirtualPlacement) String() string {
 	return common.ToJson(p.preassignedCellToLeafCells())
 }
@@ -246,6 +430,9 @@ func (p groupVirtualPlacement) preassignedCellToLeafCells() map[api.CellAddress]
 	for _, podPlacements := range p {
 		for _, podPlacement := range podPlacements {
 			for _, leafCell := range podPlacement {
+				if leafCell == nil {
+					continue
+				}
 				vLeafCell := leafCell.(*VirtualCell)
 				address := vLeafCell.GetAddress()
 				preassignedAddress := vLeafCell.GetPreassignedCell().GetAddress()
@@ -262,17 +449,17 @@ func (p groupVirtualPlacement) preassignedCellToLeafCells() map[api.CellAddress]
 
 func (p groupVirtualPlacement) toPhysicalPlacement(
 	bindings map[api.CellAddress]*PhysicalCell,
-	leafCellNums []int32) groupPhysicalPlacement {
+	members []memberKey) groupPhysicalPlacement {
 
 	physicalPlacement := groupPhysicalPlacement{}
-	for _, podLeafCellNum := range leafCellNums {
-		podPlacements := p[podLeafCellNum]
-		physicalPlacement[podLeafCellNum] = make([]CellList, len(podPlacements))
+	for _, member := range members {
+		podPlacements := p[member]
+		physicalPlacement[member] = make([]CellList, len(podPlacements))
 		for i, podPlacement := range podPlacements {
-			physicalPlacement[podLeafCellNum][i] = make(CellList, len(podPlacement))
+			physicalPlacement[member][i] = make(CellList, len(podPlacement))
 			for j, leafCell := range podPlacement {
 				pLeafCell := bindings[leafCell.GetAddress()]
-				physicalPlacement[podLeafCellNum][i][j] = pLeafCell
+				physicalPlacement[member][i][j] = pLeafCell
 			}
 		}
 	}
@@ -283,14 +470,14 @@ func (p groupVirtualPlacement) toPhysicalPlacement(
 // lowest-level cells in a physical placement. It is generated by collecting all the unbound
 // ancestors for these cells and group them in a tree.
 func (p groupVirtualPlacement) toBindingPaths(
-	leafCellNums []int32,
+	members []memberKey,
 	bindings map[api.CellAddress]*PhysicalCell) (
 	preassignedCells []*cellBindingPathVertex,
 	nonPreassignedCells [][]*cellBindingPathVertex) {
 
 	allBindingPathVertices := map[api.CellAddress]*cellBindingPathVertex{}
-	for _, podLeafCellNum := range leafCellNums {
-		podPlacements := p[podLeafCellNum]
+	for _, member := range members {
+		podPlacements := p[member]
 		for _, podPlacement := range podPlacements {
 			for _, leafCell := range podPlacement {
 				if pLeafCell := leafCell.(*VirtualCell).GetPhysicalCell(); pLeafCell != nil {
@@ -339,6 +526,68 @@ func (p groupVirtualPlacement) toBindingPaths(
 	return preassignedCells, nonPreassignedCells
 }
 
+// nodesInPreassignedCell returns the node-level cells (or the top-level cells lower than node level)
+// used by the placement inside a preassigned cell, or inside all the preassigned cells if it is nil.
+func (p groupVirtualPlacement) nodesInPreassignedCell(preassignedCell *VirtualCell) CellList {
+	nodes := CellList{}
+	for _, podPlacements := range p {
+		for _, podPlacement := range podPlacements {
+			for _, leafCell := range podPlacement {
+				if leafCell == nil || (preassignedCell != nil &&
+					!CellEqual(leafCell.(*VirtualCell).GetPreassignedCell(), preassignedCell)) {
+					continue
+				}
+				if n := ancestorNoHigherThanNode(leafCell); !nodes.contains(n) {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+	}
+	return nodes
+}
+
+// colocatedPreassignedCells groups the preassigned cells lower than node level in the placement
+// that are used by the same pods (directly or transitively), which hence must be mapped to the same physical node.
+// It returns the group of each of such cells (only for the groups with multiple cells).
+func (p groupVirtualPlacement) colocatedPreassignedCells() map[api.CellAddress]CellList {
+	colocatedCells := map[api.CellAddress]CellList{}
+	for _, podPlacements := range p {
+		for _, podPlacement := range podPlacements {
+			podCells := CellList{}
+			for _, leafCell := range podPlacement {
+				if leafCell == nil {
+					continue
+				}
+				preassignedCell := leafCell.(*VirtualCell).GetPreassignedCell()
+				if preassignedCell.AtOrHigherThanNode() || podCells.contains(preassignedCell) {
+					continue
+				}
+				podCells = append(podCells, preassignedCell)
+			}
+			if len(podCells) < 2 {
+				continue
+			}
+			// merge the groups of the cells used by this pod
+			group := CellList{}
+			for _, c := range podCells {
+				if existingGroup, ok := colocatedCells[c.GetAddress()]; ok {
+					for _, cc := range existingGroup {
+						if !group.contains(cc) {
+							group = append(group, cc)
+						}
+					}
+				} else if !group.contains(c) {
+					group = append(group, c)
+				}
+			}
+			for _, c := range group {
+				colocatedCells[c.GetAddress()] = group
+			}
+		}
+	}
+	return colocatedCells
+}
+
 // cellBindingPathVertex is a single vertex in the tree of a cell binding path,
 // containing the vertices of its children to bind.
 type cellBindingPathVertex struct {
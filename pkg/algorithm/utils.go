@@ -24,7 +24,9 @@ package algorithm
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
+	"time"
 
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
@@ -39,9 +41,10 @@ func generatePodScheduleResult(
 	groupPhysicalPlacement groupPhysicalPlacement,
 	groupVirtualPlacement groupVirtualPlacement,
 	preemptionVictims map[string]common.Set,
+	gracefulVictims []internal.GracefulVictim,
 	waitReason string,
 	cellLevelToType map[CellChain]map[CellLevel]api.CellType,
-	currentLeafCellNum int32,
+	currentMember memberKey,
 	currentPodIndex int32,
 	group *AlgoAffinityGroup,
 	groupName string,
@@ -57,15 +60,15 @@ func generatePodScheduleResult(
 	if groupVirtualPlacement != nil {
 		klog.Infof("[%v]: Virtual placement: %v", internal.Key(pod), groupVirtualPlacement)
 	}
-	if len(preemptionVictims) > 0 {
+	if len(preemptionVictims) > 0 || len(gracefulVictims) > 0 {
 		return internal.PodScheduleResult{
-			PodPreemptInfo: generatePodPreemptInfo(preemptionVictims, pod),
+			PodPreemptInfo: generatePodPreemptInfo(preemptionVictims, gracefulVictims, pod),
 		}
 	}
 	// we find the selected node after the preemption is done, otherwise the preemption victims
 	// may cause the selected node to be excluded from the suggested nodes
 	affinityGroupBindInfo, selectedNode, selectedLeafCellIndices, cellChain := generateAffinityGroupBindInfo(
-		groupPhysicalPlacement, groupVirtualPlacement, cellLevelToType, currentLeafCellNum, currentPodIndex, group, groupName)
+		groupPhysicalPlacement, groupVirtualPlacement, cellLevelToType, currentMember, currentPodIndex, group, groupName)
 	klog.Infof("[%v]: pod is decided to be scheduled to node %v, leaf cells %v",
 		internal.Key(pod), selectedNode, common.ToJson(selectedLeafCellIndices))
 	return internal.PodScheduleResult{
@@ -79,7 +82,22 @@ func generatePodScheduleResult(
 }
 
 // generatePodPreemptInfo writes the preemption victims into a PodPreemptInfo.
-func generatePodPreemptInfo(preemptionVictims map[string]common.Set, pod *core.Pod) *internal.PodPreemptInfo {
+func generatePodPreemptInfo(
+	preemptionVictims map[string]common.Set,
+	gracefulVictims []internal.GracefulVictim,
+	pod *core.Pod) *internal.PodPreemptInfo {
+
+	if len(gracefulVictims) > 0 {
+		var gracefulVictimKeys []string
+		for _, v := range gracefulVictims {
+			gracefulVictimKeys = append(gracefulVictimKeys, internal.Key(v.Pod))
+		}
+		klog.Infof("[%v]: Preemption victims in grace periods: %v",
+			internal.Key(pod), common.ToJson(gracefulVictimKeys))
+	}
+	if len(preemptionVictims) == 0 {
+		return &internal.PodPreemptInfo{GracefulVictims: gracefulVictims}
+	}
 	klog.Infof("[%v]: Preemption victim candidates: %v",
 		internal.Key(pod), victimsToString(preemptionVictims))
 	var (
@@ -99,7 +117,7 @@ func generatePodPreemptInfo(preemptionVictims map[string]common.Set, pod *core.P
 		victimKeys = append(victimKeys, internal.Key(v.(*core.Pod)))
 	}
 	klog.Infof("[%v]: need to preempt pods %v", internal.Key(pod), common.ToJson(victimKeys))
-	return &internal.PodPreemptInfo{VictimPods: victimPods}
+	return &internal.PodPreemptInfo{VictimPods: victimPods, GracefulVictims: gracefulVictims}
 }
 
 // generateAffinityGroupBindInfo translates the physical and virtual placements of an affinity group
@@ -109,7 +127,7 @@ func generateAffinityGroupBindInfo(
 	groupPhysicalPlacement groupPhysicalPlacement,
 	groupVirtualPlacement groupVirtualPlacement,
 	cellLevelToType map[CellChain]map[CellLevel]api.CellType,
-	currentLeafCellNum int32,
+	currentMember memberKey,
 	currentPodIndex int32,
 	group *AlgoAffinityGroup,
 	groupName string) (
@@ -120,14 +138,22 @@ func generateAffinityGroupBindInfo(
 
 	affinityGroupBindInfo = make([]api.AffinityGroupMemberBindInfo, len(groupPhysicalPlacement))
 	groupMemberIndex := 0
-	for podLeafCellNum, podPhysicalPlacements := range groupPhysicalPlacement {
+	for member, podPhysicalPlacements := range groupPhysicalPlacement {
 		mbi := api.AffinityGroupMemberBindInfo{
+			LeafCellType:  member.leafCellType,
 			PodPlacements: make([]api.PodPlacementInfo, len(podPhysicalPlacements)),
 		}
 		for podIndex := int32(0); podIndex < int32(len(podPhysicalPlacements)); podIndex++ {
-			mbi.PodPlacements[podIndex].PhysicalLeafCellIndices = make([]int32, podLeafCellNum)
-			mbi.PodPlacements[podIndex].PreassignedCellTypes = make([]api.CellType, podLeafCellNum)
-			for leafCellIndex := int32(0); leafCellIndex < podLeafCellNum; leafCellIndex++ {
+			mbi.PodPlacements[podIndex].PhysicalLeafCellIndices = make([]int32, member.leafCellNum)
+			mbi.PodPlacements[podIndex].PreassignedCellTypes = make([]api.CellType, member.leafCellNum)
+			if group != nil && podIndex < int32(len(group.releasedPods[member])) &&
+				group.releasedPods[member][podIndex] != "" {
+				// the leaf cells of a completed pod have been released, and may be used by other groups,
+				// so only the released pod is recorded, to avoid allocating them again when adding an allocated pod
+				mbi.PodPlacements[podIndex].ReleasedPod = group.releasedPods[member][podIndex]
+				continue
+			}
+			for leafCellIndex := int32(0); leafCellIndex < member.leafCellNum; leafCellIndex++ {
 				pLeafCell := podPhysicalPlacements[podIndex][leafCellIndex]
 				if pLeafCell == nil {
 					if group == nil || group.state == groupPreempting {
@@ -135,7 +161,7 @@ func generateAffinityGroupBindInfo(
 					}
 					// if the physical placement of this pod is not found (e.g., removed due to reconfiguration),
 					// we will insist the decision by retrieving it from other pods
-					mbi.PodPlacements[podIndex], chain = retrieveMissingPodPlacement(group, podLeafCellNum, podIndex)
+					mbi.PodPlacements[podIndex] = retrieveMissingPodPlacement(group, member, podIndex)
 					klog.Warningf(
 						"pod placement has been invalid and is retrieved from annotation of other pods: node %v, leaf cell %v",
 						mbi.PodPlacements[podIndex].PhysicalNode, mbi.PodPlacements[podIndex].PhysicalLeafCellIndices[leafCellIndex])
@@ -145,10 +171,11 @@ func generateAffinityGroupBindInfo(
 					// in its "nodes" and "leafCellIndices" as the node and leaf cell address
 					if mbi.PodPlacements[podIndex].PhysicalNode == "" {
 						mbi.PodPlacements[podIndex].PhysicalNode = nodes[0]
+						mbi.PodPlacements[podIndex].CellChain = string(pLeafCell.GetChain())
 					}
 					mbi.PodPlacements[podIndex].PhysicalLeafCellIndices[leafCellIndex] = leafCellIndices[0]
 					if groupVirtualPlacement != nil {
-						vLeafCell := groupVirtualPlacement[podLeafCellNum][podIndex][leafCellIndex].(*VirtualCell)
+						vLeafCell := groupVirtualPlacement[member][podIndex][leafCellIndex].(*VirtualCell)
 						mbi.PodPlacements[podIndex].PreassignedCellTypes[leafCellIndex] =
 							cellLevelToType[vLeafCell.GetChain()][vLeafCell.GetPreassignedCell().GetLevel()]
 					} else {
@@ -157,12 +184,10 @@ func generateAffinityGroupBindInfo(
 				}
 			}
 		}
-		if podLeafCellNum == currentLeafCellNum {
+		if member == currentMember {
 			selectedNode = mbi.PodPlacements[currentPodIndex].PhysicalNode
 			selectedLeafCellIndices = mbi.PodPlacements[currentPodIndex].PhysicalLeafCellIndices
-			if pLeafCell := groupPhysicalPlacement[currentLeafCellNum][currentPodIndex][0]; pLeafCell != nil {
-				chain = string(pLeafCell.GetChain())
-			}
+			chain = mbi.PodPlacements[currentPodIndex].CellChain
 		}
 		affinityGroupBindInfo[groupMemberIndex] = mbi
 		groupMemberIndex++
@@ -179,9 +204,9 @@ func collectBadOrNonSuggestedNodes(
 	badOrNonSuggestedNodes common.Set) {
 
 	badOrNonSuggestedNodes = common.NewSet()
-	for leafCellNum := range placement {
-		for podIndex := range placement[leafCellNum] {
-			for _, leafCell := range placement[leafCellNum][podIndex] {
+	for member := range placement {
+		for podIndex := range placement[member] {
+			for _, leafCell := range placement[member][podIndex] {
 				if leafCell == nil {
 					continue
 				}
@@ -196,6 +221,15 @@ func collectBadOrNonSuggestedNodes(
 	return badOrNonSuggestedNodes
 }
 
+// toLeafCellFraction converts the leaf cell fraction of a pod into the units of leafCellFractionScale.
+// A pod without a fraction uses whole leaf cells.
+func toLeafCellFraction(f float64) int32 {
+	if f == 0 {
+		return leafCellFractionScale
+	}
+	return int32(math.Max(1, math.Round(f*leafCellFractionScale)))
+}
+
 // collectPreemptionVictims collects preemption victims of an affinity group.
 // If any of the leaf cells allocated for the whole group is still used by a pod,
 // we will wait for the preemption, as a group is gang-scheduled.
@@ -204,9 +238,9 @@ func collectPreemptionVictims(placement groupPhysicalPlacement) (
 
 	victimPods = map[string]common.Set{} // node -> pods
 	overlappingPreemptorGroups = common.NewSet()
-	for leafCellNum := range placement {
-		for podIndex := range placement[leafCellNum] {
-			for _, leafCell := range placement[leafCellNum][podIndex] {
+	for member := range placement {
+		for podIndex := range placement[member] {
+			for _, leafCell := range placement[member][podIndex] {
 				if leafCell == nil {
 					continue
 				}
@@ -214,13 +248,16 @@ func collectPreemptionVictims(placement groupPhysicalPlacement) (
 				state := pLeafCell.GetState()
 				if state == cellUsed || state == cellReserving {
 					// for any victim pod, gang-preempt all the other pods from the same affinity group
-					for _, pods := range pLeafCell.GetUsingGroup().allocatedPods {
-						for _, v := range pods {
-							if v != nil {
-								if _, ok := victimPods[v.Spec.NodeName]; !ok {
-									victimPods[v.Spec.NodeName] = common.NewSet()
+					// (and from the other groups sharing the leaf cell)
+					for _, g := range pLeafCell.GetUsingGroups() {
+						for _, pods := range g.allocatedPods {
+							for _, v := range pods {
+								if v != nil {
+									if _, ok := victimPods[v.Spec.NodeName]; !ok {
+										victimPods[v.Spec.NodeName] = common.NewSet()
+									}
+									victimPods[v.Spec.NodeName].Add(v)
 								}
-								victimPods[v.Spec.NodeName].Add(v)
 							}
 						}
 					}
@@ -234,6 +271,153 @@ func collectPreemptionVictims(placement groupPhysicalPlacement) (
 	return victimPods, overlappingPreemptorGroups
 }
 
+// collectAgingReservationVictims collects the preemption victims in the placement of an aged affinity group
+// reserving cells (see HivedAlgorithm.reserveForAgedAffinityGroup) with priority p. Only the groups using the cells
+// at lower priorities (and the backfilled groups that have overrun) are preempted, and the names of the other groups
+// using the cells are returned to wait for.
+func collectAgingReservationVictims(placement groupPhysicalPlacement, p CellPriority) (
+	victimPods map[string]common.Set, waitedGroups common.Set, overlappingPreemptorGroups common.Set) {
+
+	victimPods = map[string]common.Set{} // node -> pods
+	waitedGroups = common.NewSet()
+	overlappingPreemptorGroups = common.NewSet()
+	for member := range placement {
+		for podIndex := range placement[member] {
+			for _, leafCell := range placement[member][podIndex] {
+				if leafCell == nil {
+					continue
+				}
+				pLeafCell := leafCell.(*PhysicalCell)
+				state := pLeafCell.GetState()
+				if state == cellUsed || state == cellReserving {
+					for _, g := range pLeafCell.GetUsingGroups() {
+						if g.backfilled && time.Now().Before(g.expectedEndTime) {
+							// a backfilled group is waited for until it overruns
+							waitedGroups.Add(g.name)
+							continue
+						}
+						usingPriority := CellPriority(g.priority)
+						if g.virtualLeafCellPlacement == nil {
+							// a lazy preempted group is using the cell opportunistically
+							usingPriority = opportunisticPriority
+						}
+						if usingPriority >= p {
+							waitedGroups.Add(g.name)
+							continue
+						}
+						for _, pods := range g.allocatedPods {
+							for _, v := range pods {
+								if v != nil {
+									if _, ok := victimPods[v.Spec.NodeName]; !ok {
+										victimPods[v.Spec.NodeName] = common.NewSet()
+									}
+									victimPods[v.Spec.NodeName].Add(v)
+								}
+							}
+						}
+					}
+				}
+				if state == cellReserving || state == cellReserved {
+					overlappingPreemptorGroups.Add(pLeafCell.GetReservingOrReservedGroup())
+				}
+			}
+		}
+	}
+	return victimPods, waitedGroups, overlappingPreemptorGroups
+}
+
+// computePreemptionCost computes the cost of preempting the victims in a placement (see api.PreemptionCost).
+func computePreemptionCost(placement groupPhysicalPlacement) api.PreemptionCost {
+	victimGroups := map[*AlgoAffinityGroup]bool{}
+	for member := range placement {
+		for podIndex := range placement[member] {
+			for _, leafCell := range placement[member][podIndex] {
+				if leafCell == nil {
+					continue
+				}
+				pLeafCell := leafCell.(*PhysicalCell)
+				if state := pLeafCell.GetState(); state == cellUsed || state == cellReserving {
+					for _, g := range pLeafCell.GetUsingGroups() {
+						victimGroups[g] = true
+					}
+				}
+			}
+		}
+	}
+	cost := api.PreemptionCost{}
+	now := time.Now()
+	for g := range victimGroups {
+		priority := g.priority
+		if g.virtualLeafCellPlacement == nil {
+			// a lazy preempted group is using the cells opportunistically
+			priority = api.OpportunisticPriority
+		}
+		if cost.VictimGroups == 0 || priority > cost.MaxVictimPriority {
+			cost.MaxVictimPriority = priority
+		}
+		cost.VictimGroups++
+		for _, podPlacements := range g.physicalLeafCellPlacement {
+			for _, podPlacement := range podPlacements {
+				for _, leafCell := range podPlacement {
+					if leafCell != nil {
+						cost.VictimLeafCells++
+					}
+				}
+			}
+		}
+		var startTime time.Time
+		for _, pods := range g.allocatedPods {
+			for _, p := range pods {
+				if p != nil && !p.CreationTimestamp.IsZero() &&
+					(startTime.IsZero() || p.CreationTimestamp.Time.Before(startTime)) {
+					startTime = p.CreationTimestamp.Time
+				}
+			}
+		}
+		if !startTime.IsZero() {
+			cost.VictimRunningSeconds += int64(now.Sub(startTime).Seconds())
+		}
+	}
+	return cost
+}
+
+// lessPreemptionCost compares two preemption costs by their fields in order.
+func lessPreemptionCost(a api.PreemptionCost, b api.PreemptionCost) bool {
+	if a.VictimGroups != b.VictimGroups {
+		return a.VictimGroups < b.VictimGroups
+	}
+	if a.VictimLeafCells != b.VictimLeafCells {
+		return a.VictimLeafCells < b.VictimLeafCells
+	}
+	if a.MaxVictimPriority != b.MaxVictimPriority {
+		return a.MaxVictimPriority < b.MaxVictimPriority
+	}
+	return a.VictimRunningSeconds < b.VictimRunningSeconds
+}
+
+// preemptionVictimNodes returns the nodes in a VC placement whose leaf cells are mapped to
+// the physical leaf cells used by the victims in the corresponding physical placement.
+func preemptionVictimNodes(physicalPlacement groupPhysicalPlacement, virtualPlacement groupVirtualPlacement) CellList {
+	nodes := CellList{}
+	for member := range physicalPlacement {
+		for podIndex := range physicalPlacement[member] {
+			for leafCellIndex, leafCell := range physicalPlacement[member][podIndex] {
+				if leafCell == nil {
+					continue
+				}
+				if state := leafCell.(*PhysicalCell).GetState(); state != cellUsed && state != cellReserving {
+					continue
+				}
+				vLeafCell := virtualPlacement[member][podIndex][leafCellIndex]
+				if n := ancestorNoHigherThanNode(vLeafCell); !nodes.contains(n) {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+	}
+	return nodes
+}
+
 func victimsToString(victimPods map[string]common.Set) string {
 	s := map[string][]types.UID{}
 	for node, victims := range victimPods {
@@ -247,21 +431,27 @@ func victimsToString(victimPods map[string]common.Set) string {
 
 // retrieveMissingPodPlacement finds the placement of a pod from the annotation of other pods in the same group
 // when the pod's placement has been invalid (i.e., not found in the spec).
-func retrieveMissingPodPlacement(g *AlgoAffinityGroup, leafCellNum int32, podIndex int32) (api.PodPlacementInfo, string) {
+func retrieveMissingPodPlacement(g *AlgoAffinityGroup, member memberKey, podIndex int32) api.PodPlacementInfo {
 	for _, pods := range g.allocatedPods {
 		for _, p := range pods {
 			if p != nil {
 				info := internal.ExtractPodBindInfo(p)
 				for _, mbi := range info.AffinityGroupBindInfo {
-					if leafCellNum == int32(len(mbi.PodPlacements[0].PhysicalLeafCellIndices)) {
-						return mbi.PodPlacements[podIndex], info.CellChain
+					if member == getBindInfoMemberKey(mbi) {
+						placement := mbi.PodPlacements[podIndex]
+						if placement.CellChain == "" {
+							// the pod is placed in the same chain as the other pods
+							placement.CellChain = info.CellChain
+						}
+						return placement
 					}
 				}
 			}
 		}
 	}
 	panic(fmt.Sprintf(
-		"No allocated pod found in an allocated group %v when retrieving placement for pod %v with leaf cell number %v", g.name, podIndex, leafCellNum))
+		"No allocated pod found in an allocated group %v when retrieving placement for pod %v of member %v",
+		g.name, podIndex, common.ToJson(member)))
 }
 
 // retrieveVirtualCell finds the corresponding virtual cell for a physical cell in the placements of an affinity group.
@@ -270,11 +460,11 @@ func retrieveVirtualCell(
 	virtualPlacement groupVirtualPlacement,
 	pLeafCell *PhysicalCell) (vLeafCell *VirtualCell) {
 
-	for leafCellNum := range physicalPlacement {
-		for podIndex := range physicalPlacement[leafCellNum] {
-			for leafCellIndex, leafCell := range physicalPlacement[leafCellNum][podIndex] {
+	for member := range physicalPlacement {
+		for podIndex := range physicalPlacement[member] {
+			for leafCellIndex, leafCell := range physicalPlacement[member][podIndex] {
 				if leafCell != nil && CellEqual(leafCell, pLeafCell) {
-					return virtualPlacement[leafCellNum][podIndex][leafCellIndex].(*VirtualCell)
+					return virtualPlacement[member][podIndex][leafCellIndex].(*VirtualCell)
 				}
 			}
 		}
@@ -283,10 +473,11 @@ func retrieveVirtualCell(
 }
 
 // getAllocatedPodIndex assigns a new index for a new pod in an affinity group.
-func getNewPodIndex(pods []*core.Pod) int32 {
+func getNewPodIndex(pods []*core.Pod, releasedPods []types.UID) int32 {
 	podIndex := int32(-1)
 	for i, p := range pods {
-		if p == nil {
+		// the placement of a released pod cannot be used by a new pod
+		if p == nil && releasedPods[i] == "" {
 			podIndex = int32(i)
 			break
 		}
@@ -294,10 +485,26 @@ func getNewPodIndex(pods []*core.Pod) int32 {
 	return podIndex
 }
 
+// getPodMemberKey returns the member of its affinity group a pod belongs to.
+func getPodMemberKey(s *api.PodSchedulingSpec) memberKey {
+	if s.AffinityGroup.Members[0].LeafCellType == "" {
+		return memberKey{leafCellNum: s.LeafCellNumber}
+	}
+	return memberKey{leafCellType: s.LeafCellType, leafCellNum: s.LeafCellNumber}
+}
+
+// getBindInfoMemberKey returns the member of an affinity group recorded in its bind info.
+func getBindInfoMemberKey(mbi api.AffinityGroupMemberBindInfo) memberKey {
+	return memberKey{
+		leafCellType: mbi.LeafCellType,
+		leafCellNum:  int32(len(mbi.PodPlacements[0].PhysicalLeafCellIndices)),
+	}
+}
+
 // getAllocatedPodIndex finds the index of an allocated pod in its group according to its placement.
-func getAllocatedPodIndex(info *api.PodBindInfo, leafCellNum int32) int32 {
+func getAllocatedPodIndex(info *api.PodBindInfo, member memberKey) int32 {
 	for _, gms := range info.AffinityGroupBindInfo {
-		if leafCellNumber := int32(len(gms.PodPlacements[0].PhysicalLeafCellIndices)); leafCellNumber == leafCellNum {
+		if getBindInfoMemberKey(gms) == member {
 			for podIndex, placement := range gms.PodPlacements {
 				if placement.PhysicalNode == info.Node && common.Int32SliceContains(
 					placement.PhysicalLeafCellIndices, info.LeafCellIsolation[0]) {
@@ -310,7 +517,7 @@ func getAllocatedPodIndex(info *api.PodBindInfo, leafCellNum int32) int32 {
 }
 
 // allPodsReleased checks if all the pods of an affinity group were released.
-func allPodsReleased(allocatedPods map[int32][]*core.Pod) bool {
+func allPodsReleased(allocatedPods map[memberKey][]*core.Pod) bool {
 	for _, pods := range allocatedPods {
 		for _, p := range pods {
 			if p != nil {
@@ -321,6 +528,30 @@ func allPodsReleased(allocatedPods map[int32][]*core.Pod) bool {
 	return true
 }
 
+// countReleasedPods returns the number of pods whose leaf cells have been released among those of a leaf cell number.
+func countReleasedPods(releasedPods []types.UID) (released int32) {
+	for _, p := range releasedPods {
+		if p != "" {
+			released++
+		}
+	}
+	return released
+}
+
+// countCreatedPods returns the number of pods of an affinity group that have been allocated
+// (including the completed ones whose leaf cells have been released), and the total number.
+func countCreatedPods(g *AlgoAffinityGroup) (created int32, total int32) {
+	for member, pods := range g.allocatedPods {
+		for podIndex, p := range pods {
+			if p != nil || g.releasedPods[member][podIndex] != "" {
+				created++
+			}
+		}
+		total += int32(len(pods))
+	}
+	return created, total
+}
+
 // findPhysicalLeafCell finds a physical leaf cell in the full list. If the leaf cell is not found in the chain specified
 // in the PodBindInfo (due to reconfiguration), we will try to search in the other chains.
 func findPhysicalLeafCell(
@@ -390,6 +621,51 @@ func inFreeCellList(c *PhysicalCell) bool {
 	}
 }
 
+// collectLeafCells returns the leaf cells in a cell.
+func collectLeafCells(c Cell) CellList {
+	if c.GetLevel() == lowestLevel {
+		return CellList{c}
+	}
+	leafCells := CellList{}
+	for _, child := range c.GetChildren() {
+		leafCells = append(leafCells, collectLeafCells(child)...)
+	}
+	return leafCells
+}
+
+// getUsedLeafCellNum returns the number of leaf cells used in a cell at any priority.
+func getUsedLeafCellNum(c Cell) int32 {
+	num := int32(0)
+	for _, n := range c.GetUsedLeafCellNumAtPriorities() {
+		num += n
+	}
+	return num
+}
+
+// isReservableVirtualCell checks if a virtual cell can be chosen for a reservation, i.e.,
+// none of its leaf cells is bound to a physical cell reserved by a preempting group or another reservation.
+func isReservableVirtualCell(c Cell) bool {
+	for _, leafCell := range collectLeafCells(c) {
+		if pLeafCell := leafCell.(*VirtualCell).GetPhysicalCell(); pLeafCell != nil &&
+			(pLeafCell.GetState() == cellReserving || pLeafCell.GetState() == cellReserved) {
+			return false
+		}
+	}
+	return true
+}
+
+// isInPlacement checks if a leaf cell is in a physical placement.
+func isInPlacement(placement groupPhysicalPlacement, c Cell) bool {
+	for _, podPlacements := range placement {
+		for _, podPlacement := range podPlacements {
+			if podPlacement.contains(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // setCellState sets state for a cell and its parent recursively. A parent cell will be in Used state
 // if any of its children is in Used state. For the other states (Free, Reserving, Reserved),
 // a parent will be in the state if all of this children are in the state.
@@ -76,8 +76,29 @@ type Config struct {
 	// K8S Default Scheduler.
 	WaitingPodSchedulingBlockMilliSec *int64 `yaml:"waitingPodSchedulingBlockMilliSec"`
 
+	// The intra-VC scheduler is unaware of whether its placement can be mapped to the physical
+	// cluster within the K8S suggested nodes. If the mapping fails, the intra-VC scheduling will
+	// be retried with the failed nodes excluded, until it has been attempted by this number of times.
+	// Default to 3, and 1 means no retry.
+	MaxIntraVCSchedulingAttempts *int32 `yaml:"maxIntraVCSchedulingAttempts"`
+
+	// How the idle cells, i.e., the cells not bound to any VC, are shared among the
+	// opportunistic Pods of the VCs, see IdleCellSharingPolicies.
+	// Default to IdleCellSharingFirstComeFirstServed.
+	IdleCellSharingPolicy *IdleCellSharingPolicy `yaml:"idleCellSharingPolicy"`
+
+	// If an allocated AffinityGroup still misses some of its Pods (e.g., its controller crashed
+	// before creating them) after this timeout, an event is recorded on its existing Pods, and the
+	// reason is shown in its status.
+	// Default to 0, i.e., never timed out.
+	GangSchedulingTimeoutSec *int64 `yaml:"gangSchedulingTimeoutSec"`
+
+	// Whether the existing Pods of an AffinityGroup timed out by GangSchedulingTimeoutSec are also
+	// deleted to release its cells.
+	// Default to false.
+	GangSchedulingTimeoutDeletePods *bool `yaml:"gangSchedulingTimeoutDeletePods"`
+
 	// Specify the whole physical cluster
-	// TODO: Automatically construct it based on node info from Device Plugins
 	PhysicalCluster *PhysicalClusterSpec `yaml:"physicalCluster"`
 
 	// Specify all the virtual clusters belongs to the physical cluster
@@ -103,6 +124,19 @@ func NewConfig(rawConfig *Config) *Config {
 	if c.WaitingPodSchedulingBlockMilliSec == nil {
 		c.WaitingPodSchedulingBlockMilliSec = common.PtrInt64(0)
 	}
+	if c.MaxIntraVCSchedulingAttempts == nil {
+		c.MaxIntraVCSchedulingAttempts = common.PtrInt32(3)
+	}
+	if c.IdleCellSharingPolicy == nil {
+		policy := IdleCellSharingFirstComeFirstServed
+		c.IdleCellSharingPolicy = &policy
+	}
+	if c.GangSchedulingTimeoutSec == nil {
+		c.GangSchedulingTimeoutSec = common.PtrInt64(0)
+	}
+	if c.GangSchedulingTimeoutDeletePods == nil {
+		c.GangSchedulingTimeoutDeletePods = common.PtrBool(false)
+	}
 	if c.PhysicalCluster == nil {
 		c.PhysicalCluster = defaultPhysicalCluster()
 	}
@@ -111,20 +145,38 @@ func NewConfig(rawConfig *Config) *Config {
 	}
 	// Append default value for empty items in physical cell
 	defaultingPhysicalCells(c.PhysicalCluster)
+	defaultingVirtualClusters(*c.VirtualClusters)
 	// Validation
-	// TODO: Validate VirtualClusters against PhysicalCluster
+	if errs := ValidateConfig(c); len(errs) > 0 {
+		panic(errs)
+	}
 
 	return c
 }
 
+func defaultingVirtualClusters(vcs map[VirtualClusterName]VirtualClusterSpec) {
+	for vc, spec := range vcs {
+		if spec.IntraVCScheduler == "" {
+			spec.IntraVCScheduler = IntraVCSchedulerTopologyPacking
+		}
+		if spec.FairShareWeight == nil {
+			spec.FairShareWeight = common.PtrInt32(1)
+		}
+		vcs[vc] = spec
+	}
+}
+
 func defaultingPhysicalCells(pc *PhysicalClusterSpec) {
 	cts := pc.CellTypes
 	pcs := pc.PhysicalCells
 	for idx, pc := range pcs {
-		_, ok := cts[pc.CellType]
-		if !ok {
-			// unknown cell type
-			panic(fmt.Sprintf("physicalCells contains unknown cellType: %v", pc.CellType))
+		if _, ok := cts[pc.CellType]; !ok {
+			// unknown cell type, leave it to be reported by validation
+			continue
+		}
+		if _, ok := GetCellChain(cts, pc.CellType); !ok {
+			// cyclic cell types cannot be inferred, leave it to be reported by validation
+			continue
 		}
 		inferPhysicalCellSpec(&pcs[idx], cts, pc.CellType, int32(idx), "")
 	}
@@ -199,7 +251,30 @@ func InitRawConfig(configPath *string) *Config {
 	return &c
 }
 
-func WatchConfig(configPath *string, c *Config) {
+// InitRawConfigStrict is the same as InitRawConfig, but also rejects the fields unknown
+// to Config, which would otherwise be ignored silently. It is used to check the config
+// offline, so that a file which is not a Config at all (or has a misspelled field)
+// cannot pass.
+func InitRawConfigStrict(configPath *string) *Config {
+	c := Config{}
+	configFilePath := *configPath
+
+	yamlBytes, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		panic(fmt.Errorf(
+			"Failed to read config file: %v, %v", configFilePath, err))
+	}
+
+	common.FromYamlStrict(string(yamlBytes), &c)
+	return &c
+}
+
+// WatchConfig watches the config file, and calls applyConfig with the new Config
+// once the file content is changed to another valid Config.
+// If applyConfig returns false, i.e. the change cannot be applied in place, the
+// process will exit, and the new Config will be picked up after it is restarted.
+// Otherwise, applyConfig either applied the new Config or kept the current one.
+func WatchConfig(configPath *string, c *Config, applyConfig func(newConfig *Config) bool) {
 	v := viper.New()
 	configFilePath := *configPath
 
@@ -209,13 +284,33 @@ func WatchConfig(configPath *string, c *Config) {
 
 	v.OnConfigChange(func(e fsnotify.Event) {
 		klog.Infof("Watched config file changed: %v", e.Name)
-		if ok := reflect.DeepEqual(*c, *NewConfig(InitRawConfig(configPath))); !ok {
-			klog.Error("Config file content changed, exiting ...")
-			os.Exit(0)
+		newConfig, err := loadConfig(configPath)
+		if err != nil {
+			// The file may be partially written, so just wait for the next change.
+			klog.Errorf("Config file content is invalid, keep using the current config: %v", err)
+			return
+		}
+		if ok := reflect.DeepEqual(*c, *newConfig); !ok {
+			klog.Infof("Config file content changed, applying: %v", DiffConfig(c, newConfig))
+			if !applyConfig(newConfig) {
+				klog.Error("Config file content changed and cannot be applied in place, exiting ...")
+				os.Exit(0)
+			}
+			c = newConfig
+			klog.Infof("Config file content changed and handled")
 		}
 	})
 }
 
+func loadConfig(configPath *string) (c *Config, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return NewConfig(InitRawConfig(configPath)), nil
+}
+
 func BuildKubeConfig(sConfig *Config) *rest.Config {
 	kConfig, err := clientcmd.BuildConfigFromFlags(
 		*sConfig.KubeApiServerAddress, *sConfig.KubeConfigFilePath)
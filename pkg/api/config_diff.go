@@ -0,0 +1,211 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigDiff is the difference from an old Config to a new Config.
+// The physical cells are identified by the cellAddress of the top-level cells.
+type ConfigDiff struct {
+	// Changed fields which can only be applied by restarting the scheduler.
+	RestartRequiredFields []string
+	// Changed fields which can be applied in place directly.
+	InPlaceFields []string
+
+	// Changed scheduling policy fields which are applied in place to the scheduling
+	// algorithm, without reconstructing the scheduling view.
+	AlgorithmFields []string
+
+	SkuTypesChanged  bool
+	CellTypesChanged bool
+	// The discovery spec itself, the discovered physical cells are compared as
+	// the other physical cells.
+	DiscoveryChanged     bool
+	AddedPhysicalCells   []CellAddress
+	RemovedPhysicalCells []CellAddress
+	ChangedPhysicalCells []CellAddress
+
+	AddedVirtualClusters   []VirtualClusterName
+	RemovedVirtualClusters []VirtualClusterName
+	// VCs whose virtualCells, pinnedCells, intraVCScheduler or reservations are changed
+	ResizedVirtualClusters []VirtualClusterName
+	// VCs whose other fields (i.e. the scheduling policies) are changed
+	ReconfiguredVirtualClusters []VirtualClusterName
+}
+
+// DiffConfig computes the ConfigDiff between two defaulted Configs.
+func DiffConfig(oldConfig *Config, newConfig *Config) *ConfigDiff {
+	d := &ConfigDiff{}
+	if !reflect.DeepEqual(oldConfig.KubeApiServerAddress, newConfig.KubeApiServerAddress) {
+		d.RestartRequiredFields = append(d.RestartRequiredFields, "kubeApiServerAddress")
+	}
+	if !reflect.DeepEqual(oldConfig.KubeConfigFilePath, newConfig.KubeConfigFilePath) {
+		d.RestartRequiredFields = append(d.RestartRequiredFields, "kubeConfigFilePath")
+	}
+	if !reflect.DeepEqual(oldConfig.WebServerAddress, newConfig.WebServerAddress) {
+		d.RestartRequiredFields = append(d.RestartRequiredFields, "webServerAddress")
+	}
+	if !reflect.DeepEqual(oldConfig.ForcePodBindThreshold, newConfig.ForcePodBindThreshold) {
+		d.InPlaceFields = append(d.InPlaceFields, "forcePodBindThreshold")
+	}
+	if !reflect.DeepEqual(oldConfig.WaitingPodSchedulingBlockMilliSec, newConfig.WaitingPodSchedulingBlockMilliSec) {
+		d.InPlaceFields = append(d.InPlaceFields, "waitingPodSchedulingBlockMilliSec")
+	}
+	if !reflect.DeepEqual(oldConfig.MaxIntraVCSchedulingAttempts, newConfig.MaxIntraVCSchedulingAttempts) {
+		d.AlgorithmFields = append(d.AlgorithmFields, "maxIntraVCSchedulingAttempts")
+	}
+	if !reflect.DeepEqual(oldConfig.IdleCellSharingPolicy, newConfig.IdleCellSharingPolicy) {
+		d.AlgorithmFields = append(d.AlgorithmFields, "idleCellSharingPolicy")
+	}
+	if !reflect.DeepEqual(oldConfig.GangSchedulingTimeoutSec, newConfig.GangSchedulingTimeoutSec) {
+		d.AlgorithmFields = append(d.AlgorithmFields, "gangSchedulingTimeoutSec")
+	}
+	if !reflect.DeepEqual(oldConfig.GangSchedulingTimeoutDeletePods, newConfig.GangSchedulingTimeoutDeletePods) {
+		d.AlgorithmFields = append(d.AlgorithmFields, "gangSchedulingTimeoutDeletePods")
+	}
+
+	oldPc, newPc := oldConfig.PhysicalCluster, newConfig.PhysicalCluster
+	d.SkuTypesChanged = !reflect.DeepEqual(oldPc.SkuTypes, newPc.SkuTypes)
+	d.CellTypesChanged = !reflect.DeepEqual(oldPc.CellTypes, newPc.CellTypes)
+	d.DiscoveryChanged = !reflect.DeepEqual(oldPc.Discovery, newPc.Discovery)
+	oldCells := map[CellAddress]PhysicalCellSpec{}
+	for _, spec := range oldPc.PhysicalCells {
+		oldCells[spec.CellAddress] = spec
+	}
+	newCells := map[CellAddress]PhysicalCellSpec{}
+	for _, spec := range newPc.PhysicalCells {
+		newCells[spec.CellAddress] = spec
+		if oldSpec, ok := oldCells[spec.CellAddress]; !ok {
+			d.AddedPhysicalCells = append(d.AddedPhysicalCells, spec.CellAddress)
+		} else if !reflect.DeepEqual(oldSpec, spec) {
+			d.ChangedPhysicalCells = append(d.ChangedPhysicalCells, spec.CellAddress)
+		}
+	}
+	for _, spec := range oldPc.PhysicalCells {
+		if _, ok := newCells[spec.CellAddress]; !ok {
+			d.RemovedPhysicalCells = append(d.RemovedPhysicalCells, spec.CellAddress)
+		}
+	}
+
+	oldVcs, newVcs := *oldConfig.VirtualClusters, *newConfig.VirtualClusters
+	for vc, spec := range newVcs {
+		if oldSpec, ok := oldVcs[vc]; !ok {
+			d.AddedVirtualClusters = append(d.AddedVirtualClusters, vc)
+		} else if isVirtualClusterResized(oldSpec, spec) {
+			d.ResizedVirtualClusters = append(d.ResizedVirtualClusters, vc)
+		} else if !reflect.DeepEqual(oldSpec, spec) {
+			d.ReconfiguredVirtualClusters = append(d.ReconfiguredVirtualClusters, vc)
+		}
+	}
+	for vc := range oldVcs {
+		if _, ok := newVcs[vc]; !ok {
+			d.RemovedVirtualClusters = append(d.RemovedVirtualClusters, vc)
+		}
+	}
+	sortVCNames(d.AddedVirtualClusters)
+	sortVCNames(d.RemovedVirtualClusters)
+	sortVCNames(d.ResizedVirtualClusters)
+	sortVCNames(d.ReconfiguredVirtualClusters)
+	return d
+}
+
+// isVirtualClusterResized returns true if the cells of the VC are changed.
+func isVirtualClusterResized(oldSpec VirtualClusterSpec, newSpec VirtualClusterSpec) bool {
+	return !reflect.DeepEqual(oldSpec.VirtualCells, newSpec.VirtualCells) ||
+		!reflect.DeepEqual(oldSpec.PinnedCells, newSpec.PinnedCells) ||
+		oldSpec.IntraVCScheduler != newSpec.IntraVCScheduler ||
+		!reflect.DeepEqual(oldSpec.Reservations, newSpec.Reservations)
+}
+
+// IsEmpty returns true if nothing is changed.
+func (d *ConfigDiff) IsEmpty() bool {
+	return len(d.RestartRequiredFields) == 0 && len(d.InPlaceFields) == 0 &&
+		!d.DiscoveryChanged && !d.ClusterChanged() && !d.PoliciesChanged()
+}
+
+// RestartRequired returns true if the change cannot be applied in place.
+func (d *ConfigDiff) RestartRequired() bool {
+	return len(d.RestartRequiredFields) > 0
+}
+
+// ClusterChanged returns true if the cells of the physical cluster or any virtual cluster
+// are changed, i.e. the scheduling view needs to be reconstructed.
+func (d *ConfigDiff) ClusterChanged() bool {
+	return d.SkuTypesChanged ||
+		d.CellTypesChanged ||
+		len(d.AddedPhysicalCells) > 0 ||
+		len(d.RemovedPhysicalCells) > 0 ||
+		len(d.ChangedPhysicalCells) > 0 ||
+		len(d.AddedVirtualClusters) > 0 ||
+		len(d.RemovedVirtualClusters) > 0 ||
+		len(d.ResizedVirtualClusters) > 0
+}
+
+// PoliciesChanged returns true if any algorithm field or the scheduling policy of any
+// virtual cluster is changed, which can be applied without reconstructing the scheduling view.
+func (d *ConfigDiff) PoliciesChanged() bool {
+	return len(d.AlgorithmFields) > 0 || len(d.ReconfiguredVirtualClusters) > 0
+}
+
+func (d *ConfigDiff) String() string {
+	var changes []string
+	add := func(name string, values interface{}) {
+		if reflect.ValueOf(values).Len() > 0 {
+			changes = append(changes, fmt.Sprintf("%v: %v", name, values))
+		}
+	}
+	add("restart required fields", d.RestartRequiredFields)
+	add("in place fields", d.InPlaceFields)
+	add("algorithm fields", d.AlgorithmFields)
+	if d.SkuTypesChanged {
+		changes = append(changes, "skuTypes changed")
+	}
+	if d.CellTypesChanged {
+		changes = append(changes, "cellTypes changed")
+	}
+	if d.DiscoveryChanged {
+		changes = append(changes, "discovery changed")
+	}
+	add("added physical cells", d.AddedPhysicalCells)
+	add("removed physical cells", d.RemovedPhysicalCells)
+	add("changed physical cells", d.ChangedPhysicalCells)
+	add("added virtual clusters", d.AddedVirtualClusters)
+	add("removed virtual clusters", d.RemovedVirtualClusters)
+	add("resized virtual clusters", d.ResizedVirtualClusters)
+	add("reconfigured virtual clusters", d.ReconfiguredVirtualClusters)
+	if len(changes) == 0 {
+		return "no change"
+	}
+	return strings.Join(changes, "; ")
+}
+
+func sortVCNames(vcs []VirtualClusterName) {
+	sort.Slice(vcs, func(i, j int) bool {
+		return vcs[i] < vcs[j]
+	})
+}
@@ -0,0 +1,135 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/microsoft/hivedscheduler/pkg/common"
+)
+
+const testDiffVCs = `
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: GPU-RACK.GPU-NODE
+      cellNumber: 1
+    pinnedCells:
+    - pinnedCellId: PIN0
+`
+
+func newTestDiffConfig() *Config {
+	c := &Config{}
+	common.FromYaml(testCellTypes+testPhysicalCells+testDiffVCs, c)
+	return NewConfig(c)
+}
+
+func TestDiffConfig(t *testing.T) {
+	if d := DiffConfig(newTestDiffConfig(), newTestDiffConfig()); !d.IsEmpty() {
+		t.Fatalf("Expected no change, but got: %v", d)
+	}
+
+	testCases := []struct {
+		name   string
+		change func(c *Config)
+		// the expected diff, besides the fields compared below
+		check           func(d *ConfigDiff) bool
+		clusterChanged  bool
+		policiesChanged bool
+	}{
+		{
+			name: "skuTypes changed",
+			change: func(c *Config) {
+				c.PhysicalCluster.SkuTypes = map[string]SkuTypeSpec{"GPU": {Gpu: 1, Cpu: "4", Memory: "8Gi"}}
+			},
+			check:          func(d *ConfigDiff) bool { return d.SkuTypesChanged },
+			clusterChanged: true,
+		},
+		{
+			name: "skuType resource changed",
+			change: func(c *Config) {
+				c.PhysicalCluster.SkuTypes = map[string]SkuTypeSpec{"GPU": {Gpu: 1, Cpu: "8", Memory: "8Gi"}}
+			},
+			check:          func(d *ConfigDiff) bool { return d.SkuTypesChanged },
+			clusterChanged: true,
+		},
+		{
+			name: "discovery enabled",
+			change: func(c *Config) {
+				c.PhysicalCluster.Discovery = &PhysicalClusterDiscoverySpec{}
+			},
+			check: func(d *ConfigDiff) bool { return d.DiscoveryChanged },
+		},
+		{
+			name: "discovery resource name changed",
+			change: func(c *Config) {
+				c.PhysicalCluster.Discovery = &PhysicalClusterDiscoverySpec{LeafCellResourceName: "nvidia.com/gpu"}
+			},
+			check: func(d *ConfigDiff) bool { return d.DiscoveryChanged },
+		},
+		{
+			name: "virtual cells changed",
+			change: func(c *Config) {
+				(*c.VirtualClusters)["vc1"].VirtualCells[0].CellType = "GPU-RACK"
+			},
+			check: func(d *ConfigDiff) bool {
+				return reflect.DeepEqual(d.ResizedVirtualClusters, []VirtualClusterName{"vc1"})
+			},
+			clusterChanged: true,
+		},
+		{
+			name: "vc policy changed",
+			change: func(c *Config) {
+				vcs := (*c.VirtualClusters)["vc1"]
+				vcs.FairShareWeight = common.PtrInt32(2)
+				vcs.AgingThresholdSeconds = 60
+				(*c.VirtualClusters)["vc1"] = vcs
+			},
+			check: func(d *ConfigDiff) bool {
+				return reflect.DeepEqual(d.ReconfiguredVirtualClusters, []VirtualClusterName{"vc1"}) &&
+					len(d.ResizedVirtualClusters) == 0
+			},
+			policiesChanged: true,
+		},
+		{
+			name: "algorithm field changed",
+			change: func(c *Config) {
+				c.MaxIntraVCSchedulingAttempts = common.PtrInt32(5)
+			},
+			check: func(d *ConfigDiff) bool {
+				return reflect.DeepEqual(d.AlgorithmFields, []string{"maxIntraVCSchedulingAttempts"})
+			},
+			policiesChanged: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		oldConfig, newConfig := newTestDiffConfig(), newTestDiffConfig()
+		tc.change(newConfig)
+		d := DiffConfig(oldConfig, newConfig)
+		if d.IsEmpty() || d.RestartRequired() || !tc.check(d) ||
+			d.ClusterChanged() != tc.clusterChanged || d.PoliciesChanged() != tc.policiesChanged {
+			t.Errorf("%v: unexpected diff: %v", tc.name, d)
+		}
+	}
+}
@@ -54,6 +54,20 @@ const (
 	// It is in PodBindInfo YAML format.
 	AnnotationKeyPodBindInfo = GroupName + "/pod-bind-info"
 
+	// Populated by this scheduler on a victim Pod in its preemption grace period,
+	// see VirtualClusterSpec.PreemptionGracePeriodSeconds.
+	// It is in PreemptionNotice YAML format.
+	AnnotationKeyPodPreemptionNotice = GroupName + "/pod-preemption-notice"
+	// A notified victim Pod could set below annotation to "true" (e.g., after it
+	// has checkpointed), so that it is deleted without waiting for the deadline.
+	AnnotationKeyPodPreemptionAcknowledged = GroupName + "/pod-preemption-acknowledged"
+
+	// Used to discover physical cells from nodes, see PhysicalClusterDiscoverySpec.
+	// The node level cellType of the node.
+	LabelKeyNodeCellType = GroupName + "/node-cell-type"
+	// The cellAddress of the node's ancestor cell of the cellType appended to the prefix.
+	LabelKeyPrefixCellAddress = GroupName + "/cell."
+
 	// Priority Range of Guaranteed Pod.
 	MaxGuaranteedPriority = int32(1000)
 	MinGuaranteedPriority = int32(0)
@@ -62,6 +76,41 @@ const (
 	OpportunisticPriority = int32(-1)
 )
 
+///////////////////////////////////////////////////////////////////////////////////////
+// Intra-VC Scheduling Policies
+///////////////////////////////////////////////////////////////////////////////////////
+const (
+	// Pack Pods to the nodes with fewer free leaf cells, and to the leaf cells with the best affinity.
+	IntraVCSchedulerTopologyPacking IntraVCSchedulerPolicy = "topology-packing"
+	// Spread Pods to the nodes with more free leaf cells, so that fewer Pods are affected by a node failure.
+	IntraVCSchedulerSpread IntraVCSchedulerPolicy = "spread"
+	// Place Pods to the first nodes that can hold them, in the order of the cells in the VC.
+	IntraVCSchedulerFirstFit IntraVCSchedulerPolicy = "first-fit"
+)
+
+var IntraVCSchedulerPolicies = []IntraVCSchedulerPolicy{
+	IntraVCSchedulerTopologyPacking,
+	IntraVCSchedulerSpread,
+	IntraVCSchedulerFirstFit,
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+// Idle Cell Sharing Policies
+///////////////////////////////////////////////////////////////////////////////////////
+const (
+	// Idle cells are used by the opportunistic Pods of any VC, first-come-first-served.
+	IdleCellSharingFirstComeFirstServed IdleCellSharingPolicy = "first-come-first-served"
+	// Idle cells are lent to the VCs in proportion to their fairShareWeight. An opportunistic
+	// affinity group which would make its VC exceed the fair share has to wait, if another VC
+	// further below its fair share has waiting opportunistic affinity groups.
+	IdleCellSharingWeightedFairShare IdleCellSharingPolicy = "weighted-fair-share"
+)
+
+var IdleCellSharingPolicies = []IdleCellSharingPolicy{
+	IdleCellSharingFirstComeFirstServed,
+	IdleCellSharingWeightedFairShare,
+}
+
 var EnvValueConfigFilePath = common.GetEnv("CONFIG", "./hivedscheduler.yaml")
 var EnvValueKubeApiServerAddress = common.GetEnv("KUBE_APISERVER_ADDRESS", "")
 var EnvValueKubeConfigFilePath = common.GetEnv("KUBECONFIG", os.Getenv("HOME")+"/.kube/config")
@@ -91,4 +140,8 @@ const (
 	PhysicalClusterPath = ClusterStatusPath + "/physicalcluster"
 	// Inspect current virtual cluster(s)' status
 	VirtualClustersPath = ClusterStatusPath + "/virtualclusters/"
+	// Inspect current opportunistic leaf cell usage of the virtual cluster(s)
+	OpportunisticUsagePath = InspectPath + "/opportunisticusage/"
+	// Inspect the proposed AffinityGroup relocations to defragment the physical cluster
+	DefragmentationPlanPath = InspectPath + "/defragmentationplan"
 )
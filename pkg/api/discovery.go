@@ -0,0 +1,258 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// NewDiscoveredConfig returns a copy of the Config whose physical cells are discovered
+// from the nodes, if the discovery is enabled. Otherwise, the Config itself is returned.
+// Error is delivered by panic, e.g. ConfigErrorList if the discovered Config is invalid.
+func NewDiscoveredConfig(c *Config, nodes []*core.Node) *Config {
+	if c.PhysicalCluster.Discovery == nil {
+		return c
+	}
+
+	dc := &Config{}
+	common.FromYaml(common.ToYaml(c), dc)
+	dc.PhysicalCluster.Discovery = nil
+	pcs := append(dc.PhysicalCluster.PhysicalCells, DiscoverPhysicalCells(c.PhysicalCluster, nodes)...)
+	for idx := len(dc.PhysicalCluster.PhysicalCells); idx < len(pcs); idx++ {
+		inferPhysicalCellSpec(&pcs[idx], dc.PhysicalCluster.CellTypes, pcs[idx].CellType, int32(idx), "")
+	}
+	dc.PhysicalCluster.PhysicalCells = pcs
+
+	if errs := ValidateConfig(dc); len(errs) > 0 {
+		panic(errs)
+	}
+	return dc
+}
+
+// DiscoverPhysicalCells constructs the top-level physical cells from the labeled nodes
+// which are not specified in PhysicalCells, see PhysicalClusterDiscoverySpec.
+func DiscoverPhysicalCells(pc *PhysicalClusterSpec, nodes []*core.Node) []PhysicalCellSpec {
+	cts := pc.CellTypes
+	parentTypes := map[CellType][]CellType{}
+	for _, ct := range sortedCellTypes(cts) {
+		parentTypes[cts[ct].ChildCellType] = append(parentTypes[cts[ct].ChildCellType], ct)
+	}
+	specifiedNodes := common.NewSet()
+	for _, spec := range pc.PhysicalCells {
+		collectNodes(spec, cts, specifiedNodes)
+	}
+
+	sortedNodes := make([]*core.Node, len(nodes))
+	copy(sortedNodes, nodes)
+	sort.Slice(sortedNodes, func(i, j int) bool {
+		return sortedNodes[i].Name < sortedNodes[j].Name
+	})
+	root := newDiscoveredCell("", "")
+	for _, node := range sortedNodes {
+		if specifiedNodes.Contains(node.Name) || node.Labels[LabelKeyNodeCellType] == "" {
+			continue
+		}
+		cellPath, err := getNodeCellPath(node, cts, parentTypes, pc.Discovery)
+		if err != nil {
+			klog.Warningf("[%v]: Node is not discovered: %v", node.Name, err)
+			continue
+		}
+		c := root
+		for i := len(cellPath) - 1; i >= 0; i-- {
+			c = c.getOrAddChild(cellPath[i].cellType, cellPath[i].address)
+		}
+	}
+
+	var specs []PhysicalCellSpec
+	for _, c := range root.sortedChildren() {
+		specs = append(specs, c.toPhysicalCellSpec(cts))
+	}
+	return specs
+}
+
+// GetNodeDiscoveryKey returns the information of the node used in the discovery,
+// so that the physical cells only need to be discovered again once it is changed.
+// Empty key means the node is not to be discovered.
+func GetNodeDiscoveryKey(node *core.Node, d *PhysicalClusterDiscoverySpec) string {
+	if node.Labels[LabelKeyNodeCellType] == "" {
+		return ""
+	}
+	var items []string
+	for k, v := range node.Labels {
+		if k == LabelKeyNodeCellType || strings.HasPrefix(k, LabelKeyPrefixCellAddress) {
+			items = append(items, k+"="+v)
+		}
+	}
+	sort.Strings(items)
+	if d.LeafCellResourceName != "" {
+		q := node.Status.Allocatable[core.ResourceName(d.LeafCellResourceName)]
+		items = append(items, d.LeafCellResourceName+"="+q.String())
+	}
+	return strings.Join(items, ",")
+}
+
+type discoveredCellKey struct {
+	cellType CellType
+	address  CellAddress
+}
+
+// getNodeCellPath returns the node cell and its ancestor cells, from the bottom to the top.
+func getNodeCellPath(
+	node *core.Node,
+	cts map[CellType]CellTypeSpec,
+	parentTypes map[CellType][]CellType,
+	d *PhysicalClusterDiscoverySpec) ([]discoveredCellKey, error) {
+
+	nodeCellType := CellType(node.Labels[LabelKeyNodeCellType])
+	if ct, ok := cts[nodeCellType]; !ok || !ct.IsNodeLevel {
+		return nil, fmt.Errorf("%v is not a node level cellType", nodeCellType)
+	}
+	if d.LeafCellResourceName != "" {
+		leafCellNum := int64(1)
+		for ct, ok := cts[nodeCellType]; ok; ct, ok = cts[ct.ChildCellType] {
+			leafCellNum *= int64(ct.ChildCellNumber)
+		}
+		q := node.Status.Allocatable[core.ResourceName(d.LeafCellResourceName)]
+		if q.Value() < leafCellNum {
+			return nil, fmt.Errorf("allocatable %v %v is less than the leaf cell number %v of cellType %v",
+				q.String(), d.LeafCellResourceName, leafCellNum, nodeCellType)
+		}
+	}
+
+	path := []discoveredCellKey{{cellType: nodeCellType, address: CellAddress(node.Name)}}
+	for ct := nodeCellType; ; {
+		var labeledParents []CellType
+		for _, p := range parentTypes[ct] {
+			if _, ok := node.Labels[LabelKeyPrefixCellAddress+string(p)]; ok {
+				labeledParents = append(labeledParents, p)
+			}
+		}
+		if len(labeledParents) == 0 {
+			return path, nil
+		}
+		if len(labeledParents) > 1 {
+			return nil, fmt.Errorf("the parent of cellType %v is ambiguous: %v", ct, labeledParents)
+		}
+		ct = labeledParents[0]
+		address := node.Labels[LabelKeyPrefixCellAddress+string(ct)]
+		if address == "" {
+			return nil, fmt.Errorf("the cellAddress of cellType %v is empty", ct)
+		}
+		path = append(path, discoveredCellKey{cellType: ct, address: CellAddress(address)})
+	}
+}
+
+type discoveredCell struct {
+	discoveredCellKey
+	children map[discoveredCellKey]*discoveredCell
+}
+
+func newDiscoveredCell(cellType CellType, address CellAddress) *discoveredCell {
+	return &discoveredCell{
+		discoveredCellKey: discoveredCellKey{cellType: cellType, address: address},
+		children:          map[discoveredCellKey]*discoveredCell{},
+	}
+}
+
+func (c *discoveredCell) getOrAddChild(cellType CellType, address CellAddress) *discoveredCell {
+	key := discoveredCellKey{cellType: cellType, address: address}
+	if c.children[key] == nil {
+		c.children[key] = newDiscoveredCell(cellType, address)
+	}
+	return c.children[key]
+}
+
+func (c *discoveredCell) sortedChildren() []*discoveredCell {
+	children := make([]*discoveredCell, 0, len(c.children))
+	for _, child := range c.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].cellType != children[j].cellType {
+			return children[i].cellType < children[j].cellType
+		}
+		return children[i].address < children[j].address
+	})
+	return children
+}
+
+func (c *discoveredCell) toPhysicalCellSpec(cts map[CellType]CellTypeSpec) PhysicalCellSpec {
+	spec := PhysicalCellSpec{CellType: c.cellType, CellAddress: c.address}
+	ct := cts[c.cellType]
+	if ct.IsNodeLevel {
+		// the leaf cells will be inferred
+		return spec
+	}
+	children := c.sortedChildren()
+	if int32(len(children)) > ct.ChildCellNumber {
+		klog.Warningf("Discovered cell %v of cellType %v has %v children, more than %v, ignoring the others: %v",
+			c.address, c.cellType, len(children), ct.ChildCellNumber, children[ct.ChildCellNumber:])
+		children = children[:ct.ChildCellNumber]
+	}
+	for _, child := range children {
+		spec.CellChildren = append(spec.CellChildren, child.toPhysicalCellSpec(cts))
+	}
+	for i := int32(len(children)); i < ct.ChildCellNumber; i++ {
+		spec.CellChildren = append(spec.CellChildren, newPlaceholderCellSpec(
+			cts, ct.ChildCellType, CellAddress(fmt.Sprintf("%v-missing-%v", c.address, i))))
+	}
+	return spec
+}
+
+func (k discoveredCellKey) String() string {
+	return string(k.address)
+}
+
+// newPlaceholderCellSpec constructs a cell whose nodes never exist.
+func newPlaceholderCellSpec(cts map[CellType]CellTypeSpec, cellType CellType, address CellAddress) PhysicalCellSpec {
+	spec := PhysicalCellSpec{CellType: cellType, CellAddress: address}
+	if ct := cts[cellType]; !ct.IsNodeLevel {
+		for i := int32(0); i < ct.ChildCellNumber; i++ {
+			spec.CellChildren = append(spec.CellChildren, newPlaceholderCellSpec(
+				cts, ct.ChildCellType, CellAddress(fmt.Sprintf("%v-%v", address, i))))
+		}
+	}
+	return spec
+}
+
+// collectNodes collects the names of all the nodes in the defaulted physical cell.
+func collectNodes(spec PhysicalCellSpec, cts map[CellType]CellTypeSpec, nodes common.Set) {
+	ct, ok := cts[spec.CellType]
+	if !ok {
+		return
+	}
+	if ct.IsNodeLevel {
+		splitAddress := strings.Split(string(spec.CellAddress), "/")
+		nodes.Add(splitAddress[len(splitAddress)-1])
+		return
+	}
+	for _, child := range spec.CellChildren {
+		collectNodes(child, cts, nodes)
+	}
+}
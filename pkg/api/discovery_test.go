@@ -0,0 +1,193 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testLeafCellResourceName = "nvidia.com/gpu"
+
+// newTestNode creates a node with the given node level cellType, the given cellAddress
+// of each ancestor cellType, and the given allocatable leaf cells (none if negative).
+func newTestNode(name string, cellType string, addresses map[string]string, leafCellNum int64) *core.Node {
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: name, Labels: map[string]string{}}}
+	if cellType != "" {
+		node.Labels[LabelKeyNodeCellType] = cellType
+	}
+	for ct, address := range addresses {
+		node.Labels[LabelKeyPrefixCellAddress+ct] = address
+	}
+	if leafCellNum >= 0 {
+		node.Status.Allocatable = core.ResourceList{
+			testLeafCellResourceName: *resource.NewQuantity(leafCellNum, resource.DecimalSI)}
+	}
+	return node
+}
+
+// formatCellSpecs formats the cells as cellType/cellAddress(children...), to be compared easily.
+func formatCellSpecs(specs []PhysicalCellSpec) string {
+	var items []string
+	for _, spec := range specs {
+		item := string(spec.CellType) + "/" + string(spec.CellAddress)
+		if len(spec.CellChildren) > 0 {
+			item += "(" + formatCellSpecs(spec.CellChildren) + ")"
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+func TestDiscoverPhysicalCells(t *testing.T) {
+	rack := func(address string) map[string]string {
+		return map[string]string{"GPU-RACK": address}
+	}
+	testCases := []struct {
+		name      string
+		discovery PhysicalClusterDiscoverySpec
+		nodes     []*core.Node
+		expected  string
+	}{
+		{
+			name: "nodes without cellAddress labels",
+			nodes: []*core.Node{
+				newTestNode("node1", "GPU-NODE", nil, -1),
+				newTestNode("node0", "CPU-NODE", nil, -1),
+			},
+			expected: "CPU-NODE/node0,GPU-NODE/node1",
+		},
+		{
+			name: "nodes without or with unknown node level cellType",
+			nodes: []*core.Node{
+				newTestNode("node0", "", nil, -1),
+				newTestNode("node1", "GPU-POD", nil, -1),
+				newTestNode("node2", "GPU-RACK", nil, -1),
+				newTestNode("node3", "GPU-NODE", nil, -1),
+			},
+			expected: "GPU-NODE/node3",
+		},
+		{
+			name: "nodes already specified in physicalCells",
+			nodes: []*core.Node{
+				newTestNode("0.0.0.0", "GPU-NODE", nil, -1),
+				newTestNode("node0", "GPU-NODE", nil, -1),
+			},
+			expected: "GPU-NODE/node0",
+		},
+		{
+			name: "nodes grouped by the cellAddress labels",
+			nodes: []*core.Node{
+				newTestNode("node3", "GPU-NODE", rack("rack2"), -1),
+				newTestNode("node2", "GPU-NODE", rack("rack1"), -1),
+				newTestNode("node1", "GPU-NODE", rack("rack1"), -1),
+				newTestNode("node0", "GPU-NODE", rack("rack2"), -1),
+			},
+			expected: "GPU-RACK/rack1(GPU-NODE/node1,GPU-NODE/node2),GPU-RACK/rack2(GPU-NODE/node0,GPU-NODE/node3)",
+		},
+		{
+			name: "empty cellAddress label",
+			nodes: []*core.Node{
+				newTestNode("node0", "GPU-NODE", rack(""), -1),
+				newTestNode("node1", "GPU-NODE", nil, -1),
+			},
+			expected: "GPU-NODE/node1",
+		},
+		{
+			name: "missing children padded with placeholders",
+			nodes: []*core.Node{
+				newTestNode("node0", "GPU-NODE", rack("rack1"), -1),
+			},
+			expected: "GPU-RACK/rack1(GPU-NODE/node0,GPU-NODE/rack1-missing-1)",
+		},
+		{
+			name: "extra children ignored",
+			nodes: []*core.Node{
+				newTestNode("node0", "GPU-NODE", rack("rack1"), -1),
+				newTestNode("node1", "GPU-NODE", rack("rack1"), -1),
+				newTestNode("node2", "GPU-NODE", rack("rack1"), -1),
+			},
+			expected: "GPU-RACK/rack1(GPU-NODE/node0,GPU-NODE/node1)",
+		},
+		{
+			name:      "nodes with insufficient allocatable leaf cells",
+			discovery: PhysicalClusterDiscoverySpec{LeafCellResourceName: testLeafCellResourceName},
+			nodes: []*core.Node{
+				newTestNode("node0", "GPU-NODE", nil, 4),
+				newTestNode("node1", "GPU-NODE", nil, 3),
+				newTestNode("node2", "GPU-NODE", nil, -1),
+				newTestNode("node3", "CPU-NODE", nil, 2),
+			},
+			expected: "CPU-NODE/node3,GPU-NODE/node0",
+		},
+	}
+	for _, tc := range testCases {
+		c := &Config{}
+		common.FromYaml(testCellTypes+testPhysicalCells, c)
+		defaultingPhysicalCells(c.PhysicalCluster)
+		discovery := tc.discovery
+		c.PhysicalCluster.Discovery = &discovery
+		if specs := formatCellSpecs(DiscoverPhysicalCells(c.PhysicalCluster, tc.nodes)); specs != tc.expected {
+			t.Errorf("%v: Expected the discovered cells %v, but got %v", tc.name, tc.expected, specs)
+		}
+	}
+}
+
+func TestGetNodeDiscoveryKey(t *testing.T) {
+	node := newTestNode("node0", "GPU-NODE", map[string]string{"GPU-RACK": "rack1"}, 4)
+	node.Labels["kubernetes.io/hostname"] = "node0"
+	testCases := []struct {
+		name      string
+		node      *core.Node
+		discovery PhysicalClusterDiscoverySpec
+		expected  string
+	}{
+		{
+			name:     "node without node level cellType",
+			node:     newTestNode("node1", "", map[string]string{"GPU-RACK": "rack1"}, 4),
+			expected: "",
+		},
+		{
+			name:     "labels only",
+			node:     node,
+			expected: LabelKeyPrefixCellAddress + "GPU-RACK=rack1," + LabelKeyNodeCellType + "=GPU-NODE",
+		},
+		{
+			name:      "labels and allocatable leaf cells",
+			node:      node,
+			discovery: PhysicalClusterDiscoverySpec{LeafCellResourceName: testLeafCellResourceName},
+			expected: LabelKeyPrefixCellAddress + "GPU-RACK=rack1," + LabelKeyNodeCellType + "=GPU-NODE," +
+				testLeafCellResourceName + "=4",
+		},
+	}
+	for _, tc := range testCases {
+		if key := GetNodeDiscoveryKey(tc.node, &tc.discovery); key != tc.expected {
+			t.Errorf("%v: Expected the discovery key %q, but got %q", tc.name, tc.expected, key)
+		}
+	}
+}
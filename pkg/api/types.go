@@ -40,8 +40,40 @@ type (
 
 // Physical cluster definition
 type PhysicalClusterSpec struct {
+	// Leaf cellType -> its resource unit, see SkuTypeSpec.
+	SkuTypes      map[string]SkuTypeSpec    `yaml:"skuTypes,omitempty"`
 	CellTypes     map[CellType]CellTypeSpec `yaml:"cellTypes"`
 	PhysicalCells []PhysicalCellSpec        `yaml:"physicalCells"`
+	// If specified, physical cells are also discovered from the labeled nodes,
+	// besides the ones specified in PhysicalCells.
+	Discovery *PhysicalClusterDiscoverySpec `yaml:"discovery,omitempty"`
+}
+
+// Discover physical cells from nodes:
+// A node is discovered if it has the LabelKeyNodeCellType label, whose value is a
+// node level cellType. Its ancestor cells are specified by the labels with key
+// LabelKeyPrefixCellAddress + cellType, whose value is the cellAddress of the
+// ancestor cell, such as the rack name.
+// Nodes with the same ancestor cell are grouped into it, and the cell is padded
+// with placeholder nodes if it has fewer children than its childCellNumber. These
+// placeholder nodes never exist, so they are considered as bad nodes.
+type PhysicalClusterDiscoverySpec struct {
+	// The resource name of the leaf cell in Node.Status.Allocatable, such as nvidia.com/gpu.
+	// If specified, a node is discovered only if its allocatable amount of the resource
+	// is not less than the leaf cell number of its node level cellType.
+	LeafCellResourceName string `yaml:"leafCellResourceName,omitempty"`
+}
+
+// A skuType defines the resource unit of a leaf cellType in all resource dimensions.
+// A Pod requesting N leaf cells of the leaf cellType can request at most N times of
+// the cpu and memory, otherwise it may be rejected by the kubelet.
+type SkuTypeSpec struct {
+	// Number of gpus in the resource unit, it is only informative.
+	Gpu int32 `yaml:"gpu" json:"gpu,omitempty"`
+	// In K8S resource quantity format, such as 4, 500m, 8192Mi.
+	// Empty means not to check the resource.
+	Cpu    string `yaml:"cpu" json:"cpu,omitempty"`
+	Memory string `yaml:"memory" json:"memory,omitempty"`
 }
 
 type CellTypeSpec struct {
@@ -64,8 +96,49 @@ type VirtualClusterName string
 type VirtualClusterSpec struct {
 	VirtualCells []VirtualCellSpec `yaml:"virtualCells"`
 	PinnedCells  []PinnedCellSpec  `yaml:"pinnedCells,omitempty"`
+	// The policy to place Pods inside the VC, see IntraVCSchedulerPolicies.
+	// Default to IntraVCSchedulerTopologyPacking.
+	IntraVCScheduler IntraVCSchedulerPolicy `yaml:"intraVCScheduler,omitempty"`
+	// The maximum number of leaf cells of each leaf cell type that the opportunistic
+	// Pods of the VC can use in total. Unlimited for leaf cell types not specified.
+	MaxOpportunisticLeafCells map[string]int32 `yaml:"maxOpportunisticLeafCells,omitempty"`
+	// The weight of the VC when sharing the idle cells under IdleCellSharingWeightedFairShare.
+	// Default to 1.
+	FairShareWeight *int32 `yaml:"fairShareWeight,omitempty"`
+	// Once the oldest waiting guaranteed affinity group in the VC has been waiting for longer than
+	// this, cells are reserved for it, so that the later groups with non-higher priorities cannot take them.
+	// Default to 0, i.e., no reservation.
+	AgingThresholdSeconds int64 `yaml:"agingThresholdSeconds,omitempty"`
+	// When the Pods of the VC are to be preempted, they are notified (see AnnotationKeyPodPreemptionNotice)
+	// and only deleted after this period, or once they acknowledge the preemption.
+	// Default to 0, i.e., deleted immediately.
+	PreemptionGracePeriodSeconds int64 `yaml:"preemptionGracePeriodSeconds,omitempty"`
+	// Cells of the VC reserved for a time window, which only the AffinityGroups tagged with
+	// the reservation (see PodSchedulingSpec.Reservation) can use during the window.
+	Reservations []ReservationSpec `yaml:"reservations,omitempty"`
 }
 
+// A reservation of CellNumber cells of CellType in a VC from StartTime to EndTime.
+// Once the reservation begins to drain, the cells are chosen and no longer given to new AffinityGroups,
+// and the AffinityGroups already using them are waited for to complete (instead of being preempted).
+type ReservationSpec struct {
+	// Unique among all the VCs.
+	Name string `yaml:"name"`
+	// A cellType in the VC, which may be at any level (e.g., a rack).
+	CellType   CellType `yaml:"cellType"`
+	CellNumber int32    `yaml:"cellNumber"`
+	// Time in RFC3339 format.
+	StartTime string `yaml:"startTime"`
+	EndTime   string `yaml:"endTime"`
+	// The reservation begins to drain this period before StartTime.
+	// Default to 0, i.e., drain from when the reservation is configured.
+	DrainSeconds int64 `yaml:"drainSeconds,omitempty"`
+}
+
+type IntraVCSchedulerPolicy string
+
+type IdleCellSharingPolicy string
+
 type VirtualCellSpec struct {
 	CellNumber int32    `yaml:"cellNumber"`
 	CellType   CellType `yaml:"cellType"`
@@ -76,13 +149,32 @@ type PinnedCellSpec struct {
 }
 
 type PodSchedulingSpec struct {
-	VirtualCluster          VirtualClusterName `yaml:"virtualCluster"`
-	Priority                int32              `yaml:"priority"`
-	PinnedCellId            PinnedCellId       `yaml:"pinnedCellId"`
-	LeafCellType            string             `yaml:"leafCellType"`
-	LeafCellNumber          int32              `yaml:"leafCellNumber"`
-	GangReleaseEnable       bool               `yaml:"gangReleaseEnable"`
-	LazyPreemptionEnable    bool               `yaml:"lazyPreemptionEnable"`
+	VirtualCluster VirtualClusterName `yaml:"virtualCluster"`
+	Priority       int32              `yaml:"priority"`
+	PinnedCellId   PinnedCellId       `yaml:"pinnedCellId"`
+	// If the AffinityGroup.Members specify LeafCellType, it defaults to that of the only member
+	// with the same LeafCellNumber, and it should be specified if several members have the same
+	// LeafCellNumber, see AffinityGroupMemberSpec.
+	LeafCellType   string `yaml:"leafCellType"`
+	LeafCellNumber int32  `yaml:"leafCellNumber"`
+	// If in (0, 1), the Pod uses only this fraction of one leaf cell (LeafCellNumber should be 1),
+	// and shares the leaf cell with other such Pods of the same VC (at any priority), so the VC quota
+	// is counted in fractions. A shared leaf cell has the highest priority among the Pods sharing it.
+	LeafCellFraction float64 `yaml:"leafCellFraction,omitempty"`
+	// If true, the leaf cells of each completed Pod are released immediately,
+	// instead of being held until all the Pods in the AffinityGroup complete.
+	GangReleaseEnable    bool `yaml:"gangReleaseEnable"`
+	LazyPreemptionEnable bool `yaml:"lazyPreemptionEnable"`
+	// If true, the AffinityGroup can be placed across multiple cell chains of the same leaf cell type
+	// when it cannot fit into any single chain. Each Pod is still placed within one chain.
+	CrossChainEnable bool `yaml:"crossChainEnable"`
+	// If specified, the AffinityGroup can use the cells of this reservation (see ReservationSpec)
+	// of its VC during the reservation window.
+	Reservation string `yaml:"reservation,omitempty"`
+	// The declared runtime of the AffinityGroup. If specified, the AffinityGroup can be backfilled into
+	// the cells reserved for an aged AffinityGroup when it is expected to complete before the aged one
+	// can start, and it is preempted if it overruns. Default to 0, i.e., not declared.
+	ExpectedRuntimeSeconds  int64              `yaml:"expectedRuntimeSeconds,omitempty"`
 	IgnoreK8sSuggestedNodes bool               `yaml:"ignoreK8sSuggestedNodes" default:"true"`
 	AffinityGroup           *AffinityGroupSpec `yaml:"affinityGroup"`
 }
@@ -92,20 +184,38 @@ type AffinityGroupSpec struct {
 	Members []AffinityGroupMemberSpec `yaml:"members"`
 }
 
+// A member of an AffinityGroup, i.e., PodNumber Pods each with LeafCellNumber leaf cells.
+// A Pod is matched to its member by its LeafCellType and LeafCellNumber, so the members with
+// the same LeafCellType and LeafCellNumber are merged into one.
 type AffinityGroupMemberSpec struct {
 	PodNumber      int32 `yaml:"podNumber"`
 	LeafCellNumber int32 `yaml:"leafCellNumber"`
+	// If specified (for all the members), each member is placed on its own leaf cell type, e.g.,
+	// 1-leaf-cell Pods on K80 and 1-leaf-cell Pods on P100 in the same AffinityGroup.
+	LeafCellType string `yaml:"leafCellType,omitempty"`
+	// An elastic member is allocated with MinPodNumber Pods, and can be extended in place
+	// up to MaxPodNumber Pods later. Both default to PodNumber, and PodNumber defaults to MinPodNumber.
+	MinPodNumber int32 `yaml:"minPodNumber,omitempty"`
+	MaxPodNumber int32 `yaml:"maxPodNumber,omitempty"`
+}
+
+// Used to notify a victim Pod of the preemption in its grace period
+type PreemptionNotice struct {
+	Preemptor string `yaml:"preemptor"` // name of the preemptor AffinityGroup
+	Deadline  string `yaml:"deadline"`  // time in RFC3339 format, after which the victim Pod will be deleted
 }
 
 // Used to recover scheduler allocated resource
 type PodBindInfo struct {
 	Node                  string                        `yaml:"node"`              // node to bind
 	LeafCellIsolation     []int32                       `yaml:"leafCellIsolation"` // leaf cells to bind
-	CellChain             string                        `yaml:"cellChain"`         // cell chain selected
+	CellChain             string                        `yaml:"cellChain"`         // cell chain selected for this pod
 	AffinityGroupBindInfo []AffinityGroupMemberBindInfo `yaml:"affinityGroupBindInfo"`
 }
 
 type AffinityGroupMemberBindInfo struct {
+	// leaf cell type of the member, if the members of the affinity group specify their own types
+	LeafCellType  string             `yaml:"leafCellType,omitempty"`
 	PodPlacements []PodPlacementInfo `yaml:"podPlacements"`
 }
 
@@ -115,6 +225,12 @@ type PodPlacementInfo struct {
 	// preassigned cell types used by the pods. used to locate the virtual cells
 	// when adding an allocated pod
 	PreassignedCellTypes []CellType `yaml:"preassignedCellTypes"`
+	// cell chain of the pod, which may differ among the pods of an affinity group placed across chains,
+	// or among the members of an affinity group with different leaf cell types
+	CellChain string `yaml:"cellChain,omitempty"`
+	// the completed pod whose leaf cells have been released if gang release is enabled, in which
+	// case the placement is left empty, and is not allocated again when adding an allocated pod
+	ReleasedPod types.UID `yaml:"releasedPod,omitempty"`
 }
 
 type WebServerPaths struct {
@@ -154,14 +270,49 @@ type AffinityGroup struct {
 type AffinityGroupState string
 
 type AffinityGroupStatus struct {
-	VC                   VirtualClusterName            `json:"vc"`
-	Priority             int32                         `json:"priority"`
-	State                AffinityGroupState            `json:"state"`
-	PhysicalPlacement    map[string][]int32            `json:"physicalPlacement,omitempty"` // node -> leaf cell indices
-	VirtualPlacement     map[CellAddress][]CellAddress `json:"virtualPlacement,omitempty"`  // preassigned cell -> leaf cells
-	AllocatedPods        []types.UID                   `json:"allocatedPods,omitempty"`
-	PreemptingPods       []types.UID                   `json:"preemptingPods,omitempty"`
-	LazyPreemptionStatus *LazyPreemptionStatus         `json:"lazyPreemptionStatus,omitempty"`
+	VC                VirtualClusterName            `json:"vc"`
+	Priority          int32                         `json:"priority"`
+	State             AffinityGroupState            `json:"state"`
+	PhysicalPlacement map[string][]int32            `json:"physicalPlacement,omitempty"` // node -> leaf cell indices
+	VirtualPlacement  map[CellAddress][]CellAddress `json:"virtualPlacement,omitempty"`  // preassigned cell -> leaf cells
+	AllocatedPods     []types.UID                   `json:"allocatedPods,omitempty"`
+	// Completed Pods whose leaf cells have been released, if GangReleaseEnable.
+	ReleasedPods         []types.UID           `json:"releasedPods,omitempty"`
+	PreemptingPods       []types.UID           `json:"preemptingPods,omitempty"`
+	LazyPreemptionStatus *LazyPreemptionStatus `json:"lazyPreemptionStatus,omitempty"`
+	// Current and desired (i.e., maximum) Pod numbers, which differ only for elastic AffinityGroups.
+	CurrentPodNumbers map[int32]int32 `json:"currentPodNumbers,omitempty"` // leaf cell number -> pod number
+	DesiredPodNumbers map[int32]int32 `json:"desiredPodNumbers,omitempty"` // leaf cell number -> pod number
+	// The affinity level achieved by each Pod in the PhysicalPlacement, i.e. the level of the lowest common
+	// ancestor of its leaf cells (1 for the leaf cell level, 0 if the Pod has no placement yet).
+	PodAffinityLevels map[int32][]int32 `json:"podAffinityLevels,omitempty"` // leaf cell number -> level of each pod
+	// How the placement was chosen among the alternatives, if the AffinityGroup preempted others.
+	PreemptionDecision *PreemptionDecision `json:"preemptionDecision,omitempty"`
+	// Why the AffinityGroup is being released before its Pods complete, e.g., some of its Pods
+	// are still missing after the gang scheduling timeout (see Config.GangSchedulingTimeoutSec).
+	ReleaseReason string `json:"releaseReason,omitempty"`
+	// Why the AffinityGroup is still incomplete after the gang scheduling timeout, if its Pods are
+	// not deleted (see Config.GangSchedulingTimeoutDeletePods).
+	IncompleteReason string `json:"incompleteReason,omitempty"`
+}
+
+type PreemptionDecision struct {
+	// Costs of the alternative placements considered. The first one is found by the packing heuristics,
+	// and each following one avoids the nodes of the victims in the previous ones.
+	AlternativeCosts []PreemptionCost `json:"alternativeCosts"`
+	// Index of the chosen alternative, which has the least cost.
+	Chosen int32 `json:"chosen"`
+}
+
+// PreemptionCost of a placement, compared by the fields in order (the fewer the better).
+type PreemptionCost struct {
+	VictimGroups int32 `json:"victimGroups"`
+	// Total leaf cells used by the victim AffinityGroups
+	VictimLeafCells int32 `json:"victimLeafCells"`
+	// Highest priority of the victim AffinityGroups
+	MaxVictimPriority int32 `json:"maxVictimPriority"`
+	// Total time the victim AffinityGroups have been running for
+	VictimRunningSeconds int64 `json:"victimRunningSeconds"`
 }
 
 type LazyPreemptionStatus struct {
@@ -182,9 +333,10 @@ const (
 )
 
 type CellStatus struct {
-	LeafCellType string   `json:"leafCellType,omitempty"`
-	CellType     CellType `json:"cellType"`
-	IsNodeLevel  bool     `json:"isNodeLevel,omitempty"`
+	LeafCellType string       `json:"leafCellType,omitempty"`
+	LeafCellSku  *SkuTypeSpec `json:"leafCellSku,omitempty"`
+	CellType     CellType     `json:"cellType"`
+	IsNodeLevel  bool         `json:"isNodeLevel,omitempty"`
 	// Address of a physical cell consists of its address (or index) in each level
 	// (e.g., node0/0/0/0 may represent node0, CPU socket 0, PCIe switch 0, GPU 0.
 	// Address of a virtual cell consists of its VC name, index of the preassigned cell,
@@ -204,6 +356,8 @@ type PhysicalCellStatus struct {
 	CellChildren []*PhysicalCellStatus `json:"cellChildren,omitempty"`
 	VC           VirtualClusterName    `json:"vc,omitempty"`
 	VirtualCell  *VirtualCellStatus    `json:"virtualCell,omitempty"`
+	// Used fraction of a leaf cell shared by the Pods with LeafCellFraction.
+	UsedLeafCellFraction float64 `json:"usedLeafCellFraction,omitempty"`
 }
 
 type VirtualCellStatus struct {
@@ -223,6 +377,51 @@ type ClusterStatus struct {
 	VirtualClusters map[VirtualClusterName]VirtualClusterStatus `json:"virtualClusters"`
 }
 
+type OpportunisticUsage struct {
+	// Number of leaf cells used by the opportunistic Pods of the VC of each leaf cell type
+	UsedLeafCells map[string]int32 `json:"usedLeafCells"`
+	// Configured maxOpportunisticLeafCells of the VC, see VirtualClusterSpec
+	MaxLeafCells map[string]int32 `json:"maxLeafCells,omitempty"`
+	// Fair share of the VC in the idle leaf cells of each leaf cell type,
+	// only under IdleCellSharingWeightedFairShare
+	FairShareLeafCells map[string]int32 `json:"fairShareLeafCells,omitempty"`
+}
+
+// DefragmentationPlan proposes to relocate some AffinityGroups, i.e., to delete and resubmit them,
+// so that the high-level cells fragmented by them are freed for the AffinityGroups requesting large cells.
+type DefragmentationPlan struct {
+	// AffinityGroups to relocate, in the order they are proposed
+	Relocations []AffinityGroupRelocation `json:"relocations"`
+	// Free cells of each cell chain before and after the relocations
+	Chains []ChainFreeCells `json:"chains"`
+}
+
+type AffinityGroupRelocation struct {
+	Name     string             `json:"name"`
+	VC       VirtualClusterName `json:"vc"`
+	Priority int32              `json:"priority"`
+	// Cell freed by relocating the AffinityGroup (together with the others relocated for the same cell)
+	FreedCell CellAddress `json:"freedCell"`
+	// Nodes the AffinityGroup uses now, and the nodes it is expected to use after being resubmitted.
+	// Note the actual placement after the resubmission is still decided by the scheduler.
+	FromNodes []string `json:"fromNodes"`
+	ToNodes   []string `json:"toNodes"`
+}
+
+type ChainFreeCells struct {
+	Chain string `json:"chain"`
+	// From the highest level to the lowest level
+	Levels []LevelFreeCells `json:"levels"`
+}
+
+type LevelFreeCells struct {
+	Level    int32    `json:"level"`
+	CellType CellType `json:"cellType"`
+	// Number of cells whose leaf cells are all unused and healthy
+	Before int32 `json:"before"`
+	After  int32 `json:"after"`
+}
+
 func (pcs *PhysicalCellStatus) deepCopy() *PhysicalCellStatus {
 	copied := &PhysicalCellStatus{
 		CellStatus: pcs.CellStatus,
@@ -0,0 +1,516 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ConfigError is a single problem found in the Config, located by its YAML path,
+// such as virtualClusters.VC1.virtualCells[0].cellType.
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Message)
+}
+
+// ConfigErrorList collects all the problems found in one validation pass, so that
+// they can be fixed together instead of one at a time.
+type ConfigErrorList []*ConfigError
+
+func (l ConfigErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("Found %v error(s) in config:\n  %v", len(l), strings.Join(msgs, "\n  "))
+}
+
+// ValidateConfig validates the PhysicalCluster and the VirtualClusters against it.
+// It should be called after defaulting, and returns all the problems found.
+// If the physical cells are to be discovered, the checks of the VirtualClusters
+// depending on them are deferred until they are discovered, see NewDiscoveredConfig.
+func ValidateConfig(c *Config) ConfigErrorList {
+	v := newConfigValidator(c)
+	v.validateSkuTypes()
+	v.validateCellTypes()
+	v.validatePhysicalCells()
+	v.validateVirtualClusters()
+	v.validateIdleCellSharingPolicy()
+	v.validateGangSchedulingTimeout()
+	return v.errs
+}
+
+// GetCellChain returns the cell types of a cell chain from the top cell type to the leaf cell type.
+// It returns false if the chain cannot be resolved, i.e., a cell type is referred to by itself.
+func GetCellChain(cts map[CellType]CellTypeSpec, top CellType) ([]CellType, bool) {
+	chain := []CellType{}
+	visited := map[CellType]bool{}
+	for ct := top; ; {
+		if visited[ct] {
+			return nil, false
+		}
+		visited[ct] = true
+		chain = append(chain, ct)
+		spec, ok := cts[ct]
+		if !ok {
+			// not found in cts, it's a leaf cell type
+			return chain, true
+		}
+		ct = spec.ChildCellType
+	}
+}
+
+type pinnedCellRef struct {
+	path  string
+	chain CellType
+	level int32
+}
+
+type configValidator struct {
+	skuTypes        map[string]SkuTypeSpec
+	cellTypes       map[CellType]CellTypeSpec
+	physicalCells   []PhysicalCellSpec
+	virtualClusters map[VirtualClusterName]VirtualClusterSpec
+	// nil if not specified
+	idleCellSharingPolicy    *IdleCellSharingPolicy
+	gangSchedulingTimeoutSec *int64
+
+	// chain (i.e., top cell type) -> cell types from the top to the leaf
+	chains map[CellType][]CellType
+	// chain -> number of top-level physical cells
+	chainCellNum map[CellType]int32
+	// pinnedCellId -> where it is defined in physicalCells
+	pinnedCells map[PinnedCellId]pinnedCellRef
+	// whether physical cells are to be discovered
+	discovery bool
+
+	errs ConfigErrorList
+}
+
+func newConfigValidator(c *Config) *configValidator {
+	v := &configValidator{
+		cellTypes:       map[CellType]CellTypeSpec{},
+		virtualClusters: map[VirtualClusterName]VirtualClusterSpec{},
+		chains:          map[CellType][]CellType{},
+		chainCellNum:    map[CellType]int32{},
+		pinnedCells:     map[PinnedCellId]pinnedCellRef{},
+	}
+	if c.PhysicalCluster != nil {
+		v.skuTypes = c.PhysicalCluster.SkuTypes
+		if c.PhysicalCluster.CellTypes != nil {
+			v.cellTypes = c.PhysicalCluster.CellTypes
+		}
+		v.physicalCells = c.PhysicalCluster.PhysicalCells
+		v.discovery = c.PhysicalCluster.Discovery != nil
+	}
+	if c.VirtualClusters != nil {
+		v.virtualClusters = *c.VirtualClusters
+	}
+	v.idleCellSharingPolicy = c.IdleCellSharingPolicy
+	v.gangSchedulingTimeoutSec = c.GangSchedulingTimeoutSec
+	return v
+}
+
+func (v *configValidator) addError(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// getChain returns the resolved cell chain of a top cell type, or nil if it cannot be resolved.
+func (v *configValidator) getChain(top CellType) []CellType {
+	if chain, ok := v.chains[top]; ok {
+		return chain
+	}
+	chain, ok := GetCellChain(v.cellTypes, top)
+	if !ok {
+		chain = nil
+	}
+	v.chains[top] = chain
+	return chain
+}
+
+func (v *configValidator) validateSkuTypes() {
+	names := make([]string, 0, len(v.skuTypes))
+	for name := range v.skuTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec := v.skuTypes[name]
+		path := fmt.Sprintf("physicalCluster.skuTypes.%v", name)
+		if _, ok := v.cellTypes[CellType(name)]; ok {
+			v.addError(path, "skuType %v is not a leaf cellType, as it is defined in cellTypes", name)
+		}
+		if _, err := ParseSkuQuantity(spec.Cpu); err != nil {
+			v.addError(path+".cpu", "invalid quantity %v: %v", spec.Cpu, err)
+		}
+		if _, err := ParseSkuQuantity(spec.Memory); err != nil {
+			v.addError(path+".memory", "invalid quantity %v: %v", spec.Memory, err)
+		}
+	}
+}
+
+func isKnownIdleCellSharingPolicy(policy IdleCellSharingPolicy) bool {
+	for _, p := range IdleCellSharingPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *configValidator) validateIdleCellSharingPolicy() {
+	if v.idleCellSharingPolicy != nil && !isKnownIdleCellSharingPolicy(*v.idleCellSharingPolicy) {
+		v.addError("idleCellSharingPolicy", "unknown idleCellSharingPolicy %v, should be one of %v",
+			*v.idleCellSharingPolicy, IdleCellSharingPolicies)
+	}
+}
+
+func (v *configValidator) validateGangSchedulingTimeout() {
+	if v.gangSchedulingTimeoutSec != nil && *v.gangSchedulingTimeoutSec < 0 {
+		v.addError("gangSchedulingTimeoutSec", "gangSchedulingTimeoutSec %v is negative", *v.gangSchedulingTimeoutSec)
+	}
+}
+
+func isKnownIntraVCScheduler(policy IntraVCSchedulerPolicy) bool {
+	for _, p := range IntraVCSchedulerPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSkuQuantity parses the cpu or memory of a skuType, and returns nil if it is empty.
+func ParseSkuQuantity(quantity string) (*resource.Quantity, error) {
+	if quantity == "" {
+		return nil, nil
+	}
+	q, err := resource.ParseQuantity(quantity)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (v *configValidator) validateCellTypes() {
+	for _, ct := range sortedCellTypes(v.cellTypes) {
+		spec := v.cellTypes[ct]
+		path := fmt.Sprintf("physicalCluster.cellTypes.%v", ct)
+		if spec.ChildCellType == "" {
+			v.addError(path+".childCellType", "childCellType is empty")
+		}
+		if spec.ChildCellNumber <= 0 {
+			v.addError(path+".childCellNumber", "childCellNumber %v is non-positive", spec.ChildCellNumber)
+		}
+		// report a cycle only once, i.e., at its lexicographically smallest cell type
+		cycle := []string{string(ct)}
+		for c := spec.ChildCellType; ; c = v.cellTypes[c].ChildCellType {
+			if _, ok := v.cellTypes[c]; !ok || c < ct {
+				break
+			}
+			cycle = append(cycle, string(c))
+			if c == ct {
+				v.addError(path, "cellTypes form a cycle: %v", strings.Join(cycle, " -> "))
+				break
+			}
+			if len(cycle) > len(v.cellTypes) {
+				// a cycle not containing ct, it will be reported at its own smallest cell type
+				break
+			}
+		}
+	}
+}
+
+func (v *configValidator) validatePhysicalCells() {
+	nodeLevelChecked := map[CellType]bool{}
+	for i, spec := range v.physicalCells {
+		path := fmt.Sprintf("physicalCluster.physicalCells[%v]", i)
+		if _, ok := v.cellTypes[spec.CellType]; !ok {
+			v.addError(path+".cellType",
+				"unknown cellType %v, top-level physical cells must use a cellType defined in cellTypes", spec.CellType)
+			continue
+		}
+		chain := v.getChain(spec.CellType)
+		if chain == nil {
+			// the cycle has been reported in validateCellTypes
+			continue
+		}
+		if !nodeLevelChecked[spec.CellType] {
+			nodeLevelChecked[spec.CellType] = true
+			var nodeLevelTypes []string
+			for _, ct := range chain {
+				if v.cellTypes[ct].IsNodeLevel {
+					nodeLevelTypes = append(nodeLevelTypes, string(ct))
+				}
+			}
+			if len(nodeLevelTypes) == 0 {
+				v.addError(path+".cellType",
+					"cell chain %v has no node-level cellType (isNodeLevel), but each physical cell "+
+						"should contain exactly one", spec.CellType)
+			} else if len(nodeLevelTypes) > 1 {
+				v.addError(path+".cellType",
+					"cell chain %v has multiple node-level cellTypes %v, but each physical cell "+
+						"should contain exactly one", spec.CellType, nodeLevelTypes)
+			}
+		}
+		v.chainCellNum[spec.CellType]++
+		v.validatePhysicalCell(spec, chain, 0, path)
+	}
+}
+
+// validatePhysicalCell validates a physical cell at the index-th cell type of the chain, and its children recursively.
+func (v *configValidator) validatePhysicalCell(spec PhysicalCellSpec, chain []CellType, index int, path string) {
+	ct := chain[index]
+	if spec.CellType != ct {
+		v.addError(path+".cellType", "cellType %v does not match the expected cellType %v", spec.CellType, ct)
+	}
+	if pid := spec.PinnedCellId; pid != "" {
+		if ref, ok := v.pinnedCells[pid]; ok {
+			v.addError(path+".pinnedCellId", "duplicate pinnedCellId %v, already defined at %v", pid, ref.path)
+		} else {
+			v.pinnedCells[pid] = pinnedCellRef{
+				path:  path,
+				chain: chain[0],
+				level: int32(len(chain) - index),
+			}
+		}
+	}
+	if index == len(chain)-1 {
+		if len(spec.CellChildren) > 0 {
+			v.addError(path+".cellChildren", "leaf cell of cellType %v cannot have cellChildren", ct)
+		}
+		return
+	}
+	if n := v.cellTypes[ct].ChildCellNumber; n > 0 && int32(len(spec.CellChildren)) != n {
+		v.addError(path+".cellChildren",
+			"%v cellChildren specified, but cellType %v requires %v", len(spec.CellChildren), ct, n)
+	}
+	for i, child := range spec.CellChildren {
+		v.validatePhysicalCell(child, chain, index+1, fmt.Sprintf("%v.cellChildren[%v]", path, i))
+	}
+}
+
+func (v *configValidator) validateVirtualClusters() {
+	// chain -> level -> vc -> number of cells requested
+	requested := map[CellType]map[int32]map[VirtualClusterName]int32{}
+	request := func(chain CellType, level int32, vc VirtualClusterName, num int32) {
+		if requested[chain] == nil {
+			requested[chain] = map[int32]map[VirtualClusterName]int32{}
+		}
+		if requested[chain][level] == nil {
+			requested[chain][level] = map[VirtualClusterName]int32{}
+		}
+		requested[chain][level][vc] += num
+	}
+	pinnedCellUsers := map[PinnedCellId]string{}
+	reservationUsers := map[string]string{}
+
+	vcNames := make([]string, 0, len(v.virtualClusters))
+	for vc := range v.virtualClusters {
+		vcNames = append(vcNames, string(vc))
+	}
+	sort.Strings(vcNames)
+	for _, name := range vcNames {
+		vc := VirtualClusterName(name)
+		spec := v.virtualClusters[vc]
+		if spec.IntraVCScheduler != "" && !isKnownIntraVCScheduler(spec.IntraVCScheduler) {
+			v.addError(fmt.Sprintf("virtualClusters.%v.intraVCScheduler", vc),
+				"unknown intraVCScheduler %v, should be one of %v", spec.IntraVCScheduler, IntraVCSchedulerPolicies)
+		}
+		for leafCellType, num := range spec.MaxOpportunisticLeafCells {
+			if num < 0 {
+				v.addError(fmt.Sprintf("virtualClusters.%v.maxOpportunisticLeafCells.%v", vc, leafCellType),
+					"maxOpportunisticLeafCells %v is negative", num)
+			}
+		}
+		if spec.FairShareWeight != nil && *spec.FairShareWeight <= 0 {
+			v.addError(fmt.Sprintf("virtualClusters.%v.fairShareWeight", vc),
+				"fairShareWeight %v is not positive", *spec.FairShareWeight)
+		}
+		if spec.AgingThresholdSeconds < 0 {
+			v.addError(fmt.Sprintf("virtualClusters.%v.agingThresholdSeconds", vc),
+				"agingThresholdSeconds %v is negative", spec.AgingThresholdSeconds)
+		}
+		if spec.PreemptionGracePeriodSeconds < 0 {
+			v.addError(fmt.Sprintf("virtualClusters.%v.preemptionGracePeriodSeconds", vc),
+				"preemptionGracePeriodSeconds %v is negative", spec.PreemptionGracePeriodSeconds)
+		}
+		for i, r := range spec.Reservations {
+			path := fmt.Sprintf("virtualClusters.%v.reservations[%v]", vc, i)
+			if user, ok := reservationUsers[r.Name]; ok {
+				v.addError(path+".name", "reservation %v is already defined by %v", r.Name, user)
+			} else if r.Name == "" {
+				v.addError(path+".name", "name is empty")
+			} else {
+				reservationUsers[r.Name] = path
+			}
+			v.validateReservation(r, path)
+		}
+		for i, cell := range spec.VirtualCells {
+			path := fmt.Sprintf("virtualClusters.%v.virtualCells[%v]", vc, i)
+			if cell.CellNumber < 0 {
+				v.addError(path+".cellNumber", "cellNumber %v is negative", cell.CellNumber)
+			}
+			sl := strings.Split(string(cell.CellType), ".")
+			top := CellType(sl[0])
+			if _, ok := v.cellTypes[top]; !ok {
+				v.addError(path+".cellType", "unknown cellType %v", top)
+				continue
+			}
+			chain := v.getChain(top)
+			if chain == nil {
+				continue
+			}
+			if v.chainCellNum[top] == 0 && !v.discovery {
+				v.addError(path+".cellType", "no physical cell of cellType %v (leaf cell type %v) "+
+					"is defined in physicalCells", top, chain[len(chain)-1])
+				continue
+			}
+			valid := true
+			for j := 1; j < len(sl); j++ {
+				if j >= len(chain) {
+					v.addError(path+".cellType", "%v is below the leaf cellType %v of cell chain %v",
+						sl[j], chain[len(chain)-1], top)
+					valid = false
+					break
+				}
+				if CellType(sl[j]) != chain[j] {
+					v.addError(path+".cellType", "%v is not the child cellType of %v, expected %v",
+						sl[j], sl[j-1], chain[j])
+					valid = false
+					break
+				}
+			}
+			if valid && cell.CellNumber > 0 {
+				request(top, int32(len(chain)-len(sl)+1), vc, cell.CellNumber)
+			}
+		}
+		for i, pinned := range spec.PinnedCells {
+			path := fmt.Sprintf("virtualClusters.%v.pinnedCells[%v].pinnedCellId", vc, i)
+			ref, ok := v.pinnedCells[pinned.PinnedCellId]
+			if !ok {
+				v.addError(path, "pinnedCellId %v is not found in physicalCells", pinned.PinnedCellId)
+				continue
+			}
+			if user, ok := pinnedCellUsers[pinned.PinnedCellId]; ok {
+				v.addError(path, "pinnedCellId %v is already referred to by %v", pinned.PinnedCellId, user)
+				continue
+			}
+			pinnedCellUsers[pinned.PinnedCellId] = path
+			request(ref.chain, ref.level, vc, 1)
+		}
+	}
+
+	if v.discovery {
+		return
+	}
+	// check the assigned cells of all the VCs can be fit into the physical cells, level by level
+	chains := make([]string, 0, len(requested))
+	for chain := range requested {
+		chains = append(chains, string(chain))
+	}
+	sort.Strings(chains)
+	for _, name := range chains {
+		top := CellType(name)
+		chain := v.chains[top]
+		available := v.chainCellNum[top]
+		for index, ct := range chain {
+			level := int32(len(chain) - index)
+			total := int32(0)
+			var details []string
+			for _, vc := range sortedVCNames(requested[top][level]) {
+				total += requested[top][level][vc]
+				details = append(details, fmt.Sprintf("%v: %v", vc, requested[top][level][vc]))
+			}
+			left := available - total
+			if left < 0 {
+				v.addError("virtualClusters", "cell chain %v is over-subscribed at level %v (cellType %v): "+
+					"%v cells requested by VCs (%v), but only %v available",
+					top, level, ct, total, strings.Join(details, ", "), available)
+				// lower levels are not checked as they will be over-subscribed accordingly
+				break
+			}
+			if index < len(chain)-1 {
+				available = left * v.cellTypes[ct].ChildCellNumber
+			}
+		}
+	}
+}
+
+func (v *configValidator) validateReservation(r ReservationSpec, path string) {
+	if _, ok := v.cellTypes[r.CellType]; !ok {
+		v.addError(path+".cellType", "unknown cellType %v", r.CellType)
+	}
+	if r.CellNumber <= 0 {
+		v.addError(path+".cellNumber", "cellNumber %v is not positive", r.CellNumber)
+	}
+	if r.DrainSeconds < 0 {
+		v.addError(path+".drainSeconds", "drainSeconds %v is negative", r.DrainSeconds)
+	}
+	start, startErr := time.Parse(time.RFC3339, r.StartTime)
+	if startErr != nil {
+		v.addError(path+".startTime", "startTime %v is not in RFC3339 format", r.StartTime)
+	}
+	end, endErr := time.Parse(time.RFC3339, r.EndTime)
+	if endErr != nil {
+		v.addError(path+".endTime", "endTime %v is not in RFC3339 format", r.EndTime)
+	}
+	if startErr == nil && endErr == nil && !end.After(start) {
+		v.addError(path+".endTime", "endTime %v is not after startTime %v", r.EndTime, r.StartTime)
+	}
+}
+
+func sortedCellTypes(cts map[CellType]CellTypeSpec) []CellType {
+	names := make([]string, 0, len(cts))
+	for ct := range cts {
+		names = append(names, string(ct))
+	}
+	sort.Strings(names)
+	sorted := make([]CellType, len(names))
+	for i, n := range names {
+		sorted[i] = CellType(n)
+	}
+	return sorted
+}
+
+func sortedVCNames(m map[VirtualClusterName]int32) []VirtualClusterName {
+	names := make([]string, 0, len(m))
+	for vc := range m {
+		names = append(names, string(vc))
+	}
+	sort.Strings(names)
+	sorted := make([]VirtualClusterName, len(names))
+	for i, n := range names {
+		sorted[i] = VirtualClusterName(n)
+	}
+	return sorted
+}
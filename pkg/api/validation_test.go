@@ -0,0 +1,234 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microsoft/hivedscheduler/pkg/common"
+)
+
+const testCellTypes = `
+physicalCluster:
+  cellTypes:
+    GPU-NODE:
+      childCellType: GPU
+      childCellNumber: 4
+      isNodeLevel: true
+    GPU-RACK:
+      childCellType: GPU-NODE
+      childCellNumber: 2
+    CPU-NODE:
+      childCellType: CPU
+      childCellNumber: 2
+      isNodeLevel: true
+`
+
+const testPhysicalCells = `
+  physicalCells:
+  - cellType: GPU-RACK
+    cellAddress: rack0
+    cellChildren:
+    - cellAddress: 0.0.0.0
+      pinnedCellId: PIN0
+    - cellAddress: 0.0.0.1
+`
+
+func validateTestConfig(configYaml string) ConfigErrorList {
+	c := &Config{}
+	common.FromYaml(configYaml, c)
+	defaultingPhysicalCells(c.PhysicalCluster)
+	return ValidateConfig(c)
+}
+
+func TestValidateConfig(t *testing.T) {
+	validVCs := `
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: GPU-RACK.GPU-NODE
+      cellNumber: 1
+    pinnedCells:
+    - pinnedCellId: PIN0
+`
+	if errs := validateTestConfig(testCellTypes + testPhysicalCells + validVCs); len(errs) != 0 {
+		t.Fatalf("Expected the config to be valid, but got %v", errs)
+	}
+
+	testCases := []struct {
+		name   string
+		config string
+		// the path and a part of the message of the only error expected
+		path    string
+		message string
+	}{
+		{
+			name: "unknown cell type",
+			config: testCellTypes + testPhysicalCells + `
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: GPU-POD
+      cellNumber: 1
+`,
+			path:    "virtualClusters.vc1.virtualCells[0].cellType",
+			message: "unknown cellType GPU-POD",
+		},
+		{
+			name: "duplicate pinnedCellId",
+			config: testCellTypes + `
+  physicalCells:
+  - cellType: GPU-RACK
+    cellAddress: rack0
+    cellChildren:
+    - cellAddress: 0.0.0.0
+      pinnedCellId: PIN0
+    - cellAddress: 0.0.0.1
+      pinnedCellId: PIN0
+`,
+			path:    "physicalCluster.physicalCells[0].cellChildren[1].pinnedCellId",
+			message: "duplicate pinnedCellId PIN0",
+		},
+		{
+			name: "over-subscribed chain level",
+			config: testCellTypes + testPhysicalCells + `
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: GPU-RACK.GPU-NODE
+      cellNumber: 1
+  vc2:
+    virtualCells:
+    - cellType: GPU-RACK.GPU-NODE
+      cellNumber: 2
+`,
+			path:    "virtualClusters",
+			message: "cell chain GPU-RACK is over-subscribed at level 2",
+		},
+		{
+			name: "pinned cell in two VCs",
+			config: testCellTypes + testPhysicalCells + `
+virtualClusters:
+  vc1:
+    pinnedCells:
+    - pinnedCellId: PIN0
+  vc2:
+    pinnedCells:
+    - pinnedCellId: PIN0
+`,
+			path:    "virtualClusters.vc2.pinnedCells[0].pinnedCellId",
+			message: "pinnedCellId PIN0 is already referred to by virtualClusters.vc1.pinnedCells[0].pinnedCellId",
+		},
+		{
+			name: "missing node-level flag",
+			config: `
+physicalCluster:
+  cellTypes:
+    GPU-NODE:
+      childCellType: GPU
+      childCellNumber: 4
+    GPU-RACK:
+      childCellType: GPU-NODE
+      childCellNumber: 2
+` + testPhysicalCells,
+			path:    "physicalCluster.physicalCells[0].cellType",
+			message: "cell chain GPU-RACK has no node-level cellType",
+		},
+		{
+			name: "leaf cell type with no chain",
+			config: testCellTypes + testPhysicalCells + `
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: CPU-NODE
+      cellNumber: 1
+`,
+			path:    "virtualClusters.vc1.virtualCells[0].cellType",
+			message: "no physical cell of cellType CPU-NODE (leaf cell type CPU)",
+		},
+	}
+	for _, tc := range testCases {
+		errs := validateTestConfig(tc.config)
+		if len(errs) != 1 || errs[0].Path != tc.path || !strings.Contains(errs[0].Message, tc.message) {
+			t.Errorf("%v: Expected error at %v containing %q, but got %v", tc.name, tc.path, tc.message, errs)
+		}
+	}
+
+	// all the errors are collected in one run
+	errs := validateTestConfig(testCellTypes + `
+  physicalCells:
+  - cellType: GPU-RACK
+    cellAddress: rack0
+    cellChildren:
+    - cellAddress: 0.0.0.0
+      pinnedCellId: PIN0
+    - cellAddress: 0.0.0.1
+      pinnedCellId: PIN0
+virtualClusters:
+  vc1:
+    virtualCells:
+    - cellType: GPU-POD
+      cellNumber: 1
+    - cellType: CPU-NODE
+      cellNumber: 1
+    - cellType: GPU-RACK
+      cellNumber: 2
+    pinnedCells:
+    - pinnedCellId: PIN0
+  vc2:
+    pinnedCells:
+    - pinnedCellId: PIN0
+`)
+	expectedPaths := []string{
+		"physicalCluster.physicalCells[0].cellChildren[1].pinnedCellId",
+		"virtualClusters.vc1.virtualCells[0].cellType",
+		"virtualClusters.vc1.virtualCells[1].cellType",
+		"virtualClusters.vc2.pinnedCells[0].pinnedCellId",
+		"virtualClusters",
+	}
+	if len(errs) != len(expectedPaths) {
+		t.Fatalf("Expected %v errors, but got %v", len(expectedPaths), errs)
+	}
+	for i, path := range expectedPaths {
+		if errs[i].Path != path {
+			t.Errorf("Expected error %v at %v, but got %v", i, path, errs[i])
+		}
+	}
+}
+
+func TestInitRawConfigStrict(t *testing.T) {
+	configFilePath := "../../example/config/design/hivedscheduler.yaml"
+	InitRawConfigStrict(&configFilePath)
+
+	// a K8S manifest is not a Config
+	manifestFilePath := "../../example/run/deploy.yaml"
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected %v to be rejected, but not", manifestFilePath)
+			}
+		}()
+		InitRawConfigStrict(&manifestFilePath)
+	}()
+}
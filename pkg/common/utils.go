@@ -188,6 +188,14 @@ func FromYaml(yamlStr string, objAddr interface{}) {
 	}
 }
 
+// FromYamlStrict is the same as FromYaml, but also fails on the fields unknown to the Object.
+func FromYamlStrict(yamlStr string, objAddr interface{}) {
+	err := yaml.UnmarshalStrict([]byte(yamlStr), objAddr)
+	if err != nil {
+		panic(fmt.Errorf("Failed to unmarshal YAML to Object: %v", err))
+	}
+}
+
 func ToJson(obj interface{}) string {
 	return string(ToJsonBytes(obj))
 }
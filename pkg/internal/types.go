@@ -52,6 +52,9 @@ type InspectHandlers struct {
 	GetPhysicalClusterStatusHandler    func() si.PhysicalClusterStatus
 	GetAllVirtualClustersStatusHandler func() map[si.VirtualClusterName]si.VirtualClusterStatus
 	GetVirtualClusterStatusHandler     func(vcName si.VirtualClusterName) si.VirtualClusterStatus
+	GetAllOpportunisticUsageHandler    func() map[si.VirtualClusterName]si.OpportunisticUsage
+	GetOpportunisticUsageHandler       func(vcName si.VirtualClusterName) si.OpportunisticUsage
+	GetDefragmentationPlanHandler      func() si.DefragmentationPlan
 }
 
 // SchedulerAlgorithm is used to make the pod schedule decision based on its whole
@@ -97,6 +100,24 @@ type SchedulerAlgorithm interface {
 	GetPhysicalClusterStatus() si.PhysicalClusterStatus
 	GetAllVirtualClustersStatus() map[si.VirtualClusterName]si.VirtualClusterStatus
 	GetVirtualClusterStatus(si.VirtualClusterName) si.VirtualClusterStatus
+	GetAllOpportunisticUsage() map[si.VirtualClusterName]si.OpportunisticUsage
+	GetOpportunisticUsage(si.VirtualClusterName) si.OpportunisticUsage
+	GetDefragmentationPlan() si.DefragmentationPlan
+
+	// Return the allocated AffinityGroups which still miss some Pods after the gang
+	// scheduling timeout, so that events can be recorded on their existing Pods.
+	// If the Pods are to be deleted, the AffinityGroups are marked as released, and
+	// returned until then.
+	ReleaseTimedOutAffinityGroups() []TimedOutAffinityGroup
+
+	// Apply the changed scheduling policies in place, without reconstructing
+	// the scheduling view, see si.ConfigDiff.PoliciesChanged.
+	UpdatePolicies(sConfig *si.Config)
+
+	// Inherit the states which cannot be recovered from the Pods, such as since
+	// when the AffinityGroups have been waiting, from the SchedulerAlgorithm to be
+	// replaced by this one, after all the current Pods are replayed into this one.
+	InheritState(old SchedulerAlgorithm)
 }
 
 type SchedulingPhase string
@@ -215,6 +236,25 @@ type PodPreemptInfo struct {
 	// It can contain victim Pods across multiple nodes, such as a victim group may
 	// contain Pods across multiple nodes.
 	VictimPods []*core.Pod
+	// The victim Pods in their preemption grace periods, which should be notified
+	// of the preemption instead of being deleted, unless they have acknowledged it.
+	GracefulVictims []GracefulVictim
+}
+
+type GracefulVictim struct {
+	Pod    *core.Pod
+	Notice si.PreemptionNotice
+}
+
+// An AffinityGroup still incomplete after the gang scheduling timeout.
+type TimedOutAffinityGroup struct {
+	Name   string
+	Reason string
+	// Whether the AffinityGroup is released, hence its existing Pods should be deleted.
+	// Otherwise, an event is only recorded on them.
+	DeletePods bool
+	// The existing Pods of the AffinityGroup.
+	Pods []*core.Pod
 }
 
 type PodKey struct {
@@ -25,12 +25,15 @@ package internal
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 
 	si "github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	kubeClient "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -265,29 +268,181 @@ func ExtractPodSchedulingSpec(pod *core.Pod) *si.PodSchedulingSpec {
 	if podSchedulingSpec.LeafCellNumber <= 0 {
 		panic(fmt.Errorf(errPfx + "LeafCellNumber is non-positive"))
 	}
+	if podSchedulingSpec.ExpectedRuntimeSeconds < 0 {
+		panic(fmt.Errorf("%vExpectedRuntimeSeconds is negative", errPfx))
+	}
 	if podSchedulingSpec.AffinityGroup.Name == "" {
 		panic(fmt.Errorf(errPfx + "AffinityGroup.Name is empty"))
 	}
 
 	isPodInGroup := false
-	for _, member := range podSchedulingSpec.AffinityGroup.Members {
+	podLeafCellTypes := common.NewSet() // leaf cell types of the members the Pod may belong to
+	for i := range podSchedulingSpec.AffinityGroup.Members {
+		member := &podSchedulingSpec.AffinityGroup.Members[i]
+		if member.PodNumber == 0 {
+			member.PodNumber = member.MinPodNumber
+		} else if member.MinPodNumber != 0 && member.MinPodNumber != member.PodNumber {
+			panic(fmt.Errorf("%vAffinityGroup.Members has PodNumber different from MinPodNumber", errPfx))
+		}
+		member.MinPodNumber = member.PodNumber
+		if member.MaxPodNumber == 0 {
+			member.MaxPodNumber = member.PodNumber
+		}
 		if member.PodNumber <= 0 {
 			panic(fmt.Errorf(errPfx + "AffinityGroup.Members has non-positive PodNumber"))
 		}
+		if member.MaxPodNumber < member.MinPodNumber {
+			panic(fmt.Errorf("%vAffinityGroup.Members has MaxPodNumber less than MinPodNumber", errPfx))
+		}
 		if member.LeafCellNumber <= 0 {
 			panic(fmt.Errorf(errPfx + "AffinityGroup.Members has non-positive LeafCellNumber"))
 		}
-		if member.LeafCellNumber == podSchedulingSpec.LeafCellNumber {
+		if (member.LeafCellType == "") != (podSchedulingSpec.AffinityGroup.Members[0].LeafCellType == "") {
+			panic(fmt.Errorf("%vAffinityGroup.Members should either all or none specify LeafCellType", errPfx))
+		}
+		if member.LeafCellNumber == podSchedulingSpec.LeafCellNumber && (member.LeafCellType == "" ||
+			podSchedulingSpec.LeafCellType == "" || member.LeafCellType == podSchedulingSpec.LeafCellType) {
 			isPodInGroup = true
+			if member.LeafCellType != "" {
+				podLeafCellTypes.Add(member.LeafCellType)
+			}
 		}
 	}
 	if !isPodInGroup {
 		panic(fmt.Errorf(errPfx + "AffinityGroup.Members does not contains current Pod"))
 	}
+	if len(podLeafCellTypes.Items()) > 1 {
+		panic(fmt.Errorf("%vLeafCellType is not specified to choose among the AffinityGroup.Members "+
+			"with the same LeafCellNumber", errPfx))
+	}
+	for t := range podLeafCellTypes.Items() {
+		podSchedulingSpec.LeafCellType = t.(string)
+	}
+	if podSchedulingSpec.LeafCellFraction != 0 {
+		if podSchedulingSpec.LeafCellFraction < 0 || podSchedulingSpec.LeafCellFraction >= 1 {
+			panic(fmt.Errorf("%vLeafCellFraction is not in (0, 1)", errPfx))
+		}
+		if podSchedulingSpec.LeafCellNumber != 1 {
+			panic(fmt.Errorf("%vLeafCellNumber is not 1 when LeafCellFraction is specified", errPfx))
+		}
+		if members := podSchedulingSpec.AffinityGroup.Members; len(members) != 1 || members[0].MaxPodNumber != 1 {
+			panic(fmt.Errorf("%vAffinityGroup has more than one Pod when LeafCellFraction is specified", errPfx))
+		}
+		if podSchedulingSpec.PinnedCellId != "" {
+			panic(fmt.Errorf("%vPinnedCellId is not supported when LeafCellFraction is specified", errPfx))
+		}
+		if podSchedulingSpec.LazyPreemptionEnable {
+			panic(fmt.Errorf("%vLazyPreemptionEnable is not supported when LeafCellFraction is specified", errPfx))
+		}
+		if podSchedulingSpec.Reservation != "" {
+			panic(fmt.Errorf("%vReservation is not supported when LeafCellFraction is specified", errPfx))
+		}
+	}
+	if podSchedulingSpec.Reservation != "" {
+		if podSchedulingSpec.Priority < si.MinGuaranteedPriority {
+			panic(fmt.Errorf("%vReservation is not supported for opportunistic Pods", errPfx))
+		}
+		if podSchedulingSpec.PinnedCellId != "" {
+			panic(fmt.Errorf("%vReservation is not supported when PinnedCellId is specified", errPfx))
+		}
+	}
 
 	return &podSchedulingSpec
 }
 
+// Check the Pod does not request more cpu or memory than LeafCellNumber times
+// (or LeafCellFraction times for a fractional Pod) of the skuType of its LeafCellType.
+// If the LeafCellType is not specified, the Pod may be placed on any leaf cell
+// type, so it is only rejected if it exceeds the skuTypes of all leaf cell types.
+func CheckPodSkuResources(
+	pod *core.Pod, s *si.PodSchedulingSpec, pc *si.PhysicalClusterSpec) {
+	leafCells := float64(s.LeafCellNumber)
+	if s.LeafCellFraction != 0 {
+		leafCells = s.LeafCellFraction
+	}
+	errPfx := fmt.Sprintf("Pod resource requests exceed %v times of the skuType: ", leafCells)
+
+	leafCellTypes := []string{s.LeafCellType}
+	if s.LeafCellType == "" {
+		leafCellTypes = getLeafCellTypes(pc.CellTypes)
+	}
+	errs := []string{}
+	for _, leafCellType := range leafCellTypes {
+		err := checkSkuResources(pod, leafCells, leafCellType, pc.SkuTypes)
+		if err == "" {
+			return
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		panic(NewBadRequestError(errPfx + strings.Join(errs, "; ")))
+	}
+}
+
+// Check the Pod against the skuType of the leaf cell type, and return the reason
+// if it exceeds the skuType, otherwise return empty.
+func checkSkuResources(
+	pod *core.Pod, leafCells float64, leafCellType string, skuTypes map[string]si.SkuTypeSpec) string {
+	sku, ok := skuTypes[leafCellType]
+	if !ok {
+		return ""
+	}
+	for _, resourceName := range []core.ResourceName{core.ResourceCPU, core.ResourceMemory} {
+		skuQuantity := sku.Cpu
+		if resourceName == core.ResourceMemory {
+			skuQuantity = sku.Memory
+		}
+		q, err := si.ParseSkuQuantity(skuQuantity)
+		if q == nil || err != nil {
+			continue
+		}
+		request := getPodResourceRequest(pod, resourceName)
+		if float64(request.MilliValue()) > float64(q.MilliValue())*leafCells {
+			return fmt.Sprintf(
+				"Pod requests %v %v, but skuType %v only has %v %v for each leaf cell",
+				request.String(), resourceName, leafCellType, q.String(), resourceName)
+		}
+	}
+	return ""
+}
+
+// Get the leaf cell types of all cell chains, i.e. the child cell types which are
+// not defined as cell types.
+func getLeafCellTypes(cellTypes map[si.CellType]si.CellTypeSpec) []string {
+	leafCellTypes := []string{}
+	for _, spec := range cellTypes {
+		child := spec.ChildCellType
+		if _, ok := cellTypes[child]; !ok && !common.StringsContains(leafCellTypes, string(child)) {
+			leafCellTypes = append(leafCellTypes, string(child))
+		}
+	}
+	sort.Strings(leafCellTypes)
+	return leafCellTypes
+}
+
+// Get the effective resource request of the Pod in the same way as K8S, i.e. the
+// max of the sum of all containers and each init container, and the limit is used
+// if the request is not specified.
+func getPodResourceRequest(pod *core.Pod, resourceName core.ResourceName) resource.Quantity {
+	getContainerRequest := func(c core.Container) resource.Quantity {
+		if q, ok := c.Resources.Requests[resourceName]; ok {
+			return q
+		}
+		return c.Resources.Limits[resourceName]
+	}
+
+	request := resource.Quantity{}
+	for _, c := range pod.Spec.Containers {
+		request.Add(getContainerRequest(c))
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if q := getContainerRequest(c); q.Cmp(request) > 0 {
+			request = q
+		}
+	}
+	return request
+}
+
 func BindPod(kClient kubeClient.Interface, bindingPod *core.Pod) {
 	// The K8S Bind is atomic and can only succeed at most once.
 	err := kClient.CoreV1().Pods(bindingPod.Namespace).Bind(&core.Binding{
@@ -313,6 +468,89 @@ func BindPod(kClient kubeClient.Interface, bindingPod *core.Pod) {
 		bindingPod.Annotations[si.AnnotationKeyPodLeafCellIsolation])
 }
 
+// NotifyPreemption writes the preemption notice into the annotation of a victim Pod,
+// and records an event for it.
+func NotifyPreemption(kClient kubeClient.Interface, victim *core.Pod, notice si.PreemptionNotice) {
+	patch := common.ToJson(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				si.AnnotationKeyPodPreemptionNotice: common.ToYaml(notice),
+			},
+		},
+	})
+	_, err := kClient.CoreV1().Pods(victim.Namespace).Patch(victim.Name, types.MergePatchType, []byte(patch))
+	if err != nil {
+		panic(fmt.Errorf("Failed to write preemption notice to Pod: %v", err))
+	}
+
+	message := fmt.Sprintf(
+		"Pod will be preempted by affinity group %v at %v, unless it acknowledges the preemption earlier",
+		notice.Preemptor, notice.Deadline)
+	recordPodWarningEvent(kClient, victim, "PreemptionNotice", message)
+
+	klog.Infof("[%v]: Succeeded to notify Pod: %v", Key(victim), message)
+}
+
+// RecordTimedOutPodEvent records an event for a Pod whose AffinityGroup is still incomplete
+// after the gang scheduling timeout.
+func RecordTimedOutPodEvent(kClient kubeClient.Interface, pod *core.Pod, group string, reason string) {
+	message := fmt.Sprintf("Affinity group %v of the Pod is incomplete: %v", group, reason)
+	recordPodWarningEvent(kClient, pod, "GangSchedulingTimeout", message)
+}
+
+// DeleteTimedOutPod records an event for a Pod whose AffinityGroup is released after the
+// gang scheduling timeout, and deletes it so that the leaf cells of the AffinityGroup are
+// released. The failure is only logged, since the deletion will be retried.
+func DeleteTimedOutPod(kClient kubeClient.Interface, pod *core.Pod, group string, reason string) {
+	message := fmt.Sprintf("Pod is deleted since its affinity group %v is released: %v", group, reason)
+	recordPodWarningEvent(kClient, pod, "GangSchedulingTimeout", message)
+
+	err := kClient.CoreV1().Pods(pod.Namespace).Delete(
+		pod.Name, &meta.DeleteOptions{Preconditions: meta.NewUIDPreconditions(string(pod.UID))})
+	if err != nil {
+		klog.Warningf("[%v]: Failed to delete Pod, will retry later: %v", Key(pod), err)
+		return
+	}
+
+	klog.Infof("[%v]: Succeeded to delete Pod: %v", Key(pod), message)
+}
+
+func recordPodWarningEvent(kClient kubeClient.Interface, pod *core.Pod, reason string, message string) {
+	now := meta.Now()
+	// The event is only informative, so failing to record it is tolerated.
+	_, err := kClient.CoreV1().Events(pod.Namespace).Create(&core.Event{
+		ObjectMeta: meta.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: core.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           core.EventTypeWarning,
+		Source:         core.EventSource{Component: si.ComponentName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	})
+	if err != nil {
+		klog.Warningf("[%v]: Failed to record %v event: %v", Key(pod), reason, err)
+	}
+}
+
+func IsPreemptionNotified(pod *core.Pod, notice si.PreemptionNotice) bool {
+	return pod.Annotations[si.AnnotationKeyPodPreemptionNotice] == common.ToYaml(notice)
+}
+
+func IsPreemptionAcknowledged(pod *core.Pod) bool {
+	return pod.Annotations[si.AnnotationKeyPodPreemptionAcknowledged] == "true"
+}
+
 func NewBadRequestError(message string) *si.WebServerError {
 	return si.NewWebServerError(http.StatusBadRequest, message)
 }
@@ -24,6 +24,7 @@ package scheduler
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
@@ -34,7 +35,11 @@ import (
 	"github.com/microsoft/hivedscheduler/pkg/webserver"
 	core "k8s.io/api/core/v1"
 	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeInformer "k8s.io/client-go/informers"
 	kubeClient "k8s.io/client-go/kubernetes"
 	coreLister "k8s.io/client-go/listers/core/v1"
@@ -44,6 +49,14 @@ import (
 	ei "k8s.io/kubernetes/pkg/scheduler/api"
 )
 
+// The period to check whether any affinity group should be released after the
+// gang scheduling timeout, see si.Config.GangSchedulingTimeoutSec.
+const gangSchedulingTimeoutCheckPeriod = 10 * time.Second
+
+// The period to discover the physical cells again if the discovery related
+// information of any node is changed, so that the node changes are batched.
+const physicalCellsRediscoveryPeriod = 10 * time.Second
+
 // HivedScheduler is the scheduling framework which serves as the bridge between
 // the scheduling algorithm and K8S.
 // It provides the whole cluster scheduling view and the interested pod scheduling
@@ -54,6 +67,18 @@ type HivedScheduler struct {
 	kConfig *rest.Config
 	sConfig *si.Config
 
+	// ClusterConfig is the config which the SchedulerAlgorithm is constructed from.
+	// It is the same as SConfig, unless the physical cells are discovered from
+	// nodes, see si.NewDiscoveredConfig.
+	clusterConfig *si.Config
+	// Node name -> si.GetNodeDiscoveryKey for all discovered nodes, used to check
+	// whether the physical cells need to be discovered again.
+	// It is only updated once the discovered physical cells are applied.
+	discoveryNodeKeys map[string]string
+	// Whether the discovery related information of any node is changed since the
+	// physical cells are discovered and applied.
+	discoveryNodesChanged bool
+
 	// Client is used to write remote objects in ApiServer.
 	// Remote objects are up-to-date and is writable.
 	//
@@ -105,6 +130,8 @@ type HivedScheduler struct {
 	// scheduling view inside the SchedulerAlgorithm.
 	// It also ensures the SchedulerAlgorithm.Schedule() will never be executed
 	// concurrently.
+	// The SchedulerAlgorithm and SConfig may be replaced when the config is changed,
+	// so they should also be accessed with the SchedulerLock held.
 	schedulerLock *sync.RWMutex
 
 	// PodScheduleStatuses serves as the ground truth of the scheduling view.
@@ -124,11 +151,28 @@ func NewHivedScheduler() *HivedScheduler {
 
 	sConfig := si.NewConfig(si.InitRawConfig(&si.EnvValueConfigFilePath))
 	klog.Infof("With Config: \n%v", common.ToYaml(sConfig))
-	si.WatchConfig(&si.EnvValueConfigFilePath, sConfig)
 	kConfig := si.BuildKubeConfig(sConfig)
 
 	kClient := internal.CreateClient(kConfig)
 
+	// The physical cells need to be discovered before the SchedulerAlgorithm is
+	// constructed, so the nodes are listed without waiting for the NodeInformer.
+	clusterConfig := sConfig
+	discoveryNodeKeys := map[string]string{}
+	if sConfig.PhysicalCluster.Discovery != nil {
+		nodeList, err := kClient.CoreV1().Nodes().List(meta.ListOptions{})
+		if err != nil {
+			panic(fmt.Errorf("Failed to list nodes to discover physical cells: %v", err))
+		}
+		nodes := make([]*core.Node, len(nodeList.Items))
+		for i := range nodeList.Items {
+			nodes[i] = &nodeList.Items[i]
+		}
+		discoveryNodeKeys = getDiscoveryNodeKeys(nodes, sConfig.PhysicalCluster.Discovery)
+		clusterConfig = si.NewDiscoveredConfig(sConfig, nodes)
+		klog.Infof("With Discovered PhysicalCluster: \n%v", common.ToYaml(clusterConfig.PhysicalCluster))
+	}
+
 	nodeListerInformer := kubeInformer.NewSharedInformerFactory(kClient, 0).Core().V1().Nodes()
 	podListerInformer := kubeInformer.NewSharedInformerFactory(kClient, 0).Core().V1().Pods()
 	nodeInformer := nodeListerInformer.Informer()
@@ -139,6 +183,8 @@ func NewHivedScheduler() *HivedScheduler {
 	s := &HivedScheduler{
 		kConfig:             kConfig,
 		sConfig:             sConfig,
+		clusterConfig:       clusterConfig,
+		discoveryNodeKeys:   discoveryNodeKeys,
 		kClient:             kClient,
 		nodeInformer:        nodeInformer,
 		podInformer:         podInformer,
@@ -146,7 +192,7 @@ func NewHivedScheduler() *HivedScheduler {
 		podLister:           podLister,
 		schedulerLock:       &sync.RWMutex{},
 		podScheduleStatuses: internal.PodScheduleStatuses{},
-		schedulerAlgorithm:  algorithm.NewHivedAlgorithm(sConfig),
+		schedulerAlgorithm:  algorithm.NewHivedAlgorithm(clusterConfig),
 	}
 
 	// Setup Informer Callbacks
@@ -187,9 +233,14 @@ func NewHivedScheduler() *HivedScheduler {
 			GetPhysicalClusterStatusHandler:    s.getPhysicalClusterStatus,
 			GetAllVirtualClustersStatusHandler: s.getAllVirtualClustersStatus,
 			GetVirtualClusterStatusHandler:     s.getVirtualClusterStatus,
+			GetAllOpportunisticUsageHandler:    s.getAllOpportunisticUsage,
+			GetOpportunisticUsageHandler:       s.getOpportunisticUsage,
+			GetDefragmentationPlanHandler:      s.getDefragmentationPlan,
 		},
 	)
 
+	si.WatchConfig(&si.EnvValueConfigFilePath, sConfig, s.applyConfig)
+
 	return s
 }
 
@@ -210,18 +261,246 @@ func (s *HivedScheduler) Run(stopCh <-chan struct{}) {
 
 	// Previous bound pods recovery completed, start to accept scheduling request.
 	s.webServer.AsyncRun(stopCh)
+	go wait.Until(s.releaseTimedOutAffinityGroups, gangSchedulingTimeoutCheckPeriod, stopCh)
+	go wait.Until(s.rediscoverPhysicalCells, physicalCellsRediscoveryPeriod, stopCh)
 	klog.Infof("Running " + si.ComponentName)
 
 	<-stopCh
 }
 
+// Apply the changed config to the running scheduler.
+// Return false if the change cannot be applied in place, so that the scheduler
+// should be restarted to pick up the new config.
+// If the change fails to be applied, e.g., the scheduling view cannot be rebuilt,
+// the error is logged and the current config is kept, until the config is changed
+// again. Restarting would not help, since the same config would fail again.
+func (s *HivedScheduler) applyConfig(newConfig *si.Config) bool {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	diff := si.DiffConfig(s.sConfig, newConfig)
+	if diff.RestartRequired() {
+		klog.Warningf("Config fields cannot be applied in place: %v", diff.RestartRequiredFields)
+		return false
+	}
+	newClusterConfig, err := s.discoverClusterConfig(newConfig)
+	if err != nil {
+		klog.Errorf("Failed to discover physical cells with the new config, "+
+			"keep using the current config: %v", err)
+		return true
+	}
+	if err := s.applyClusterConfig(newClusterConfig); err != nil {
+		klog.Errorf("Failed to rebuild the scheduling view with the new config, "+
+			"keep using the current config: %v", err)
+		return true
+	}
+	if diff.DiscoveryChanged && newConfig.PhysicalCluster.Discovery != nil {
+		// The nodes are already listed successfully in discoverClusterConfig.
+		nodes, _ := s.nodeLister.List(labels.Everything())
+		s.discoveryNodeKeys = getDiscoveryNodeKeys(nodes, newConfig.PhysicalCluster.Discovery)
+		s.discoveryNodesChanged = false
+	}
+	s.sConfig = newConfig
+	return true
+}
+
+// Apply the changed cluster config:
+// If only the scheduling policies are changed, they are updated in place.
+// Otherwise, the SchedulerAlgorithm is reconstructed with all the current nodes and
+// pods replayed, and the current SchedulerAlgorithm is kept if failed.
+func (s *HivedScheduler) applyClusterConfig(newClusterConfig *si.Config) error {
+	diff := si.DiffConfig(s.clusterConfig, newClusterConfig)
+	if diff.ClusterChanged() {
+		klog.Infof("Cluster changed, rebuilding the scheduling view: %v", diff)
+		newAlgorithm, preemptResults, err := s.rebuildSchedulerAlgorithm(newClusterConfig)
+		if err != nil {
+			return err
+		}
+		s.schedulerAlgorithm = newAlgorithm
+		// The preempting pods whose preemptions cannot be recovered with the new
+		// config will be scheduled again.
+		for uid, podStatus := range s.podScheduleStatuses {
+			if podStatus.PodState != internal.PodPreempting {
+				continue
+			}
+			if result, ok := preemptResults[uid]; ok {
+				podStatus.PodScheduleResult = result
+			} else {
+				klog.Infof("[%v]: Preemption is not kept with the new config, "+
+					"waiting to be scheduled again", internal.Key(podStatus.Pod))
+				s.podScheduleStatuses[uid] = &internal.PodScheduleStatus{
+					Pod:               podStatus.Pod,
+					PodState:          internal.PodWaiting,
+					PodScheduleResult: nil,
+				}
+			}
+		}
+	} else if diff.PoliciesChanged() {
+		klog.Infof("Scheduling policies changed, updating in place: %v", diff)
+		s.schedulerAlgorithm.UpdatePolicies(newClusterConfig)
+	}
+	s.clusterConfig = newClusterConfig
+	return nil
+}
+
+// Discover the physical cells from current nodes, if the discovery is enabled.
+func (s *HivedScheduler) discoverClusterConfig(sConfig *si.Config) (clusterConfig *si.Config, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if sConfig.PhysicalCluster.Discovery == nil {
+		return sConfig, nil
+	}
+	nodes, err := s.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return si.NewDiscoveredConfig(sConfig, nodes), nil
+}
+
+// Mark the physical cells to be discovered again if the discovery related
+// information of the node is changed, see rediscoverPhysicalCells.
+func (s *HivedScheduler) checkNodeDiscoveryKey(node *core.Node, deleted bool) {
+	discovery := s.sConfig.PhysicalCluster.Discovery
+	if discovery == nil {
+		return
+	}
+	key := ""
+	if !deleted {
+		key = si.GetNodeDiscoveryKey(node, discovery)
+	}
+	if key != s.discoveryNodeKeys[node.Name] {
+		klog.Infof("[%v]: Node discovery information changed: %v", node.Name, key)
+		s.discoveryNodesChanged = true
+	}
+}
+
+// Discover the physical cells again if the discovery related information of any
+// node is changed, and apply them in the same way as the config is changed.
+// The node keys are only recorded once applied, so a failed discovery is retried
+// in the next period.
+func (s *HivedScheduler) rediscoverPhysicalCells() {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+	defer internal.HandleWebServerPanic(nil)
+
+	discovery := s.sConfig.PhysicalCluster.Discovery
+	if !s.discoveryNodesChanged || discovery == nil {
+		return
+	}
+	nodes, err := s.nodeLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list nodes to discover physical cells: %v", err)
+		return
+	}
+	newKeys := getDiscoveryNodeKeys(nodes, discovery)
+	if reflect.DeepEqual(newKeys, s.discoveryNodeKeys) {
+		s.discoveryNodesChanged = false
+		return
+	}
+
+	klog.Infof("Node discovery information changed, discovering physical cells")
+	newClusterConfig, err := s.discoverClusterConfig(s.sConfig)
+	if err == nil {
+		err = s.applyClusterConfig(newClusterConfig)
+	}
+	if err != nil {
+		klog.Errorf("Failed to apply the discovered physical cells, "+
+			"keep using the current ones and retry later: %v", err)
+		return
+	}
+	s.discoveryNodeKeys = newKeys
+	s.discoveryNodesChanged = false
+}
+
+// Construct a new SchedulerAlgorithm from the new config, and recover the whole
+// scheduling view from the current nodes and the current pods, in the same way as
+// the scheduler is restarted, except that all the information is already in memory.
+// The preempting pods are scheduled again after all the allocated pods are recovered,
+// so that their preemptions are kept if still possible with the new config, and the
+// new PodScheduleResults of the kept preemptions are returned. Then the states which
+// cannot be recovered from the pods are inherited from the current SchedulerAlgorithm.
+// The current SchedulerAlgorithm is kept untouched, so it can still be used if the
+// recovery failed.
+func (s *HivedScheduler) rebuildSchedulerAlgorithm(newConfig *si.Config) (
+	newAlgorithm internal.SchedulerAlgorithm,
+	preemptResults map[types.UID]*internal.PodScheduleResult,
+	err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	newAlgorithm = algorithm.NewHivedAlgorithm(newConfig)
+	nodes, err := s.nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+	nodeNames := make([]string, len(nodes))
+	for i, node := range nodes {
+		newAlgorithm.AddNode(node)
+		nodeNames[i] = node.Name
+	}
+	var preemptingPods []*core.Pod
+	for _, podStatus := range s.podScheduleStatuses {
+		if internal.IsAllocated(podStatus.PodState) {
+			newAlgorithm.AddAllocatedPod(podStatus.Pod)
+		} else {
+			newAlgorithm.AddUnallocatedPod(podStatus.Pod)
+			if podStatus.PodState == internal.PodPreempting {
+				preemptingPods = append(preemptingPods, podStatus.Pod)
+			}
+		}
+	}
+	preemptResults = map[types.UID]*internal.PodScheduleResult{}
+	for _, pod := range preemptingPods {
+		if result := schedulePreemptingPod(newAlgorithm, pod, nodeNames); result.PodPreemptInfo != nil {
+			preemptResults[pod.UID] = &result
+		}
+	}
+	newAlgorithm.InheritState(s.schedulerAlgorithm)
+	return newAlgorithm, preemptResults, nil
+}
+
+// Schedule the preempting pod again in the PreemptingPhase, and an empty result is
+// returned if the pod can no longer be scheduled, such as its VC is removed.
+func schedulePreemptingPod(
+	a internal.SchedulerAlgorithm, pod *core.Pod, nodeNames []string) (result internal.PodScheduleResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Warningf("[%v]: Failed to schedule the preempting pod again: %v", internal.Key(pod), r)
+			result = internal.PodScheduleResult{}
+		}
+	}()
+	return a.Schedule(pod, nodeNames, internal.PreemptingPhase)
+}
+
+// Get the discovery keys of the nodes which can be discovered, see si.GetNodeDiscoveryKey.
+func getDiscoveryNodeKeys(nodes []*core.Node, discovery *si.PhysicalClusterDiscoverySpec) map[string]string {
+	keys := map[string]string{}
+	for _, node := range nodes {
+		if key := si.GetNodeDiscoveryKey(node, discovery); key != "" {
+			keys[node.Name] = key
+		}
+	}
+	return keys
+}
+
 func (s *HivedScheduler) addNode(obj interface{}) {
 	node := internal.ToNode(obj)
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
 	logPfx := fmt.Sprintf("[%v]: addNode: ", node.Name)
 	klog.Infof(logPfx + "Started")
 	defer internal.HandleInformerPanic(logPfx, true)
 
 	s.schedulerAlgorithm.AddNode(node)
+	s.checkNodeDiscoveryKey(node, false)
 }
 
 func (s *HivedScheduler) updateNode(oldObj, newObj interface{}) {
@@ -235,19 +514,27 @@ func (s *HivedScheduler) updateNode(oldObj, newObj interface{}) {
 		return
 	}
 
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
 	logPfx := fmt.Sprintf("[%v]: updateNode: ", newNode.Name)
 	defer internal.HandleInformerPanic(logPfx, false)
 
 	s.schedulerAlgorithm.UpdateNode(oldNode, newNode)
+	s.checkNodeDiscoveryKey(newNode, false)
 }
 
 func (s *HivedScheduler) deleteNode(obj interface{}) {
 	node := internal.ToNode(obj)
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
 	logPfx := fmt.Sprintf("[%v]: deleteNode: ", node.Name)
 	klog.Infof(logPfx + "Started")
 	defer internal.HandleInformerPanic(logPfx, true)
 
 	s.schedulerAlgorithm.DeleteNode(node)
+	s.checkNodeDiscoveryKey(node, true)
 }
 
 func (s *HivedScheduler) addPod(obj interface{}) {
@@ -482,6 +769,34 @@ func (s *HivedScheduler) forceBindExecutor(bindingPod *core.Pod) {
 	})
 }
 
+// Record events on the existing Pods of the affinity groups still incomplete after
+// the gang scheduling timeout. If the groups are released, also delete the Pods, so
+// that their cells are released once the deletions are delivered by the podInformer.
+// The failed deletions are retried in the next check.
+func (s *HivedScheduler) releaseTimedOutAffinityGroups() {
+	defer internal.HandleWebServerPanic(nil)
+
+	timedOutGroups := func() []internal.TimedOutAffinityGroup {
+		s.schedulerLock.Lock()
+		defer s.schedulerLock.Unlock()
+		return s.schedulerAlgorithm.ReleaseTimedOutAffinityGroups()
+	}()
+	for _, g := range timedOutGroups {
+		for _, pod := range g.Pods {
+			livePod, err := s.podLister.Pods(pod.Namespace).Get(pod.Name)
+			if err != nil || livePod.UID != pod.UID || livePod.DeletionTimestamp != nil {
+				// The Pod is already deleted or being deleted.
+				continue
+			}
+			if g.DeletePods {
+				internal.DeleteTimedOutPod(s.kClient, livePod, g.Name, g.Reason)
+			} else {
+				internal.RecordTimedOutPodEvent(s.kClient, livePod, g.Name, g.Reason)
+			}
+		}
+	}
+}
+
 func (s *HivedScheduler) filterRoutine(args ei.ExtenderArgs) *ei.ExtenderFilterResult {
 	s.schedulerLock.Lock()
 	defer s.schedulerLock.Unlock()
@@ -512,6 +827,10 @@ func (s *HivedScheduler) filterRoutine(args ei.ExtenderArgs) *ei.ExtenderFilterR
 	// At this point, podState must be in:
 	// {PodWaiting, PodPreempting}
 
+	// Reject the Pod which can never be admitted by the kubelet after bound.
+	internal.CheckPodSkuResources(
+		pod, internal.ExtractPodSchedulingSpec(pod), s.clusterConfig.PhysicalCluster)
+
 	// Carry out a new scheduling
 	result := s.schedulerAlgorithm.Schedule(pod, suggestedNodes, internal.FilteringPhase)
 
@@ -680,7 +999,23 @@ func (s *HivedScheduler) preemptRoutine(args ei.ExtenderPreemptionArgs) *ei.Exte
 			PodScheduleResult: &result,
 		}
 
-		victims := result.PodPreemptInfo.VictimPods
+		victims := append([]*core.Pod{}, result.PodPreemptInfo.VictimPods...)
+		for _, gracefulVictim := range result.PodPreemptInfo.GracefulVictims {
+			victim := gracefulVictim.Pod
+			livePod, err := s.podLister.Pods(victim.Namespace).Get(victim.Name)
+			if err != nil || livePod.UID != victim.UID {
+				// The victim is already deleted.
+				continue
+			}
+			if internal.IsPreemptionAcknowledged(livePod) {
+				klog.Infof(logPfx+"Victim %v acknowledged the preemption in its grace period",
+					internal.Key(victim))
+				victims = append(victims, victim)
+			} else if !internal.IsPreemptionNotified(livePod, gracefulVictim.Notice) {
+				internal.NotifyPreemption(s.kClient, livePod, gracefulVictim.Notice)
+			}
+		}
+
 		nodesVictims := map[string]*ei.MetaVictims{}
 		nodesVictimsMsg := map[string][]string{}
 
@@ -721,25 +1056,64 @@ func (s *HivedScheduler) preemptRoutine(args ei.ExtenderPreemptionArgs) *ei.Exte
 }
 
 func (s *HivedScheduler) getAllAffinityGroups() si.AffinityGroupList {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetAllAffinityGroups()
 }
 
 func (s *HivedScheduler) getAffinityGroup(name string) si.AffinityGroup {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetAffinityGroup(name)
 }
 
 func (s *HivedScheduler) getClusterStatus() si.ClusterStatus {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetClusterStatus()
 }
 
 func (s *HivedScheduler) getPhysicalClusterStatus() si.PhysicalClusterStatus {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetPhysicalClusterStatus()
 }
 
 func (s *HivedScheduler) getAllVirtualClustersStatus() map[si.VirtualClusterName]si.VirtualClusterStatus {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetAllVirtualClustersStatus()
 }
 
 func (s *HivedScheduler) getVirtualClusterStatus(vcn si.VirtualClusterName) si.VirtualClusterStatus {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
 	return s.schedulerAlgorithm.GetVirtualClusterStatus(vcn)
 }
+
+func (s *HivedScheduler) getAllOpportunisticUsage() map[si.VirtualClusterName]si.OpportunisticUsage {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
+	return s.schedulerAlgorithm.GetAllOpportunisticUsage()
+}
+
+func (s *HivedScheduler) getOpportunisticUsage(vcn si.VirtualClusterName) si.OpportunisticUsage {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
+	return s.schedulerAlgorithm.GetOpportunisticUsage(vcn)
+}
+
+func (s *HivedScheduler) getDefragmentationPlan() si.DefragmentationPlan {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
+	return s.schedulerAlgorithm.GetDefragmentationPlan()
+}
@@ -82,6 +82,8 @@ func NewWebServer(sConfig *si.Config,
 	ws.route(si.ClusterStatusPath, ws.serve(ws.serveClusterStatus))
 	ws.route(si.PhysicalClusterPath, ws.serve(ws.servePhysicalClusterStatus))
 	ws.route(si.VirtualClustersPath, ws.serve(ws.serveVirtualClustersStatus))
+	ws.route(si.OpportunisticUsagePath, ws.serve(ws.serveOpportunisticUsage))
+	ws.route(si.DefragmentationPlanPath, ws.serve(ws.serveDefragmentationPlan))
 	return ws
 }
 
@@ -298,3 +300,33 @@ func (ws *WebServer) serveVirtualClustersStatus(w http.ResponseWriter, r *http.R
 		"NotImplemented: %v: %v",
 		r.Method, r.URL.Path)))
 }
+
+func (ws *WebServer) serveOpportunisticUsage(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, si.OpportunisticUsagePath)
+	if name == "" {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetAllOpportunisticUsageHandler()))
+			return
+		}
+	} else {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetOpportunisticUsageHandler(si.VirtualClusterName(name))))
+			return
+		}
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveDefragmentationPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetDefragmentationPlanHandler()))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}